@@ -26,8 +26,8 @@ export async function loadImage(md5: string) {
         method: 'GET',
         headers: authHeader(''),
         responseType: 'arraybuffer',
-    }).then((response: any) => {
-        const bytes = new Uint8Array(response.data);
+    }).then(async (response: any) => {
+        const bytes = await loadSegments(md5, new Uint8Array(response.data));
         const binary = bytes.reduce((data, b) => data += String.fromCharCode(b), '');
         response.data = 'data:image/jpeg;base64,' + btoa(binary);
         const img = new Image();
@@ -82,7 +82,10 @@ export async function loadPictureDirectory(directory: string) {
                 // console.log('DATA:' + data);
                 const p: any[] = [];
                 data.Records.forEach((d: any) => {
-                    p.push({ title: d.PictureName, msrc: d.Md5, index: d.ISN });
+                    p.push({
+                        title: d.PictureName, msrc: d.Md5, index: d.ISN,
+                        MIMEType: d.MIMEType, w: d.Width, h: d.Height,
+                    });
                 });
                 // console.log('Result ' + JSON.stringify(p));
                 return p;
@@ -128,8 +131,8 @@ export async function loadVideo(md5: string) {
         method: 'GET',
         headers: authHeader(''),
         responseType: 'arraybuffer',
-    }).then((response: any) => {
-        const bytes = new Uint8Array(response.data);
+    }).then(async (response: any) => {
+        const bytes = await loadSegments(md5, new Uint8Array(response.data));
         const binary = bytes.reduce((data, b) => data += String.fromCharCode(b), '');
         response.data = 'data:video/mp4;base64,' + btoa(binary);
         const i = {
@@ -167,6 +170,47 @@ export async function loadThumbnail(md5: string) {
         (error: any) => console.log('Image read error ' + md5 + ': ' + error));
 }
 
+// loadSegments append the segments of media bigger than the maximum blob
+// size to the first segment read from the media field. The segments are
+// stored in the segment file with the key <checksum>-<sequence>.
+async function loadSegments(md5: string, media: Uint8Array) {
+    const response = await axios({
+        url: config.Url() +
+            '/rest/map/PictureData?limit=1&fields=NrSegments&search=Md5=' +
+            md5,
+        method: 'GET',
+        headers: authHeader('application/json'),
+    });
+    const records = response.data.Records || [];
+    const nrSegments = records.length > 0 ? records[0].NrSegments : 0;
+    if (!nrSegments || nrSegments < 2) {
+        return media;
+    }
+    const segments = [media];
+    let size = media.length;
+    for (let sequence = 1; sequence < nrSegments; sequence++) {
+        const key = md5 + '-' + ('00000' + sequence).slice(-6);
+        const segment = await axios({
+            url: config.Url() +
+                '/binary/map/PictureSegment/*/SegmentData?search=SegmentKey=' +
+                key,
+            method: 'GET',
+            headers: authHeader(''),
+            responseType: 'arraybuffer',
+        });
+        const bytes = new Uint8Array(segment.data);
+        segments.push(bytes);
+        size += bytes.length;
+    }
+    const result = new Uint8Array(size);
+    let offset = 0;
+    segments.forEach((segment) => {
+        result.set(segment, offset);
+        offset += segment.length;
+    });
+    return result;
+}
+
 export async function streamVideo(md5: string, videoElement: any) {
     // console.log('Streaming Video MD5=' + md5 + ' -> ' + videoElement);
     // console.log('Video element=' + JSON.stringify(videoElement));
@@ -176,9 +220,10 @@ export async function streamVideo(md5: string, videoElement: any) {
         md5,
         {
             headers: authHeader('video/mp4'),
-            responseType: 'blob',
-        }).then((response: any) => {
-            const videoBlob = new Blob([response.data], { type: 'video/mp4' });
+            responseType: 'arraybuffer',
+        }).then(async (response: any) => {
+            const media = await loadSegments(md5, new Uint8Array(response.data));
+            const videoBlob = new Blob([media], { type: 'video/mp4' });
             videoElement.src = URL.createObjectURL(videoBlob);
             // console.log('Video stream blob loaded of size ' + videoBlob.size);
             videoElement.oncanplay = () => {
@@ -38,13 +38,14 @@ import (
 var hostname string
 
 type checker struct {
-	conn            *adabas.Connection
-	adabas          *adabas.Adabas
+	repository      store.PictureRepository
 	limit           uint64
 	deleteDuplikate bool
 	validateLob     bool
-	picFnr          adabas.Fnr
 	maxOccurance    int
+	checksums       uint64
+	duplicates      uint64
+	records         uint64
 }
 
 var timeFormat = "2006-01-02 15:04:05"
@@ -117,8 +118,11 @@ func main() {
 	var delete bool
 	var validate bool
 	var verify bool
+	var memoryFile string
 	var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to `file`")
 	var memprofile = flag.String("memprofile", "", "write memory profile to `file`")
+	var metrics = flag.String("metrics", "", "serve Prometheus metrics on /metrics of `address`, e.g. :9100")
+	var reportFile = flag.String("report", "", "write JSON run report to `file`")
 
 	flag.StringVar(&dbidParameter, "d", "23", "Map repository Database id")
 	flag.IntVar(&picFnrParameter, "p", 100, "Map repository file number")
@@ -127,7 +131,10 @@ func main() {
 	flag.BoolVar(&delete, "D", false, "Delete duplicate entries")
 	flag.BoolVar(&validate, "V", false, "Validate large object entries")
 	flag.BoolVar(&verify, "c", false, "Verify image content")
+	flag.StringVar(&memoryFile, "M", "", "Use local memory repository stored in this file instead of Adabas")
 	flag.Parse()
+	report := store.NewRunReport("checker", flag.CommandLine)
+	defer report.Exit(*reportFile)
 
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
@@ -146,92 +153,92 @@ func main() {
 	// 	flag.Usage()
 	// 	return
 	// }
-	fmt.Printf("Connect to file at  %s/%d\n", dbidParameter, picFnrParameter)
-
-	id := adabas.NewAdabasID()
-	a, err := adabas.NewAdabas(dbidParameter, id)
+	var repository store.PictureRepository
+	var err error
+	if memoryFile != "" {
+		fmt.Printf("Use memory repository %s\n", memoryFile)
+		repository, err = store.OpenMemoryRepository(memoryFile)
+	} else {
+		fmt.Printf("Connect to file at  %s/%d\n", dbidParameter, picFnrParameter)
+		repository, err = store.OpenAdabasRepository(&store.DatabaseReference{Dbid: dbidParameter,
+			PictureFile: adabas.Fnr(picFnrParameter)})
+	}
 	if err != nil {
 		fmt.Println("Adabas target generation error", err)
+		report.Abort(err)
 		return
 	}
-	c := &checker{adabas: a, picFnr: adabas.Fnr(picFnrParameter),
+	defer repository.Close()
+	stat := store.NewPictureStatistic()
+	store.SetRepositoryStatistics(repository, stat)
+	report.SetStatistics(stat)
+	if *metrics != "" {
+		err := store.NewMetricsExporter(stat).ListenAndServe(*metrics)
+		if err != nil {
+			fmt.Println("Metrics server error", err)
+			report.Abort(err)
+			return
+		}
+	}
+	c := &checker{repository: repository,
 		limit: uint64(limit), deleteDuplikate: delete,
 		maxOccurance: occurance, validateLob: validate}
+	report.AddCounter("checksums", func() uint64 { return c.checksums })
+	report.AddCounter("duplicates", func() uint64 { return c.duplicates })
+	report.AddCounter("records", func() uint64 { return c.records })
 	err = c.analyzeDoublikats()
 	if err != nil {
 		fmt.Println("Error anaylzing douplikats", err)
+		report.Abort(err)
 	}
 	err = c.listDuplikats()
 	if err != nil {
 		fmt.Printf("List duplicate error: %v\n", err)
+		report.Abort(err)
 	}
 	if verify {
 		fmt.Printf("%s Start verifying database picture content\n", time.Now().Format(timeFormat))
-		err := store.VerifyPicture(dbidParameter, adabas.Fnr(picFnrParameter), 1)
+		err := store.VerifyPictureRepository(repository, 1, stat)
 		if err != nil {
 			fmt.Printf("%s Error during verify of database picture content: %v\n", time.Now().Format(timeFormat), err)
+			report.Abort(err)
 			return
 		}
+		snapshot := stat.Snapshot()
+		fmt.Printf("%s Verified=%d NotFound=%d DiffData=%d DiffSize=%d OtherHost=%d\n", time.Now().Format(timeFormat),
+			snapshot.Verified, snapshot.NotFound, snapshot.DiffFound, snapshot.SizeDiffFound, snapshot.OtherHost)
 		fmt.Printf("%s finished verify of database picture content\n", time.Now().Format(timeFormat))
 	}
 
 }
 
 func (checker *checker) analyzeDoublikats() (err error) {
-	checker.conn, err = adabas.NewConnection("acj;inmap=" + checker.adabas.URL.String())
-	if err != nil {
-		return err
-	}
-	readCheck, rerr := checker.conn.CreateFileReadRequest(checker.picFnr)
-	if rerr != nil {
-		checker.conn.Close()
-		return rerr
-	}
-	readCheck.Limit = checker.limit
-	rerr = readCheck.QueryFields("CP")
-	if rerr != nil {
-		checker.conn.Close()
-		return rerr
-	}
-	cursor, err := readCheck.HistogramByCursoring("CP")
-	if err != nil {
-		fmt.Printf("Error checking descriptor quantity for ChecksumPicture: %v\n", err)
-		panic("Read error " + err.Error())
-	}
 	counter := uint64(0)
 	dupli := uint64(0)
-	for cursor.HasNextRecord() && (checker.limit == 0 || counter < checker.limit) {
-		record, recErr := cursor.NextRecord()
-		if recErr != nil {
-			panic("Read error " + recErr.Error())
-		}
+	err = checker.repository.HistogramChecksum(checker.limit, func(checksum string, quantity uint64) error {
 		if checker.validateLob {
-			checker.validateData(record.HashFields["CP"].String())
+			checker.validateData(checksum)
 		}
 		counter++
-		if record.Quantity != 1 {
-			fmt.Printf("quantity=%03d -> %s\n", record.Quantity, record.HashFields["ChecksumPicture"])
+		if quantity != 1 {
+			fmt.Printf("quantity=%03d -> %s\n", quantity, checksum)
 			dupli++
 		}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Error checking descriptor quantity for ChecksumPicture: %v\n", err)
+		panic("Read error " + err.Error())
 	}
 	fmt.Printf("There are %06d duplicate of %06d\n", dupli, counter)
+	checker.checksums = counter
+	checker.duplicates = dupli
 	return nil
 }
 
 func (checker *checker) validateData(checksum string) error {
-	readCheck, rerr := checker.conn.CreateMapReadRequest((*store.PictureData)(nil), 100)
-	if rerr != nil {
-		checker.conn.Close()
-		return rerr
-	}
-	rerr = readCheck.QueryFields("CP,PD,DP")
-	if rerr != nil {
-		checker.conn.Close()
-		return rerr
-	}
-	readCheck.Multifetch = 1
 	adatypes.Central.Log.Debugf("Read checksums records")
-	cursor, err := readCheck.ReadLogicalWithCursoring("CP=" + checksum)
+	cursor, err := checker.repository.ReadChecksum(checksum)
 	if err != nil {
 		fmt.Printf("Error checking descriptor quantity for ChecksumPicture: %v\n", err)
 		panic("Read error " + err.Error())
@@ -256,19 +263,8 @@ func (checker *checker) validateData(checksum string) error {
 }
 
 func (checker *checker) listDuplikats() error {
-	readCheck, rerr := checker.conn.CreateMapReadRequest((*store.PictureMetadata)(nil), int(checker.picFnr))
-	if rerr != nil {
-		checker.conn.Close()
-		return rerr
-	}
-	readCheck.Limit = checker.limit
-	rerr = readCheck.QueryFields("#PL,PL")
-	if rerr != nil {
-		checker.conn.Close()
-		return rerr
-	}
 	var isnList []adatypes.Isn
-	cursor, err := readCheck.ReadLogicalWithCursoring("CP>=' '")
+	cursor, err := checker.repository.ReadMetadata(checker.limit)
 	if err != nil {
 		fmt.Printf("Error checking descriptor quantity for ChecksumPicture: %v\n", err)
 		panic("Read error " + err.Error())
@@ -319,6 +315,7 @@ func (checker *checker) listDuplikats() error {
 		}
 	}
 	fmt.Printf("Have analysed %d records\n", counter)
+	checker.records = uint64(counter)
 	fmt.Printf("\nSchema quantity of picture location:\n")
 	fmt.Printf("NrPicture - Quantity - QuantityLen\n")
 	for q, c := range quantityStatistics {
@@ -337,17 +334,12 @@ func (checker *checker) listDuplikats() error {
 }
 
 func (checker *checker) deleteIsns(isnList []adatypes.Isn) error {
-	deleteRequest, err := checker.conn.CreateMapDeleteRequest("PictureMetadata")
-	if err != nil {
-		checker.conn.Close()
-		return err
-	}
 	for _, isn := range isnList {
-		err := deleteRequest.Delete(isn)
+		err := checker.repository.Delete(uint64(isn))
 		if err != nil {
 			return err
 		}
-		err = deleteRequest.EndTransaction()
+		err = checker.repository.EndTransaction()
 		if err != nil {
 			return err
 		}
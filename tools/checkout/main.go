@@ -21,9 +21,10 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"path"
 	"runtime"
@@ -72,16 +73,14 @@ func (cc processStep) command() string {
 }
 
 type checker struct {
-	conn      *adabas.Connection
-	read      *adabas.ReadRequest
-	list      *adabas.ReadRequest
-	adabas    *adabas.Adabas
-	directory string
-	limit     uint64
-	found     uint64
-	created   uint64
-	empty     uint64
-	step      processStep
+	repository store.PictureRepository
+	directory  string
+	limit      uint64
+	found      uint64
+	created    uint64
+	empty      uint64
+	step       processStep
+	report     *store.RunReport
 }
 
 var timeFormat = "2006-01-02 15:04:05"
@@ -151,28 +150,38 @@ func main() {
 	var mapFnrParameter int
 	var limit int
 	var directory string
+	var memoryFile string
+	var segmentFnrParameter int
 	var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to `file`")
 	var memprofile = flag.String("memprofile", "", "write memory profile to `file`")
+	var reportFile = flag.String("report", "", "write JSON run report to `file`")
 
 	flag.StringVar(&dbidParameter, "d", "23", "Map repository Database id")
 	flag.IntVar(&mapFnrParameter, "f", 4, "Map repository file number")
+	flag.IntVar(&segmentFnrParameter, "S", 0, "Segment file number of media bigger than the maximum binary blob size")
 	flag.IntVar(&limit, "l", 10, "Maximum records to read (0 is all)")
 	flag.StringVar(&directory, "D", "", "Directory storing files to")
+	flag.StringVar(&memoryFile, "M", "", "Use local memory repository stored in this file instead of Adabas")
 	flag.Parse()
+	report := store.NewRunReport("checkout", flag.CommandLine)
+	defer report.Exit(*reportFile)
 
 	if directory == "" {
 		fmt.Println("Please enter directory ...")
 		flag.Usage()
+		report.Abort(errors.New("directory option is required"))
 		return
 	}
 	if fi, err := os.Stat(directory); err != nil {
 		fmt.Println("Error opening directory ..." + directory + " : " + err.Error())
 		flag.Usage()
+		report.Abort(err)
 		return
 	} else {
 		if !fi.IsDir() {
 			fmt.Println("Please enter directory, not file ...")
 			flag.Usage()
+			report.Abort(errors.New("directory option is a file"))
 			return
 		}
 	}
@@ -194,20 +203,30 @@ func main() {
 	// 	flag.Usage()
 	// 	return
 	// }
-	fmt.Printf("Connect to map repository %s/%d\n", dbidParameter, mapFnrParameter)
-
-	id := adabas.NewAdabasID()
-	a, err := adabas.NewAdabas(dbidParameter, id)
+	var repository store.PictureRepository
+	var err error
+	if memoryFile != "" {
+		fmt.Printf("Use memory repository %s\n", memoryFile)
+		repository, err = store.OpenMemoryRepository(memoryFile)
+	} else {
+		fmt.Printf("Connect to map repository %s/%d\n", dbidParameter, mapFnrParameter)
+		repository, err = store.OpenAdabasRepository(&store.DatabaseReference{Dbid: dbidParameter,
+			PictureFile: adabas.Fnr(mapFnrParameter), SegmentFile: adabas.Fnr(segmentFnrParameter)})
+	}
 	if err != nil {
 		fmt.Println("Adabas target generation error", err)
+		report.Abort(err)
 		return
 	}
-	adabas.AddGlobalMapRepository(a.URL, adabas.Fnr(mapFnrParameter))
-	defer adabas.DelGlobalMapRepository(a.URL, adabas.Fnr(mapFnrParameter))
-	c := &checker{adabas: a, limit: uint64(limit), step: initialize, directory: directory}
+	defer repository.Close()
+	c := &checker{repository: repository, limit: uint64(limit), step: initialize, directory: directory, report: report}
+	report.AddCounter("found", func() uint64 { return c.found })
+	report.AddCounter("created", func() uint64 { return c.created })
+	report.AddCounter("empty", func() uint64 { return c.empty })
 	err = c.checkoutOriginals()
 	if err != nil {
 		fmt.Println("Error anaylzing douplikats", err)
+		report.Abort(err)
 	}
 }
 
@@ -230,42 +249,32 @@ func schedule(what func(), delay time.Duration) chan bool {
 
 func (checker *checker) checkoutOriginals() (err error) {
 	checker.step = analyzeDoublikats
-	checker.conn, err = adabas.NewConnection("acj;map")
-	if err != nil {
-		return err
-	}
-	defer checker.conn.Close()
-	checker.read, err = checker.conn.CreateMapReadRequest("PictureMetadata")
-	if err != nil {
-		checker.conn.Close()
-		return err
-	}
-	checker.read.Limit = checker.limit
-	err = checker.read.QueryFields("PictureName,Option,ExifTaken,ExifOrigTime")
-	if err != nil {
-		checker.conn.Close()
-		return err
-	}
 	counter := uint64(0)
 	output := func() {
 		fmt.Printf("%s Picture counter=%d created=%d found=%d empty=%d -> %s\n",
 			time.Now().Format(timeFormat), counter, checker.created, checker.found, checker.empty, checker.step.command())
 	}
 	stop := schedule(output, 15*time.Second)
-	_, err = checker.read.ReadLogicalWithStream("Option=original", func(record *adabas.Record, x interface{}) error {
+	cursor, err := checker.repository.ReadOption("original")
+	if err != nil {
+		fmt.Printf("Error checking descriptor quantity for ChecksumPicture: %v\n", err)
+		panic("Read error " + err.Error())
+	}
+	for cursor.HasNextRecord() && (checker.limit == 0 || counter < checker.limit) {
 		checker.step = readStream
+		data, err := cursor.NextData()
+		if err != nil {
+			fmt.Printf("Error checking descriptor quantity for ChecksumPicture: %v\n", err)
+			panic("Read error " + err.Error())
+		}
+		metadata := data.(*store.PictureMetadata)
 
 		// fmt.Printf("quantity=%03d -> %s\n", record.Quantity, record.HashFields["ChecksumPicture"])
-		err = checker.writeFile(record)
+		err = checker.writeFile(metadata)
 		if err != nil {
 			return err
 		}
 		counter++
-		return nil
-	}, nil)
-	if err != nil {
-		fmt.Printf("Error checking descriptor quantity for ChecksumPicture: %v\n", err)
-		panic("Read error " + err.Error())
 	}
 	stop <- true
 	fmt.Printf("There are %06d records -> %d found and %d created, %d empty\n",
@@ -273,14 +282,18 @@ func (checker *checker) checkoutOriginals() (err error) {
 	return nil
 }
 
-func (checker *checker) writeFile(record *adabas.Record) (err error) {
+func (checker *checker) writeFile(metadata *store.PictureMetadata) (err error) {
 	p := checker.directory
 
 	// new mtime
 	newAtime := time.Date(1980, time.January, 1, 10, 00, 00, 0, time.UTC)
 	newMtime := time.Date(1980, time.January, 1, 10, 00, 00, 0, time.UTC)
 
-	t := strings.Trim(record.HashFields["ExifTaken"].String(), " ")
+	pictureName := ""
+	if len(metadata.PictureLocation) > 0 {
+		pictureName = metadata.PictureLocation[0].PictureName
+	}
+	t := strings.Trim(metadata.ExifTaken, " ")
 	if t != "" {
 
 		exifTime, tErr := time.Parse(timeParseFormat, t)
@@ -293,7 +306,7 @@ func (checker *checker) writeFile(record *adabas.Record) (err error) {
 		}
 		p = fmt.Sprintf("%s%s%s", p, string(os.PathSeparator), newAtime.Format(fileTimeFormat))
 	} else {
-		p += path.Dir(record.HashFields["PictureName"].String())
+		p += path.Dir(pictureName)
 		p = strings.ReplaceAll(p, "../", "/")
 	}
 	_, err = os.Stat(p)
@@ -303,7 +316,7 @@ func (checker *checker) writeFile(record *adabas.Record) (err error) {
 			return err
 		}
 	}
-	n := path.Base(record.HashFields["PictureName"].String())
+	n := path.Base(pictureName)
 	f := p + string(os.PathSeparator) + n
 	if _, err := os.Stat(f); !os.IsNotExist(err) {
 		checker.found++
@@ -313,46 +326,35 @@ func (checker *checker) writeFile(record *adabas.Record) (err error) {
 		return nil
 	}
 	checker.step = listDuplikats
-	if checker.list == nil {
-		checker.list, err = checker.conn.CreateMapReadRequest(&store.PictureData{})
-		if err != nil {
-			checker.conn.Close()
-			return
-		}
-		err = checker.list.QueryFields("ChecksumPicture,Media")
-		if err != nil {
-			checker.conn.Close()
-			return
-		}
-
-	}
-	result, err := checker.list.ReadISN(record.Isn)
+	data, err := checker.repository.ReadMedia(metadata.Index)
 	if err != nil {
 		fmt.Printf("Error checking descriptor quantity for ChecksumPicture: %v\n", err)
 		panic("Read error " + err.Error())
 	}
-	if len(result.Data) != 1 {
-		panic("Result read of ISN")
-	}
-	data := result.Data[0].(*store.PictureData)
 	if len(data.Media) == 0 {
-		fmt.Println("Stored data empty :", record.HashFields["PictureName"].String())
+		fmt.Println("Stored data empty :", pictureName)
 		checker.empty++
-		delRequest, delErr := checker.conn.CreateMapDeleteRequest("PictureMetadata")
+		checker.step = delete
+		delErr := checker.repository.Delete(metadata.Index)
 		if delErr != nil {
 			fmt.Println("Delete err", delErr)
+			checker.report.FailedIsn(metadata.Index, delErr)
 			return nil
 		}
-		delRequest.Delete(record.Isn)
-		delRequest.EndTransaction()
+		checker.step = deleteEnd
+		checker.repository.EndTransaction()
 		return nil
 	}
 	file, err := os.OpenFile(f, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer file.Close()
-	file.Write(data.Media)
+	_, err = io.Copy(file, store.MediaReader(checker.repository, data))
+	if err != nil {
+		fmt.Println("Error writing media", f, err)
+		return err
+	}
 
 	// set new mtime
 	err = os.Chtimes(f, newAtime, newMtime)
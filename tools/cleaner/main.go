@@ -22,6 +22,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -29,6 +30,7 @@ import (
 	"runtime"
 	"runtime/pprof"
 	"strings"
+	"sync/atomic"
 	"time"
 	"tux-lobload/store"
 
@@ -41,17 +43,13 @@ import (
 var hostname string
 
 type deleter struct {
-	re                    []*regexp.Regexp
-	deleteRequest         *adabas.DeleteRequest
-	readDirectoryRequest  *adabas.ReadRequest
-	storeDirectoryRequest *adabas.StoreRequest
-	connection            *adabas.Connection
-	test                  bool
-	picFnr                adabas.Fnr
-	found                 uint64
-	deleted               uint64
-	transactions          uint64
-	counter               uint64
+	re           []*regexp.Regexp
+	repository   store.PictureRepository
+	test         bool
+	found        uint64
+	deleted      uint64
+	transactions uint64
+	counter      uint64
 }
 
 var timeFormat = "2006-01-02 15:04:05"
@@ -61,10 +59,7 @@ type elementCounter struct {
 }
 
 type validater struct {
-	conn            *adabas.Connection
-	read            *adabas.ReadRequest
-	delete          *adabas.DeleteRequest
-	list            *adabas.ReadRequest
+	repository      store.PictureRepository
 	limit           uint64
 	elementMap      map[int]*elementCounter
 	checkedPicture  uint64
@@ -144,8 +139,13 @@ func main() {
 	var test bool
 	var validate bool
 	var query string
+	var memoryFile string
+	var distance int
+	var reportFile string
 	var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to `file`")
 	var memprofile = flag.String("memprofile", "", "write memory profile to `file`")
+	var metrics = flag.String("metrics", "", "serve Prometheus metrics on /metrics of `address`, e.g. :9100")
+	var runReport = flag.String("report", "", "write JSON run report to `file`")
 
 	flag.StringVar(&dbidParameter, "d", "23", "Database id")
 	flag.IntVar(&mapFnrParameter, "p", 100, "Picture file number")
@@ -153,7 +153,12 @@ func main() {
 	flag.BoolVar(&test, "t", false, "Dry run, don't change")
 	flag.BoolVar(&validate, "v", false, "Validate uniquness of media content")
 	flag.StringVar(&query, "q", "", "Filter for regexp query used to clean up")
+	flag.IntVar(&distance, "s", -1, "Cluster near duplicates within Hamming distance of the perceptual hash (-1 is disabled)")
+	flag.StringVar(&reportFile, "o", "", "Write near duplicate clusters as JSON into this file instead of stdout")
+	flag.StringVar(&memoryFile, "M", "", "Use local memory repository stored in this file instead of Adabas")
 	flag.Parse()
+	report := store.NewRunReport("cleaner", flag.CommandLine)
+	defer report.Exit(*runReport)
 
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
@@ -167,8 +172,9 @@ func main() {
 	}
 	defer writeMemProfile(*memprofile)
 
-	if query == "" && !validate {
-		fmt.Println("Need to give exclude mask or enable validation!!!")
+	if query == "" && !validate && distance < 0 {
+		fmt.Println("Need to give exclude mask, enable validation or similarity check!!!")
+		report.Abort(errors.New("need exclude mask, validation or similarity check"))
 		return
 	}
 
@@ -176,80 +182,114 @@ func main() {
 		fmt.Println("Test mode ENABLED")
 	}
 
-	fmt.Printf("Connect to %s/%d\n", dbidParameter, mapFnrParameter)
+	var repository store.PictureRepository
+	var err error
+	if memoryFile != "" {
+		fmt.Printf("Use memory repository %s\n", memoryFile)
+		repository, err = store.OpenMemoryRepository(memoryFile)
+	} else {
+		fmt.Printf("Connect to %s/%d\n", dbidParameter, mapFnrParameter)
+		repository, err = store.OpenAdabasRepository(&store.DatabaseReference{Dbid: dbidParameter,
+			PictureFile: adabas.Fnr(mapFnrParameter)})
+	}
+	if err != nil {
+		fmt.Println("Error getting connection", err)
+		report.Abort(err)
+		return
+	}
+	defer repository.Close()
+	stat := store.NewPictureStatistic()
+	store.SetRepositoryStatistics(repository, stat)
+	report.SetStatistics(stat)
+	exporter := store.NewMetricsExporter(stat)
+	if *metrics != "" {
+		err := exporter.ListenAndServe(*metrics)
+		if err != nil {
+			fmt.Println("Metrics server error", err)
+			report.Abort(err)
+			return
+		}
+	}
 	if query != "" {
-		d := &deleter{test: test, picFnr: adabas.Fnr(mapFnrParameter)}
+		d := &deleter{test: test, repository: repository}
+		exportCounter(exporter, report, "cleaner_checked", "Records checked by exclude mask", &d.counter)
+		exportCounter(exporter, report, "cleaner_found", "Records with all locations excluded", &d.found)
+		exportCounter(exporter, report, "cleaner_deleted", "Records deleted by exclude mask", &d.deleted)
+		exportCounter(exporter, report, "cleaner_transactions", "Transactions of the exclude mask", &d.transactions)
 		fmt.Println("Clear using exclude mask with: " + query)
 		queries := strings.Split(query, ",")
 		for _, q := range queries {
 			re, err := regexp.Compile(q)
 			if err != nil {
 				fmt.Println("Query error regexp:", err)
+				report.Abort(err)
 				return
 			}
 			d.re = append(d.re, re)
 
 		}
-		connection, err := adabas.NewConnection(fmt.Sprintf("acj;inmap=%s,%d", dbidParameter, mapFnrParameter))
-		if err != nil {
-			fmt.Println("Error getting connection")
-			return
-		}
-		connection.Close()
-		d.connection = connection
-		err = removeQueries(connection, d, uint64(limit))
+		err = removeQueries(d, uint64(limit))
 		if err != nil {
 			fmt.Println("Error anaylzing douplikats", err)
+			report.Abort(err)
 		}
 	}
 	if validate {
-		val := &validater{limit: uint64(limit), test: test, elementMap: make(map[int]*elementCounter)}
+		val := &validater{repository: repository, limit: uint64(limit), test: test, elementMap: make(map[int]*elementCounter)}
+		exportCounter(exporter, report, "cleaner_validated", "Records of duplicate checksums validated", &val.checkedPicture)
+		exportCounter(exporter, report, "cleaner_ok", "Validated records with same media", &val.okPictures)
+		exportCounter(exporter, report, "cleaner_unique", "Duplicate checksums validated", &val.unique)
+		exportCounter(exporter, report, "cleaner_failure", "Validated records with different media", &val.failurePictures)
+		exportCounter(exporter, report, "cleaner_empty", "Validated records with empty media", &val.emptyPictures)
+		exportCounter(exporter, report, "cleaner_deleted_duplicates", "Duplicate records deleted", &val.deleteDuplikate)
+		exportCounter(exporter, report, "cleaner_deleted_empty", "Empty records deleted", &val.deleteEmpty)
 		val.analyzeDoublikats()
 	}
+	if distance >= 0 {
+		err = clusterSimilar(repository, uint64(limit), distance, reportFile)
+		if err != nil {
+			fmt.Println("Error clustering near duplicates", err)
+			report.Abort(err)
+		}
+	}
 }
 
-func removeQuery(record *adabas.Record, x interface{}) error {
-	v := record.HashFields["PL"].(*adatypes.StructureValue)
-	//fmt.Printf("%d %d\n", v.NrElements(), v.NrValues(1))
+func (de *deleter) removeQuery(metadata *store.PictureMetadata) error {
 	found := 0
 	fnMap := make(map[string]bool)
-	de := x.(*deleter)
-	for _, e := range v.Elements {
-		for _, sv := range e.Values {
-			fn := sv.String()
-			//			fmt.Printf("%s %T -> %s\n", sv.Type().Name(), sv, sv.String())
-			for _, re := range de.re {
-				if re.MatchString(fn) {
-					fnMap[fn] = true
-					found++
-					break
-				} else {
-					fnMap[fn] = false
-				}
+	for _, pl := range metadata.PictureLocation {
+		fn := pl.PictureDirectory
+		for _, re := range de.re {
+			if re.MatchString(fn) {
+				fnMap[fn] = true
+				found++
+				break
+			} else {
+				fnMap[fn] = false
 			}
 		}
 	}
 	switch {
-	case found == v.NrElements():
-		fmt.Println("Found all, could delete ISN:", record.Isn)
+	case found == len(metadata.PictureLocation):
+		fmt.Println("Found all, could delete ISN:", metadata.Index)
 		if !de.test {
-			err := de.deleteRequest.Delete(record.Isn)
+			err := de.repository.Delete(metadata.Index)
 			if err != nil {
 				return err
 			}
-			de.deleted++
+			atomic.AddUint64(&de.deleted, 1)
 			if de.counter%100 == 0 {
-				err := de.deleteRequest.EndTransaction()
+				err := de.repository.EndTransaction()
 				if err != nil {
 					return err
 				}
-				de.transactions++
+				atomic.AddUint64(&de.transactions, 1)
 			}
 		}
-		de.found++
+		atomic.AddUint64(&de.found, 1)
 	case found > 0:
-		fmt.Println("Found parts, could delete parts of ISN:", record.Isn)
-		de.filterDirectories(record.Isn, fnMap)
+		fmt.Println("Found parts, could delete parts of ISN:", metadata.Index)
+		de.filterDirectories(metadata, fnMap)
 		// for v, b := range fnMap {
 		// 	fmt.Println(v, b)
 		// }
@@ -257,16 +297,11 @@ func removeQuery(record *adabas.Record, x interface{}) error {
 		//	fmt.Println("Ignore :" + fn)
 
 	}
-	de.counter++
+	atomic.AddUint64(&de.counter, 1)
 	return nil
 }
 
-func (de *deleter) filterDirectories(isn adatypes.Isn, fnMap map[string]bool) {
-	result, err := de.readDirectoryRequest.ReadISN(isn)
-	if err != nil {
-		panic("Error reading ISN: " + err.Error())
-	}
-	metadata := result.Data[0].(*store.PictureMetadata)
+func (de *deleter) filterDirectories(metadata *store.PictureMetadata, fnMap map[string]bool) {
 	fmt.Println("Read ISN:", metadata.Index)
 
 	pnList := make([]*store.PictureLocation, 0)
@@ -291,65 +326,44 @@ func (de *deleter) filterDirectories(isn adatypes.Isn, fnMap map[string]bool) {
 	metadata.PictureLocation = pnList
 	if !de.test {
 		fmt.Println("Update ISN:", metadata.Index)
-		err = de.storeDirectoryRequest.UpdateData(metadata)
+		err := de.repository.UpdateLocations(metadata)
 		if err != nil {
 			panic("Error storing ISN: " + err.Error())
 		}
-		err = de.storeDirectoryRequest.EndTransaction()
+		err = de.repository.EndTransaction()
 		if err != nil {
 			panic("Error end transaction of ISN: " + err.Error())
 		}
 	}
 }
 
-func removeQueries(conn *adabas.Connection, de *deleter, limit uint64) error {
-	readCheck, err := conn.CreateFileReadRequest(de.picFnr)
-	if err != nil {
-		conn.Close()
-		return err
-	}
-	readCheck.Limit = limit
-	err = readCheck.QueryFields("PD")
-	if err != nil {
-		conn.Close()
-		return err
-	}
-	de.deleteRequest, err = conn.CreateDeleteRequest(de.picFnr)
-	if err != nil {
-		conn.Close()
-		return err
-	}
-	de.readDirectoryRequest, err = conn.CreateMapReadRequest((*store.PictureMetadata)(nil))
-	if err != nil {
-		conn.Close()
-		return err
-	}
-	err = de.readDirectoryRequest.QueryFields("PL")
-	if err != nil {
-		fmt.Printf("Error defining field query: %v\n", err)
-		de.deleteRequest.BackoutTransaction()
-		panic("Read error " + err.Error())
-	}
-	de.storeDirectoryRequest, err = conn.CreateMapStoreRequest((*store.PictureMetadata)(nil))
-	if err != nil {
-		conn.Close()
-		return err
-	}
-	err = de.storeDirectoryRequest.StoreFields("PL")
-	if err != nil {
-		fmt.Printf("Error defining store fields: %v\n", err)
-		de.deleteRequest.BackoutTransaction()
-		panic("Read error " + err.Error())
-	}
-	_, err = readCheck.ReadPhysicalSequenceStream(removeQuery, de)
+func removeQueries(de *deleter, limit uint64) error {
+	cursor, err := de.repository.ReadMetadata(limit)
 	if err != nil {
 		fmt.Printf("Error reading physical sequence stream: %v\n", err)
-		de.deleteRequest.BackoutTransaction()
 		panic("Read error " + err.Error())
 	}
+	for cursor.HasNextRecord() {
+		data, err := cursor.NextData()
+		if err != nil {
+			fmt.Printf("Error reading physical sequence stream: %v\n", err)
+			panic("Read error " + err.Error())
+		}
+		err = de.removeQuery(data.(*store.PictureMetadata))
+		if err != nil {
+			return err
+		}
+	}
 	fmt.Printf("Check %d records, found=%d, deleted=%d,transactions=%d\n", de.counter, de.found, de.deleted, de.transactions)
-	err = de.deleteRequest.EndTransaction()
-	return err
+	return de.repository.EndTransaction()
+}
+
+// exportCounter export counter of the cleaner in the metrics and the run
+// report, the counter is updated atomically
+func exportCounter(exporter *store.MetricsExporter, report *store.RunReport, name, help string, counter *uint64) {
+	value := func() uint64 { return atomic.LoadUint64(counter) }
+	exporter.AddCounter(name, help, value)
+	report.AddCounter(name, value)
 }
 
 func writeMemProfile(file string) {
@@ -369,64 +383,30 @@ func writeMemProfile(file string) {
 }
 
 func (validater *validater) analyzeDoublikats() (err error) {
-	validater.conn, err = adabas.NewConnection("acj;map")
-	if err != nil {
-		return err
-	}
-	defer validater.conn.Close()
-	if validater.read == nil {
-		validater.read, err = validater.conn.CreateMapReadRequest("PictureMetadata")
-		if err != nil {
-			validater.conn.Close()
-			return err
-		}
-		validater.read.Limit = validater.limit
-		err = validater.read.QueryFields("ChecksumPicture,PictureName")
-		if err != nil {
-			validater.conn.Close()
-			return err
-		}
-	}
 	counter := uint64(0)
 	output := func() {
 		fmt.Printf("%s Picture counter=%d checked=%d ok=%d unique=%d failure=%d empty=%d del Dupli=%d del Empty=%d\n",
-			time.Now().Format(timeFormat), counter, validater.checkedPicture,
-			validater.okPictures, validater.unique, validater.failurePictures,
-			validater.emptyPictures, validater.deleteDuplikate, validater.deleteEmpty)
+			time.Now().Format(timeFormat), atomic.LoadUint64(&counter), atomic.LoadUint64(&validater.checkedPicture),
+			atomic.LoadUint64(&validater.okPictures), atomic.LoadUint64(&validater.unique),
+			atomic.LoadUint64(&validater.failurePictures), atomic.LoadUint64(&validater.emptyPictures),
+			atomic.LoadUint64(&validater.deleteDuplikate), atomic.LoadUint64(&validater.deleteEmpty))
 	}
 	stop := schedule(output, 15*time.Second)
-	cursor, err := validater.read.HistogramByCursoring("ChecksumPicture")
-	// result, err := validater.read.ReadLogicalByStream("ChecksumPicture", func(record *adabas.Record, x interface{}) error {
-	// 	// fmt.Printf("quantity=%03d -> %s\n", record.Quantity, record.HashFields["ChecksumPicture"])
-	// 	err = validater.listDuplikats(record.HashFields["ChecksumPicture"].String())
-	// 	if err != nil {
-	// 		return err
-	// 	}
-	// 	counter++
-	// 	return nil
-	// }, nil)
-	if err != nil {
-		fmt.Printf("Error histogram descriptor quantity for ChecksumPicture: %v\n", err)
-		panic("Read error " + err.Error())
-	}
-	for cursor.HasNextRecord() {
-		counter++
-		record, err := cursor.NextRecord()
-		if err != nil {
-			fmt.Printf("Error getting next record cursor: %v\n", err)
-			panic("Cursor error " + err.Error())
-		}
-		// fmt.Println("Quantity: ", record.Quantity)
-		if record.Quantity > 1 {
-			err = validater.listDuplikats(record.HashFields["ChecksumPicture"].String())
+	err = validater.repository.HistogramChecksum(validater.limit, func(checksum string, quantity uint64) error {
+		atomic.AddUint64(&counter, 1)
+		// fmt.Println("Quantity: ", quantity)
+		if quantity > 1 {
+			err := validater.listDuplikats(checksum)
 			if err != nil {
 				fmt.Printf("Error cursor list duplicates: %v\n", err)
 				panic("Duplicate error " + err.Error())
 			}
 		}
-		if validater.limit != 0 && counter >= validater.limit {
-			break
-		}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Error histogram descriptor quantity for ChecksumPicture: %v\n", err)
+		panic("Read error " + err.Error())
 	}
 	stop <- true
 	fmt.Printf("%s Picture counter=%d checked=%d ok=%d unique=%d failure=%d empty=%d del Dupli=%d del Empty=%d\n",
@@ -441,32 +421,19 @@ func (validater *validater) analyzeDoublikats() (err error) {
 }
 
 func (validater *validater) listDuplikats(checksum string) (err error) {
-	if validater.list == nil {
-		validater.list, err = validater.conn.CreateMapReadRequest(&store.PictureData{})
-		if err != nil {
-			validater.conn.Close()
-			return
-		}
-		err = validater.list.QueryFields("Media")
-		if err != nil {
-			validater.conn.Close()
-			return
-		}
-		validater.list.Multifetch = 1
-		validater.list.Limit = 1
-	}
-	cursor, err := validater.list.ReadLogicalWithCursoring("ChecksumPicture=" + checksum)
+	cursor, err := validater.repository.ReadChecksum(checksum)
 	if err != nil {
 		fmt.Printf("Error checking descriptor quantity for ChecksumPicture: %v (%s)\n", err, checksum)
 		panic("Read error " + err.Error())
 	}
-	validater.unique++
+	atomic.AddUint64(&validater.unique, 1)
 	first := true
 	var data []byte
+	var sha string
 	var baseIsn uint64
 	counter := 0
 	for cursor.HasNextRecord() {
-		validater.checkedPicture++
+		atomic.AddUint64(&validater.checkedPicture, 1)
 		counter++
 		record, recErr := cursor.NextData()
 		if recErr != nil {
@@ -475,11 +442,12 @@ func (validater *validater) listDuplikats(checksum string) (err error) {
 		curPicture := record.(*store.PictureData)
 		if first {
 			data = curPicture.Media
+			sha = curPicture.ChecksumSHA256
 			if len(data) == 0 {
 				fmt.Println("Main record media is empty", checksum)
-				validater.emptyPictures++
+				atomic.AddUint64(&validater.emptyPictures, 1)
 			} else {
-				validater.okPictures++
+				atomic.AddUint64(&validater.okPictures, 1)
 			}
 			baseIsn = curPicture.Index
 			first = false
@@ -487,24 +455,24 @@ func (validater *validater) listDuplikats(checksum string) (err error) {
 			if data != nil {
 				if len(curPicture.Media) == 0 {
 					fmt.Println("Second record media is empty", checksum)
-					validater.emptyPictures++
+					atomic.AddUint64(&validater.emptyPictures, 1)
 					fmt.Println("Delete empty ISN:", curPicture.Index, " of ", baseIsn)
 					err = validater.Delete(curPicture.Index)
 					if err != nil {
 						return err
 					}
-					validater.deleteEmpty++
-				} else if bytes.Equal(data, curPicture.Media) {
+					atomic.AddUint64(&validater.deleteEmpty, 1)
+				} else if !sameMedia(data, sha, curPicture) {
 					fmt.Println("Record entry differ to first", checksum)
-					validater.failurePictures++
+					atomic.AddUint64(&validater.failurePictures, 1)
 				} else {
-					validater.okPictures++
+					atomic.AddUint64(&validater.okPictures, 1)
 					fmt.Println("Delete duplikate ISN:", curPicture.Index, " of ", baseIsn)
 					err = validater.Delete(curPicture.Index)
 					if err != nil {
 						return err
 					}
-					validater.deleteDuplikate++
+					atomic.AddUint64(&validater.deleteDuplikate, 1)
 				}
 			} else {
 				fmt.Println("First record is empty")
@@ -521,22 +489,23 @@ func (validater *validater) listDuplikats(checksum string) (err error) {
 		validater.elementMap[counter] = &elementCounter{counter: 1}
 	}
 	if !validater.test {
-		return validater.conn.EndTransaction()
+		return validater.repository.EndTransaction()
 	}
 	return nil
 }
 
+// sameMedia compare media with the first record. The SHA-256 checksum is
+// used if both records contain it, otherwise the media is compared.
+func sameMedia(data []byte, sha string, curPicture *store.PictureData) bool {
+	if sha != "" && curPicture.ChecksumSHA256 != "" {
+		return sha == curPicture.ChecksumSHA256
+	}
+	return bytes.Equal(data, curPicture.Media)
+}
+
 func (validater *validater) Delete(isn uint64) (err error) {
 	if !validater.test {
-		if validater.delete == nil {
-			validater.delete, err = validater.conn.CreateMapDeleteRequest("PictureMetadata")
-			if err != nil {
-				validater.conn.Close()
-				return
-			}
-		}
-
-		validater.delete.Delete(adatypes.Isn(isn))
+		return validater.repository.Delete(isn)
 	}
 	return nil
 }
@@ -0,0 +1,210 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"tux-lobload/store"
+)
+
+// similarLocation location of a near-duplicate record
+type similarLocation struct {
+	Host      string `json:"host"`
+	Directory string `json:"directory"`
+	Name      string `json:"name"`
+}
+
+// similarRecord near-duplicate record in a cluster
+type similarRecord struct {
+	Isn             uint64            `json:"isn"`
+	PerceptualHash  string            `json:"perceptualHash"`
+	Distance        int               `json:"distance"`
+	ChecksumPicture string            `json:"checksumPicture"`
+	MIMEType        string            `json:"mimeType"`
+	Width           uint32            `json:"width"`
+	Height          uint32            `json:"height"`
+	ExifXdimension  uint32            `json:"exifXdimension"`
+	ExifYdimension  uint32            `json:"exifYdimension"`
+	Locations       []similarLocation `json:"locations"`
+}
+
+// similarCluster records within the Hamming distance of each other
+type similarCluster struct {
+	PerceptualHash string           `json:"perceptualHash"`
+	Records        []*similarRecord `json:"records"`
+}
+
+type similarEntry struct {
+	hash     uint64
+	metadata *store.PictureMetadata
+}
+
+// bkNode node of the BK-tree used to search hashes within a Hamming distance
+type bkNode struct {
+	hash     uint64
+	entries  []int
+	children map[int]*bkNode
+}
+
+func (node *bkNode) add(hash uint64, entry int) {
+	for {
+		d := store.HammingDistance(node.hash, hash)
+		if d == 0 {
+			node.entries = append(node.entries, entry)
+			return
+		}
+		child, ok := node.children[d]
+		if !ok {
+			node.children[d] = &bkNode{hash: hash, entries: []int{entry}, children: make(map[int]*bkNode)}
+			return
+		}
+		node = child
+	}
+}
+
+func (node *bkNode) search(hash uint64, distance int, fn func(entry int)) {
+	d := store.HammingDistance(node.hash, hash)
+	if d <= distance {
+		for _, e := range node.entries {
+			fn(e)
+		}
+	}
+	for cd, child := range node.children {
+		if cd >= d-distance && cd <= d+distance {
+			child.search(hash, distance, fn)
+		}
+	}
+}
+
+// unionFind disjoint sets of the entry index
+type unionFind []int
+
+func (uf unionFind) find(i int) int {
+	for uf[i] != i {
+		uf[i] = uf[uf[i]]
+		i = uf[i]
+	}
+	return i
+}
+
+func (uf unionFind) union(a, b int) {
+	ra, rb := uf.find(a), uf.find(b)
+	if ra != rb {
+		if ra < rb {
+			uf[rb] = ra
+		} else {
+			uf[ra] = rb
+		}
+	}
+}
+
+// clusterSimilar read all metadata containing a perceptual hash and report
+// all clusters of records within the given Hamming distance as JSON
+func clusterSimilar(repository store.PictureRepository, limit uint64, distance int, reportFile string) error {
+	cursor, err := repository.ReadMetadata(limit)
+	if err != nil {
+		return err
+	}
+	entries := make([]*similarEntry, 0)
+	var root *bkNode
+	for cursor.HasNextRecord() {
+		data, err := cursor.NextData()
+		if err != nil {
+			return err
+		}
+		md := data.(*store.PictureMetadata)
+		if md.PerceptualHash == "" {
+			continue
+		}
+		hash, err := store.ParsePerceptualHash(md.PerceptualHash)
+		if err != nil {
+			fmt.Printf("Invalid perceptual hash ISN=%d: %v\n", md.Index, err)
+			continue
+		}
+		entries = append(entries, &similarEntry{hash: hash, metadata: md})
+		if root == nil {
+			root = &bkNode{hash: hash, entries: []int{0}, children: make(map[int]*bkNode)}
+		} else {
+			root.add(hash, len(entries)-1)
+		}
+	}
+	uf := make(unionFind, len(entries))
+	for i := range uf {
+		uf[i] = i
+	}
+	for i, e := range entries {
+		root.search(e.hash, distance, func(entry int) {
+			uf.union(i, entry)
+		})
+	}
+	members := make(map[int][]int)
+	for i := range entries {
+		r := uf.find(i)
+		members[r] = append(members[r], i)
+	}
+	clusters := make([]*similarCluster, 0)
+	for r, list := range members {
+		if len(list) < 2 {
+			continue
+		}
+		first := entries[r]
+		cluster := &similarCluster{PerceptualHash: first.metadata.PerceptualHash}
+		for _, i := range list {
+			cluster.Records = append(cluster.Records, newSimilarRecord(entries[i], first.hash))
+		}
+		clusters = append(clusters, cluster)
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].Records[0].Isn < clusters[j].Records[0].Isn
+	})
+	fmt.Printf("Found %d clusters of near duplicates in %d records with distance %d\n",
+		len(clusters), len(entries), distance)
+
+	var w io.Writer = os.Stdout
+	if reportFile != "" {
+		f, err := os.Create(reportFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(clusters)
+}
+
+func newSimilarRecord(e *similarEntry, base uint64) *similarRecord {
+	md := e.metadata
+	sr := &similarRecord{Isn: md.Index, PerceptualHash: md.PerceptualHash,
+		Distance: store.HammingDistance(base, e.hash), ChecksumPicture: md.ChecksumPicture,
+		MIMEType: md.MIMEType, Width: md.Width, Height: md.Height,
+		ExifXdimension: md.ExifXdimension, ExifYdimension: md.ExifYdimension,
+		Locations: make([]similarLocation, 0, len(md.PictureLocation))}
+	for _, l := range md.PictureLocation {
+		sr.Locations = append(sr.Locations, similarLocation{Host: l.PictureHost,
+			Directory: l.PictureDirectory, Name: l.PictureName})
+	}
+	return sr
+}
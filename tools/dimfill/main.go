@@ -0,0 +1,251 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+	"tux-lobload/store"
+
+	"github.com/tknie/adabas-go-api/adabas"
+	"github.com/tknie/adabas-go-api/adatypes"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var timeFormat = "2006-01-02 15:04:05"
+
+type migration struct {
+	repository store.PictureRepository
+	limit      uint64
+	test       bool
+	counter    uint64
+	updated    uint64
+	unchanged  uint64
+	failures   uint64
+	report     *store.RunReport
+}
+
+func init() {
+	level := zapcore.ErrorLevel
+	ed := os.Getenv("ENABLE_DEBUG")
+	switch ed {
+	case "1":
+		level = zapcore.DebugLevel
+		adatypes.Central.SetDebugLevel(true)
+	case "2":
+		level = zapcore.InfoLevel
+	}
+
+	err := initLogLevelWithFile("dimfill.log", level)
+	if err != nil {
+		fmt.Println("Error initialize logging")
+		os.Exit(255)
+	}
+}
+
+func initLogLevelWithFile(fileName string, level zapcore.Level) (err error) {
+	p := os.Getenv("LOGPATH")
+	if p == "" {
+		p = "."
+	}
+	name := p + string(os.PathSeparator) + fileName
+
+	rawJSON := []byte(`{
+		"level": "error",
+		"encoding": "console",
+		"outputPaths": [ "loadpicture.log"],
+		"errorOutputPaths": ["stderr"],
+		"encoderConfig": {
+		  "messageKey": "message",
+		  "levelKey": "level",
+		  "levelEncoder": "lowercase"
+		}
+	  }`)
+
+	var cfg zap.Config
+	if err := json.Unmarshal(rawJSON, &cfg); err != nil {
+		fmt.Println("Error initialize logging (json)")
+		os.Exit(255)
+	}
+	cfg.Level.SetLevel(level)
+	cfg.OutputPaths = []string{name}
+	logger, err := cfg.Build()
+	if err != nil {
+		fmt.Println("Error initialize logging (build)")
+		os.Exit(255)
+	}
+	defer logger.Sync()
+
+	sugar := logger.Sugar()
+
+	sugar.Infof("Start logging with level", level)
+	adatypes.Central.Log = sugar
+
+	return
+}
+
+func main() {
+	var dbidParameter string
+	var mapFnrParameter int
+	var segmentFnrParameter int
+	var limit int
+	var test bool
+	var memoryFile string
+	var reportFile string
+
+	flag.StringVar(&dbidParameter, "d", "23", "Database id")
+	flag.IntVar(&mapFnrParameter, "p", 100, "Picture file number")
+	flag.IntVar(&segmentFnrParameter, "S", 0, "Segment file number for media bigger than the maximum binary blob size (0 is disabled)")
+	flag.IntVar(&limit, "l", 10, "Maximum records to read (0 is all)")
+	flag.BoolVar(&test, "t", false, "Dry run, don't change")
+	flag.StringVar(&memoryFile, "M", "", "Use local memory repository stored in this file instead of Adabas")
+	flag.StringVar(&reportFile, "report", "", "Write JSON run report to `file`")
+	flag.Parse()
+	report := store.NewRunReport("dimfill", flag.CommandLine)
+	defer report.Exit(reportFile)
+
+	if test {
+		fmt.Println("Test mode ENABLED")
+	}
+
+	var repository store.PictureRepository
+	var err error
+	if memoryFile != "" {
+		fmt.Printf("Use memory repository %s\n", memoryFile)
+		repository, err = store.OpenMemoryRepository(memoryFile)
+	} else {
+		fmt.Printf("Connect to %s/%d\n", dbidParameter, mapFnrParameter)
+		repository, err = store.OpenAdabasRepository(&store.DatabaseReference{Dbid: dbidParameter,
+			PictureFile: adabas.Fnr(mapFnrParameter), SegmentFile: adabas.Fnr(segmentFnrParameter)})
+	}
+	if err != nil {
+		fmt.Println("Error getting connection", err)
+		report.Abort(err)
+		return
+	}
+	defer repository.Close()
+
+	mg := &migration{repository: repository, limit: uint64(limit), test: test, report: report}
+	report.AddCounter("counter", func() uint64 { return mg.counter })
+	report.AddCounter("updated", func() uint64 { return mg.updated })
+	report.AddCounter("unchanged", func() uint64 { return mg.unchanged })
+	report.AddCounter("failures", func() uint64 { return mg.failures })
+	err = mg.migrate()
+	if err != nil {
+		fmt.Println("Error migrating dimensions", err)
+		report.Abort(err)
+	}
+}
+
+func (mg *migration) String() string {
+	return fmt.Sprintf("%s Picture counter=%d updated=%d unchanged=%d failures=%d",
+		time.Now().Format(timeFormat), mg.counter, mg.updated, mg.unchanged, mg.failures)
+}
+
+// migrate walk all picture metadata and recompute the original dimensions
+// out of the media (DP) and the thumbnail dimensions out of the thumbnail (DT)
+func (mg *migration) migrate() error {
+	stop := schedule(func() { fmt.Println(mg) }, 15*time.Second)
+	defer func() { stop <- true }()
+	cursor, err := mg.repository.ReadMetadata(mg.limit)
+	if err != nil {
+		return err
+	}
+	for cursor.HasNextRecord() {
+		d, err := cursor.NextData()
+		if err != nil {
+			return err
+		}
+		mg.counter++
+		md := d.(*store.PictureMetadata)
+		err = mg.migrateRecord(md)
+		if err != nil {
+			fmt.Printf("Error dimensions ISN=%d: %v\n", md.Index, err)
+			mg.report.FailedIsn(md.Index, err)
+			mg.failures++
+		}
+	}
+	fmt.Println(mg)
+	if mg.test {
+		return nil
+	}
+	return mg.repository.EndTransaction()
+}
+
+func (mg *migration) migrateRecord(md *store.PictureMetadata) error {
+	format := store.FormatByMIMEType(md.MIMEType)
+	data, err := mg.repository.ReadMedia(md.Index)
+	if err != nil {
+		return err
+	}
+	if len(data.Media) == 0 {
+		return fmt.Errorf("media empty")
+	}
+	width, height := uint32(0), uint32(0)
+	if format != nil && format.Image() {
+		width, height, err = store.MediaDimensions(format, mg.repository, data, md.ExifOrientation)
+		if err != nil {
+			return err
+		}
+	}
+	thumbnailWidth, thumbnailHeight := store.ThumbnailDimensions(data)
+	old := *md
+	md.SetDimensions(format, width, height, thumbnailWidth, thumbnailHeight)
+	if old.Width == md.Width && old.Height == md.Height && old.Fill == md.Fill &&
+		old.ThumbnailWidth == md.ThumbnailWidth && old.ThumbnailHeight == md.ThumbnailHeight {
+		mg.unchanged++
+		return nil
+	}
+	fmt.Printf("Dimensions ISN=%d %dx%d thumbnail %dx%d fill %s\n", md.Index,
+		md.Width, md.Height, md.ThumbnailWidth, md.ThumbnailHeight, md.Fill)
+	mg.updated++
+	if mg.test {
+		return nil
+	}
+	err = mg.repository.UpdateDimensions(md)
+	if err != nil {
+		return err
+	}
+	if mg.updated%100 == 0 {
+		return mg.repository.EndTransaction()
+	}
+	return nil
+}
+
+func schedule(what func(), delay time.Duration) chan bool {
+	stop := make(chan bool)
+
+	go func() {
+		for {
+			what()
+			select {
+			case <-time.After(delay):
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
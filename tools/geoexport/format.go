@@ -0,0 +1,127 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"tux-lobload/store"
+)
+
+type geoJSONCollection struct {
+	Type     string            `json:"type"`
+	Features []*geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Type       string            `json:"type"`
+	Geometry   geoJSONGeometry   `json:"geometry"`
+	Properties geoJSONProperties `json:"properties"`
+}
+
+type geoJSONGeometry struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+type geoJSONProperties struct {
+	Name            string `json:"name"`
+	Description     string `json:"description,omitempty"`
+	ChecksumPicture string `json:"checksumPicture"`
+	MIMEType        string `json:"mimeType"`
+	Taken           string `json:"taken,omitempty"`
+	GeoCell         string `json:"geoCell"`
+	Thumbnail       string `json:"thumbnail"`
+}
+
+// writeGeoJSON write all features as GeoJSON feature collection, the
+// coordinates are longitude, latitude and altitude
+func (ex *exporter) writeGeoJSON(w io.Writer) error {
+	collection := &geoJSONCollection{Type: "FeatureCollection", Features: make([]*geoJSONFeature, 0)}
+	for _, f := range ex.features {
+		md := f.metadata
+		collection.Features = append(collection.Features, &geoJSONFeature{Type: "Feature",
+			Geometry: geoJSONGeometry{Type: "Point",
+				Coordinates: []float64{md.ExifLongitude, md.ExifLatitude, md.ExifAltitude}},
+			Properties: geoJSONProperties{Name: f.name, Description: f.text,
+				ChecksumPicture: md.ChecksumPicture, MIMEType: md.MIMEType,
+				Taken: md.ExifTaken, GeoCell: md.GeoCell, Thumbnail: ex.thumbnail(md)}})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(collection)
+}
+
+type kml struct {
+	XMLName  xml.Name    `xml:"http://www.opengis.net/kml/2.2 kml"`
+	Document kmlDocument `xml:"Document"`
+}
+
+type kmlDocument struct {
+	Placemarks []*kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name         string    `xml:"name"`
+	Description  string    `xml:"description,omitempty"`
+	ExtendedData []kmlData `xml:"ExtendedData>Data"`
+	Point        kmlPoint  `xml:"Point"`
+}
+
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+type kmlPoint struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+// writeKML write all features as KML placemarks
+func (ex *exporter) writeKML(w io.Writer) error {
+	doc := &kml{}
+	for _, f := range ex.features {
+		md := f.metadata
+		doc.Document.Placemarks = append(doc.Document.Placemarks, &kmlPlacemark{Name: f.name,
+			Description: f.text,
+			ExtendedData: []kmlData{{Name: "checksumPicture", Value: md.ChecksumPicture},
+				{Name: "mimeType", Value: md.MIMEType}, {Name: "taken", Value: md.ExifTaken},
+				{Name: "geoCell", Value: md.GeoCell}, {Name: "thumbnail", Value: ex.thumbnail(md)}},
+			Point: kmlPoint{Coordinates: coordinates(md)}})
+	}
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(doc)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+func coordinates(md *store.PictureMetadata) string {
+	return fmt.Sprintf("%f,%f,%f", md.ExifLongitude, md.ExifLatitude, md.ExifAltitude)
+}
@@ -0,0 +1,318 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"tux-lobload/store"
+
+	"github.com/tknie/adabas-go-api/adabas"
+	"github.com/tknie/adabas-go-api/adatypes"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// thumbnailPath REST path of the thumbnail used by the web application
+const thumbnailPath = "/binary/map/Picture/*/Thumbnail?search=Md5="
+
+type exporter struct {
+	repository store.PictureRepository
+	limit      uint64
+	url        string
+	cell       string
+	album      map[string]*store.Picture
+	features   []*feature
+}
+
+// feature geotagged picture exported as GeoJSON feature or KML placemark
+type feature struct {
+	metadata *store.PictureMetadata
+	name     string
+	text     string
+}
+
+func init() {
+	level := zapcore.ErrorLevel
+	ed := os.Getenv("ENABLE_DEBUG")
+	switch ed {
+	case "1":
+		level = zapcore.DebugLevel
+		adatypes.Central.SetDebugLevel(true)
+	case "2":
+		level = zapcore.InfoLevel
+	}
+
+	err := initLogLevelWithFile("geoexport.log", level)
+	if err != nil {
+		fmt.Println("Error initialize logging")
+		os.Exit(255)
+	}
+}
+
+func initLogLevelWithFile(fileName string, level zapcore.Level) (err error) {
+	p := os.Getenv("LOGPATH")
+	if p == "" {
+		p = "."
+	}
+	name := p + string(os.PathSeparator) + fileName
+
+	rawJSON := []byte(`{
+		"level": "error",
+		"encoding": "console",
+		"outputPaths": [ "loadpicture.log"],
+		"errorOutputPaths": ["stderr"],
+		"encoderConfig": {
+		  "messageKey": "message",
+		  "levelKey": "level",
+		  "levelEncoder": "lowercase"
+		}
+	  }`)
+
+	var cfg zap.Config
+	if err := json.Unmarshal(rawJSON, &cfg); err != nil {
+		fmt.Println("Error initialize logging (json)")
+		os.Exit(255)
+	}
+	cfg.Level.SetLevel(level)
+	cfg.OutputPaths = []string{name}
+	logger, err := cfg.Build()
+	if err != nil {
+		fmt.Println("Error initialize logging (build)")
+		os.Exit(255)
+	}
+	defer logger.Sync()
+
+	sugar := logger.Sugar()
+
+	sugar.Infof("Start logging with level", level)
+	adatypes.Central.Log = sugar
+
+	return
+}
+
+func main() {
+	var dbidParameter string
+	var mapFnrParameter int
+	var pictureFnrParameter int
+	var limit int
+	var memoryFile string
+	var outputFile string
+	var format string
+	var albumTitle string
+	var albumFile string
+	var url string
+	var cell string
+	var reportFile string
+
+	flag.StringVar(&dbidParameter, "d", "23", "Database id")
+	flag.IntVar(&pictureFnrParameter, "p", 100, "Picture file number")
+	flag.IntVar(&mapFnrParameter, "f", 4, "Map repository file number used to read the album")
+	flag.IntVar(&limit, "l", 0, "Maximum records to read (0 is all)")
+	flag.StringVar(&memoryFile, "M", "", "Use local memory repository stored in this file instead of Adabas")
+	flag.StringVar(&outputFile, "o", "", "Output file, standard output if empty")
+	flag.StringVar(&format, "F", "geojson", "Output format geojson or kml")
+	flag.StringVar(&albumTitle, "A", "", "Export only the pictures of the album with this title")
+	flag.StringVar(&albumFile, "J", "", "Read the album out of this JSON album export instead of Adabas")
+	flag.StringVar(&url, "u", "", "Base URL of the thumbnail reference")
+	flag.StringVar(&cell, "c", "", "Export only pictures in geo cells starting with this prefix")
+	flag.StringVar(&reportFile, "report", "", "Write JSON run report to `file`")
+	flag.Parse()
+	report := store.NewRunReport("geoexport", flag.CommandLine)
+	defer report.Exit(reportFile)
+
+	format = strings.ToLower(format)
+	if format != "geojson" && format != "kml" {
+		fmt.Println("Output format must be geojson or kml")
+		flag.Usage()
+		report.Abort(fmt.Errorf("unknown output format %s", format))
+		return
+	}
+
+	var repository store.PictureRepository
+	var err error
+	if memoryFile != "" {
+		fmt.Fprintf(os.Stderr, "Use memory repository %s\n", memoryFile)
+		repository, err = store.OpenMemoryRepository(memoryFile)
+	} else {
+		fmt.Fprintf(os.Stderr, "Connect to %s/%d\n", dbidParameter, pictureFnrParameter)
+		repository, err = store.OpenAdabasRepository(&store.DatabaseReference{Dbid: dbidParameter,
+			PictureFile: adabas.Fnr(pictureFnrParameter)})
+	}
+	if err != nil {
+		fmt.Println("Error getting connection", err)
+		report.Abort(err)
+		return
+	}
+	defer repository.Close()
+
+	ex := &exporter{repository: repository, limit: uint64(limit), url: url, cell: cell}
+	report.AddCounter("exported", func() uint64 { return uint64(len(ex.features)) })
+	if albumTitle != "" {
+		var album *store.Album
+		if albumFile != "" {
+			album, err = readAlbumFile(albumFile, albumTitle)
+		} else {
+			album, err = readAlbum(dbidParameter, mapFnrParameter, albumTitle)
+		}
+		if err != nil {
+			fmt.Println("Error reading album", err)
+			report.Abort(err)
+			return
+		}
+		ex.album = make(map[string]*store.Picture)
+		for _, p := range album.Pictures {
+			ex.album[p.Md5] = p
+		}
+	}
+	err = ex.collect()
+	if err != nil {
+		fmt.Println("Error reading geotagged pictures", err)
+		report.Abort(err)
+		return
+	}
+
+	var out io.Writer = os.Stdout
+	if outputFile != "" {
+		f, ferr := os.Create(outputFile)
+		if ferr != nil {
+			fmt.Println("Error creating output file", ferr)
+			report.Abort(ferr)
+			return
+		}
+		defer f.Close()
+		out = f
+	}
+	if format == "kml" {
+		err = ex.writeKML(out)
+	} else {
+		err = ex.writeGeoJSON(out)
+	}
+	if err != nil {
+		fmt.Println("Error writing export", err)
+		report.Abort(err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d geotagged pictures\n", len(ex.features))
+}
+
+// readAlbum read album with the given title using the Adabas map repository
+func readAlbum(dbidParameter string, mapFnrParameter int, title string) (*store.Album, error) {
+	adabas.AddGlobalMapRepositoryReference(fmt.Sprintf("%s,%d", dbidParameter, mapFnrParameter))
+	con, err := adabas.NewConnection("acj;map")
+	if err != nil {
+		return nil, err
+	}
+	defer con.Close()
+	readRequest, err := con.CreateMapReadRequest((*store.Album)(nil))
+	if err != nil {
+		return nil, err
+	}
+	err = readRequest.QueryFields("Title,Pictures")
+	if err != nil {
+		return nil, err
+	}
+	result, err := readRequest.ReadLogicalWith("Title=" + title)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Data) == 0 {
+		return nil, fmt.Errorf("album %s not found", title)
+	}
+	return result.Data[0].(*store.Album), nil
+}
+
+// readAlbumFile read album with the given title out of a JSON album export
+func readAlbumFile(fileName string, title string) (*store.Album, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var export struct {
+		Records []*store.Album
+	}
+	err = json.Unmarshal(data, &export)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range export.Records {
+		if a.Title == title {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("album %s not found", title)
+}
+
+// collect read the metadata and keep the geotagged pictures of the album
+// or geo cell selection. The geo cell selection uses the descriptor (GC).
+func (ex *exporter) collect() error {
+	var cursor store.PictureCursor
+	var err error
+	if ex.cell != "" {
+		cursor, err = ex.repository.ReadGeoCell(ex.cell)
+	} else {
+		cursor, err = ex.repository.ReadMetadata(ex.limit)
+	}
+	if err != nil {
+		return err
+	}
+	read := uint64(0)
+	for cursor.HasNextRecord() {
+		if ex.limit != 0 && read >= ex.limit {
+			break
+		}
+		read++
+		d, err := cursor.NextData()
+		if err != nil {
+			return err
+		}
+		md := d.(*store.PictureMetadata)
+		// fixed length fields are returned blank padded
+		md.ChecksumPicture = strings.Trim(md.ChecksumPicture, " ")
+		md.GeoCell = strings.Trim(md.GeoCell, " ")
+		if !md.Geotagged() {
+			continue
+		}
+		f := &feature{metadata: md, name: md.Title}
+		if len(md.PictureLocation) > 0 && f.name == "" {
+			f.name = md.PictureLocation[0].PictureName
+		}
+		if ex.album != nil {
+			p, ok := ex.album[md.ChecksumPicture]
+			if !ok {
+				continue
+			}
+			// album pictures may reference the same media more than once
+			delete(ex.album, md.ChecksumPicture)
+			f.name = p.Name
+			f.text = p.Description
+		}
+		ex.features = append(ex.features, f)
+	}
+	return nil
+}
+
+func (ex *exporter) thumbnail(md *store.PictureMetadata) string {
+	return ex.url + thumbnailPath + md.ChecksumPicture
+}
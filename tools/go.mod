@@ -7,10 +7,11 @@ require (
 	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
 	github.com/tknie/adabas-go-api v1.7.2
 	go.uber.org/zap v1.23.0
+	golang.org/x/image v0.18.0
 )
 
 require (
 	go.uber.org/atomic v1.10.0 // indirect
 	go.uber.org/multierr v1.8.0 // indirect
-	golang.org/x/text v0.3.7 // indirect
+	golang.org/x/text v0.16.0 // indirect
 )
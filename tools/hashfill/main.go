@@ -0,0 +1,256 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"tux-lobload/store"
+
+	"github.com/tknie/adabas-go-api/adabas"
+	"github.com/tknie/adabas-go-api/adatypes"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var timeFormat = "2006-01-02 15:04:05"
+
+type backfill struct {
+	repository store.PictureRepository
+	limit      uint64
+	force      bool
+	test       bool
+	counter    uint64
+	updated    uint64
+	skipped    uint64
+	mismatch   uint64
+	failures   uint64
+	report     *store.RunReport
+}
+
+func init() {
+	level := zapcore.ErrorLevel
+	ed := os.Getenv("ENABLE_DEBUG")
+	switch ed {
+	case "1":
+		level = zapcore.DebugLevel
+		adatypes.Central.SetDebugLevel(true)
+	case "2":
+		level = zapcore.InfoLevel
+	}
+
+	err := initLogLevelWithFile("hashfill.log", level)
+	if err != nil {
+		fmt.Println("Error initialize logging")
+		os.Exit(255)
+	}
+}
+
+func initLogLevelWithFile(fileName string, level zapcore.Level) (err error) {
+	p := os.Getenv("LOGPATH")
+	if p == "" {
+		p = "."
+	}
+	name := p + string(os.PathSeparator) + fileName
+
+	rawJSON := []byte(`{
+		"level": "error",
+		"encoding": "console",
+		"outputPaths": [ "loadpicture.log"],
+		"errorOutputPaths": ["stderr"],
+		"encoderConfig": {
+		  "messageKey": "message",
+		  "levelKey": "level",
+		  "levelEncoder": "lowercase"
+		}
+	  }`)
+
+	var cfg zap.Config
+	if err := json.Unmarshal(rawJSON, &cfg); err != nil {
+		fmt.Println("Error initialize logging (json)")
+		os.Exit(255)
+	}
+	cfg.Level.SetLevel(level)
+	cfg.OutputPaths = []string{name}
+	logger, err := cfg.Build()
+	if err != nil {
+		fmt.Println("Error initialize logging (build)")
+		os.Exit(255)
+	}
+	defer logger.Sync()
+
+	sugar := logger.Sugar()
+
+	sugar.Infof("Start logging with level", level)
+	adatypes.Central.Log = sugar
+
+	return
+}
+
+func main() {
+	var dbidParameter string
+	var mapFnrParameter int
+	var segmentFnrParameter int
+	var limit int
+	var force bool
+	var test bool
+	var memoryFile string
+	var reportFile string
+
+	flag.StringVar(&dbidParameter, "d", "23", "Database id")
+	flag.IntVar(&mapFnrParameter, "p", 100, "Picture file number")
+	flag.IntVar(&segmentFnrParameter, "S", 0, "Segment file number for media bigger than the maximum binary blob size (0 is disabled)")
+	flag.IntVar(&limit, "l", 10, "Maximum records to read (0 is all)")
+	flag.BoolVar(&force, "f", false, "Recalculate SHA-256 checksum even if already set")
+	flag.BoolVar(&test, "t", false, "Dry run, don't change")
+	flag.StringVar(&memoryFile, "M", "", "Use local memory repository stored in this file instead of Adabas")
+	flag.StringVar(&reportFile, "report", "", "Write JSON run report to `file`")
+	flag.Parse()
+	report := store.NewRunReport("hashfill", flag.CommandLine)
+	defer report.Exit(reportFile)
+
+	if test {
+		fmt.Println("Test mode ENABLED")
+	}
+
+	var repository store.PictureRepository
+	var err error
+	if memoryFile != "" {
+		fmt.Printf("Use memory repository %s\n", memoryFile)
+		repository, err = store.OpenMemoryRepository(memoryFile)
+	} else {
+		fmt.Printf("Connect to %s/%d\n", dbidParameter, mapFnrParameter)
+		repository, err = store.OpenAdabasRepository(&store.DatabaseReference{Dbid: dbidParameter,
+			PictureFile: adabas.Fnr(mapFnrParameter), SegmentFile: adabas.Fnr(segmentFnrParameter)})
+	}
+	if err != nil {
+		fmt.Println("Error getting connection", err)
+		report.Abort(err)
+		return
+	}
+	defer repository.Close()
+
+	bf := &backfill{repository: repository, limit: uint64(limit), force: force, test: test, report: report}
+	report.AddCounter("counter", func() uint64 { return bf.counter })
+	report.AddCounter("updated", func() uint64 { return bf.updated })
+	report.AddCounter("skipped", func() uint64 { return bf.skipped })
+	report.AddCounter("mismatch", func() uint64 { return bf.mismatch })
+	report.AddCounter("failures", func() uint64 { return bf.failures })
+	err = bf.fill()
+	if err != nil {
+		fmt.Println("Error backfill SHA-256 checksum", err)
+		report.Abort(err)
+	}
+}
+
+func (bf *backfill) String() string {
+	return fmt.Sprintf("%s Picture counter=%d updated=%d skipped=%d mismatch=%d failures=%d",
+		time.Now().Format(timeFormat), bf.counter, bf.updated, bf.skipped, bf.mismatch, bf.failures)
+}
+
+// fill walk all picture data and store the SHA-256 checksum of the media
+// including all segments
+func (bf *backfill) fill() error {
+	stop := schedule(func() { fmt.Println(bf) }, 15*time.Second)
+	defer func() { stop <- true }()
+	cursor, err := bf.repository.ReadData(bf.limit)
+	if err != nil {
+		return err
+	}
+	for cursor.HasNextRecord() {
+		d, err := cursor.NextData()
+		if err != nil {
+			return err
+		}
+		bf.counter++
+		data := d.(*store.PictureData)
+		if data.ChecksumSHA256 != "" && !bf.force {
+			bf.skipped++
+			continue
+		}
+		err = bf.fillRecord(data)
+		if err != nil {
+			fmt.Printf("Error checksum ISN=%d: %v\n", data.Index, err)
+			bf.report.FailedIsn(data.Index, err)
+			bf.failures++
+		}
+	}
+	fmt.Println(bf)
+	if bf.test {
+		return nil
+	}
+	return bf.repository.EndTransaction()
+}
+
+// fillRecord calculate checksums of the media. The SHA-256 checksum is only
+// stored if the MD5 checksum (CP) matches the media.
+func (bf *backfill) fillRecord(data *store.PictureData) error {
+	if len(data.Media) == 0 {
+		return fmt.Errorf("media empty")
+	}
+	h := md5.New()
+	hs := sha256.New()
+	_, err := io.Copy(io.MultiWriter(h, hs), store.MediaReader(bf.repository, data))
+	if err != nil {
+		return err
+	}
+	if fmt.Sprintf("%X", h.Sum(nil)) != strings.Trim(data.ChecksumPicture, " ") {
+		fmt.Printf("Media checksum mismatch ISN=%d CP=%s\n", data.Index, data.ChecksumPicture)
+		bf.mismatch++
+		return nil
+	}
+	data.ChecksumSHA256 = fmt.Sprintf("%X", hs.Sum(nil))
+	bf.updated++
+	if bf.test {
+		return nil
+	}
+	err = bf.repository.UpdateSHA256(data)
+	if err != nil {
+		return err
+	}
+	if bf.updated%100 == 0 {
+		return bf.repository.EndTransaction()
+	}
+	return nil
+}
+
+func schedule(what func(), delay time.Duration) chan bool {
+	stop := make(chan bool)
+
+	go func() {
+		for {
+			what()
+			select {
+			case <-time.After(delay):
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
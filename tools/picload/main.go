@@ -21,15 +21,19 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"runtime"
 	"runtime/pprof"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 	"tux-lobload/store"
 
@@ -41,6 +45,11 @@ import (
 
 var hostname string
 var timeFormat = "2006-01-02 15:04:05"
+
+// journalInterval interval the checkpoint journal is flushed
+var journalInterval = 10 * time.Second
+
+var errInterrupted = errors.New("directory walk interrupted")
 var wg sync.WaitGroup
 
 func init() {
@@ -135,8 +144,23 @@ func main() {
 	var query string
 	var interval int
 	var nrThreads int
+	var memoryFile string
+	var mediaMemory int64
+	var segmentFnrParameter int
+	var renditionFnrParameter int
+	var renditionSizes string
+	var thumbnailMethod string
+	var quarantineReport string
+	var storeCorrupt bool
+	var retryResponses string
+	var journalFile string
+	var resume bool
+	var retryFailed bool
+	var stateFile string
 	var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to `file`")
 	var memprofile = flag.String("memprofile", "", "write memory profile to `file`")
+	var metrics = flag.String("metrics", "", "serve Prometheus metrics on /metrics of `address`, e.g. :9100")
+	var reportFile = flag.String("report", "", "write JSON run report to `file`")
 	dbReference := &store.DatabaseReference{}
 
 	flag.StringVar(&pictureDirectory, "D", "", "Directory of picture to be imported")
@@ -144,6 +168,12 @@ func main() {
 	flag.StringVar(&filter, "F", "@eadir", "Comma-separated list of parts which may excluded")
 	flag.StringVar(&query, "q", ".*/@eaDir/.*", "Ignore paths using this regexp")
 	flag.IntVar(&picFnrParameter, "p", 4, "Picture file number")
+	flag.IntVar(&segmentFnrParameter, "S", 0, "Segment file number for media bigger than the maximum binary blob size (0 is disabled)")
+	flag.IntVar(&renditionFnrParameter, "R", 0, "Rendition file number for scaled copies of the pictures (0 is disabled)")
+	flag.StringVar(&renditionSizes, "z", "1024,2048", "Comma-separated long edge sizes of the renditions")
+	flag.StringVar(&thumbnailMethod, "T", "exact", "Thumbnail method: exact, reduced (reduce 1/2, 1/4 or 1/8 after decoding before resampling) or exif (embedded EXIF thumbnail)")
+	flag.IntVar(&store.ThumbnailSize, "Z", store.ThumbnailSize, "Long edge size of the thumbnails")
+	flag.IntVar(&store.ThumbnailQuality, "Q", store.ThumbnailQuality, "JPEG quality of the thumbnails and renditions (1-100)")
 	flag.IntVar(&nrThreads, "t", 2, "Nr of parallel storage threads")
 	flag.BoolVar(&verify, "V", false, "Verify data")
 	flag.BoolVar(&verbose, "v", false, "Verbose output")
@@ -153,9 +183,48 @@ func main() {
 	flag.BoolVar(&checksumRun, "c", false, "Checksum run, no data load")
 	flag.IntVar(&deleteIsn, "r", -1, "Delete ISN image")
 	flag.IntVar(&binarySize, "b", 1550000000, "Maximum binary blob size")
+	flag.Int64Var(&mediaMemory, "m", 0, "Maximum media bytes in memory over all threads (0 is unlimited)")
+	flag.StringVar(&quarantineReport, "j", "", "Write JSON report of corrupt media files into this file")
+	flag.BoolVar(&storeCorrupt, "k", false, "Store corrupt media files failing the integrity validation too")
+	flag.IntVar(&store.DefaultRetryPolicy.Attempts, "A", 1, "Attempts of Adabas operations failing with temporary response codes (1 is no retry)")
+	flag.DurationVar(&store.DefaultRetryPolicy.Backoff, "W", store.DefaultRetryPolicy.Backoff, "Wait time before the first retry, doubled for each retry")
+	flag.DurationVar(&store.DefaultRetryPolicy.MaxBackoff, "X", store.DefaultRetryPolicy.MaxBackoff, "Maximum wait time between retries")
+	flag.StringVar(&retryResponses, "E", store.DefaultRetryResponses, "Comma-separated list of retriable Adabas response codes")
+	flag.StringVar(&memoryFile, "M", "", "Use local memory repository stored in this file instead of Adabas")
+	flag.StringVar(&journalFile, "journal", "", "Checkpoint journal `file` of the directory load (empty disables)")
+	flag.BoolVar(&resume, "resume", false, "Resume the directory load where the checkpoint journal stopped")
+	flag.BoolVar(&retryFailed, "retry-failed", false, "Load only the paths failed in the checkpoint journal")
+	flag.StringVar(&stateFile, "state", "", "Local file state `file` to skip files unchanged since their load (empty disables)")
 	flag.Parse()
+	report := store.NewRunReport("picload", flag.CommandLine)
+	defer report.Exit(*reportFile)
 	dbReference.Dbid = dbidParameter
 	dbReference.PictureFile = adabas.Fnr(picFnrParameter)
+	dbReference.SegmentFile = adabas.Fnr(segmentFnrParameter)
+	dbReference.RenditionFile = adabas.Fnr(renditionFnrParameter)
+	sizes, err := store.ParseRenditionSizes(renditionSizes)
+	if err != nil {
+		fmt.Println("Rendition sizes error", err)
+		report.Abort(err)
+		return
+	}
+	store.RenditionSizes = sizes
+	store.DefaultRetryPolicy.Responses, err = store.ParseResponseCodes(retryResponses)
+	if err != nil {
+		fmt.Println("Retry response codes error", err)
+		report.Abort(err)
+		return
+	}
+	if store.DefaultRetryPolicy.Attempts > 1 {
+		fmt.Println("Retry policy:", store.DefaultRetryPolicy)
+	}
+	store.ThumbnailMode, err = store.ParseThumbnailMethod(thumbnailMethod)
+	if err != nil {
+		fmt.Println("Thumbnail method error", err)
+		report.Abort(err)
+		return
+	}
+	store.MediaBudget.SetLimit(mediaMemory)
 
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
@@ -172,12 +241,41 @@ func main() {
 	if !verify && (pictureDirectory == "" && deleteIsn == -1) {
 		fmt.Println("Picture directory option is required")
 		flag.Usage()
+		report.Abort(errors.New("picture directory option is required"))
 		return
 	}
-	fmt.Printf("Connect to map repository %s/%d\n", dbidParameter, picFnrParameter)
+	var repository store.PictureRepository
+	if memoryFile != "" {
+		fmt.Printf("Use memory repository %s\n", memoryFile)
+		mr, err := store.OpenMemoryRepository(memoryFile)
+		if err != nil {
+			fmt.Println("Memory repository error", err)
+			report.Abort(err)
+			return
+		}
+		repository = mr
+		defer mr.Close()
+	} else {
+		fmt.Printf("Connect to map repository %s/%d\n", dbidParameter, picFnrParameter)
+	}
 
+	stat := store.NewPictureStatistic()
+	report.SetStatistics(stat)
+	exporter := store.NewMetricsExporter(stat)
+	if *metrics != "" {
+		err := exporter.ListenAndServe(*metrics)
+		if err != nil {
+			fmt.Println("Metrics server error", err)
+			report.Abort(err)
+			return
+		}
+	}
 	if deleteIsn > 0 {
-		ps := createPictureStore(dbReference, shortenName)
+		ps, err := createPictureStore(dbReference, shortenName, repository, stat)
+		if err != nil {
+			report.Abort(err)
+			return
+		}
 		defer ps.Close()
 
 		ps.ChecksumRun = checksumRun
@@ -185,9 +283,10 @@ func main() {
 		ps.Update = update
 		ps.Verbose = verbose
 		ps.Filter = strings.Split(filter, ",")
-		err := ps.DeleteIsn(adatypes.Isn(deleteIsn))
+		err = ps.DeleteIsn(adatypes.Isn(deleteIsn))
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error deleting Isn=%d: %v", deleteIsn, err)
+			report.FailedIsn(uint64(deleteIsn), err)
 		} else {
 			fmt.Printf("Isn=%d successfull deleted ....\n", deleteIsn)
 		}
@@ -199,9 +298,10 @@ func main() {
 		lastChecked := uint64(0)
 		psList := make([]*store.PictureConnection, 0)
 		output := func() {
-			fmt.Print(store.Statistics.String())
+			snapshot := stat.Snapshot()
+			fmt.Print(snapshot.String())
 			c++
-			if lastChecked != store.Statistics.Checked {
+			if lastChecked != snapshot.Checked {
 				c = 0
 			} else {
 				if c > 25 {
@@ -211,7 +311,7 @@ func main() {
 					panic("Multiple loop found")
 				}
 			}
-			lastChecked = store.Statistics.Checked
+			lastChecked = snapshot.Checked
 		}
 		queries := strings.Split(query, ",")
 		reg := make([]*regexp.Regexp, 0)
@@ -219,85 +319,177 @@ func main() {
 			r, err := regexp.Compile(q)
 			if err != nil {
 				fmt.Println("Query error regexp:", err)
+				report.Abort(err)
 				return
 			}
 			reg = append(reg, r)
 		}
+		if journalFile == "" && (resume || retryFailed) {
+			fmt.Println("Checkpoint journal is required to resume")
+			report.Abort(errors.New("checkpoint journal is required to resume"))
+			return
+		}
+		var journal *store.Journal
+		if journalFile != "" {
+			var err error
+			journal, err = store.OpenJournal(journalFile, pictureDirectory, resume || retryFailed)
+			if err != nil {
+				fmt.Println("Checkpoint journal error", err)
+				report.Abort(err)
+				return
+			}
+			defer journal.Close()
+			if resume || retryFailed {
+				fmt.Printf("%s Resume after %s with %d failed paths\n", time.Now().Format(timeFormat),
+					journal.Position(), len(journal.FailedPaths()))
+			}
+		}
+		var fileState *store.FileStateStore
+		if stateFile != "" {
+			database := fmt.Sprintf("%s/%d", dbReference.Dbid, dbReference.PictureFile)
+			if memoryFile != "" {
+				database = memoryFile
+			}
+			var err error
+			fileState, err = store.OpenFileState(stateFile, database)
+			if err != nil {
+				fmt.Println("File state error", err)
+				report.Abort(err)
+				return
+			}
+			defer fileState.Close()
+		}
+		interrupted := handleInterrupt(report, *reportFile, journal)
+		stopFlush := schedule(func() {
+			err := journal.Flush()
+			if err != nil {
+				fmt.Println("Error flushing checkpoint journal:", err)
+			}
+			err = fileState.Flush()
+			if err != nil {
+				fmt.Println("Error flushing file state:", err)
+			}
+		}, journalInterval)
 		if verbose {
 			fmt.Printf("%s Loading path %s\n", time.Now().Format(timeFormat), pictureDirectory)
 		}
 		stop := schedule(output, 60*time.Second)
 		pathChan := make(chan string, nrThreads)
-		stopThread := make(chan bool, nrThreads)
-		wg.Add(nrThreads)
 		for i := 0; i < nrThreads; i++ {
-
-			ps := createPictureStore(dbReference, shortenName)
+			ps, err := createPictureStore(dbReference, shortenName, repository, stat)
+			if err != nil {
+				report.Abort(err)
+				close(pathChan)
+				wg.Wait()
+				stopFlush <- true
+				stop <- true
+				return
+			}
 			psList = append(psList, ps)
+			exporter.AddWorker(ps)
 			ps.ChecksumRun = checksumRun
 			ps.MaxBlobSize = int64(binarySize)
 			ps.Update = update
 			ps.Verbose = verbose
 			ps.Filter = strings.Split(filter, ",")
-			go processImage(ps, pathChan, stopThread)
+			ps.StoreCorrupt = storeCorrupt
+			ps.FileState = fileState
+			wg.Add(1)
+			go processImage(ps, report, journal, pathChan)
 		}
-		_ = filepath.Walk(pictureDirectory, func(path string, info os.FileInfo, err error) error {
-			if info == nil || info.IsDir() {
-				adatypes.Central.Log.Infof("Info empty or dir: %s", path)
-				return nil
+		if retryFailed {
+			for _, path := range journal.FailedPaths() {
+				if atomic.LoadInt32(interrupted) != 0 {
+					break
+				}
+				pathChan <- path
 			}
-			suffix := path[strings.LastIndex(path, ".")+1:]
-			suffix = strings.ToLower(suffix)
-			switch suffix {
-			case "jpg", "jpeg", "gif", "m4v", "mov":
-				adatypes.Central.Log.Debugf("Checking picture file: %s", path)
-				add := true
-				if query != "" {
-					for _, r := range reg {
-						add = checkQueryPath(r, path)
-						if !add {
-							break
-						}
+		} else {
+			_ = filepath.Walk(pictureDirectory, func(path string, info os.FileInfo, err error) error {
+				if atomic.LoadInt32(interrupted) != 0 {
+					return errInterrupted
+				}
+				if info == nil || info.IsDir() {
+					if info != nil && journal.SkipDir(path) {
+						adatypes.Central.Log.Infof("Skip completed dir: %s", path)
+						return filepath.SkipDir
 					}
+					adatypes.Central.Log.Infof("Info empty or dir: %s", path)
+					return nil
+				}
+				if journal.Completed(path) {
+					stat.Inc(store.StatResumed)
+					return nil
 				}
-				if add {
-					pathChan <- path
+				if store.FormatBySuffix(path) != nil {
+					adatypes.Central.Log.Debugf("Checking picture file: %s", path)
+					add := true
+					if query != "" {
+						for _, r := range reg {
+							add = checkQueryPath(r, path)
+							if !add {
+								break
+							}
+						}
+					}
+					if add {
+						journal.Dispatch(path)
+						pathChan <- path
+					} else {
+						stat.Inc(store.StatIgnored)
+					}
 				} else {
-					store.Statistics.Ignored++
+					adatypes.Central.Log.Infof("Skip unknown media format: %s", path)
+					stat.Inc(store.StatUnknown)
 				}
-			default:
-			}
-			return nil
-		})
+				return nil
+			})
+		}
+		close(pathChan)
+		wg.Wait()
+		stopFlush <- true
 		stop <- true
 		output()
 		fmt.Printf("%s Done\n",
 			time.Now().Format(timeFormat))
-		for e, n := range store.Statistics.Errors {
-			fmt.Println(e, ":", n)
+		snapshot := stat.Snapshot()
+		for _, e := range snapshot.ErrorClasses() {
+			fmt.Println(e, ":", snapshot.Errors[e])
 		}
-		for i := 0; i < nrThreads; i++ {
-			stopThread <- true
+		if quarantineReport != "" {
+			err := store.Quarantine.WriteReport(quarantineReport)
+			if err != nil {
+				fmt.Println("Error writing quarantine report:", err)
+			} else {
+				fmt.Printf("%d corrupt media files reported in %s\n", store.Quarantine.Len(), quarantineReport)
+			}
 		}
-		wg.Wait()
 	}
 	if verify {
 		output := func() {
+			snapshot := stat.Snapshot()
 			fmt.Printf("%s Verified=%d NotFound=%d DiffData=%d DiffSize=%d OtherHost=%d\n", time.Now().Format(timeFormat),
-				store.Statistics.Verified, store.Statistics.NotFound, store.Statistics.DiffFound,
-				store.Statistics.SizeDiffFound, store.Statistics.OtherHost)
-			list := make([]string, 0)
-			store.Statistics.HostsFound.Range(func(key, value interface{}) bool {
-				list = append(list, key.(string))
-				return true
-			})
-			fmt.Printf("%s hosts -> %v\n", time.Now().Format(timeFormat), list)
+				snapshot.Verified, snapshot.NotFound, snapshot.DiffFound,
+				snapshot.SizeDiffFound, snapshot.OtherHost)
+			fmt.Printf("%s hosts -> %v\n", time.Now().Format(timeFormat), snapshot.HostsFound)
 		}
 		stop := schedule(output, time.Duration(interval)*time.Second)
 		fmt.Printf("%s Start verifying database picture content\n", time.Now().Format(timeFormat))
-		err := store.VerifyPicture(dbidParameter, adabas.Fnr(picFnrParameter), nrThreads)
+		var err error
+		if repository == nil {
+			repository, err = store.OpenAdabasRepository(dbReference)
+			if err != nil {
+				fmt.Println("Adabas connection error", err)
+				report.Abort(err)
+				return
+			}
+			defer repository.Close()
+		}
+		store.SetRepositoryStatistics(repository, stat)
+		err = store.VerifyPictureRepository(repository, nrThreads, stat)
 		if err != nil {
 			fmt.Printf("%s Error during verify of database picture content: %v\n", time.Now().Format(timeFormat), err)
+			report.Abort(err)
 			return
 		}
 		stop <- true
@@ -307,59 +499,81 @@ func main() {
 
 }
 
-func createPictureStore(dbReference *store.DatabaseReference, shortenName bool) *store.PictureConnection {
-	connection, err := adabas.NewConnection(fmt.Sprintf("acj;inmap=%s,%d", dbReference.Dbid, dbReference.PictureFile))
+// createPictureStore picture connection using the shared repository or a
+// new Adabas connection. Connection errors are returned as backend errors.
+func createPictureStore(dbReference *store.DatabaseReference, shortenName bool, repository store.PictureRepository,
+	stat *store.PictureStatistic) (*store.PictureConnection, error) {
+	if repository != nil {
+		ps := store.InitStorePictureRepository(!shortenName, repository)
+		ps.SetStatistics(stat)
+		return ps, nil
+	}
+	ps, err := store.OpenStorePictureBinary(!shortenName, dbReference)
 	if err != nil {
 		fmt.Println("Adabas connection error", err)
-		panic("Adabas communication error")
+		return nil, err
 	}
+	ps.SetStatistics(stat)
+	return ps, nil
+}
 
-	ps, perr := store.InitStorePictureBinary(!shortenName, dbReference, connection)
-	if perr != nil {
-		fmt.Println("Adabas connection error", perr)
-		panic("Adabas communication error")
-	}
-	return ps
+// handleInterrupt stop the directory load on SIGINT or SIGTERM, the
+// workers finish their current files and the run is partial. A second
+// signal aborts the run at once. The checkpoint journal is flushed in both
+// cases.
+func handleInterrupt(report *store.RunReport, reportFile string, journal *store.Journal) *int32 {
+	interrupted := new(int32)
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Printf("%s Interrupted by %v, finishing current files ...\n", time.Now().Format(timeFormat), sig)
+		report.Interrupt(fmt.Sprintf("interrupted by %v", sig))
+		atomic.StoreInt32(interrupted, 1)
+		journal.Flush()
+		sig = <-signals
+		fmt.Printf("%s Interrupted by %v, exit\n", time.Now().Format(timeFormat), sig)
+		report.Abort(fmt.Errorf("interrupted by %v", sig))
+		journal.Flush()
+		report.Exit(reportFile)
+	}()
+	return interrupted
 }
 
-func processImage(ps *store.PictureConnection, pathChan chan string, stopThread chan bool) {
+// processImage load all paths of the channel until it is closed
+func processImage(ps *store.PictureConnection, report *store.RunReport, journal *store.Journal, pathChan chan string) {
 	defer ps.Close()
 	defer wg.Done()
-	for {
-		select {
-		case <-stopThread:
-			if ps.Verbose {
-				fmt.Println("Close processing thread")
-			}
-			return
-		case path := <-pathChan:
-			for _, f := range ps.Filter {
-				if strings.Contains(path, f) {
-					err := ps.DeletePath(path)
-					if err == nil {
-						store.Statistics.NrDeleted++
-					}
+	for path := range pathChan {
+		for _, f := range ps.Filter {
+			if strings.Contains(path, f) {
+				err := ps.DeletePath(path)
+				if err == nil {
+					ps.Statistics().Inc(store.StatNrDeleted)
 				}
 			}
+		}
 
-			ps.CurrentFile = path
-			err := ps.LoadPicture(!ps.Update, path)
-			if err != nil {
-				adatypes.Central.Log.Debugf("Loaded %s with error=%v", ps, err)
-				fmt.Fprintln(os.Stderr, "Error loading picture", path, ":", err)
-				if strings.HasPrefix(err.Error(), "file tooo big") {
-					store.Statistics.ToBig++
-				} else {
-					if n, ok := store.Statistics.Errors[err.Error()]; ok {
-						store.Statistics.Errors[err.Error()] = n + 1
-					} else {
-						store.Statistics.Errors[err.Error()] = 1
-					}
-					store.Statistics.NrErrors++
-				}
+		ps.CurrentFile = path
+		err := ps.LoadPicture(!ps.Update, path)
+		journal.Done(path, err)
+		if err != nil {
+			adatypes.Central.Log.Debugf("Loaded %s with error=%v", ps, err)
+			fmt.Fprintln(os.Stderr, "Error loading picture", path, ":", err)
+			report.FailedPath(path, err)
+			switch {
+			case errors.Is(err, store.ErrTooBig):
+				ps.Statistics().Inc(store.StatToBig)
+			case errors.Is(err, store.ErrCorrupt):
+				// counted as corrupt and reported in the quarantine list
+			default:
+				ps.Statistics().AddError(err)
 			}
 		}
 	}
+	if ps.Verbose {
+		fmt.Println("Close processing thread")
+	}
 }
 
 func checkQueryPath(reg *regexp.Regexp, path string) bool {
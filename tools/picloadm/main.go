@@ -21,6 +21,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -132,6 +133,8 @@ func main() {
 	var query string
 	var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to `file`")
 	var memprofile = flag.String("memprofile", "", "write memory profile to `file`")
+	var metrics = flag.String("metrics", "", "serve Prometheus metrics on /metrics of `address`, e.g. :9100")
+	var reportFile = flag.String("report", "", "write JSON run report to `file`")
 
 	flag.StringVar(&pictureDirectory, "D", "", "Directory of picture to be imported")
 	flag.StringVar(&dbidParameter, "d", "23", "Map repository Database id")
@@ -145,6 +148,8 @@ func main() {
 	flag.IntVar(&deleteIsn, "r", -1, "Delete ISN image")
 	flag.IntVar(&binarySize, "b", 50000000, "Maximum binary blob size")
 	flag.Parse()
+	report := store.NewRunReport("picloadm", flag.CommandLine)
+	defer report.Exit(*reportFile)
 
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
@@ -161,6 +166,7 @@ func main() {
 	if !verify && (pictureDirectory == "" && deleteIsn == -1) {
 		fmt.Println("Picture directory option is required")
 		flag.Usage()
+		report.Abort(errors.New("picture directory option is required"))
 		return
 	}
 	fmt.Printf("Connect to map repository %s/%d\n", dbidParameter, mapFnrParameter)
@@ -169,6 +175,7 @@ func main() {
 	a, err := adabas.NewAdabas(dbidParameter, id)
 	if err != nil {
 		fmt.Println("Adabas target generation error", err)
+		report.Abort(err)
 		return
 	}
 	adabas.AddGlobalMapRepository(a.URL, adabas.Fnr(mapFnrParameter))
@@ -177,17 +184,34 @@ func main() {
 
 	dbReference := &store.DatabaseReference{}
 
-	ps := createPictureStore(dbReference, shortenName)
+	ps, err := store.OpenStorePictureBinary(!shortenName, dbReference)
+	if err != nil {
+		fmt.Println("Adabas connection error", err)
+		report.Abort(err)
+		return
+	}
 	defer ps.Close()
 
 	ps.ChecksumRun = checksumRun
 	ps.MaxBlobSize = int64(binarySize)
 	ps.Filter = strings.Split(filter, ",")
+	report.SetStatistics(ps.Statistics())
+	if *metrics != "" {
+		exporter := store.NewMetricsExporter(ps.Statistics())
+		exporter.AddWorker(ps)
+		err := exporter.ListenAndServe(*metrics)
+		if err != nil {
+			fmt.Println("Metrics server error", err)
+			report.Abort(err)
+			return
+		}
+	}
 
 	if deleteIsn > 0 {
 		err := ps.DeleteIsn(adatypes.Isn(deleteIsn))
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error deleting Isn=%d: %v", deleteIsn, err)
+			report.FailedIsn(uint64(deleteIsn), err)
 		} else {
 			fmt.Printf("Isn=%d successfull deleted ....\n", deleteIsn)
 		}
@@ -195,12 +219,14 @@ func main() {
 	}
 
 	if pictureDirectory != "" {
+		stat := ps.Statistics()
 		output := func() {
-			fmt.Println(store.Statistics.String())
+			fmt.Println(stat.String())
 		}
 		reg, err := regexp.Compile(query)
 		if err != nil {
 			fmt.Println("Query error regexp:", err)
+			report.Abort(err)
 			return
 		}
 
@@ -211,18 +237,15 @@ func main() {
 				adatypes.Central.Log.Infof("Info empty or dir: %s", path)
 				return nil
 			}
-			suffix := path[strings.LastIndex(path, ".")+1:]
-			suffix = strings.ToLower(suffix)
 			for _, f := range ps.Filter {
 				if strings.Contains(path, f) {
 					err := ps.DeletePath(path)
 					if err == nil {
-						store.Statistics.NrDeleted++
+						stat.Inc(store.StatNrDeleted)
 					}
 				}
 			}
-			switch suffix {
-			case "jpg", "jpeg", "gif", "m4v", "mov":
+			if store.FormatBySuffix(path) != nil {
 				adatypes.Central.Log.Debugf("Checking picture file: %s", path)
 				add := true
 				if query != "" {
@@ -233,36 +256,39 @@ func main() {
 					if err != nil {
 						adatypes.Central.Log.Debugf("Loaded %s with error=%v", ps, err)
 						fmt.Fprintln(os.Stderr, "Error loading picture", path, ":", err)
-						if strings.HasPrefix(err.Error(), "file tooo big") {
-							store.Statistics.ToBig++
-						} else {
-							if n, ok := store.Statistics.Errors[err.Error()]; ok {
-								store.Statistics.Errors[err.Error()] = n + 1
-							} else {
-								store.Statistics.Errors[err.Error()] = 1
-							}
-							store.Statistics.NrErrors++
+						report.FailedPath(path, err)
+						switch {
+						case errors.Is(err, store.ErrTooBig):
+							stat.Inc(store.StatToBig)
+						case errors.Is(err, store.ErrCorrupt):
+							// counted as corrupt and reported in the quarantine list
+						default:
+							stat.AddError(err)
 						}
 					}
 				} else {
-					store.Statistics.Ignored++
+					stat.Inc(store.StatIgnored)
 				}
-			default:
+			} else {
+				adatypes.Central.Log.Infof("Skip unknown media format: %s", path)
+				stat.Inc(store.StatUnknown)
 			}
 			return nil
 		})
 		stop <- true
+		snapshot := stat.Snapshot()
 		fmt.Printf("%s Done Picture directory checked=%d loaded=%d found=%d too big=%d empty=%d ignored=%d errors=%d\n",
-			time.Now().Format(timeFormat), store.Statistics.Checked, store.Statistics.Loaded, store.Statistics.Found, store.Statistics.ToBig, store.Statistics.Empty, store.Statistics.Ignored, store.Statistics.NrErrors)
-		for e, n := range store.Statistics.Errors {
-			fmt.Println(e, ":", n)
+			time.Now().Format(timeFormat), snapshot.Checked, snapshot.Loaded, snapshot.Found, snapshot.ToBig, snapshot.Empty, snapshot.Ignored, snapshot.NrErrors)
+		for _, e := range snapshot.ErrorClasses() {
+			fmt.Println(e, ":", snapshot.Errors[e])
 		}
 	}
 	if verify {
 		fmt.Printf("%s Start verifying database picture content\n", time.Now().Format(timeFormat))
-		err = store.VerifyPicture(dbidParameter, adabas.Fnr(mapFnrParameter), 1)
+		err = store.VerifyPicture(dbidParameter, adabas.Fnr(mapFnrParameter), 1, ps.Statistics())
 		if err != nil {
 			fmt.Printf("%s Error during verify of database picture content: %v\n", time.Now().Format(timeFormat), err)
+			report.Abort(err)
 			return
 		}
 		fmt.Printf("%s finished verify of database picture content\n", time.Now().Format(timeFormat))
@@ -270,21 +296,6 @@ func main() {
 
 }
 
-func createPictureStore(dbReference *store.DatabaseReference, shortenName bool) *store.PictureConnection {
-	connection, err := adabas.NewConnection(fmt.Sprintf("acj;inmap=%s,%d", dbReference.Dbid, dbReference.PictureFile))
-	if err != nil {
-		fmt.Println("Adabas connection error", err)
-		panic("Adabas communication error")
-	}
-
-	ps, perr := store.InitStorePictureBinary(!shortenName, dbReference, connection)
-	if perr != nil {
-		fmt.Println("Adabas connection error", perr)
-		panic("Adabas communication error")
-	}
-	return ps
-}
-
 func checkQueryPath(reg *regexp.Regexp, path string) bool {
 	return !reg.MatchString(path)
 }
@@ -22,8 +22,10 @@ package main
 import (
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"tux-lobload/store"
@@ -35,8 +37,9 @@ import (
 )
 
 type reader struct {
-	mapName    string
-	repository string
+	mapName     string
+	repository  string
+	segmentFile int
 }
 
 func init() {
@@ -101,13 +104,18 @@ func main() {
 	var compare bool
 	var fileName string
 	var hash string
+	var reportFile string
 	flag.StringVar(&r.mapName, "m", "", "Adabas map name")
 	flag.StringVar(&r.repository, "r", "", "repository location of Adabas maps")
 	flag.StringVar(&fileName, "l", "", "Load file into media data")
 	flag.StringVar(&hash, "h", "", "Hash value the data should be load at")
+	flag.IntVar(&r.segmentFile, "S", 0, "Segment file number of media bigger than the maximum binary blob size")
 	flag.BoolVar(&verify, "v", false, "Verify data")
 	flag.BoolVar(&compare, "c", false, "Compare data")
+	flag.StringVar(&reportFile, "report", "", "Write JSON run report to `file`")
 	flag.Parse()
+	report := store.NewRunReport("reader", flag.CommandLine)
+	defer report.Exit(reportFile)
 
 	connection, err := adabas.NewConnection("acj;map" + r.mapName + ";config=[" + r.repository + "]")
 	if err != nil {
@@ -117,15 +125,20 @@ func main() {
 
 	if fileName != "" && hash != "" {
 		if compare {
-			compareMedia(connection, r, fileName, hash)
-			return
+			err = compareMedia(connection, r, fileName, hash)
+		} else {
+			_, err = loadMedia(r, fileName, hash)
+		}
+		if err != nil {
+			fmt.Println("Error media", fileName, err)
+			report.Abort(err)
 		}
-		loadMedia(r, fileName, hash)
 		return
 	}
 
 	if !verify && r.mapName == "" {
 		fmt.Println("Adabas Map option is required")
+		report.Abort(errors.New("adabas map option is required"))
 		return
 	}
 
@@ -137,10 +150,13 @@ func main() {
 		}
 	}
 	if verify {
-		verifyLargeObjects(r)
-		return
+		err = verifyLargeObjects(r, report)
+	} else {
+		err = readTitle(r)
+	}
+	if err != nil {
+		report.Abort(err)
 	}
-	readTitle(r)
 }
 
 func createChecksum(b []byte) string {
@@ -150,13 +166,33 @@ func createChecksum(b []byte) string {
 	return fmt.Sprintf("%X", ms)
 }
 
+// largeObjectCheck context of the media checksum verification
+type largeObjectCheck struct {
+	report      *store.RunReport
+	connection  *adabas.Connection
+	segmentFile adabas.Fnr
+}
+
 func receiveInterface(data interface{}, x interface{}) error {
 	p := data.(*store.PictureData)
-	ckSum := createChecksum(p.Media)
+	check := x.(*largeObjectCheck)
+	if p.NrSegments > 1 && check.segmentFile == 0 {
+		fmt.Printf("Skip segmented media of ISN=%d, no segment file given\n", p.Index)
+		return nil
+	}
+	m := md5.New()
+	size, err := io.Copy(m, store.DatabaseMediaReader(check.connection, check.segmentFile, p))
+	if err != nil {
+		fmt.Printf("Error reading segments of ISN=%d: %v\n", p.Index, err)
+		check.report.FailedIsn(p.Index, err)
+		return nil
+	}
+	ckSum := fmt.Sprintf("%X", m.Sum(nil))
 	chkSav := strings.Trim(p.ChecksumPicture, " ")
 	if ckSum != chkSav {
 		fmt.Println("Received Media data not valid")
-		fmt.Println(ckSum, " -> ", chkSav, "=", len(p.Media))
+		fmt.Println(ckSum, " -> ", chkSav, "=", size)
+		check.report.FailedIsn(p.Index, fmt.Errorf("%w: checksum %s differs from %s", store.ErrCorrupt, ckSum, chkSav))
 	}
 	/*if strings.Trim(p.Data.ChecksumThumbnail, " ") != "" {
 		ckSum = createChecksum(p.Data.Thumbnail)
@@ -176,11 +212,21 @@ func compareMedia(connection *adabas.Connection, r *reader, loadFile, hash strin
 	if err != nil {
 		return
 	}
+	p.Data.Media, err = os.ReadFile(loadFile)
+	if err != nil {
+		return
+	}
 	p2 := &store.PictureBinary{}
 	err = p2.ReadDatabase(connection, hash, r.repository)
 	if err != nil {
 		return err
 	}
+	if r.segmentFile > 0 {
+		err = p2.ReadDatabaseSegments(connection, adabas.Fnr(r.segmentFile))
+		if err != nil {
+			return err
+		}
+	}
 	if len(p.Data.Media) != len(p2.Data.Media) {
 		fmt.Printf("Different media length %d != %d\n", p.Data.Media, p2.Data.Media)
 	}
@@ -199,7 +245,15 @@ func compareMedia(connection *adabas.Connection, r *reader, loadFile, hash strin
 func loadMedia(r *reader, loadFile, hash string) (*store.PictureBinary, error) {
 	fmt.Println("Load file", loadFile, "into", hash)
 	p := &store.PictureBinary{MetaData: &store.PictureMetadata{}, FileName: loadFile}
-	p.LoadFile()
+	err := p.LoadFile()
+	if err != nil {
+		return nil, err
+	}
+	// the media is not kept by LoadFile, it is stored in one piece here
+	p.Data.Media, err = os.ReadFile(loadFile)
+	if err != nil {
+		return nil, err
+	}
 
 	connection, err := adabas.NewConnection("acj;map;config=[" + r.repository + "]")
 	if err != nil {
@@ -230,50 +284,53 @@ func loadMedia(r *reader, loadFile, hash string) (*store.PictureBinary, error) {
 	return p, nil
 }
 
-func readTitle(r *reader) {
+func readTitle(r *reader) error {
 	connection, err := adabas.NewConnection("acj;map;config=[" + r.repository + "]")
 	if err != nil {
-		return
+		return err
 	}
 	defer connection.Close()
 
 	request, rerr := connection.CreateMapReadRequest(store.Album{})
 	if rerr != nil {
 		fmt.Println("Error create request", rerr)
-		return
+		return rerr
 	}
 	err = request.QueryFields("Title")
 	if err != nil {
-		return
+		return err
 	}
 	var result *adabas.Response
 	result, err = request.ReadPhysicalSequence()
 	if err != nil {
 		fmt.Println("Error reading ISN order", err)
-		return
+		return err
 	}
 	for _, x := range result.Data {
 		fmt.Println(x.(*store.Album).Title)
 	}
-
+	return nil
 }
 
-func verifyLargeObjects(r *reader) {
+// verifyLargeObjects verify the media checksum of all records, records
+// with invalid media are reported as failed
+func verifyLargeObjects(r *reader, report *store.RunReport) error {
 	connection, err := adabas.NewConnection("acj;map;config=[" + r.repository + "]")
 	if err != nil {
-		return
+		return err
 	}
 	defer connection.Close()
 
 	request, rerr := connection.CreateMapReadRequest(store.PictureData{})
 	if rerr != nil {
 		fmt.Println("Error create request", rerr)
-		return
+		return rerr
 	}
-	_, err = request.ReadPhysicalInterface(receiveInterface, nil)
+	check := &largeObjectCheck{report: report, connection: connection, segmentFile: adabas.Fnr(r.segmentFile)}
+	_, err = request.ReadPhysicalInterface(receiveInterface, check)
 	if err != nil {
 		fmt.Println("Error reading ISN order", err)
-		return
+		return err
 	}
-
+	return nil
 }
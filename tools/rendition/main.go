@@ -0,0 +1,360 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"tux-lobload/store"
+
+	"github.com/tknie/adabas-go-api/adabas"
+	"github.com/tknie/adabas-go-api/adatypes"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var timeFormat = "2006-01-02 15:04:05"
+
+type generator struct {
+	repository store.PictureRepository
+	limit      uint64
+	sizes      []uint32
+	nrThreads  int
+	test       bool
+	counter    uint64
+	generated  uint64
+	complete   uint64
+	skipped    uint64
+	failures   uint64
+	report     *store.RunReport
+}
+
+// job picture whose missing renditions are generated by a worker
+type job struct {
+	metadata *store.PictureMetadata
+	format   *store.MediaFormat
+	data     *store.PictureData
+	sizes    []uint32
+}
+
+// result renditions generated by a worker
+type result struct {
+	metadata   *store.PictureMetadata
+	renditions []*store.Rendition
+	err        error
+}
+
+func init() {
+	level := zapcore.ErrorLevel
+	ed := os.Getenv("ENABLE_DEBUG")
+	switch ed {
+	case "1":
+		level = zapcore.DebugLevel
+		adatypes.Central.SetDebugLevel(true)
+	case "2":
+		level = zapcore.InfoLevel
+	}
+
+	err := initLogLevelWithFile("rendition.log", level)
+	if err != nil {
+		fmt.Println("Error initialize logging")
+		os.Exit(255)
+	}
+}
+
+func initLogLevelWithFile(fileName string, level zapcore.Level) (err error) {
+	p := os.Getenv("LOGPATH")
+	if p == "" {
+		p = "."
+	}
+	name := p + string(os.PathSeparator) + fileName
+
+	rawJSON := []byte(`{
+		"level": "error",
+		"encoding": "console",
+		"outputPaths": [ "loadpicture.log"],
+		"errorOutputPaths": ["stderr"],
+		"encoderConfig": {
+		  "messageKey": "message",
+		  "levelKey": "level",
+		  "levelEncoder": "lowercase"
+		}
+	  }`)
+
+	var cfg zap.Config
+	if err := json.Unmarshal(rawJSON, &cfg); err != nil {
+		fmt.Println("Error initialize logging (json)")
+		os.Exit(255)
+	}
+	cfg.Level.SetLevel(level)
+	cfg.OutputPaths = []string{name}
+	logger, err := cfg.Build()
+	if err != nil {
+		fmt.Println("Error initialize logging (build)")
+		os.Exit(255)
+	}
+	defer logger.Sync()
+
+	sugar := logger.Sugar()
+
+	sugar.Infof("Start logging with level", level)
+	adatypes.Central.Log = sugar
+
+	return
+}
+
+func main() {
+	var dbidParameter string
+	var pictureFnrParameter int
+	var segmentFnrParameter int
+	var renditionFnrParameter int
+	var renditionSizes string
+	var thumbnailMethod string
+	var nrThreads int
+	var limit int
+	var test bool
+	var memoryFile string
+	var reportFile string
+
+	flag.StringVar(&dbidParameter, "d", "23", "Database id")
+	flag.IntVar(&pictureFnrParameter, "p", 100, "Picture file number")
+	flag.IntVar(&segmentFnrParameter, "S", 0, "Segment file number for media bigger than the maximum binary blob size (0 is disabled)")
+	flag.IntVar(&renditionFnrParameter, "R", 0, "Rendition file number for scaled copies of the pictures")
+	flag.StringVar(&renditionSizes, "z", "1024,2048", "Comma-separated long edge sizes of the renditions")
+	flag.StringVar(&thumbnailMethod, "m", "exact", "Scaling method: exact or reduced (reduce 1/2, 1/4 or 1/8 after decoding before resampling)")
+	flag.IntVar(&store.ThumbnailQuality, "Q", store.ThumbnailQuality, "JPEG quality of the renditions (1-100)")
+	flag.IntVar(&nrThreads, "n", 4, "Nr of parallel scaling threads")
+	flag.IntVar(&limit, "l", 10, "Maximum records to read (0 is all)")
+	flag.BoolVar(&test, "t", false, "Dry run, don't change")
+	flag.StringVar(&memoryFile, "M", "", "Use local memory repository stored in this file instead of Adabas")
+	flag.StringVar(&reportFile, "report", "", "Write JSON run report to `file`")
+	flag.Parse()
+	report := store.NewRunReport("rendition", flag.CommandLine)
+	defer report.Exit(reportFile)
+
+	sizes, err := store.ParseRenditionSizes(renditionSizes)
+	if err != nil || len(sizes) == 0 {
+		fmt.Println("Rendition sizes are required", err)
+		flag.Usage()
+		report.Abort(errors.New("rendition sizes are required"))
+		return
+	}
+	store.ThumbnailMode, err = store.ParseThumbnailMethod(thumbnailMethod)
+	if err != nil {
+		fmt.Println("Scaling method error", err)
+		report.Abort(err)
+		return
+	}
+	if memoryFile == "" && renditionFnrParameter == 0 {
+		fmt.Println("Rendition file number is required")
+		flag.Usage()
+		report.Abort(errors.New("rendition file number is required"))
+		return
+	}
+	if nrThreads < 1 {
+		nrThreads = 1
+	}
+	if test {
+		fmt.Println("Test mode ENABLED")
+	}
+
+	var repository store.PictureRepository
+	if memoryFile != "" {
+		fmt.Printf("Use memory repository %s\n", memoryFile)
+		repository, err = store.OpenMemoryRepository(memoryFile)
+	} else {
+		fmt.Printf("Connect to %s/%d\n", dbidParameter, pictureFnrParameter)
+		repository, err = store.OpenAdabasRepository(&store.DatabaseReference{Dbid: dbidParameter,
+			PictureFile: adabas.Fnr(pictureFnrParameter), SegmentFile: adabas.Fnr(segmentFnrParameter),
+			RenditionFile: adabas.Fnr(renditionFnrParameter)})
+	}
+	if err != nil {
+		fmt.Println("Error getting connection", err)
+		report.Abort(err)
+		return
+	}
+	defer repository.Close()
+
+	gen := &generator{repository: repository, limit: uint64(limit), sizes: sizes,
+		nrThreads: nrThreads, test: test, report: report}
+	report.AddCounter("counter", func() uint64 { return gen.counter })
+	report.AddCounter("generated", func() uint64 { return gen.generated })
+	report.AddCounter("complete", func() uint64 { return gen.complete })
+	report.AddCounter("skipped", func() uint64 { return gen.skipped })
+	report.AddCounter("failures", func() uint64 { return gen.failures })
+	err = gen.generate()
+	if err != nil {
+		fmt.Println("Error generating renditions", err)
+		report.Abort(err)
+	}
+}
+
+func (gen *generator) String() string {
+	return fmt.Sprintf("%s Picture counter=%d generated=%d complete=%d skipped=%d failures=%d",
+		time.Now().Format(timeFormat), gen.counter, gen.generated, gen.complete, gen.skipped, gen.failures)
+}
+
+// generate walk all picture metadata and generate the missing renditions.
+// The repository is only accessed by this goroutine, decoding and scaling
+// is done by the worker threads.
+func (gen *generator) generate() error {
+	stop := schedule(func() { fmt.Println(gen) }, 15*time.Second)
+	defer func() { stop <- true }()
+	jobs := make(chan *job, gen.nrThreads)
+	results := make(chan *result, gen.nrThreads)
+	var wg sync.WaitGroup
+	for i := 0; i < gen.nrThreads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				renditions, err := store.CreateRenditions(j.format,
+					store.MediaReader(gen.repository, j.data), j.metadata, j.sizes)
+				results <- &result{metadata: j.metadata, renditions: renditions, err: err}
+			}
+		}()
+	}
+	err := gen.dispatch(jobs, results)
+	close(jobs)
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	for r := range results {
+		gen.store(r)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(gen)
+	if gen.test {
+		return nil
+	}
+	return gen.repository.EndTransaction()
+}
+
+// dispatch send all pictures with missing renditions to the workers and
+// store the results in between
+func (gen *generator) dispatch(jobs chan *job, results chan *result) error {
+	cursor, err := gen.repository.ReadMetadata(gen.limit)
+	if err != nil {
+		return err
+	}
+	for cursor.HasNextRecord() {
+		d, err := cursor.NextData()
+		if err != nil {
+			return err
+		}
+		gen.counter++
+		md := d.(*store.PictureMetadata)
+		format := store.FormatByMIMEType(md.MIMEType)
+		if format == nil || !format.Image() {
+			gen.skipped++
+			continue
+		}
+		md.ChecksumPicture = strings.Trim(md.ChecksumPicture, " ")
+		missing, err := store.MissingRenditionSizes(gen.repository, md, gen.sizes)
+		if err != nil {
+			return err
+		}
+		if len(missing) == 0 {
+			gen.complete++
+			continue
+		}
+		data, err := gen.repository.ReadMedia(md.Index)
+		if err != nil {
+			fmt.Printf("Error reading media ISN=%d: %v\n", md.Index, err)
+			gen.report.FailedIsn(md.Index, err)
+			gen.failures++
+			continue
+		}
+		// segments are read by the workers, so load them here
+		err = store.LoadSegments(gen.repository, data)
+		if err != nil {
+			fmt.Printf("Error reading segments ISN=%d: %v\n", md.Index, err)
+			gen.report.FailedIsn(md.Index, err)
+			gen.failures++
+			continue
+		}
+		j := &job{metadata: md, format: format, data: data, sizes: missing}
+		for sent := false; !sent; {
+			select {
+			case jobs <- j:
+				sent = true
+			case r := <-results:
+				gen.store(r)
+			}
+		}
+	}
+	return nil
+}
+
+func (gen *generator) store(r *result) {
+	if r.err != nil {
+		fmt.Printf("Error generating renditions ISN=%d: %v\n", r.metadata.Index, r.err)
+		gen.report.FailedIsn(r.metadata.Index, r.err)
+		gen.failures++
+		return
+	}
+	for _, rendition := range r.renditions {
+		fmt.Printf("Rendition ISN=%d size=%d %dx%d\n", r.metadata.Index, rendition.Size,
+			rendition.Width, rendition.Height)
+		gen.generated++
+		if gen.test {
+			continue
+		}
+		err := gen.repository.StoreRendition(rendition)
+		if err != nil {
+			fmt.Printf("Error storing rendition ISN=%d: %v\n", r.metadata.Index, err)
+			gen.report.FailedIsn(r.metadata.Index, err)
+			gen.failures++
+			return
+		}
+		if gen.generated%100 == 0 {
+			err = gen.repository.EndTransaction()
+			if err != nil {
+				fmt.Println("Error end of transaction", err)
+			}
+		}
+	}
+}
+
+func schedule(what func(), delay time.Duration) chan bool {
+	stop := make(chan bool)
+
+	go func() {
+		for {
+			what()
+			select {
+			case <-time.After(delay):
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
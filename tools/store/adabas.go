@@ -21,10 +21,14 @@ package store
 
 import (
 	"bytes"
+	"crypto/md5"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tknie/adabas-go-api/adabas"
@@ -33,46 +37,52 @@ import (
 
 // PictureConnection picture connection handle
 type PictureConnection struct {
+	repository  PictureRepository
+	ShortenName bool
+	Update      bool
+	ChecksumRun bool
+	Verbose     bool
+	Filter      []string
+	MaxBlobSize int64
+	CurrentFile string
+	statistics  *PictureStatistic
+	processing  atomic.Value
+	// StoreCorrupt store media files failing the integrity validation
+	StoreCorrupt bool
+	// FileState skip files unchanged since they were loaded, changed
+	// files are updated
+	FileState *FileStateStore
+	// ownRepository the repository was opened for the connection and is
+	// closed with it
+	ownRepository bool
+}
+
+// adabasRepository Adabas implementation of the picture repository
+type adabasRepository struct {
 	dbReference       *DatabaseReference
 	connection        *adabas.Connection
 	store             *adabas.StoreRequest
 	storeData         *adabas.StoreRequest
 	storeThumb        *adabas.StoreRequest
+	storeSHA256       *adabas.StoreRequest
+	storeMIMEType     *adabas.StoreRequest
+	storeDimensions   *adabas.StoreRequest
 	storeEntries      *adabas.StoreRequest
 	readFileNameCheck *adabas.ReadRequest
 	readMediaCheck    *adabas.ReadRequest
 	readAddAndCheck   *adabas.ReadRequest
-	histCheck         *adabas.ReadRequest
-	ShortenName       bool
-	Update            bool
-	ChecksumRun       bool
-	Verbose           bool
-	Filter            []string
-	MaxBlobSize       int64
-	CurrentFile       string
-}
-
-type PictureStatistic struct {
-	Found         uint64
-	Empty         uint64
-	Loaded        uint64
-	Added         uint64
-	Checked       uint64
-	ToBig         uint64
-	NrErrors      uint64
-	Duplicated    uint64
-	Errors        map[string]uint64
-	NrDeleted     uint64
-	Ignored       uint64
-	Verified      uint64
-	SizeDiffFound uint64
-	DiffFound     uint64
-	NotFound      uint64
-	OtherHost     uint64
-	HostsFound    sync.Map
-}
-
-var Statistics = &PictureStatistic{Errors: make(map[string]uint64)}
+	readMedia         *adabas.ReadRequest
+	readName          *adabas.ReadRequest
+	readPair          *adabas.ReadRequest
+	readSegmentInfo   *adabas.ReadRequest
+	deleteRequest     *adabas.DeleteRequest
+	storeSegment      *adabas.StoreRequest
+	readSegment       *adabas.ReadRequest
+	deleteSegment     *adabas.DeleteRequest
+	storeRendition    *adabas.StoreRequest
+	readRendition     *adabas.ReadRequest
+	deleteRendition   *adabas.DeleteRequest
+}
 
 // Hostname of this host
 var Hostname = "Unknown"
@@ -97,26 +107,13 @@ func checkEmpty(fileName string) bool {
 	return false
 }
 
-func (stat *PictureStatistic) String() string {
-	var buffer bytes.Buffer
-	buffer.WriteString(fmt.Sprintf("%s Picture directory checked=%d loaded=%d found=%d too big=%d errors=%d deleted=%d\n",
-		time.Now().Format(timeFormat), stat.Checked, stat.Loaded, stat.Found, stat.ToBig, stat.NrErrors, stat.NrDeleted))
-	buffer.WriteString(fmt.Sprintf("%s Picture directory added=%d empty=%d ignored=%d duplicated=%d\n",
-		time.Now().Format(timeFormat), stat.Added, stat.Empty, stat.Ignored, stat.Duplicated))
-
-	return buffer.String()
-}
-
 func (ps *PictureConnection) pictureFileAvailable(key string) (bool, error) {
-	//fmt.Println("Check Md5=" + key)
-	result, err := ps.readFileNameCheck.HistogramWith("PM=" + key)
+	ok, err := ps.repository.PictureFileAvailable(key)
 	if err != nil {
 		fmt.Printf("Error checking PictureHash=%s: %v\n", key, err)
-		panic("Read error " + err.Error())
-		//		return false, err
+		return false, backendError("check picture file", err)
 	}
-	// result.DumpValues()
-	if len(result.Values) > 0 || len(result.Data) > 0 {
+	if ok {
 		adatypes.Central.Log.Debugf("PM=%s is available\n", key)
 		return true, nil
 	}
@@ -124,16 +121,29 @@ func (ps *PictureConnection) pictureFileAvailable(key string) (bool, error) {
 	return false, nil
 }
 
-func (ps *PictureConnection) pictureMediaAvailable(key string) (bool, error) {
-	//fmt.Println("Check Md5=" + key)
-	result, err := ps.readMediaCheck.HistogramWith("CP=" + key)
+// pictureMediaAvailable check if the media checksum (CP) is stored. If the
+// SHA-256 checksum is given and stored, it need to match too. Otherwise it
+// is a MD5 collision and ErrCollision is returned, the media cannot be
+// stored under the same CP.
+func (ps *PictureConnection) pictureMediaAvailable(key, sha string) (bool, error) {
+	ok, err := ps.repository.PictureMediaAvailable(key)
 	if err != nil {
 		fmt.Printf("Error checking PictureHash=%s: %v\n", key, err)
-		panic("Read error " + err.Error())
-		//		return false, err
+		return false, backendError("check picture media", err)
 	}
-	// result.DumpValues()
-	if len(result.Values) > 0 || len(result.Data) > 0 {
+	if ok && sha != "" {
+		list, err := ps.repository.ReadChecksumMetadata(key)
+		if err != nil {
+			fmt.Printf("Error checking PictureHash=%s: %v\n", key, err)
+			return false, backendError("read checksum", err)
+		}
+		if matchSHA256(list, sha) == nil {
+			fmt.Printf("MD5 collision of CP=%s, SHA-256 %s differ\n", key, sha)
+			ps.statistics.Inc(StatCollisions)
+			return false, fmt.Errorf("CP=%s SHA-256 %s: %w", key, sha, ErrCollision)
+		}
+	}
+	if ok {
 		adatypes.Central.Log.Debugf("CP=%s is available\n", key)
 		return true, nil
 	}
@@ -141,159 +151,979 @@ func (ps *PictureConnection) pictureMediaAvailable(key string) (bool, error) {
 	return false, nil
 }
 
-/* func (ps *PictureConnection) checkPicture(key string) (bool, error) {
-	//fmt.Println("Check Md5=" + key)
-	result, err := ps.histCheck.HistogramWith("CP=" + key)
+// matchSHA256 search metadata with the given SHA-256 checksum (CS). Entries
+// without SHA-256 checksum are not backfilled yet and only checked by MD5.
+func matchSHA256(list []*PictureMetadata, sha string) *PictureMetadata {
+	var unknown *PictureMetadata
+	for _, md := range list {
+		switch md.ChecksumSHA256 {
+		case sha:
+			return md
+		case "":
+			if unknown == nil {
+				unknown = md
+			}
+		}
+	}
+	return unknown
+}
+
+// Repository storage backend of the picture connection
+func (ps *PictureConnection) Repository() PictureRepository {
+	return ps.repository
+}
+
+// Close connection. The repository is closed only if it was opened for the
+// connection, shared repositories are closed by their owner.
+func (ps *PictureConnection) Close() {
+	if ps != nil && ps.ownRepository && ps.repository != nil {
+		ps.repository.Close()
+	}
+}
+
+// connectionURL Adabas map connection URL of the database reference
+func connectionURL(dbReference *DatabaseReference) string {
+	return fmt.Sprintf("acj;inmap=%s,%d", dbReference.Dbid, dbReference.PictureFile)
+}
+
+// OpenAdabasRepository open Adabas picture repository referenced by database
+// reference. Failed operations are retried using the DefaultRetryPolicy.
+// Connection errors are returned as backend errors.
+func OpenAdabasRepository(dbReference *DatabaseReference) (PictureRepository, error) {
+	connection, err := adabas.NewConnection(connectionURL(dbReference))
 	if err != nil {
-		fmt.Printf("Error checking ChecksumPicture=%s: %v\n", key, err)
-		panic("Read error " + err.Error())
-		//		return false, err
+		return nil, backendError("connect", err)
 	}
-	// result.DumpValues()
-	if len(result.Values) > 0 || len(result.Data) > 0 {
-		adatypes.Central.Log.Debugf("ChecksumPicture=%s is available\n", key)
-		return true, nil
+	repository, err := NewAdabasRepository(dbReference, connection)
+	if err != nil {
+		return nil, backendError("open repository", err)
 	}
-	adatypes.Central.Log.Debugf("ChecksumPicture=%s is not loaded\n", key)
-	return false, nil
-}*/
+	return WithRetry(repository, DefaultRetryPolicy), nil
+}
 
-// Close connection
-func (ps *PictureConnection) Close() {
-	if ps != nil && ps.connection != nil {
-		ps.connection.Close()
+// NewAdabasRepository create Adabas picture repository using the given connection
+func NewAdabasRepository(dbReference *DatabaseReference, connection *adabas.Connection) (PictureRepository, error) {
+	ar := &adabasRepository{dbReference: dbReference, connection: connection}
+	var err error
+	ar.store, err = connection.CreateMapStoreRequest((*PictureMetadata)(nil))
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	err = ar.store.StoreFields("*")
+	if err != nil {
+		return nil, err
+	}
+	ar.storeData, err = connection.CreateMapStoreRequest((*PictureData)(nil))
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	err = ar.storeData.StoreFields("DP")
+	if err != nil {
+		return nil, err
+	}
+	ar.storeThumb, err = connection.CreateMapStoreRequest((*PictureData)(nil))
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	err = ar.storeThumb.StoreFields("CP,DT")
+	// "Md5,ChecksumPicture,ChecksumThumbnail,Thumbnail")
+	if err != nil {
+		return nil, err
+	}
+	ar.storeSHA256, err = connection.CreateMapStoreRequest((*PictureData)(nil))
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	err = ar.storeSHA256.StoreFields("CS")
+	if err != nil {
+		return nil, err
+	}
+	ar.storeEntries, err = connection.CreateMapStoreRequest((*PictureMetadata)(nil))
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	err = ar.storeEntries.StoreFields("PL")
+	if err != nil {
+		return nil, err
+	}
+	ar.readFileNameCheck, err = connection.CreateMapReadRequest((*PictureMetadata)(nil))
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	err = ar.readFileNameCheck.QueryFields("PM")
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	ar.readAddAndCheck, err = connection.CreateMapReadRequest((*PictureMetadata)(nil))
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	err = ar.readAddAndCheck.QueryFields("CP,CS,PL")
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	ar.readMediaCheck, err = connection.CreateMapReadRequest((*PictureData)(nil))
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	err = ar.readMediaCheck.QueryFields("CP")
+	if err != nil {
+		connection.Close()
+		return nil, err
+	}
+	return ar, nil
+}
+
+func isnList(result *adabas.Response) []uint64 {
+	list := make([]uint64, 0)
+	for _, v := range result.Values {
+		list = append(list, uint64(v.Isn))
+	}
+	if len(list) > 0 {
+		return list
+	}
+	for _, d := range result.Data {
+		switch r := d.(type) {
+		case *PictureMetadata:
+			list = append(list, r.Index)
+		case *PictureData:
+			list = append(list, r.Index)
+		}
+	}
+	return list
+}
+
+// PictureFileAvailable check if picture path key (PM) is stored
+func (ar *adabasRepository) PictureFileAvailable(key string) (bool, error) {
+	result, err := ar.readFileNameCheck.HistogramWith("PM=" + key)
+	if err != nil {
+		return false, err
+	}
+	return len(result.Values) > 0 || len(result.Data) > 0, nil
+}
+
+// PictureMediaAvailable check if picture checksum (CP) is stored
+func (ar *adabasRepository) PictureMediaAvailable(checksum string) (bool, error) {
+	result, err := ar.readMediaCheck.HistogramWith("CP=" + checksum)
+	if err != nil {
+		return false, err
+	}
+	return len(result.Values) > 0 || len(result.Data) > 0, nil
+}
+
+// ReadChecksumMetadata read metadata with locations of the checksum (CP)
+func (ar *adabasRepository) ReadChecksumMetadata(checksum string) ([]*PictureMetadata, error) {
+	result, err := ar.readAddAndCheck.ReadLogicalWith("CP=" + checksum)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*PictureMetadata, 0, len(result.Data))
+	for _, d := range result.Data {
+		list = append(list, d.(*PictureMetadata))
+	}
+	return list, nil
+}
+
+// ReadFileMetadata read metadata with locations of the picture path key (PM)
+func (ar *adabasRepository) ReadFileMetadata(key string) ([]*PictureMetadata, error) {
+	result, err := ar.readAddAndCheck.ReadLogicalWith("PM=" + key)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*PictureMetadata, 0, len(result.Data))
+	for _, d := range result.Data {
+		list = append(list, d.(*PictureMetadata))
+	}
+	return list, nil
+}
+
+// ReadMedia read picture data with media and thumbnail of the given ISN
+func (ar *adabasRepository) ReadMedia(isn uint64) (*PictureData, error) {
+	if ar.readMedia == nil {
+		var err error
+		ar.readMedia, err = ar.connection.CreateMapReadRequest((*PictureData)(nil))
+		if err != nil {
+			return nil, err
+		}
+		err = ar.readMedia.QueryFields("CP,CS,DP,DT,SG")
+		if err != nil {
+			ar.readMedia = nil
+			return nil, err
+		}
+	}
+	result, err := ar.readMedia.ReadISN(adatypes.Isn(isn))
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Data) != 1 {
+		return nil, fmt.Errorf("data of ISN=%d %w", isn, ErrNotFound)
+	}
+	return result.Data[0].(*PictureData), nil
+}
+
+// StoreMetadata insert or update all metadata fields
+func (ar *adabasRepository) StoreMetadata(insert bool, metadata *PictureMetadata) error {
+	if insert {
+		return ar.store.StoreData(metadata)
+	}
+	return ar.store.UpdateData(metadata)
+}
+
+// UpdateMediaChunk update the media (DP) of the ISN at the offset, a chunk
+// at offset 0 replaces the media
+func (ar *adabasRepository) UpdateMediaChunk(isn, offset uint64, chunk []byte) error {
+	if offset == 0 {
+		return ar.storeData.UpdateData(&PictureData{Index: isn, Media: chunk}, true)
+	}
+	return ar.storeData.UpdateLOBRecord(adatypes.Isn(isn), "DP", offset, chunk)
+}
+
+// UpdateThumbnail update checksum and thumbnail (CP,DT) of the picture data index
+func (ar *adabasRepository) UpdateThumbnail(data *PictureData) error {
+	return ar.storeThumb.UpdateData(data)
+}
+
+// UpdateDimensions update fill, original and thumbnail dimensions
+// (FI,WI,HE,TW,TH) of the metadata index
+func (ar *adabasRepository) UpdateDimensions(metadata *PictureMetadata) error {
+	if ar.storeDimensions == nil {
+		var err error
+		ar.storeDimensions, err = ar.connection.CreateMapStoreRequest((*PictureMetadata)(nil))
+		if err != nil {
+			return err
+		}
+		err = ar.storeDimensions.StoreFields("FI,WI,HE,TW,TH")
+		if err != nil {
+			ar.storeDimensions = nil
+			return err
+		}
+	}
+	return ar.storeDimensions.UpdateData(metadata)
+}
+
+// UpdateSHA256 update SHA-256 checksum (CS) of the picture data index
+func (ar *adabasRepository) UpdateSHA256(data *PictureData) error {
+	return ar.storeSHA256.UpdateData(data)
+}
+
+// UpdateMIMEType update MIME type (TY) of the picture data index
+func (ar *adabasRepository) UpdateMIMEType(data *PictureData) error {
+	if ar.storeMIMEType == nil {
+		var err error
+		ar.storeMIMEType, err = ar.connection.CreateMapStoreRequest((*PictureData)(nil))
+		if err != nil {
+			return err
+		}
+		err = ar.storeMIMEType.StoreFields("TY")
+		if err != nil {
+			ar.storeMIMEType = nil
+			return err
+		}
+	}
+	return ar.storeMIMEType.UpdateData(data)
+}
+
+// UpdateLocations update picture location list (PL) of the metadata index
+func (ar *adabasRepository) UpdateLocations(metadata *PictureMetadata) error {
+	return ar.storeEntries.UpdateData(metadata)
+}
+
+// SearchHash search all ISN containing the picture path key (PM)
+func (ar *adabasRepository) SearchHash(key string) ([]uint64, error) {
+	result, err := ar.readFileNameCheck.ReadLogicalWith("PM=" + key)
+	if err != nil {
+		return nil, err
+	}
+	return isnList(result), nil
+}
+
+// SearchName search all ISN containing the picture name (PN)
+func (ar *adabasRepository) SearchName(name string) ([]uint64, error) {
+	if ar.readName == nil {
+		var err error
+		ar.readName, err = ar.connection.CreateMapReadRequest((*PictureMetadata)(nil))
+		if err != nil {
+			return nil, err
+		}
+		err = ar.readName.QueryFields(PictureNameSN)
+		if err != nil {
+			ar.readName = nil
+			return nil, err
+		}
+	}
+	result, err := ar.readName.ReadLogicalWith(PictureNameSN + "=" + name)
+	if err != nil {
+		return nil, err
+	}
+	return isnList(result), nil
+}
+
+// SearchPair search all ISN of the RAW and JPEG pair key (RP)
+func (ar *adabasRepository) SearchPair(key string) ([]uint64, error) {
+	if ar.readPair == nil {
+		var err error
+		ar.readPair, err = ar.connection.CreateMapReadRequest((*PictureMetadata)(nil))
+		if err != nil {
+			return nil, err
+		}
+		err = ar.readPair.QueryFields("RP")
+		if err != nil {
+			ar.readPair = nil
+			return nil, err
+		}
+	}
+	result, err := ar.readPair.ReadLogicalWith("RP=" + key)
+	if err != nil {
+		return nil, err
+	}
+	return isnList(result), nil
+}
+
+// Delete delete record with given ISN, segments and renditions are removed
+// if no other record references the same checksum
+func (ar *adabasRepository) Delete(isn uint64) error {
+	if ar.dbReference.SegmentFile > 0 || ar.dbReference.RenditionFile > 0 {
+		err := ar.deleteUnusedSegments(isn)
+		if err != nil {
+			return err
+		}
+	}
+	if ar.deleteRequest == nil {
+		var err error
+		ar.deleteRequest, err = ar.connection.CreateMapDeleteRequest("PictureMetadata")
+		if err != nil {
+			return err
+		}
+	}
+	return ar.deleteRequest.Delete(adatypes.Isn(isn))
+}
+
+func (ar *adabasRepository) deleteUnusedSegments(isn uint64) error {
+	if ar.readSegmentInfo == nil {
+		var err error
+		ar.readSegmentInfo, err = ar.connection.CreateMapReadRequest((*PictureMetadata)(nil))
+		if err != nil {
+			return err
+		}
+		err = ar.readSegmentInfo.QueryFields("CP,SG")
+		if err != nil {
+			ar.readSegmentInfo = nil
+			return err
+		}
+	}
+	result, err := ar.readSegmentInfo.ReadISN(adatypes.Isn(isn))
+	if err != nil {
+		return err
+	}
+	if len(result.Data) != 1 {
+		return nil
+	}
+	metadata := result.Data[0].(*PictureMetadata)
+	if metadata.NrSegments < 2 && ar.dbReference.RenditionFile == 0 {
+		return nil
+	}
+	checksum := strings.Trim(metadata.ChecksumPicture, " ")
+	list, err := ar.ReadChecksumMetadata(checksum)
+	if err != nil {
+		return err
+	}
+	if len(list) > 1 {
+		return nil
+	}
+	err = ar.DeleteRenditions(checksum)
+	if err != nil {
+		return err
+	}
+	return ar.DeleteSegments(checksum)
+}
+
+func (ar *adabasRepository) createDataCursor(search string) (PictureCursor, error) {
+	request, err := ar.connection.CreateMapReadRequest((*PictureData)(nil))
+	if err != nil {
+		return nil, err
+	}
+	err = request.QueryFields("DP,CP,CS,PL,SG")
+	if err != nil {
+		return nil, err
+	}
+	request.Limit = 0
+	request.Multifetch = 1
+	return request.ReadLogicalWithCursoring(search)
+}
+
+// ReadHost cursor of picture data located at host (PH)
+func (ar *adabasRepository) ReadHost(host string) (PictureCursor, error) {
+	return ar.createDataCursor("PH=" + host)
+}
+
+// ReadChecksum cursor of picture data with checksum (CP)
+func (ar *adabasRepository) ReadChecksum(checksum string) (PictureCursor, error) {
+	return ar.createDataCursor("CP=" + checksum)
+}
+
+// ReadData cursor of all picture data including media and MIME type
+func (ar *adabasRepository) ReadData(limit uint64) (PictureCursor, error) {
+	request, err := ar.connection.CreateMapReadRequest((*PictureData)(nil))
+	if err != nil {
+		return nil, err
+	}
+	err = request.QueryFields("DP,DT,CP,CS,TY,PL,SG")
+	if err != nil {
+		return nil, err
+	}
+	request.Limit = limit
+	request.Multifetch = 1
+	return request.ReadPhysicalWithCursoring()
+}
+
+// ReadMetadata cursor of all picture metadata
+func (ar *adabasRepository) ReadMetadata(limit uint64) (PictureCursor, error) {
+	request, err := ar.connection.CreateMapReadRequest((*PictureMetadata)(nil))
+	if err != nil {
+		return nil, err
+	}
+	err = request.QueryFields("*")
+	if err != nil {
+		return nil, err
+	}
+	request.Limit = limit
+	return request.ReadPhysicalWithCursoring()
+}
+
+// ReadOption cursor of picture metadata with the option (OP)
+func (ar *adabasRepository) ReadOption(option string) (PictureCursor, error) {
+	return ar.createMetadataCursor("OP=" + option)
+}
+
+// ReadGeoCell cursor of picture metadata in geo cells (GC) starting with the
+// prefix. The geohash alphabet ends with z, so the prefix filled up with z
+// is the upper bound of the descriptor range.
+func (ar *adabasRepository) ReadGeoCell(prefix string) (PictureCursor, error) {
+	if len(prefix) >= geoCellPrecision {
+		return ar.createMetadataCursor("GC=" + prefix)
+	}
+	last := prefix + strings.Repeat("z", geoCellPrecision-len(prefix))
+	return ar.createMetadataCursor("GC=[" + prefix + ":" + last + "]")
+}
+
+func (ar *adabasRepository) createMetadataCursor(search string) (PictureCursor, error) {
+	request, err := ar.connection.CreateMapReadRequest((*PictureMetadata)(nil))
+	if err != nil {
+		return nil, err
+	}
+	err = request.QueryFields("*")
+	if err != nil {
+		return nil, err
+	}
+	request.Limit = 0
+	return request.ReadLogicalWithCursoring(search)
+}
+
+// HistogramChecksum call function for each checksum (CP)
+func (ar *adabasRepository) HistogramChecksum(limit uint64, fn ChecksumQuantity) error {
+	request, err := ar.connection.CreateMapReadRequest((*PictureMetadata)(nil))
+	if err != nil {
+		return err
+	}
+	request.Limit = limit
+	err = request.QueryFields("CP")
+	if err != nil {
+		return err
+	}
+	cursor, err := request.HistogramByCursoring("CP")
+	if err != nil {
+		return err
+	}
+	counter := uint64(0)
+	for cursor.HasNextRecord() && (limit == 0 || counter < limit) {
+		record, recErr := cursor.NextRecord()
+		if recErr != nil {
+			return recErr
+		}
+		counter++
+		v, ok := record.HashFields["CP"]
+		if !ok {
+			v = record.HashFields["ChecksumPicture"]
+		}
+		err = fn(strings.Trim(v.String(), " "), record.Quantity)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// segmentKey key of the segment, the checksum read out of the A40 field
+// is blank padded
+func segmentKey(checksum string, sequence uint32) string {
+	return fmt.Sprintf("%s-%06d", strings.Trim(checksum, " "), sequence)
+}
+
+// StoreSegment store media segment of the given checksum into the segment file
+func (ar *adabasRepository) StoreSegment(checksum string, sequence uint32, data []byte) error {
+	if ar.dbReference.SegmentFile == 0 {
+		return fmt.Errorf("no segment file defined")
+	}
+	if ar.storeSegment == nil {
+		var err error
+		ar.storeSegment, err = ar.connection.CreateStoreRequest(ar.dbReference.SegmentFile)
+		if err != nil {
+			return err
+		}
+		err = ar.storeSegment.StoreFields("SK,CP,SQ,DS")
+		if err != nil {
+			ar.storeSegment = nil
+			return err
+		}
+	}
+	record, err := ar.storeSegment.CreateRecord()
+	if err != nil {
+		return err
+	}
+	for field, value := range map[string]interface{}{"SK": segmentKey(checksum, sequence),
+		"CP": strings.Trim(checksum, " "), "SQ": sequence, "DS": data} {
+		err = record.SetValue(field, value)
+		if err != nil {
+			return err
+		}
+	}
+	return ar.storeSegment.Store(record)
+}
+
+// ReadSegment read media segment of the given checksum
+func (ar *adabasRepository) ReadSegment(checksum string, sequence uint32) ([]byte, error) {
+	if ar.dbReference.SegmentFile == 0 {
+		return nil, fmt.Errorf("no segment file defined")
+	}
+	if ar.readSegment == nil {
+		var err error
+		ar.readSegment, err = ar.connection.CreateFileReadRequest(ar.dbReference.SegmentFile)
+		if err != nil {
+			return nil, err
+		}
+		err = ar.readSegment.QueryFields("DS")
+		if err != nil {
+			ar.readSegment = nil
+			return nil, err
+		}
+	}
+	result, err := ar.readSegment.ReadLogicalWith("SK=" + segmentKey(checksum, sequence))
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Values) != 1 {
+		return nil, fmt.Errorf("segment %d of %s %w", sequence, checksum, ErrNotFound)
+	}
+	return result.Values[0].HashFields["DS"].Bytes(), nil
+}
+
+// DeleteSegments delete all media segments of the given checksum
+func (ar *adabasRepository) DeleteSegments(checksum string) error {
+	if ar.dbReference.SegmentFile == 0 {
+		return nil
+	}
+	request, err := ar.connection.CreateFileReadRequest(ar.dbReference.SegmentFile)
+	if err != nil {
+		return err
+	}
+	err = request.QueryFields("")
+	if err != nil {
+		return err
+	}
+	result, err := request.ReadLogicalWith("CP=" + strings.Trim(checksum, " "))
+	if err != nil {
+		return err
+	}
+	if ar.deleteSegment == nil {
+		ar.deleteSegment, err = ar.connection.CreateDeleteRequest(ar.dbReference.SegmentFile)
+		if err != nil {
+			return err
+		}
+	}
+	for _, isn := range isnList(result) {
+		err = ar.deleteSegment.Delete(adatypes.Isn(isn))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SegmentsAvailable true if a segment file is defined
+func (ar *adabasRepository) SegmentsAvailable() bool {
+	return ar.dbReference.SegmentFile > 0
+}
+
+// RenditionsAvailable true if a rendition file is defined
+func (ar *adabasRepository) RenditionsAvailable() bool {
+	return ar.dbReference.RenditionFile > 0
+}
+
+// StoreRendition store rendition of the checksum and size into the rendition file
+func (ar *adabasRepository) StoreRendition(rendition *Rendition) error {
+	if ar.dbReference.RenditionFile == 0 {
+		return fmt.Errorf("no rendition file defined")
+	}
+	if ar.storeRendition == nil {
+		var err error
+		ar.storeRendition, err = ar.connection.CreateStoreRequest(ar.dbReference.RenditionFile)
+		if err != nil {
+			return err
+		}
+		err = ar.storeRendition.StoreFields("RK,CP,RS,WI,HE,DR")
+		if err != nil {
+			ar.storeRendition = nil
+			return err
+		}
+	}
+	record, err := ar.storeRendition.CreateRecord()
+	if err != nil {
+		return err
+	}
+	for field, value := range map[string]interface{}{"RK": renditionKey(rendition.ChecksumPicture, rendition.Size),
+		"CP": rendition.ChecksumPicture, "RS": rendition.Size, "WI": rendition.Width,
+		"HE": rendition.Height, "DR": rendition.Data} {
+		err = record.SetValue(field, value)
+		if err != nil {
+			return err
+		}
+	}
+	return ar.storeRendition.Store(record)
+}
+
+// ReadRendition read rendition of the given checksum and size
+func (ar *adabasRepository) ReadRendition(checksum string, size uint32) (*Rendition, error) {
+	if ar.dbReference.RenditionFile == 0 {
+		return nil, fmt.Errorf("no rendition file defined")
+	}
+	if ar.readRendition == nil {
+		var err error
+		ar.readRendition, err = ar.connection.CreateFileReadRequest(ar.dbReference.RenditionFile)
+		if err != nil {
+			return nil, err
+		}
+		err = ar.readRendition.QueryFields("DR")
+		if err != nil {
+			ar.readRendition = nil
+			return nil, err
+		}
+	}
+	result, err := ar.readRendition.ReadLogicalWith("RK=" + renditionKey(checksum, size))
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Values) != 1 {
+		return nil, fmt.Errorf("rendition %d of %s %w", size, checksum, ErrNotFound)
+	}
+	return newRendition(checksum, size, result.Values[0].HashFields["DR"].Bytes())
+}
+
+// ReadRenditionSizes sizes of all renditions stored for the checksum
+func (ar *adabasRepository) ReadRenditionSizes(checksum string) ([]uint32, error) {
+	if ar.dbReference.RenditionFile == 0 {
+		return nil, fmt.Errorf("no rendition file defined")
+	}
+	request, err := ar.connection.CreateFileReadRequest(ar.dbReference.RenditionFile)
+	if err != nil {
+		return nil, err
+	}
+	err = request.QueryFields("RK")
+	if err != nil {
+		return nil, err
+	}
+	result, err := request.ReadLogicalWith("CP=" + checksum)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make([]uint32, 0, len(result.Values))
+	for _, record := range result.Values {
+		size, err := renditionKeySize(record.HashFields["RK"].String())
+		if err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+// DeleteRenditions delete all renditions of the given checksum
+func (ar *adabasRepository) DeleteRenditions(checksum string) error {
+	if ar.dbReference.RenditionFile == 0 {
+		return nil
+	}
+	request, err := ar.connection.CreateFileReadRequest(ar.dbReference.RenditionFile)
+	if err != nil {
+		return err
+	}
+	err = request.QueryFields("")
+	if err != nil {
+		return err
+	}
+	result, err := request.ReadLogicalWith("CP=" + checksum)
+	if err != nil {
+		return err
 	}
+	if ar.deleteRendition == nil {
+		ar.deleteRendition, err = ar.connection.CreateDeleteRequest(ar.dbReference.RenditionFile)
+		if err != nil {
+			return err
+		}
+	}
+	for _, isn := range isnList(result) {
+		err = ar.deleteRendition.Delete(adatypes.Isn(isn))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reconnect close the connection and open a new one. All requests are
+// created again, pending changes are lost.
+func (ar *adabasRepository) Reconnect() error {
+	if ar.connection != nil {
+		ar.connection.Close()
+	}
+	connection, err := adabas.NewConnection(connectionURL(ar.dbReference))
+	if err != nil {
+		return err
+	}
+	repository, err := NewAdabasRepository(ar.dbReference, connection)
+	if err != nil {
+		return err
+	}
+	*ar = *repository.(*adabasRepository)
+	return nil
 }
 
-func verifyPictureRecord(cursor *adabas.Cursoring, nrThreads int) error {
+// EndTransaction commit pending changes
+func (ar *adabasRepository) EndTransaction() error {
+	return ar.connection.EndTransaction()
+}
+
+// Close repository
+func (ar *adabasRepository) Close() {
+	if ar != nil && ar.connection != nil {
+		ar.connection.Close()
+	}
+}
+
+// verifyPictureRecord compare the media of all records read with the
+// cursor with the files of this host. Media stored in one piece is
+// compared by the verify threads. Segmented media is compared segment by
+// segment while reading, the segments are read with the same connection.
+func verifyPictureRecord(repository PictureRepository, cursor PictureCursor, nrThreads int, stat *PictureStatistic) error {
 	pictureDataChan := make(chan *PictureData, nrThreads)
 	stopThread := make(chan bool, nrThreads)
 	var wg sync.WaitGroup
 	wg.Add(nrThreads)
 	for i := 0; i < nrThreads; i++ {
-		go VerifyPictureData(&wg, stopThread, pictureDataChan)
+		go VerifyPictureData(&wg, stopThread, pictureDataChan, stat)
 	}
 	fmt.Printf("%s Start reading records ... \n", time.Now().Format(timeFormat))
+	err := readVerifyRecords(repository, cursor, pictureDataChan, stat)
+	fmt.Printf("%s Stop all threads verifying read records ...\n", time.Now().Format(timeFormat))
+	for i := 0; i < nrThreads; i++ {
+		stopThread <- true
+	}
+	wg.Wait()
+	fmt.Printf("%s Got all threads\n", time.Now().Format(timeFormat))
+	return err
+}
+
+// verifyMemory media bytes held in memory to verify the picture data: the
+// media of the record, the current segment and the compare buffers
+func verifyMemory(pm *PictureData) int64 {
+	size := int64(len(pm.Media)) + 2*readChunkSize
+	if pm.NrSegments > 1 {
+		size += int64(len(pm.Media))
+	}
+	return size
+}
+
+func readVerifyRecords(repository PictureRepository, cursor PictureCursor, pictureDataChan chan *PictureData, stat *PictureStatistic) error {
 	for cursor.HasNextRecord() {
 		data, err := cursor.NextData()
 		if err != nil {
 			return err
 		}
 		pm := data.(*PictureData)
-		pictureDataChan <- pm
-		//fmt.Printf("ISN=%d. Checksum=%s len=%d\n", pm.Index, pm.ChecksumPicture, len(pm.PictureLocation))
-		// for _, p := range pm.PictureLocation {
-		// 	//	fmt.Println(p.PictureHost, p.PictureDirectory)
-		// 	if p.PictureHost == Hostname {
-		// 		pm.compareMedia(p.PictureDirectory)
-		// 	} else {
-		// 		Statistics.OtherHost++
-		// 	}
-		// }
+		size := verifyMemory(pm)
+		MediaBudget.Acquire(size)
+		if pm.NrSegments < 2 {
+			// released by the verify thread
+			pictureDataChan <- pm
+			continue
+		}
+		err = pm.verifyLocations(func() io.Reader { return MediaReader(repository, pm) }, stat)
+		MediaBudget.Release(size)
+		if err != nil {
+			fmt.Printf("Error reading segments of %s[%d]: %v\n", pm.ChecksumPicture, pm.Index, err)
+			return err
+		}
 	}
-	fmt.Printf("%s Stop all threads verifying read records ...\n", time.Now().Format(timeFormat))
-	for i := 0; i < nrThreads; i++ {
-		stopThread <- true
+	return nil
+}
+
+// verifyLocations compare the media with the files of all locations of
+// this host. Only errors reading the media out of the database are
+// returned, differences are counted in the statistic.
+func (pic *PictureData) verifyLocations(media func() io.Reader, stat *PictureStatistic) error {
+	for _, p := range pic.PictureLocation {
+		if p.PictureHost != Hostname {
+			stat.AddOtherHost(p.PictureHost)
+			continue
+		}
+		err := pic.compareMedia(p.PictureDirectory, media(), stat)
+		if errors.Is(err, ErrBackend) || errors.Is(err, ErrNotFound) {
+			return err
+		}
 	}
-	wg.Wait()
-	fmt.Printf("%s Got all threads\n", time.Now().Format(timeFormat))
 	return nil
 }
 
-func VerifyPictureData(wg *sync.WaitGroup, stopThread chan bool, pictureDataChan chan *PictureData) {
+// VerifyPictureData compare the picture data received with the files of
+// this host until stopped. The picture data already received is verified
+// before stopping.
+func VerifyPictureData(wg *sync.WaitGroup, stopThread chan bool, pictureDataChan chan *PictureData, stat *PictureStatistic) {
+	defer wg.Done()
+	verify := func(pm *PictureData) {
+		pm.verifyLocations(func() io.Reader { return bytes.NewReader(pm.Media) }, stat)
+		MediaBudget.Release(verifyMemory(pm))
+	}
 	for {
 		select {
 		case <-stopThread:
-			wg.Done()
-			return
-		case pm := <-pictureDataChan:
-			for _, p := range pm.PictureLocation {
-				//	fmt.Println(p.PictureHost, p.PictureDirectory)
-				if p.PictureHost == Hostname {
-					pm.compareMedia(p.PictureDirectory)
-				} else {
-					Statistics.HostsFound.Store(p.PictureHost, true)
-					Statistics.OtherHost++
+			for {
+				select {
+				case pm := <-pictureDataChan:
+					verify(pm)
+				default:
+					return
 				}
 			}
+		case pm := <-pictureDataChan:
+			verify(pm)
 		}
 	}
 }
 
 // VerifyPicture verify pictures
-func VerifyPicture(target string, file adabas.Fnr, nrThreads int) error {
-	connection, err := adabas.NewConnection(fmt.Sprintf("acj;inmap=%s,%d", target, file))
+func VerifyPicture(target string, file adabas.Fnr, nrThreads int, stat *PictureStatistic) error {
+	repository, err := OpenAdabasRepository(&DatabaseReference{Dbid: target, PictureFile: file})
 	if err != nil {
 		fmt.Println("Adabas connection error", err)
-		panic("Adabas communication error in verify")
-	}
-	defer connection.Close()
-	request, rerr := connection.CreateMapReadRequest((*PictureData)(nil))
-	if rerr != nil {
-		fmt.Println("Error creating request", rerr)
-		return rerr
+		return backendError("open repository", err)
 	}
-	err = request.QueryFields("DP,CP,PL")
-	if err != nil {
-		fmt.Println("Error query fields", err)
-		return err
-	}
-	request.Limit = 0
-	request.Multifetch = 1
+	defer repository.Close()
+	return VerifyPictureRepository(repository, nrThreads, stat)
+}
 
+// VerifyPictureRepository verify pictures of this host stored in the repository
+func VerifyPictureRepository(repository PictureRepository, nrThreads int, stat *PictureStatistic) error {
 	// cursor, rErr := request.ReadPhysicalWithCursoring()
 	fmt.Println(time.Now().Format(timeFormat), "Read all pictures from host", Hostname)
-	cursor, rErr := request.ReadLogicalWithCursoring("PH=" + Hostname)
-	// request.ReadPhysicalSequenceStream(verifyPictureRecord, nil)
+	cursor, rErr := repository.ReadHost(Hostname)
 	if rErr != nil {
 		fmt.Println("Error read physical cursor start", rErr)
 		return rErr
 	}
-	return verifyPictureRecord(cursor, nrThreads)
+	return verifyPictureRecord(repository, cursor, nrThreads, stat)
+}
+
+func dumpRange(data []byte, offset int) []byte {
+	start := offset - 10
+	if start < 0 {
+		start = 0
+	}
+	end := offset + 100
+	if end > len(data) {
+		end = len(data)
+	}
+	return data[start:end]
 }
 
-func (pic *PictureData) compareMedia(loadFile string) (err error) {
+// compareMedia compare the file with the media read out of the database
+// chunk by chunk, neither is held in memory completely. Errors reading the
+// media out of the database are returned as backend errors.
+func (pic *PictureData) compareMedia(loadFile string, media io.Reader, stat *PictureStatistic) (err error) {
 	// fmt.Println("Compare file", loadFile, "with data in", pic.ChecksumPicture)
 	f, err := os.Open(loadFile)
 	if err != nil {
 		fmt.Printf("Error loading file [%d]: %v\n", pic.Index, loadFile)
-		Statistics.NotFound++
+		stat.Inc(StatNotFound)
 		return err
 	}
 	defer f.Close()
-	fi, err := f.Stat()
-	if err != nil {
-		return err
-	}
-	if fi.Size() > int64(len(pic.Media)) {
-		return fmt.Errorf("file tooo big %d>%d", fi.Size(), len(pic.Media))
-	}
-	fileData := make([]byte, fi.Size())
-	var n int
-	n, err = f.Read(fileData)
-	adatypes.Central.Log.Debugf("Number of bytes read: %d/%d -> %v\n", n, len(pic.Media), err)
-	if err != nil {
-		fmt.Printf("Error reading file: %v", err)
-		return err
+	h := md5.New()
+	buffer := make([]byte, readChunkSize)
+	dbBuffer := make([]byte, readChunkSize)
+	fileSize := int64(0)
+	mediaSize := int64(0)
+	differOffset := int64(-1)
+	fileEnd, mediaEnd := false, false
+	for !fileEnd || !mediaEnd {
+		n, m := 0, 0
+		if !fileEnd {
+			var rerr error
+			n, rerr = io.ReadFull(f, buffer)
+			switch {
+			case rerr == io.EOF || rerr == io.ErrUnexpectedEOF:
+				fileEnd = true
+			case rerr != nil:
+				fmt.Printf("Error reading file: %v", rerr)
+				return rerr
+			}
+		}
+		if !mediaEnd {
+			var merr error
+			m, merr = io.ReadFull(media, dbBuffer)
+			switch {
+			case merr == io.EOF || merr == io.ErrUnexpectedEOF:
+				mediaEnd = true
+			case merr != nil:
+				return backendError("read segment", merr)
+			}
+		}
+		h.Write(buffer[:n])
+		if differOffset < 0 {
+			for i := 0; i < n && i < m; i++ {
+				if dbBuffer[i] != buffer[i] {
+					differOffset = fileSize + int64(i)
+					fmt.Printf("Error difference offset at %d[%d]\n", differOffset, pic.Index)
+					fmt.Println(adatypes.FormatByteBuffer("Database at offset", dumpRange(dbBuffer[:m], i)))
+					fmt.Println(adatypes.FormatByteBuffer("File     at offset", dumpRange(buffer[:n], i)))
+					break
+				}
+			}
+		}
+		fileSize += int64(n)
+		mediaSize += int64(m)
 	}
-	md := createMd5(fileData)
+	adatypes.Central.Log.Debugf("Number of bytes read: %d/%d\n", fileSize, mediaSize)
+	md := fmt.Sprintf("%X", h.Sum(nil))
 	if strings.Trim(pic.ChecksumPicture, " ") != md {
 		fmt.Printf("Checksum mismatch <%s> <%s> of %s[%d]\n", md, pic.ChecksumPicture, loadFile, pic.Index)
 	}
-	if len(pic.Media) != len(fileData) {
-		fmt.Printf("Different media length %d != %d of %s[%d]\n", len(pic.Media), len(fileData), loadFile, pic.Index)
-		Statistics.SizeDiffFound++
+	if mediaSize != fileSize {
+		fmt.Printf("Different media length %d != %d of %s[%d]\n", mediaSize, fileSize, loadFile, pic.Index)
+		stat.Inc(StatSizeDiffFound)
 		return fmt.Errorf("size difference found")
 	}
-	for i := 0; i < len(pic.Media); i++ {
-		if pic.Media[i] != fileData[i] {
-			fmt.Printf("Error difference offset at %d[%d]\n", i, pic.Index)
-			fmt.Println(adatypes.FormatByteBuffer("Database at offset", pic.Media[i-10:i+100]))
-			fmt.Println(adatypes.FormatByteBuffer("File     at offset", fileData[i-10:i+100]))
-			Statistics.DiffFound++
-			return fmt.Errorf("data difference found")
-		}
+	if differOffset >= 0 {
+		stat.Inc(StatDiffFound)
+		return fmt.Errorf("data difference found")
 	}
-	Statistics.Verified++
+	stat.Inc(StatVerified)
 	return nil
 }
@@ -0,0 +1,74 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import "sync"
+
+// MemoryBudget limit of media bytes held in memory at the same time
+type MemoryBudget struct {
+	lock  sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+}
+
+// MediaBudget global budget shared by all loader threads, limit 0 is unlimited
+var MediaBudget = NewMemoryBudget(0)
+
+// NewMemoryBudget create new memory budget, limit 0 is unlimited
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	mb := &MemoryBudget{limit: limit}
+	mb.cond = sync.NewCond(&mb.lock)
+	return mb
+}
+
+// SetLimit set new limit, limit 0 is unlimited
+func (mb *MemoryBudget) SetLimit(limit int64) {
+	mb.lock.Lock()
+	mb.limit = limit
+	mb.lock.Unlock()
+	mb.cond.Broadcast()
+}
+
+// Acquire wait until size bytes are available. A request bigger than the
+// limit is granted if no other bytes are in use.
+func (mb *MemoryBudget) Acquire(size int64) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	for mb.limit > 0 && mb.used > 0 && mb.used+size > mb.limit {
+		mb.cond.Wait()
+	}
+	mb.used += size
+}
+
+// Release return size bytes to the budget
+func (mb *MemoryBudget) Release(size int64) {
+	mb.lock.Lock()
+	mb.used -= size
+	mb.lock.Unlock()
+	mb.cond.Broadcast()
+}
+
+// InUse number of bytes currently acquired
+func (mb *MemoryBudget) InUse() int64 {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	return mb.used
+}
@@ -0,0 +1,360 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"math"
+
+	"github.com/tknie/adabas-go-api/adatypes"
+)
+
+// iccHeaderLimit maximum JPEG header bytes searched for ICC profile chunks
+const iccHeaderLimit = 4 * 1024 * 1024
+
+// iccMarker identifier of the JPEG APP2 segments containing the ICC profile
+var iccMarker = []byte("ICC_PROFILE\x00")
+
+// xyzToSRGB convert PCS XYZ (D50) into linear sRGB (Bradford adapted to D65)
+var xyzToSRGB = [9]float64{
+	3.1338561, -1.6168667, -0.4906146,
+	-0.9787684, 1.9161415, 0.0334540,
+	0.0719453, -0.2289914, 1.4052427,
+}
+
+// srgbColorants D50 adapted red, green and blue colorants of sRGB
+var srgbColorants = [9]float64{
+	0.4361, 0.3851, 0.1431,
+	0.2225, 0.7169, 0.0606,
+	0.0139, 0.0971, 0.7141,
+}
+
+// headerRecorder keep the first bytes read, the ICC profile is stored
+// in front of the JPEG image data
+type headerRecorder struct {
+	buffer bytes.Buffer
+}
+
+func (hr *headerRecorder) Write(p []byte) (int, error) {
+	if rest := iccHeaderLimit - hr.buffer.Len(); rest > 0 {
+		if len(p) > rest {
+			hr.buffer.Write(p[:rest])
+		} else {
+			hr.buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// profiledImage decoded image with the transform of its ICC profile into
+// sRGB. The transform is kept through reduction and orientation and is
+// applied to the scaled thumbnail and renditions only, not to the complete
+// decoded picture.
+type profiledImage struct {
+	image.Image
+	transform *iccTransform
+}
+
+// withProfile keep the transform with the image derived of a profiled image
+func withProfile(img image.Image, transform *iccTransform) image.Image {
+	if transform == nil {
+		return img
+	}
+	return &profiledImage{Image: img, transform: transform}
+}
+
+// decodeJPEG decode JPEG in sRGB. CMYK and YCCK pictures are converted into
+// RGB, pictures with an embedded RGB matrix/TRC ICC profile (like Adobe RGB
+// or Display P3) are returned with the transform into sRGB.
+func decodeJPEG(r io.Reader) (image.Image, error) {
+	header := &headerRecorder{}
+	img, err := jpeg.Decode(io.TeeReader(r, header))
+	if err != nil {
+		return nil, err
+	}
+	if cmyk, ok := img.(*image.CMYK); ok {
+		// CMYK ICC profiles need a LUT based colour management, the
+		// inks are converted without profile
+		return cmykToRGBA(cmyk), nil
+	}
+	profile := jpegICCProfile(header.buffer.Bytes())
+	if profile == nil {
+		return img, nil
+	}
+	transform, err := parseICCProfile(profile)
+	if err != nil || transform == nil {
+		if err != nil {
+			adatypes.Central.Log.Debugf("ICC profile ignored: %v", err)
+		}
+		return img, nil
+	}
+	return withProfile(img, transform), nil
+}
+
+// cmykToRGBA convert CMYK pixel into RGBA
+func cmykToRGBA(src *image.CMYK) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		s := src.Pix[src.PixOffset(b.Min.X, b.Min.Y+y):]
+		d := dst.Pix[y*dst.Stride:]
+		for x := 0; x < b.Dx(); x++ {
+			w := 255 - uint32(s[x*4+3])
+			d[x*4] = uint8((255 - uint32(s[x*4])) * w / 255)
+			d[x*4+1] = uint8((255 - uint32(s[x*4+1])) * w / 255)
+			d[x*4+2] = uint8((255 - uint32(s[x*4+2])) * w / 255)
+			d[x*4+3] = 0xff
+		}
+	}
+	return dst
+}
+
+// jpegICCProfile collect the ICC profile out of the APP2 segments of the
+// JPEG header. The profile may be split into several numbered chunks.
+func jpegICCProfile(header []byte) []byte {
+	chunks := make(map[byte][]byte)
+	count := byte(0)
+	pos := 2
+	for pos+4 <= len(header) && header[pos] == 0xff {
+		marker := header[pos+1]
+		if marker == 0xda || marker == 0xd9 {
+			// start of scan, no more header segments
+			break
+		}
+		length := int(binary.BigEndian.Uint16(header[pos+2:]))
+		if length < 2 || pos+2+length > len(header) {
+			break
+		}
+		segment := header[pos+4 : pos+2+length]
+		if marker == 0xe2 && len(segment) > len(iccMarker)+2 && bytes.Equal(segment[:len(iccMarker)], iccMarker) {
+			sequence := segment[len(iccMarker)]
+			count = segment[len(iccMarker)+1]
+			chunks[sequence] = segment[len(iccMarker)+2:]
+		}
+		pos += 2 + length
+	}
+	if count == 0 || len(chunks) != int(count) {
+		return nil
+	}
+	var profile []byte
+	for i := byte(1); i <= count; i++ {
+		chunk, ok := chunks[i]
+		if !ok {
+			return nil
+		}
+		profile = append(profile, chunk...)
+	}
+	return profile
+}
+
+// iccTransform conversion of a RGB matrix/TRC profile into sRGB
+type iccTransform struct {
+	linear [3][256]float64
+	matrix [9]float64
+}
+
+// parseICCProfile parse the RGB colorants and tone curves of the profile.
+// No transform is returned for sRGB or non RGB profiles.
+func parseICCProfile(profile []byte) (*iccTransform, error) {
+	if len(profile) < 132 {
+		return nil, fmt.Errorf("ICC profile too short")
+	}
+	if string(profile[16:20]) != "RGB " || string(profile[20:24]) != "XYZ " {
+		return nil, nil
+	}
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < count; i++ {
+		entry := 132 + i*12
+		if entry+12 > len(profile) {
+			return nil, fmt.Errorf("ICC tag table corrupted")
+		}
+		offset := int(binary.BigEndian.Uint32(profile[entry+4:]))
+		size := int(binary.BigEndian.Uint32(profile[entry+8:]))
+		if offset < 0 || size < 0 || offset+size > len(profile) {
+			return nil, fmt.Errorf("ICC tag offset out of range")
+		}
+		tags[string(profile[entry:entry+4])] = profile[offset : offset+size]
+	}
+	transform := &iccTransform{}
+	var colorants [9]float64
+	for c, name := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		tag := tags[name]
+		if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+			return nil, fmt.Errorf("ICC profile without matrix tag %s", name)
+		}
+		for i := 0; i < 3; i++ {
+			colorants[i*3+c] = s15Fixed16(tag[8+i*4:])
+		}
+	}
+	if sameColorants(colorants, srgbColorants) {
+		return nil, nil
+	}
+	for c, name := range []string{"rTRC", "gTRC", "bTRC"} {
+		curve, err := parseToneCurve(tags[name])
+		if err != nil {
+			return nil, fmt.Errorf("ICC tone curve %s: %v", name, err)
+		}
+		for v := 0; v < 256; v++ {
+			transform.linear[c][v] = curve(float64(v) / 255)
+		}
+	}
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			sum := 0.0
+			for k := 0; k < 3; k++ {
+				sum += xyzToSRGB[row*3+k] * colorants[k*3+col]
+			}
+			transform.matrix[row*3+col] = sum
+		}
+	}
+	return transform, nil
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func sameColorants(a, b [9]float64) bool {
+	for i := range a {
+		if math.Abs(a[i]-b[i]) > 0.002 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseToneCurve parse curv or para tone curve, the returned function
+// converts the encoded value into linear light
+func parseToneCurve(tag []byte) (func(float64) float64, error) {
+	if len(tag) < 12 {
+		return nil, fmt.Errorf("missing")
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		switch {
+		case n == 0:
+			return func(v float64) float64 { return v }, nil
+		case n == 1 && len(tag) >= 14:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(v float64) float64 { return math.Pow(v, gamma) }, nil
+		case len(tag) >= 12+2*n:
+			table := make([]float64, n)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+			}
+			return func(v float64) float64 {
+				p := v * float64(n-1)
+				i := int(p)
+				if i >= n-1 {
+					return table[n-1]
+				}
+				return table[i] + (table[i+1]-table[i])*(p-float64(i))
+			}, nil
+		}
+	case "para":
+		functionType := int(binary.BigEndian.Uint16(tag[8:]))
+		nrParameter := []int{1, 3, 4, 5, 7}
+		if functionType >= len(nrParameter) || len(tag) < 12+4*nrParameter[functionType] {
+			return nil, fmt.Errorf("unsupported parametric curve %d", functionType)
+		}
+		p := make([]float64, 7)
+		for i := 0; i < nrParameter[functionType]; i++ {
+			p[i] = s15Fixed16(tag[12+4*i:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		return func(v float64) float64 {
+			switch functionType {
+			case 0:
+				return math.Pow(v, g)
+			case 1:
+				if v >= -b/a {
+					return math.Pow(a*v+b, g)
+				}
+				return 0
+			case 2:
+				if v >= -b/a {
+					return math.Pow(a*v+b, g) + c
+				}
+				return c
+			case 3:
+				if v >= d {
+					return math.Pow(a*v+b, g)
+				}
+				return c * v
+			default:
+				if v >= d {
+					return math.Pow(a*v+b, g) + e
+				}
+				return c*v + f
+			}
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported curve type %s", string(tag[:4]))
+}
+
+// srgbEncoding 12 bit linear light to 8 bit sRGB table
+var srgbEncoding = func() [4096]uint8 {
+	var table [4096]uint8
+	for i := range table {
+		v := float64(i) / 4095
+		if v <= 0.0031308 {
+			v *= 12.92
+		} else {
+			v = 1.055*math.Pow(v, 1/2.4) - 0.055
+		}
+		table[i] = uint8(math.Round(v * 255))
+	}
+	return table
+}()
+
+func encodeSRGB(v float64) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 1:
+		return 255
+	}
+	return srgbEncoding[int(v*4095+0.5)]
+}
+
+// apply convert the image into sRGB
+func (transform *iccTransform) apply(src image.Image) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+	m := &transform.matrix
+	for i := 0; i+3 < len(dst.Pix); i += 4 {
+		r := transform.linear[0][dst.Pix[i]]
+		g := transform.linear[1][dst.Pix[i+1]]
+		bl := transform.linear[2][dst.Pix[i+2]]
+		dst.Pix[i] = encodeSRGB(m[0]*r + m[1]*g + m[2]*bl)
+		dst.Pix[i+1] = encodeSRGB(m[3]*r + m[4]*g + m[5]*bl)
+		dst.Pix[i+2] = encodeSRGB(m[6]*r + m[7]*g + m[8]*bl)
+	}
+	return dst
+}
@@ -0,0 +1,222 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"testing"
+)
+
+// testSegment JPEG header segment with marker and content
+func testSegment(marker byte, content []byte) []byte {
+	segment := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(content)+2))
+	return append(segment, content...)
+}
+
+// testICCChunk APP2 segment with the ICC profile chunk
+func testICCChunk(sequence, count byte, chunk string) []byte {
+	content := append(append([]byte{}, iccMarker...), sequence, count)
+	return testSegment(0xe2, append(content, chunk...))
+}
+
+func TestJPEGICCProfile(t *testing.T) {
+	soi := []byte{0xff, 0xd8}
+	exif := testSegment(0xe1, []byte("Exif\x00\x00data"))
+	sos := testSegment(0xda, []byte{1, 2, 3})
+	tests := []struct {
+		name     string
+		segments [][]byte
+		profile  string
+	}{
+		{"single chunk", [][]byte{exif, testICCChunk(1, 1, "profile"), sos}, "profile"},
+		{"chunks out of order", [][]byte{testICCChunk(2, 2, "second"), exif,
+			testICCChunk(1, 2, "first"), sos}, "firstsecond"},
+		{"missing chunk", [][]byte{testICCChunk(1, 3, "first"), testICCChunk(3, 3, "third"), sos}, ""},
+		{"no profile", [][]byte{exif, sos}, ""},
+		{"other APP2", [][]byte{testSegment(0xe2, []byte("MPF\x00data")), sos}, ""},
+		{"after start of scan", [][]byte{sos, testICCChunk(1, 1, "profile")}, ""},
+		{"truncated segment", [][]byte{testICCChunk(1, 1, "profile")[:12]}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := bytes.Join(append([][]byte{soi}, test.segments...), nil)
+			profile := jpegICCProfile(header)
+			if string(profile) != test.profile {
+				t.Errorf("profile %q, want %q", profile, test.profile)
+			}
+		})
+	}
+}
+
+// testCurve curv tone curve tag with the table entries
+func testCurve(entries ...uint16) []byte {
+	tag := make([]byte, 12+2*len(entries))
+	copy(tag, "curv")
+	binary.BigEndian.PutUint32(tag[8:], uint32(len(entries)))
+	for i, e := range entries {
+		binary.BigEndian.PutUint16(tag[12+2*i:], e)
+	}
+	return tag
+}
+
+// testParametricCurve para tone curve tag with the parameters
+func testParametricCurve(functionType uint16, parameters ...float64) []byte {
+	tag := make([]byte, 12+4*len(parameters))
+	copy(tag, "para")
+	binary.BigEndian.PutUint16(tag[8:], functionType)
+	for i, p := range parameters {
+		binary.BigEndian.PutUint32(tag[12+4*i:], uint32(int32(math.Round(p*65536))))
+	}
+	return tag
+}
+
+func TestParseToneCurve(t *testing.T) {
+	srgb := func(v float64) float64 {
+		if v <= 0.04045 {
+			return v / 12.92
+		}
+		return math.Pow((v+0.055)/1.055, 2.4)
+	}
+	tests := []struct {
+		name  string
+		tag   []byte
+		curve func(float64) float64
+	}{
+		{"identity", testCurve(), func(v float64) float64 { return v }},
+		{"gamma", testCurve(0x0233), func(v float64) float64 { return math.Pow(v, 563.0/256) }},
+		{"table", testCurve(0, 0x4000, 0xffff), func(v float64) float64 {
+			if v <= 0.5 {
+				return v * 0x4000 / 0xffff * 2
+			}
+			return (0x4000 + (v-0.5)*2*(0xffff-0x4000)) / 0xffff
+		}},
+		{"parametric gamma", testParametricCurve(0, 1.8), func(v float64) float64 { return math.Pow(v, 1.8) }},
+		{"parametric sRGB", testParametricCurve(3, 2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045), srgb},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			curve, err := parseToneCurve(test.tag)
+			if err != nil {
+				t.Fatalf("parse tone curve: %v", err)
+			}
+			for _, v := range []float64{0, 0.02, 0.25, 0.5, 0.75, 1} {
+				if got, want := curve(v), test.curve(v); math.Abs(got-want) > 0.001 {
+					t.Errorf("curve(%v) = %v, want %v", v, got, want)
+				}
+			}
+		})
+	}
+	for name, tag := range map[string][]byte{"missing": nil, "short table": testCurve(0, 1, 2)[:14],
+		"unsupported parametric": testParametricCurve(5, 1), "unknown type": []byte("mft2\x00\x00\x00\x00\x00\x00\x00\x00")} {
+		if _, err := parseToneCurve(tag); err == nil {
+			t.Errorf("%s tone curve parsed without error", name)
+		}
+	}
+}
+
+// testMatrixProfile RGB matrix/TRC ICC profile with the D50 colorants and
+// a gamma tone curve
+func testMatrixProfile(colorants [9]float64, gamma uint16) []byte {
+	tags := map[string][]byte{"rTRC": testCurve(gamma), "gTRC": testCurve(gamma), "bTRC": testCurve(gamma)}
+	for c, name := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		tag := make([]byte, 20)
+		copy(tag, "XYZ ")
+		for i := 0; i < 3; i++ {
+			binary.BigEndian.PutUint32(tag[8+i*4:], uint32(int32(math.Round(colorants[i*3+c]*65536))))
+		}
+		tags[name] = tag
+	}
+	names := []string{"rXYZ", "gXYZ", "bXYZ", "rTRC", "gTRC", "bTRC"}
+	profile := make([]byte, 132+12*len(names))
+	copy(profile[16:], "RGB XYZ ")
+	binary.BigEndian.PutUint32(profile[128:], uint32(len(names)))
+	for i, name := range names {
+		entry := profile[132+i*12:]
+		copy(entry, name)
+		binary.BigEndian.PutUint32(entry[4:], uint32(len(profile)))
+		binary.BigEndian.PutUint32(entry[8:], uint32(len(tags[name])))
+		profile = append(profile, tags[name]...)
+	}
+	return profile
+}
+
+func TestDecodeJPEGProfile(t *testing.T) {
+	// D50 adapted colorants of Adobe RGB (1998)
+	adobeRGB := [9]float64{0.6097, 0.2053, 0.1492, 0.3111, 0.6257, 0.0632, 0.0195, 0.0609, 0.7446}
+	src := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	for i := 0; i < len(src.Pix); i += 4 {
+		src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3] = 40, 180, 60, 255
+	}
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, src, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+	withICC := func(profile []byte) []byte {
+		return bytes.Join([][]byte{plain[:2], testICCChunk(1, 1, string(profile)), plain[2:]}, nil)
+	}
+
+	img, err := decodeJPEG(bytes.NewReader(withICC(testMatrixProfile(srgbColorants, 0x0233))))
+	if err != nil {
+		t.Fatalf("decode sRGB profile: %v", err)
+	}
+	if _, ok := img.(*profiledImage); ok {
+		t.Error("sRGB profile returned with transform")
+	}
+
+	img, err = decodeJPEG(bytes.NewReader(withICC(testMatrixProfile(adobeRGB, 0x0233))))
+	if err != nil {
+		t.Fatalf("decode Adobe RGB profile: %v", err)
+	}
+	p, ok := img.(*profiledImage)
+	if !ok {
+		t.Fatalf("Adobe RGB profile returned without transform: %T", img)
+	}
+	if _, ok = p.Image.(*image.YCbCr); !ok {
+		t.Errorf("decoded picture converted before scaling: %T", p.Image)
+	}
+	reduced := reduceImage(img, 100)
+	if _, ok = reduced.(*profiledImage); !ok {
+		t.Errorf("reduced image lost the transform: %T", reduced)
+	}
+	thumbnail, w, h, err := resizePicture(reduced, 100)
+	if err != nil {
+		t.Fatalf("resize: %v", err)
+	}
+	if w != 100 || h != 75 {
+		t.Errorf("thumbnail %dx%d, want 100x75", w, h)
+	}
+	converted, err := jpeg.Decode(bytes.NewReader(thumbnail))
+	if err != nil {
+		t.Fatalf("decode thumbnail: %v", err)
+	}
+	r, _, _, _ := converted.At(50, 37).RGBA()
+	// Adobe RGB green is more saturated than sRGB green, the red channel
+	// of the sRGB pixel is clipped
+	if r>>8 > 20 {
+		t.Errorf("thumbnail pixel %v not converted into sRGB", color.RGBAModel.Convert(converted.At(50, 37)))
+	}
+}
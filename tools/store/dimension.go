@@ -0,0 +1,90 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bytes"
+	"image"
+)
+
+// exifDimensions displayed dimensions out of the EXIF X/Y dimensions,
+// orientations 5 to 8 swap width and height
+func (md *PictureMetadata) exifDimensions() (uint32, uint32) {
+	if md.ExifOrientation >= 5 && md.ExifOrientation <= 8 {
+		return md.ExifYdimension, md.ExifXdimension
+	}
+	return md.ExifXdimension, md.ExifYdimension
+}
+
+// SetDimensions set the displayed original and the thumbnail dimensions
+// and the fill. Missing original dimensions and the dimensions of RAW
+// previews are replaced by the EXIF X/Y dimensions.
+func (md *PictureMetadata) SetDimensions(format *MediaFormat, width, height, thumbnailWidth, thumbnailHeight uint32) {
+	exifWidth, exifHeight := md.exifDimensions()
+	if exifWidth > 0 && exifHeight > 0 && (width == 0 || height == 0 || (format != nil && format.Raw)) {
+		width, height = exifWidth, exifHeight
+	}
+	md.Width = width
+	md.Height = height
+	md.ThumbnailWidth = thumbnailWidth
+	md.ThumbnailHeight = thumbnailHeight
+	switch {
+	case format == nil || !format.Image():
+		md.Fill = "0"
+	case width > 0 && height > 0:
+		md.Fill = FillType(width, height)
+	default:
+		md.Fill = FillType(thumbnailWidth, thumbnailHeight)
+	}
+}
+
+// MediaDimensions displayed original dimensions of the picture data. The
+// image configuration is read if the format supports it, otherwise the
+// complete media is decoded.
+func MediaDimensions(format *MediaFormat, repository PictureRepository, data *PictureData, orientation byte) (uint32, uint32, error) {
+	var width, height int
+	config, _, err := image.DecodeConfig(MediaReader(repository, data))
+	if err == nil && !format.Raw && !format.Oriented {
+		width, height = config.Width, config.Height
+	} else {
+		img, derr := format.Decode(MediaReader(repository, data))
+		if derr != nil {
+			return 0, 0, derr
+		}
+		b := img.Bounds()
+		width, height = b.Dx(), b.Dy()
+	}
+	if !format.Oriented && orientation >= 5 && orientation <= 8 {
+		width, height = height, width
+	}
+	return uint32(width), uint32(height), nil
+}
+
+// ThumbnailDimensions width and height of the thumbnail (DT)
+func ThumbnailDimensions(data *PictureData) (uint32, uint32) {
+	if len(data.Thumbnail) == 0 {
+		return 0, 0
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data.Thumbnail))
+	if err != nil {
+		return 0, 0
+	}
+	return uint32(config.Width), uint32(config.Height)
+}
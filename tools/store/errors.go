@@ -0,0 +1,127 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"strconv"
+)
+
+var (
+	// ErrTooBig media file is bigger than the maximum binary blob size and
+	// segmentation is disabled
+	ErrTooBig = errors.New("file too big")
+	// ErrNotFound record, segment or rendition not found
+	ErrNotFound = errors.New("not found")
+	// ErrDuplicate more than one record found where only one is expected
+	ErrDuplicate = errors.New("duplicate record")
+	// ErrCollision media has the MD5 checksum (CP) of a stored media with a
+	// different SHA-256 checksum
+	ErrCollision = errors.New("checksum collision")
+	// ErrCorrupt media file failed the integrity validation
+	ErrCorrupt = errors.New("corrupt media")
+	// ErrBackend repository backend failed, the error is a BackendError
+	ErrBackend = errors.New("backend error")
+	// ErrTransactionLost the transaction was backed out or the session was
+	// lost, the uncommitted changes are lost and the unit of work has to be
+	// repeated. The error is a backend error too.
+	ErrTransactionLost = errors.New("transaction lost")
+)
+
+// responseCodePattern Adabas response code of the message code (hex) or
+// in the error message text (decimal)
+var responseCodePattern = regexp.MustCompile(`ADAGE([0-9A-F]{2})|(?i)response(?: code)?[ =:]+([0-9]+)`)
+
+// BackendError error of the repository backend with the Adabas response
+// code, zero if the response code is not known
+type BackendError struct {
+	Op       string
+	Response int
+	Err      error
+}
+
+func (e *BackendError) Error() string {
+	if e.Response > 0 {
+		return fmt.Sprintf("%s: %v (response %d)", e.Op, e.Err, e.Response)
+	}
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+// Unwrap the original backend error
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// Is all backend errors match ErrBackend
+func (e *BackendError) Is(target error) bool {
+	return target == ErrBackend
+}
+
+// backendError wrap the repository error into a BackendError. Errors of the
+// store package itself and nil are returned unchanged.
+func backendError(op string, err error) error {
+	if err == nil || errors.Is(err, ErrBackend) || errors.Is(err, ErrNotFound) ||
+		errors.Is(err, ErrDuplicate) || errors.Is(err, ErrCollision) {
+		return err
+	}
+	response := 0
+	if m := responseCodePattern.FindStringSubmatch(err.Error()); m != nil {
+		var code int64
+		if m[1] != "" {
+			code, _ = strconv.ParseInt(m[1], 16, 32)
+		} else {
+			code, _ = strconv.ParseInt(m[2], 10, 32)
+		}
+		response = int(code)
+	}
+	return &BackendError{Op: op, Response: response, Err: err}
+}
+
+// errorClassOther class of all errors not known by the store package, the
+// message is not used as class to keep the number of classes small
+const errorClassOther = "other"
+
+// ErrorClass short classification of the error used as key of the error
+// statistics. The number of classes is bounded, the error message is kept
+// in the failures of the run report only.
+func ErrorClass(err error) string {
+	var be *BackendError
+	var pe *fs.PathError
+	switch {
+	case errors.As(err, &be):
+		return fmt.Sprintf("%v response %d", ErrBackend, be.Response)
+	case errors.Is(err, ErrTooBig):
+		return ErrTooBig.Error()
+	case errors.Is(err, ErrNotFound):
+		return ErrNotFound.Error()
+	case errors.Is(err, ErrDuplicate):
+		return ErrDuplicate.Error()
+	case errors.Is(err, ErrCollision):
+		return ErrCollision.Error()
+	case errors.Is(err, ErrCorrupt):
+		return ErrCorrupt.Error()
+	case errors.As(err, &pe):
+		return "file " + pe.Op
+	}
+	return errorClassOther
+}
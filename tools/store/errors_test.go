@@ -0,0 +1,51 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestErrorClass(t *testing.T) {
+	_, pathErr := os.Open("/nonexistent/picture.jpg")
+	tests := []struct {
+		name  string
+		err   error
+		class string
+	}{
+		{"backend", backendError("store", errors.New("ADAGE09 transaction backed out")), "backend error response 9"},
+		{"backend without response", backendError("store", errors.New("connection refused")), "backend error response 0"},
+		{"wrapped corrupt", fmt.Errorf("picture a.jpg: %w", ErrCorrupt), "corrupt media"},
+		{"collision", fmt.Errorf("CP=AA: %w", ErrCollision), "checksum collision"},
+		{"file", pathErr, "file open"},
+		{"unknown message", errors.New("media empty for a.jpg"), "other"},
+		{"other unknown message", errors.New("media empty for b.jpg"), "other"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if class := ErrorClass(test.err); class != test.class {
+				t.Errorf("ErrorClass(%v) = %q, want %q", test.err, class, test.class)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// FileState state of a loaded file. Size, modification time and inode
+// identify the file content, checksum (CP) and ISN the record it is
+// stored in. Files found loaded before they were recorded have no
+// checksum and ISN.
+type FileState struct {
+	Size     int64
+	ModTime  int64
+	Inode    uint64 `json:",omitempty"`
+	Checksum string `json:",omitempty"`
+	Isn      uint64 `json:",omitempty"`
+}
+
+// fileStateEntry line of the file state store. The store is a sequence
+// of JSON lines, the last entry of a path wins.
+type fileStateEntry struct {
+	Database string `json:",omitempty"`
+	Path     string `json:",omitempty"`
+	Removed  bool   `json:",omitempty"`
+	*FileState
+}
+
+// FileStateStore local store of the file states of all loaded files keyed
+// by path. Unchanged files are skipped without reading them or searching
+// the database. The store belongs to one database, the states of another
+// database are discarded.
+type FileStateStore struct {
+	lock     sync.Mutex
+	fileName string
+	file     *os.File
+	writer   *bufio.Writer
+	encoder  *json.Encoder
+	database string
+	states   map[string]*FileState
+}
+
+// OpenFileState open the file state store of the database. The states
+// of the previous runs are read and the store is compacted.
+func OpenFileState(fileName, database string) (*FileStateStore, error) {
+	fs := &FileStateStore{fileName: fileName, database: database,
+		states: make(map[string]*FileState)}
+	err := fs.read()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	tmpName := fileName + ".tmp"
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return nil, err
+	}
+	fs.file = file
+	fs.writer = bufio.NewWriter(file)
+	fs.encoder = json.NewEncoder(fs.writer)
+	fs.write(&fileStateEntry{Database: database})
+	for path, state := range fs.states {
+		fs.write(&fileStateEntry{Path: path, FileState: state})
+	}
+	err = fs.writer.Flush()
+	if err == nil {
+		err = os.Rename(tmpName, fileName)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+// read read the file states of the previous runs
+func (fs *FileStateStore) read() error {
+	file, err := os.Open(fs.fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for {
+		entry := &fileStateEntry{}
+		err = decoder.Decode(entry)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("file state %s corrupt: %v", fs.fileName, err)
+		}
+		switch {
+		case entry.Database != "":
+			if entry.Database != fs.database {
+				fmt.Printf("File state %s of database %s discarded, loading into %s\n",
+					fs.fileName, entry.Database, fs.database)
+				fs.states = make(map[string]*FileState)
+				return nil
+			}
+		case entry.Removed:
+			delete(fs.states, entry.Path)
+		case entry.Path != "" && entry.FileState != nil:
+			fs.states[entry.Path] = entry.FileState
+		}
+	}
+	return nil
+}
+
+func (fs *FileStateStore) write(entry *fileStateEntry) {
+	err := fs.encoder.Encode(entry)
+	if err != nil {
+		fmt.Println("Error writing file state:", err)
+	}
+}
+
+// Lookup state recorded for the path. Unchanged is set if size,
+// modification time and inode of the file info match the state.
+func (fs *FileStateStore) Lookup(path string, info os.FileInfo) (state *FileState, unchanged bool) {
+	if fs == nil || info == nil {
+		return nil, false
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	state = fs.states[path]
+	if state == nil {
+		return nil, false
+	}
+	return state, state.Size == info.Size() && state.ModTime == info.ModTime().UnixNano() &&
+		state.Inode == fileInode(info)
+}
+
+// Record record the state of the path with the file info taken before
+// the file was read, the checksum (CP) and ISN of the stored record
+func (fs *FileStateStore) Record(path string, info os.FileInfo, checksum string, isn uint64) {
+	if fs == nil || info == nil {
+		return
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	state := &FileState{Size: info.Size(), ModTime: info.ModTime().UnixNano(),
+		Inode: fileInode(info), Checksum: checksum, Isn: isn}
+	fs.states[path] = state
+	fs.write(&fileStateEntry{Path: path, FileState: state})
+}
+
+// Remove remove the state of the path
+func (fs *FileStateStore) Remove(path string) {
+	if fs == nil {
+		return
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if _, ok := fs.states[path]; !ok {
+		return
+	}
+	delete(fs.states, path)
+	fs.write(&fileStateEntry{Path: path, Removed: true})
+}
+
+// Flush write all buffered states to the file state store
+func (fs *FileStateStore) Flush() error {
+	if fs == nil {
+		return nil
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	err := fs.writer.Flush()
+	if err != nil {
+		return err
+	}
+	return fs.file.Sync()
+}
+
+// Close flush and close the file state store
+func (fs *FileStateStore) Close() error {
+	if fs == nil {
+		return nil
+	}
+	err := fs.Flush()
+	cerr := fs.file.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
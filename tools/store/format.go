@@ -0,0 +1,219 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"golang.org/x/image/webp"
+)
+
+// MediaFormat registered media format
+type MediaFormat struct {
+	// Name short name of the format
+	Name string
+	// MIMEType stored in the metadata (TY)
+	MIMEType string
+	// Suffixes lower case file name suffixes without dot
+	Suffixes []string
+	// Magic check if the file header belongs to the format
+	Magic func(header []byte) bool
+	// Decode image decoder, nil if no thumbnail can be generated
+	Decode func(r io.Reader) (image.Image, error)
+	// Metadata extract EXIF or other metadata into the picture metadata
+	Metadata func(pic *PictureBinary) error
+	// Poster still image of the media file used as thumbnail of videos
+	Poster func(fileName string) (image.Image, error)
+	// Validate check the structural integrity of the media file
+	Validate func(r io.ReaderAt, size int64) error
+	// Raw camera RAW format, paired with a JPEG of the same base name
+	Raw bool
+	// Oriented decoder already applies the rotation of the container, the
+	// EXIF orientation is informational only
+	Oriented bool
+}
+
+// headerSize number of bytes needed to check all magic bytes
+const headerSize = 32
+
+var formats []*MediaFormat
+
+func init() {
+	exifMetadata := func(pic *PictureBinary) error { return pic.ExtractExif() }
+	RegisterFormat(&MediaFormat{Name: "jpeg", MIMEType: "image/jpeg", Suffixes: []string{"jpg", "jpeg"},
+		Magic:  prefixMagic([]byte{0xff, 0xd8, 0xff}),
+		Decode: decodeJPEG, Metadata: exifMetadata, Validate: validateJPEG})
+	RegisterFormat(&MediaFormat{Name: "gif", MIMEType: "image/gif", Suffixes: []string{"gif"},
+		Magic: func(header []byte) bool {
+			return bytes.HasPrefix(header, []byte("GIF87a")) || bytes.HasPrefix(header, []byte("GIF89a"))
+		},
+		Decode: gif.Decode, Validate: validateGIF})
+	RegisterFormat(&MediaFormat{Name: "png", MIMEType: "image/png", Suffixes: []string{"png"},
+		Magic:  prefixMagic([]byte("\x89PNG\r\n\x1a\n")),
+		Decode: png.Decode, Validate: validatePNG})
+	RegisterFormat(&MediaFormat{Name: "webp", MIMEType: "image/webp", Suffixes: []string{"webp"},
+		Magic: func(header []byte) bool {
+			return len(header) >= 12 && bytes.Equal(header[0:4], []byte("RIFF")) &&
+				bytes.Equal(header[8:12], []byte("WEBP"))
+		},
+		Decode: webp.Decode, Validate: validateWebp})
+	RegisterFormat(&MediaFormat{Name: "tiff", MIMEType: "image/tiff", Suffixes: []string{"tif", "tiff"},
+		Magic: tiffMagic, Decode: tiff.Decode, Metadata: exifMetadata, Validate: validateTIFF})
+	RegisterFormat(&MediaFormat{Name: "bmp", MIMEType: "image/bmp", Suffixes: []string{"bmp"},
+		Magic:  prefixMagic([]byte("BM")),
+		Decode: bmp.Decode, Validate: validateBMP})
+	RegisterFormat(&MediaFormat{Name: "cr2", MIMEType: "image/x-canon-cr2", Suffixes: []string{"cr2"},
+		Magic: cr2Magic, Decode: decodeRawPreview, Metadata: exifMetadata, Raw: true,
+		Validate: validateTIFF})
+	RegisterFormat(&MediaFormat{Name: "dng", MIMEType: "image/x-adobe-dng", Suffixes: []string{"dng"},
+		Magic: tiffMagic, Decode: decodeRawPreview, Metadata: exifMetadata, Raw: true,
+		Validate: validateTIFF})
+	RegisterFormat(&MediaFormat{Name: "nef", MIMEType: "image/x-nikon-nef", Suffixes: []string{"nef"},
+		Magic: tiffMagic, Decode: decodeRawPreview, Metadata: exifMetadata, Raw: true,
+		Validate: validateTIFF})
+	RegisterFormat(&MediaFormat{Name: "arw", MIMEType: "image/x-sony-arw", Suffixes: []string{"arw"},
+		Magic: tiffMagic, Decode: decodeRawPreview, Metadata: exifMetadata, Raw: true,
+		Validate: validateTIFF})
+	RegisterFormat(&MediaFormat{Name: "heic", MIMEType: "image/heic", Suffixes: []string{"heic"},
+		Magic: heicMagic, Decode: decodeHeif, Metadata: extractHeifMetadata, Oriented: true,
+		Validate: boxValidator("ftyp", "meta")})
+	RegisterFormat(&MediaFormat{Name: "heif", MIMEType: "image/heif", Suffixes: []string{"heif", "hif"},
+		Magic: heifMagic, Decode: decodeHeif, Metadata: extractHeifMetadata, Oriented: true,
+		Validate: boxValidator("ftyp", "meta")})
+	RegisterFormat(&MediaFormat{Name: "mov", MIMEType: "video/quicktime", Suffixes: []string{"mov", "qt"},
+		Magic: quicktimeMagic, Metadata: extractMovieMetadata, Poster: moviePoster,
+		Validate: boxValidator("moov")})
+	RegisterFormat(&MediaFormat{Name: "mp4", MIMEType: "video/mp4", Suffixes: []string{"mp4", "m4v"},
+		Magic: func(header []byte) bool {
+			return len(header) >= 8 && bytes.Equal(header[4:8], []byte("ftyp"))
+		},
+		Metadata: extractMovieMetadata, Poster: moviePoster, Validate: boxValidator("ftyp", "moov")})
+}
+
+// quicktimeMagic QuickTime brand or old QuickTime files starting without
+// file type box
+func quicktimeMagic(header []byte) bool {
+	if ftypBrand(header) == "qt  " {
+		return true
+	}
+	if len(header) < 8 {
+		return false
+	}
+	switch string(header[4:8]) {
+	case "moov", "mdat", "wide", "pnot":
+		return true
+	}
+	return false
+}
+
+func tiffMagic(header []byte) bool {
+	return bytes.HasPrefix(header, []byte("II*\x00")) || bytes.HasPrefix(header, []byte("MM\x00*"))
+}
+
+func prefixMagic(magic []byte) func(header []byte) bool {
+	return func(header []byte) bool {
+		return bytes.HasPrefix(header, magic)
+	}
+}
+
+// RegisterFormat register new media format. Formats registered later are
+// checked after the formats registered before.
+func RegisterFormat(format *MediaFormat) {
+	formats = append(formats, format)
+}
+
+// Image true if thumbnails can be generated for the format
+func (format *MediaFormat) Image() bool {
+	return format.Decode != nil
+}
+
+// FormatBySuffix search format using the file name suffix
+func FormatBySuffix(fileName string) *MediaFormat {
+	suffix := strings.ToLower(strings.TrimPrefix(filepath.Ext(fileName), "."))
+	for _, f := range formats {
+		for _, s := range f.Suffixes {
+			if s == suffix {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+// FormatByMIMEType search format using the stored MIME type (TY)
+func FormatByMIMEType(mimeType string) *MediaFormat {
+	for _, f := range formats {
+		if f.MIMEType == mimeType {
+			return f
+		}
+	}
+	return nil
+}
+
+// FormatByContent search format using the magic bytes of the file header
+func FormatByContent(header []byte) *MediaFormat {
+	for _, f := range formats {
+		if f.Magic != nil && f.Magic(header) {
+			return f
+		}
+	}
+	return nil
+}
+
+// DetectFormat detect format of the file, see DetectContentFormat
+func DetectFormat(fileName string) (*MediaFormat, bool, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, false, err
+	}
+	format, mismatch := DetectContentFormat(header[:n], fileName)
+	return format, mismatch, nil
+}
+
+// DetectContentFormat detect format of the media header. The magic bytes are
+// preferred, the suffix of the file name is used if the content is not known
+// or the suffix format matches the magic bytes too. The second return value
+// is true if the suffix does not match the content.
+func DetectContentFormat(header []byte, fileName string) (*MediaFormat, bool) {
+	suffixFormat := FormatBySuffix(fileName)
+	if suffixFormat != nil && suffixFormat.Magic != nil && suffixFormat.Magic(header) {
+		// more specific formats like RAW share the TIFF magic bytes
+		return suffixFormat, false
+	}
+	if format := FormatByContent(header); format != nil {
+		return format, suffixFormat != nil && suffixFormat.MIMEType != format.MIMEType
+	}
+	return suffixFormat, false
+}
@@ -0,0 +1,71 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import "testing"
+
+func TestDetectContentFormat(t *testing.T) {
+	jpegHeader := []byte{0xff, 0xd8, 0xff, 0xe1, 0x00, 0x10}
+	pngHeader := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	tiffHeader := []byte("II*\x00\x08\x00\x00\x00")
+	cr2Header := []byte("II*\x00\x10\x00\x00\x00CR\x02\x00")
+	heicHeader := []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00")
+	movHeader := []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00")
+	mp4Header := []byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00")
+	tests := []struct {
+		name     string
+		header   []byte
+		fileName string
+		format   string
+		mismatch bool
+	}{
+		{"jpeg", jpegHeader, "a.jpg", "jpeg", false},
+		{"jpeg upper case suffix", jpegHeader, "a.JPEG", "jpeg", false},
+		{"png", pngHeader, "a.png", "png", false},
+		{"png named jpeg", pngHeader, "a.jpg", "png", true},
+		{"jpeg without suffix", jpegHeader, "a", "jpeg", false},
+		{"unknown suffix", jpegHeader, "a.dat", "jpeg", false},
+		{"tiff", tiffHeader, "a.tif", "tiff", false},
+		{"dng shares tiff magic", tiffHeader, "a.dng", "dng", false},
+		{"nef shares tiff magic", tiffHeader, "a.NEF", "nef", false},
+		{"cr2", cr2Header, "a.cr2", "cr2", false},
+		{"cr2 named tiff", cr2Header, "a.tif", "tiff", false},
+		{"heic", heicHeader, "a.heic", "heic", false},
+		{"heic named jpeg", heicHeader, "a.jpg", "heic", true},
+		{"mov", movHeader, "a.mov", "mov", false},
+		{"mp4", mp4Header, "a.mp4", "mp4", false},
+		{"unknown content", []byte("plain text"), "a.gif", "gif", false},
+		{"empty header", nil, "a.bmp", "bmp", false},
+		{"unknown", []byte("plain text"), "a.txt", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			format, mismatch := DetectContentFormat(test.header, test.fileName)
+			name := ""
+			if format != nil {
+				name = format.Name
+			}
+			if name != test.format || mismatch != test.mismatch {
+				t.Errorf("DetectContentFormat(%s) = %q mismatch=%v, want %q mismatch=%v",
+					test.fileName, name, mismatch, test.format, test.mismatch)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+// geoCellPrecision number of geohash characters of the geo cell descriptor,
+// five characters are cells of about 5 x 5 km
+const geoCellPrecision = 5
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// GeoCell coarse geo cell (geohash) of the location, used as descriptor (GC)
+func GeoCell(lat, long float64) string {
+	latRange := [2]float64{-90, 90}
+	longRange := [2]float64{-180, 180}
+	cell := make([]byte, 0, geoCellPrecision)
+	even := true
+	bit := 0
+	index := 0
+	for len(cell) < geoCellPrecision {
+		var r *[2]float64
+		v := lat
+		if even {
+			r = &longRange
+			v = long
+		} else {
+			r = &latRange
+		}
+		mid := (r[0] + r[1]) / 2
+		index <<= 1
+		if v >= mid {
+			index |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+		bit++
+		if bit == 5 {
+			cell = append(cell, geohashAlphabet[index])
+			bit = 0
+			index = 0
+		}
+	}
+	return string(cell)
+}
+
+// SetLocation set GPS location and geo cell of the metadata. The zero
+// location is used by cameras without GPS fix and is ignored.
+func (md *PictureMetadata) SetLocation(lat, long, alt float64) {
+	if lat == 0 && long == 0 {
+		return
+	}
+	md.ExifLatitude = lat
+	md.ExifLongitude = long
+	md.ExifAltitude = alt
+	md.GeoCell = GeoCell(lat, long)
+}
+
+// Geotagged true if the metadata contain a GPS location
+func (md *PictureMetadata) Geotagged() bool {
+	return md.GeoCell != ""
+}
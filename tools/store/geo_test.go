@@ -0,0 +1,89 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import "testing"
+
+func TestGeoCell(t *testing.T) {
+	tests := []struct {
+		name string
+		lat  float64
+		long float64
+		cell string
+	}{
+		{"wikipedia example", 57.64911, 10.40744, "u4pru"},
+		{"equator meridian", 0, 0, "s0000"},
+		{"south west corner", -90, -180, "00000"},
+		{"north east corner", 90, 180, "zzzzz"},
+		{"southern hemisphere", -33.8568, 151.2153, "r3gx2"},
+		{"western hemisphere", 40.6892, -74.0445, "dr5r7"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if cell := GeoCell(test.lat, test.long); cell != test.cell {
+				t.Errorf("GeoCell(%v, %v) = %s, want %s", test.lat, test.long, cell, test.cell)
+			}
+		})
+	}
+}
+
+func TestSetLocation(t *testing.T) {
+	md := &PictureMetadata{}
+	md.SetLocation(0, 0, 100)
+	if md.Geotagged() {
+		t.Errorf("zero location is geotagged: %s", md.GeoCell)
+	}
+	md.SetLocation(57.64911, 10.40744, 12)
+	if !md.Geotagged() || md.GeoCell != "u4pru" || md.ExifAltitude != 12 {
+		t.Errorf("location not set: %#v", md)
+	}
+}
+
+func TestMemoryRepositoryReadGeoCell(t *testing.T) {
+	mr := NewMemoryRepository()
+	for _, location := range []struct {
+		name      string
+		lat, long float64
+	}{{"a.jpg", 57.64911, 10.40744}, {"b.jpg", 57.6, 10.4}, {"c.jpg", 0, 0}, {"d.jpg", -33.8568, 151.2153}} {
+		isn := storeTestRecord(t, mr, createMd5([]byte(location.name)), location.name, nil)
+		md := &mr.content.Records[isn].Metadata
+		md.SetLocation(location.lat, location.long, 0)
+	}
+	tests := []struct {
+		prefix string
+		count  int
+	}{{"u4pru", 1}, {"u4p", 2}, {"r", 1}, {"s", 0}, {"", 3}}
+	for _, test := range tests {
+		cursor, err := mr.ReadGeoCell(test.prefix)
+		if err != nil {
+			t.Fatalf("Error reading geo cell %s: %v", test.prefix, err)
+		}
+		n := 0
+		for cursor.HasNextRecord() {
+			if _, err = cursor.NextData(); err != nil {
+				t.Fatalf("Error reading cursor: %v", err)
+			}
+			n++
+		}
+		if n != test.count {
+			t.Errorf("ReadGeoCell(%q) = %d records, want %d", test.prefix, n, test.count)
+		}
+	}
+}
@@ -0,0 +1,552 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/tknie/adabas-go-api/adatypes"
+)
+
+// HeifConverter external command converting HEVC coded HEIF images into
+// JPEG, called with input and output file name. Empty disables conversion.
+var HeifConverter = "heif-convert"
+
+// heifItem item of the HEIF meta box
+type heifItem struct {
+	id           uint32
+	itemType     string
+	construction uint16
+	baseOffset   uint64
+	extents      [][2]uint64
+	width        uint32
+	height       uint32
+	thumbnails   []uint32
+	exif         []uint32
+}
+
+// heifFile parsed ISOBMFF structure of a HEIF/HEIC file
+type heifFile struct {
+	data    []byte
+	idat    []byte
+	primary uint32
+	items   map[uint32]*heifItem
+}
+
+// heicBrands major brands of HEVC coded HEIF files
+var heicBrands = map[string]bool{"heic": true, "heix": true, "heim": true, "heis": true,
+	"hevc": true, "hevx": true}
+
+// heifBrands major brands of generic HEIF files
+var heifBrands = map[string]bool{"mif1": true, "msf1": true}
+
+// ftypBrand major brand of the ISOBMFF file type box
+func ftypBrand(header []byte) string {
+	if len(header) < 12 || string(header[4:8]) != "ftyp" {
+		return ""
+	}
+	return string(header[8:12])
+}
+
+func heicMagic(header []byte) bool {
+	return heicBrands[ftypBrand(header)]
+}
+
+func heifMagic(header []byte) bool {
+	return heifBrands[ftypBrand(header)]
+}
+
+// isoBox box of the ISOBMFF container
+type isoBox struct {
+	boxType string
+	data    []byte
+}
+
+// readBoxes split data into boxes
+func readBoxes(data []byte) ([]*isoBox, error) {
+	boxes := make([]*isoBox, 0)
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("box header truncated")
+		}
+		size := uint64(binary.BigEndian.Uint32(data[0:4]))
+		boxType := string(data[4:8])
+		headerSize := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, fmt.Errorf("box %s large size truncated", boxType)
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			headerSize = 16
+		}
+		if size < headerSize || size > uint64(len(data)) {
+			return nil, fmt.Errorf("box %s size %d invalid", boxType, size)
+		}
+		boxes = append(boxes, &isoBox{boxType: boxType, data: data[headerSize:size]})
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+// boxReader big endian reader of the box content
+type boxReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (br *boxReader) uint(size int) uint64 {
+	if br.err != nil {
+		return 0
+	}
+	if br.pos+size > len(br.data) {
+		br.err = fmt.Errorf("box content truncated")
+		return 0
+	}
+	v := uint64(0)
+	for i := 0; i < size; i++ {
+		v = v<<8 | uint64(br.data[br.pos+i])
+	}
+	br.pos += size
+	return v
+}
+
+func (br *boxReader) u8() uint8   { return uint8(br.uint(1)) }
+func (br *boxReader) u16() uint16 { return uint16(br.uint(2)) }
+func (br *boxReader) u32() uint32 { return uint32(br.uint(4)) }
+
+func (br *boxReader) fourCC() string {
+	if br.err != nil || br.pos+4 > len(br.data) {
+		br.err = fmt.Errorf("box content truncated")
+		return ""
+	}
+	s := string(br.data[br.pos : br.pos+4])
+	br.pos += 4
+	return s
+}
+
+// fullBox version and flags of a full box
+func (br *boxReader) fullBox() (uint8, uint32) {
+	v := br.u32()
+	return uint8(v >> 24), v & 0xffffff
+}
+
+// parseHeif parse the meta box of the HEIF file
+func parseHeif(data []byte) (*heifFile, error) {
+	boxes, err := readBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+	hf := &heifFile{data: data, items: make(map[uint32]*heifItem)}
+	for _, b := range boxes {
+		if b.boxType == "meta" {
+			if len(b.data) < 4 {
+				return nil, fmt.Errorf("meta box truncated")
+			}
+			err = hf.parseMeta(b.data[4:])
+			if err != nil {
+				return nil, err
+			}
+			return hf, nil
+		}
+	}
+	return nil, fmt.Errorf("no HEIF meta box found")
+}
+
+func (hf *heifFile) item(id uint32) *heifItem {
+	item, ok := hf.items[id]
+	if !ok {
+		item = &heifItem{id: id}
+		hf.items[id] = item
+	}
+	return item
+}
+
+func (hf *heifFile) parseMeta(data []byte) error {
+	boxes, err := readBoxes(data)
+	if err != nil {
+		return err
+	}
+	for _, b := range boxes {
+		br := &boxReader{data: b.data}
+		switch b.boxType {
+		case "pitm":
+			version, _ := br.fullBox()
+			if version == 0 {
+				hf.primary = uint32(br.u16())
+			} else {
+				hf.primary = br.u32()
+			}
+		case "iinf":
+			err = hf.parseItemInfo(br)
+		case "iloc":
+			hf.parseItemLocation(br)
+		case "iref":
+			err = hf.parseItemReference(br)
+		case "iprp":
+			err = hf.parseItemProperties(b.data)
+		case "idat":
+			hf.idat = b.data
+		}
+		if err != nil {
+			return err
+		}
+		if br.err != nil {
+			return fmt.Errorf("%s: %v", b.boxType, br.err)
+		}
+	}
+	return nil
+}
+
+func (hf *heifFile) parseItemInfo(br *boxReader) error {
+	version, _ := br.fullBox()
+	if version == 0 {
+		br.u16()
+	} else {
+		br.u32()
+	}
+	if br.err != nil {
+		return br.err
+	}
+	boxes, err := readBoxes(br.data[br.pos:])
+	if err != nil {
+		return err
+	}
+	for _, b := range boxes {
+		if b.boxType != "infe" {
+			continue
+		}
+		ir := &boxReader{data: b.data}
+		version, _ := ir.fullBox()
+		if version < 2 {
+			// old item info entries without item type
+			continue
+		}
+		var id uint32
+		if version == 2 {
+			id = uint32(ir.u16())
+		} else {
+			id = ir.u32()
+		}
+		ir.u16()
+		itemType := ir.fourCC()
+		if ir.err != nil {
+			return ir.err
+		}
+		hf.item(id).itemType = itemType
+	}
+	return nil
+}
+
+func (hf *heifFile) parseItemLocation(br *boxReader) {
+	version, _ := br.fullBox()
+	sizes := br.u16()
+	offsetSize := int(sizes >> 12)
+	lengthSize := int(sizes >> 8 & 0xf)
+	baseOffsetSize := int(sizes >> 4 & 0xf)
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0xf)
+	}
+	var count uint32
+	if version < 2 {
+		count = uint32(br.u16())
+	} else {
+		count = br.u32()
+	}
+	for i := uint32(0); i < count && br.err == nil; i++ {
+		var id uint32
+		if version < 2 {
+			id = uint32(br.u16())
+		} else {
+			id = br.u32()
+		}
+		item := hf.item(id)
+		if version == 1 || version == 2 {
+			item.construction = br.u16() & 0xf
+		}
+		br.u16()
+		item.baseOffset = br.uint(baseOffsetSize)
+		extentCount := br.u16()
+		for e := uint16(0); e < extentCount && br.err == nil; e++ {
+			br.uint(indexSize)
+			offset := br.uint(offsetSize)
+			length := br.uint(lengthSize)
+			item.extents = append(item.extents, [2]uint64{offset, length})
+		}
+	}
+}
+
+func (hf *heifFile) parseItemReference(br *boxReader) error {
+	version, _ := br.fullBox()
+	if br.err != nil {
+		return br.err
+	}
+	boxes, err := readBoxes(br.data[br.pos:])
+	if err != nil {
+		return err
+	}
+	idSize := 2
+	if version != 0 {
+		idSize = 4
+	}
+	for _, b := range boxes {
+		rr := &boxReader{data: b.data}
+		from := uint32(rr.uint(idSize))
+		count := rr.u16()
+		for i := uint16(0); i < count && rr.err == nil; i++ {
+			to := uint32(rr.uint(idSize))
+			switch b.boxType {
+			case "thmb":
+				hf.item(to).thumbnails = append(hf.item(to).thumbnails, from)
+			case "cdsc":
+				hf.item(to).exif = append(hf.item(to).exif, from)
+			}
+		}
+		if rr.err != nil {
+			return rr.err
+		}
+	}
+	return nil
+}
+
+func (hf *heifFile) parseItemProperties(data []byte) error {
+	boxes, err := readBoxes(data)
+	if err != nil {
+		return err
+	}
+	var properties []*isoBox
+	for _, b := range boxes {
+		switch b.boxType {
+		case "ipco":
+			properties, err = readBoxes(b.data)
+			if err != nil {
+				return err
+			}
+		case "ipma":
+			br := &boxReader{data: b.data}
+			version, flags := br.fullBox()
+			count := br.u32()
+			for i := uint32(0); i < count && br.err == nil; i++ {
+				var id uint32
+				if version < 1 {
+					id = uint32(br.u16())
+				} else {
+					id = br.u32()
+				}
+				associations := br.u8()
+				for a := uint8(0); a < associations && br.err == nil; a++ {
+					var index int
+					if flags&1 != 0 {
+						index = int(br.u16() & 0x7fff)
+					} else {
+						index = int(br.u8() & 0x7f)
+					}
+					if index > 0 && index <= len(properties) && properties[index-1].boxType == "ispe" {
+						pr := &boxReader{data: properties[index-1].data}
+						pr.fullBox()
+						item := hf.item(id)
+						item.width = pr.u32()
+						item.height = pr.u32()
+					}
+				}
+			}
+			if br.err != nil {
+				return br.err
+			}
+		}
+	}
+	return nil
+}
+
+// itemData content of the item collected out of all extents
+func (hf *heifFile) itemData(item *heifItem) ([]byte, error) {
+	source := hf.data
+	switch item.construction {
+	case 0:
+	case 1:
+		source = hf.idat
+	default:
+		return nil, fmt.Errorf("item %d construction method %d not supported", item.id, item.construction)
+	}
+	size := uint64(len(source))
+	var buffer bytes.Buffer
+	for _, e := range item.extents {
+		offset := item.baseOffset + e[0]
+		if offset < item.baseOffset || offset > size {
+			return nil, fmt.Errorf("item %d extent outside of file", item.id)
+		}
+		length := e[1]
+		if length == 0 {
+			// extent reaching to the end of the data
+			length = size - offset
+		}
+		if offset+length < offset || offset+length > size {
+			return nil, fmt.Errorf("item %d extent outside of file", item.id)
+		}
+		buffer.Write(source[offset : offset+length])
+	}
+	return buffer.Bytes(), nil
+}
+
+// exifData raw TIFF content of the EXIF item describing the primary image
+func (hf *heifFile) exifData() ([]byte, error) {
+	primary := hf.items[hf.primary]
+	var candidates []uint32
+	if primary != nil {
+		candidates = primary.exif
+	}
+	for id, item := range hf.items {
+		if item.itemType == "Exif" {
+			candidates = append(candidates, id)
+		}
+	}
+	for _, id := range candidates {
+		item := hf.items[id]
+		if item == nil || item.itemType != "Exif" {
+			continue
+		}
+		data, err := hf.itemData(item)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < 4 {
+			return nil, fmt.Errorf("EXIF item truncated")
+		}
+		// EXIF item starts with offset to the TIFF header
+		offset := 4 + uint64(binary.BigEndian.Uint32(data[0:4]))
+		if offset > uint64(len(data)) {
+			return nil, fmt.Errorf("EXIF item header offset invalid")
+		}
+		return data[offset:], nil
+	}
+	return nil, fmt.Errorf("no EXIF item found")
+}
+
+// jpegPreview JPEG coded primary image or thumbnail if available
+func (hf *heifFile) jpegPreview() []byte {
+	primary := hf.items[hf.primary]
+	if primary == nil {
+		return nil
+	}
+	list := append([]uint32{primary.id}, primary.thumbnails...)
+	for _, id := range list {
+		item := hf.items[id]
+		if item != nil && item.itemType == "jpeg" {
+			data, err := hf.itemData(item)
+			if err == nil {
+				return data
+			}
+		}
+	}
+	return nil
+}
+
+// extractHeifMetadata extract EXIF data out of the HEIF container and
+// take the image dimensions out of the primary item properties
+func extractHeifMetadata(pic *PictureBinary) error {
+	media, err := pic.mediaSource()
+	if err != nil {
+		return err
+	}
+	defer media.Close()
+	data, err := io.ReadAll(media)
+	if err != nil {
+		return err
+	}
+	hf, err := parseHeif(data)
+	if err != nil {
+		return err
+	}
+	if primary, ok := hf.items[hf.primary]; ok {
+		pic.MetaData.ExifXdimension = primary.width
+		pic.MetaData.ExifYdimension = primary.height
+	}
+	tiffData, err := hf.exifData()
+	if err != nil {
+		adatypes.Central.Log.Debugf("HEIF EXIF error %v", err)
+		return err
+	}
+	x, err := exif.Decode(bytes.NewReader(tiffData))
+	if err != nil {
+		return err
+	}
+	pic.applyExif(x)
+	return nil
+}
+
+// decodeHeif decode JPEG coded preview of the HEIF file. HEVC coded images
+// are converted using the external HeifConverter.
+func decodeHeif(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	hf, err := parseHeif(data)
+	if err != nil {
+		return nil, err
+	}
+	if preview := hf.jpegPreview(); preview != nil {
+		return jpeg.Decode(bytes.NewReader(preview))
+	}
+	return convertHeif(data)
+}
+
+func convertHeif(data []byte) (image.Image, error) {
+	if HeifConverter == "" {
+		return nil, fmt.Errorf("no HEIF converter configured")
+	}
+	path, err := exec.LookPath(HeifConverter)
+	if err != nil {
+		return nil, fmt.Errorf("HEIF converter not available: %v", err)
+	}
+	dir, err := os.MkdirTemp("", "heif")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	input := dir + string(os.PathSeparator) + "input.heic"
+	output := dir + string(os.PathSeparator) + "output.jpg"
+	err = os.WriteFile(input, data, 0600)
+	if err != nil {
+		return nil, err
+	}
+	out, err := exec.Command(path, input, output).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("HEIF converter error %v: %s", err, out)
+	}
+	f, err := os.Open(output)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return jpeg.Decode(f)
+}
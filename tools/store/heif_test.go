@@ -0,0 +1,397 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// testFullBox ISOBMFF full box with version and flags
+func testFullBox(boxType string, version int, flags uint32, content ...[]byte) []byte {
+	header := testUint(4, uint64(version)<<24|uint64(flags))
+	return testBox(boxType, append([][]byte{header}, content...)...)
+}
+
+// testItemInfo item info entry of version 2 or 3
+func testItemInfo(version int, id uint32, itemType string) []byte {
+	size := 2
+	if version > 2 {
+		size = 4
+	}
+	return testFullBox("infe", version, 0, testUint(size, uint64(id)), testUint(2, 0),
+		[]byte(itemType), []byte{0})
+}
+
+// testItemInfoList item info box of version 0 containing the entries
+func testItemInfoList(entries ...[]byte) []byte {
+	return testFullBox("iinf", 0, 0, append([][]byte{testUint(2, uint64(len(entries)))}, entries...)...)
+}
+
+// testLocation item location entry
+type testLocation struct {
+	id           uint32
+	construction uint16
+	baseOffset   uint64
+	extents      [][2]uint64
+}
+
+// testItemLocation item location box with 4 byte offsets, lengths and
+// base offsets
+func testItemLocation(version int, locations ...testLocation) []byte {
+	idSize := 2
+	if version == 2 {
+		idSize = 4
+	}
+	content := [][]byte{testUint(2, 0x4440), testUint(idSize, uint64(len(locations)))}
+	for _, l := range locations {
+		content = append(content, testUint(idSize, uint64(l.id)))
+		if version > 0 {
+			content = append(content, testUint(2, uint64(l.construction)))
+		}
+		content = append(content, testUint(2, 0), testUint(4, l.baseOffset),
+			testUint(2, uint64(len(l.extents))))
+		for _, e := range l.extents {
+			content = append(content, testUint(4, e[0]), testUint(4, e[1]))
+		}
+	}
+	return testFullBox("iloc", version, 0, content...)
+}
+
+// testReference single item reference of the item reference box
+func testReference(refType string, idSize int, from uint32, to ...uint32) []byte {
+	content := [][]byte{testUint(idSize, uint64(from)), testUint(2, uint64(len(to)))}
+	for _, id := range to {
+		content = append(content, testUint(idSize, uint64(id)))
+	}
+	return testBox(refType, content...)
+}
+
+// testProperties item property box with the image spatial extents
+// associated to the items
+func testProperties(version int, flags uint32, sizes map[uint32][2]uint32) []byte {
+	properties := [][]byte{testFullBox("pixi", 0, 0, []byte{0})}
+	associations := [][]byte{testUint(4, uint64(len(sizes)))}
+	for _, id := range sortedItems(sizes) {
+		properties = append(properties, testFullBox("ispe", 0, 0,
+			testUint(4, uint64(sizes[id][0])), testUint(4, uint64(sizes[id][1]))))
+		idSize, indexSize := 2, 1
+		if version > 0 {
+			idSize = 4
+		}
+		if flags&1 != 0 {
+			indexSize = 2
+		}
+		// each item is associated to the pixi and its own ispe property
+		associations = append(associations, testUint(idSize, uint64(id)), []byte{2},
+			testUint(indexSize, 1), testUint(indexSize, uint64(len(properties))|1<<(8*indexSize-1)))
+	}
+	return testBox("iprp", testBox("ipco", properties...),
+		testFullBox("ipma", version, flags, associations...))
+}
+
+func sortedItems(sizes map[uint32][2]uint32) []uint32 {
+	ids := make([]uint32, 0, len(sizes))
+	for id := range sizes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// testHeif HEIF file with the given meta box content followed by the
+// media data box
+func testHeif(meta []byte, media []byte) []byte {
+	return bytes.Join([][]byte{testBox("ftyp", []byte("heic"), testUint(4, 0), []byte("mif1heic")),
+		meta, testBox("mdat", media)}, nil)
+}
+
+// testExifItem EXIF item content with the TIFF header offset
+func testExifItem(tiff []byte) []byte {
+	return append(append(testUint(4, 6), "Exif\x00\x00"...), tiff...)
+}
+
+// testTIFF EXIF TIFF data out of the APP1 segment of the test picture
+func testTIFF(t *testing.T) []byte {
+	data, err := os.ReadFile("../testimg/IMG_1098.jpg")
+	if err != nil {
+		t.Fatalf("Error reading test picture: %v", err)
+	}
+	index := bytes.Index(data, []byte("Exif\x00\x00"))
+	if index < 4 {
+		t.Fatal("Test picture without EXIF")
+	}
+	end := index - 2 + int(binary.BigEndian.Uint16(data[index-2:index]))
+	return data[index+6 : end]
+}
+
+func TestParseHeif(t *testing.T) {
+	tests := []struct {
+		name    string
+		meta    []byte
+		primary uint32
+		items   map[uint32]*heifItem
+	}{
+		{"version 0", testFullBox("meta", 0, 0,
+			testFullBox("pitm", 0, 0, testUint(2, 1)),
+			testItemInfoList(testItemInfo(2, 1, "hvc1"), testItemInfo(2, 2, "jpeg"),
+				testItemInfo(2, 3, "Exif")),
+			testItemLocation(0,
+				testLocation{id: 1, baseOffset: 100, extents: [][2]uint64{{0, 10}, {20, 5}}},
+				testLocation{id: 3, extents: [][2]uint64{{200, 0}}}),
+			testFullBox("iref", 0, 0, testReference("thmb", 2, 2, 1),
+				testReference("cdsc", 2, 3, 1), testReference("dimg", 2, 1, 2)),
+			testProperties(0, 0, map[uint32][2]uint32{1: {4032, 3024}, 2: {320, 240}})),
+			1, map[uint32]*heifItem{
+				1: {id: 1, itemType: "hvc1", baseOffset: 100, extents: [][2]uint64{{0, 10}, {20, 5}},
+					width: 4032, height: 3024, thumbnails: []uint32{2}, exif: []uint32{3}},
+				2: {id: 2, itemType: "jpeg", width: 320, height: 240},
+				3: {id: 3, itemType: "Exif", extents: [][2]uint64{{200, 0}}},
+			}},
+		{"large item ids", testFullBox("meta", 0, 0,
+			testFullBox("pitm", 1, 0, testUint(4, 70000)),
+			testItemInfoList(testItemInfo(3, 70000, "jpeg"), testItemInfo(3, 70001, "Exif"),
+				testItemInfo(1, 70002, "")),
+			testItemLocation(2,
+				testLocation{id: 70000, extents: [][2]uint64{{10, 20}}},
+				testLocation{id: 70001, construction: 1, extents: [][2]uint64{{0, 8}}}),
+			testFullBox("iref", 1, 0, testReference("cdsc", 4, 70001, 70000)),
+			testProperties(1, 1, map[uint32][2]uint32{70000: {1920, 1080}})),
+			70000, map[uint32]*heifItem{
+				70000: {id: 70000, itemType: "jpeg", extents: [][2]uint64{{10, 20}},
+					width: 1920, height: 1080, exif: []uint32{70001}},
+				70001: {id: 70001, itemType: "Exif", construction: 1, extents: [][2]uint64{{0, 8}}},
+			}},
+	}
+	for _, test := range tests {
+		hf, err := parseHeif(testHeif(test.meta, nil))
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if hf.primary != test.primary {
+			t.Errorf("%s: primary %d, expected %d", test.name, hf.primary, test.primary)
+		}
+		if !reflect.DeepEqual(hf.items, test.items) {
+			for id, item := range hf.items {
+				t.Logf("%s: item %d %+v", test.name, id, *item)
+			}
+			t.Errorf("%s: items not parsed as expected", test.name)
+		}
+	}
+}
+
+func TestParseHeifInvalid(t *testing.T) {
+	meta := func(content ...[]byte) []byte {
+		return testHeif(testFullBox("meta", 0, 0, content...), nil)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"no meta box", testHeif(nil, []byte("media"))},
+		{"box header truncated", []byte{0, 0, 0}},
+		{"box size too large", testUint(4, 100)},
+		{"box size too small", append(testUint(4, 4), "meta"...)},
+		{"large size truncated", append(testUint(4, 1), "meta"...)},
+		{"meta truncated", testBox("meta", []byte{0, 0})},
+		{"garbage in meta", testBox("meta", testUint(4, 0), []byte("garbage"))},
+		{"pitm truncated", meta(testFullBox("pitm", 1, 0, testUint(2, 1)))},
+		{"iinf truncated", meta(testBox("iinf", []byte{0}))},
+		{"infe truncated", meta(testItemInfoList(testFullBox("infe", 2, 0, testUint(2, 1))))},
+		{"iloc count too large", meta(testBox("iloc", testUint(4, 0), testUint(2, 0x4400),
+			testUint(2, 2), testUint(2, 1), testUint(2, 0), testUint(2, 1), testUint(4, 0), testUint(4, 1)))},
+		{"iloc extent truncated", meta(testBox("iloc", testUint(4, 0), testUint(2, 0x4400),
+			testUint(2, 1), testUint(2, 1), testUint(2, 0), testUint(2, 1), testUint(4, 0)))},
+		{"iref truncated", meta(testFullBox("iref", 0, 0,
+			testBox("thmb", testUint(2, 2), testUint(2, 3), testUint(2, 1))))},
+		{"ipma truncated", meta(testBox("iprp", testBox("ipco"),
+			testFullBox("ipma", 0, 0, testUint(4, 1), testUint(2, 1), []byte{2, 1})))},
+		{"ipco garbage", meta(testBox("iprp", testBox("ipco", []byte("garbage"))))},
+	}
+	for _, test := range tests {
+		_, err := parseHeif(test.data)
+		if err == nil {
+			t.Errorf("%s: error expected", test.name)
+		}
+	}
+}
+
+func TestHeifItemData(t *testing.T) {
+	data := []byte("0123456789")
+	idat := []byte("abcdef")
+	tests := []struct {
+		name     string
+		item     heifItem
+		expected string
+		fail     bool
+	}{
+		{"single extent", heifItem{extents: [][2]uint64{{2, 3}}}, "234", false},
+		{"base offset and extents", heifItem{baseOffset: 1, extents: [][2]uint64{{0, 2}, {5, 3}}}, "12678", false},
+		{"extent to end", heifItem{extents: [][2]uint64{{7, 0}}}, "789", false},
+		{"empty extent at end", heifItem{extents: [][2]uint64{{10, 0}}}, "", false},
+		{"item data box", heifItem{construction: 1, extents: [][2]uint64{{1, 2}, {4, 0}}}, "bcef", false},
+		{"extent outside", heifItem{extents: [][2]uint64{{8, 5}}}, "", true},
+		{"offset past end to end", heifItem{extents: [][2]uint64{{1 << 20, 0}}}, "", true},
+		{"base offset past end", heifItem{baseOffset: 11, extents: [][2]uint64{{0, 0}}}, "", true},
+		{"offset overflow", heifItem{baseOffset: math.MaxUint64, extents: [][2]uint64{{2, 1}}}, "", true},
+		{"length overflow", heifItem{extents: [][2]uint64{{1, math.MaxUint64}}}, "", true},
+		{"construction not supported", heifItem{construction: 2, extents: [][2]uint64{{0, 1}}}, "", true},
+	}
+	hf := &heifFile{data: data, idat: idat}
+	for _, test := range tests {
+		item := test.item
+		content, err := hf.itemData(&item)
+		switch {
+		case test.fail:
+			if err == nil {
+				t.Errorf("%s: error expected, got %q", test.name, content)
+			}
+		case err != nil:
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		case string(content) != test.expected:
+			t.Errorf("%s: content %q, expected %q", test.name, content, test.expected)
+		}
+	}
+}
+
+// TestHeifCorruptPreview corrupt extent of the JPEG preview must not stop
+// the load with a panic
+func TestHeifCorruptPreview(t *testing.T) {
+	data := testHeif(testFullBox("meta", 0, 0,
+		testFullBox("pitm", 0, 0, testUint(2, 1)),
+		testItemInfoList(testItemInfo(2, 1, "jpeg")),
+		testItemLocation(0, testLocation{id: 1, extents: [][2]uint64{{1 << 20, 0}}})), nil)
+	hf, err := parseHeif(data)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if preview := hf.jpegPreview(); preview != nil {
+		t.Errorf("Corrupt preview returned %d bytes", len(preview))
+	}
+	defer func(converter string) { HeifConverter = converter }(HeifConverter)
+	HeifConverter = ""
+	_, err = decodeHeif(bytes.NewReader(data))
+	if err == nil {
+		t.Error("Error expected decoding corrupt HEIF")
+	}
+}
+
+func TestHeifExifData(t *testing.T) {
+	tiff := []byte("II*\x00tiff")
+	// location of the media data content is after the ftyp and meta box
+	heif := func(locations ...testLocation) []byte {
+		meta := func(offset uint64) []byte {
+			l := make([]testLocation, len(locations))
+			for i, location := range locations {
+				l[i] = location
+				if location.construction == 0 {
+					l[i].baseOffset = offset
+				}
+			}
+			return testFullBox("meta", 0, 0,
+				testFullBox("pitm", 0, 0, testUint(2, 1)),
+				testItemInfoList(testItemInfo(2, 1, "hvc1"), testItemInfo(2, 2, "Exif")),
+				testItemLocation(1, l...),
+				testFullBox("iref", 0, 0, testReference("cdsc", 2, 2, 1)),
+				testBox("idat", testExifItem(tiff)))
+		}
+		data := testHeif(meta(0), testExifItem(tiff))
+		offset := uint64(len(data) - len(testExifItem(tiff)))
+		return testHeif(meta(offset), testExifItem(tiff))
+	}
+	tests := []struct {
+		name     string
+		data     []byte
+		expected []byte
+	}{
+		{"media data", heif(testLocation{id: 2, extents: [][2]uint64{{0, 0}}}), tiff},
+		{"item data", heif(testLocation{id: 2, construction: 1, extents: [][2]uint64{{0, 0}}}), tiff},
+		{"split extents", heif(testLocation{id: 2, extents: [][2]uint64{{0, 8}, {8, 0}}}), tiff},
+		{"header offset invalid", heif(testLocation{id: 2, extents: [][2]uint64{{4, 0}}}), nil},
+		{"item truncated", heif(testLocation{id: 2, extents: [][2]uint64{{0, 3}}}), nil},
+		{"extent outside", heif(testLocation{id: 2, extents: [][2]uint64{{1 << 20, 0}}}), nil},
+		{"no EXIF item", testHeif(testFullBox("meta", 0, 0,
+			testFullBox("pitm", 0, 0, testUint(2, 1)),
+			testItemInfoList(testItemInfo(2, 1, "hvc1"))), nil), nil},
+	}
+	for _, test := range tests {
+		hf, err := parseHeif(test.data)
+		if err != nil {
+			t.Errorf("%s: unexpected parse error %v", test.name, err)
+			continue
+		}
+		content, err := hf.exifData()
+		switch {
+		case test.expected == nil:
+			if err == nil {
+				t.Errorf("%s: error expected, got %q", test.name, content)
+			}
+		case err != nil:
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		case !bytes.Equal(content, test.expected):
+			t.Errorf("%s: EXIF %q, expected %q", test.name, content, test.expected)
+		}
+	}
+}
+
+func TestExtractHeifMetadata(t *testing.T) {
+	tiff := testTIFF(t)
+	x, err := exif.Decode(bytes.NewReader(tiff))
+	if err != nil {
+		t.Fatalf("Error decoding test EXIF: %v", err)
+	}
+	model, err := x.Get(exif.Model)
+	if err != nil {
+		t.Fatalf("Test EXIF without model: %v", err)
+	}
+	expected, _ := model.StringVal()
+	data := testHeif(testFullBox("meta", 0, 0,
+		testFullBox("pitm", 0, 0, testUint(2, 1)),
+		testItemInfoList(testItemInfo(2, 1, "hvc1"), testItemInfo(2, 2, "Exif")),
+		testItemLocation(1, testLocation{id: 2, construction: 1, extents: [][2]uint64{{0, 0}}}),
+		testFullBox("iref", 0, 0, testReference("cdsc", 2, 2, 1)),
+		testProperties(0, 0, map[uint32][2]uint32{1: {4032, 3024}}),
+		testBox("idat", testExifItem(tiff))), nil)
+	fileName := filepath.Join(t.TempDir(), "test.heic")
+	err = os.WriteFile(fileName, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pic := &PictureBinary{FileName: fileName, MetaData: &PictureMetadata{}}
+	err = extractHeifMetadata(pic)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if pic.MetaData.ExifModel != expected {
+		t.Errorf("Model %q, expected %q", pic.MetaData.ExifModel, expected)
+	}
+	if pic.MetaData.ExifXdimension == 0 || pic.MetaData.ExifYdimension == 0 {
+		t.Errorf("Dimension not set: %dx%d", pic.MetaData.ExifXdimension, pic.MetaData.ExifYdimension)
+	}
+}
@@ -0,0 +1,291 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// journalEntry line of the checkpoint journal. The journal is a sequence
+// of JSON lines, a truncated last line of an interrupted run is ignored.
+type journalEntry struct {
+	Directory string `json:",omitempty"`
+	Position  string `json:",omitempty"`
+	Done      string `json:",omitempty"`
+	Failed    string `json:",omitempty"`
+	Error     string `json:",omitempty"`
+}
+
+// journalPath path dispatched in walk order
+type journalPath struct {
+	path string
+	done bool
+}
+
+// Journal checkpoint journal of a directory load. It records the completed
+// and failed paths and the walk position, all paths up to the position in
+// walk order are completed. Resumed runs skip all completed paths.
+type Journal struct {
+	lock      sync.Mutex
+	fileName  string
+	file      *os.File
+	writer    *bufio.Writer
+	encoder   *json.Encoder
+	directory string
+	position  string
+	written   string
+	done      map[string]bool
+	failed    map[string]string
+	pending   []*journalPath
+	inflight  map[string]*journalPath
+}
+
+// OpenJournal open the checkpoint journal of the directory. If resume is
+// set the journal of the previous run is read and compacted, otherwise a
+// new journal is started.
+func OpenJournal(fileName, directory string, resume bool) (*Journal, error) {
+	j := &Journal{fileName: fileName, directory: directory, done: make(map[string]bool),
+		failed: make(map[string]string), inflight: make(map[string]*journalPath)}
+	if resume {
+		err := j.read()
+		if err != nil {
+			return nil, err
+		}
+	}
+	tmpName := fileName + ".tmp"
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return nil, err
+	}
+	j.file = file
+	j.writer = bufio.NewWriter(file)
+	j.encoder = json.NewEncoder(j.writer)
+	j.write(&journalEntry{Directory: directory})
+	if j.position != "" {
+		j.write(&journalEntry{Position: j.position})
+		j.written = j.position
+	}
+	for path := range j.done {
+		j.write(&journalEntry{Done: path})
+	}
+	for path, reason := range j.failed {
+		j.write(&journalEntry{Failed: path, Error: reason})
+	}
+	err = j.writer.Flush()
+	if err == nil {
+		err = os.Rename(tmpName, fileName)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// read read the journal of the previous run
+func (j *Journal) read() error {
+	file, err := os.Open(j.fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for {
+		entry := &journalEntry{}
+		err = decoder.Decode(entry)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("journal %s corrupt: %v", j.fileName, err)
+		}
+		switch {
+		case entry.Directory != "":
+			if entry.Directory != j.directory {
+				return fmt.Errorf("journal %s of directory %s, not %s", j.fileName, entry.Directory, j.directory)
+			}
+		case entry.Position != "":
+			j.position = entry.Position
+		case entry.Done != "":
+			j.done[entry.Done] = true
+			delete(j.failed, entry.Done)
+		case entry.Failed != "":
+			j.failed[entry.Failed] = entry.Error
+		}
+	}
+	for path := range j.done {
+		if comparePath(path, j.position) <= 0 {
+			delete(j.done, path)
+		}
+	}
+	return nil
+}
+
+func (j *Journal) write(entry *journalEntry) {
+	err := j.encoder.Encode(entry)
+	if err != nil {
+		fmt.Println("Error writing journal:", err)
+	}
+}
+
+// Position walk position of the previous run
+func (j *Journal) Position() string {
+	if j == nil {
+		return ""
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.position
+}
+
+// FailedPaths paths failed in the previous runs sorted in walk order
+func (j *Journal) FailedPaths() []string {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	paths := make([]string, 0, len(j.failed))
+	for path := range j.failed {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(a, b int) bool { return comparePath(paths[a], paths[b]) < 0 })
+	return paths
+}
+
+// SkipDir check if all paths of the directory are completed
+func (j *Journal) SkipDir(dir string) bool {
+	if j == nil {
+		return false
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.position != "" && comparePath(dir, j.position) < 0 &&
+		!strings.HasPrefix(j.position, dir+string(os.PathSeparator))
+}
+
+// Completed check if the path is completed or failed by a previous run
+func (j *Journal) Completed(path string) bool {
+	if j == nil {
+		return false
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.position != "" && comparePath(path, j.position) <= 0 {
+		return true
+	}
+	if j.done[path] {
+		return true
+	}
+	_, failed := j.failed[path]
+	return failed
+}
+
+// Dispatch record the path handed to the workers, paths must be
+// dispatched in walk order
+func (j *Journal) Dispatch(path string) {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	jp := &journalPath{path: path}
+	j.pending = append(j.pending, jp)
+	j.inflight[path] = jp
+}
+
+// Done record the path as completed, or as failed if an error is given.
+// The walk position moves behind all leading completed paths, paths not
+// dispatched, like retried failed paths, don't move it.
+func (j *Journal) Done(path string, err error) {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if err != nil {
+		j.failed[path] = err.Error()
+		j.write(&journalEntry{Failed: path, Error: err.Error()})
+	} else {
+		delete(j.failed, path)
+		j.write(&journalEntry{Done: path})
+	}
+	if jp, ok := j.inflight[path]; ok {
+		jp.done = true
+		delete(j.inflight, path)
+	}
+	for len(j.pending) > 0 && j.pending[0].done {
+		j.position = j.pending[0].path
+		j.pending[0] = nil
+		j.pending = j.pending[1:]
+	}
+}
+
+// Flush write the walk position and all buffered entries to the journal
+// file
+func (j *Journal) Flush() error {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.position != j.written {
+		j.write(&journalEntry{Position: j.position})
+		j.written = j.position
+	}
+	err := j.writer.Flush()
+	if err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Close flush and close the journal
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	err := j.Flush()
+	cerr := j.file.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// comparePath compare paths in the order of filepath.Walk, which visits
+// the directory before its entries and the entries in lexical order
+func comparePath(a, b string) int {
+	pa := strings.Split(a, string(os.PathSeparator))
+	pb := strings.Split(b, string(os.PathSeparator))
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		if c := strings.Compare(pa[i], pb[i]); c != 0 {
+			return c
+		}
+	}
+	return len(pa) - len(pb)
+}
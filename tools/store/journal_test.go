@@ -0,0 +1,182 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestComparePath(t *testing.T) {
+	p := filepath.FromSlash
+	tests := []struct {
+		a, b string
+		sign int
+	}{
+		{"a/b", "a/b", 0},
+		{"a", "a/b", -1},
+		{"a/b", "a-c", -1},
+		{"a/z", "b", -1},
+		{"a/b/c", "a/c", -1},
+		{"a/c", "a/b/c", 1},
+		{"b", "a/z/z", 1},
+	}
+	for _, test := range tests {
+		c := comparePath(p(test.a), p(test.b))
+		if (c < 0 && test.sign >= 0) || (c > 0 && test.sign <= 0) || (c == 0 && test.sign != 0) {
+			t.Errorf("comparePath(%s, %s) = %d, want sign %d", test.a, test.b, c, test.sign)
+		}
+	}
+}
+
+func TestComparePathWalkOrder(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a/b.jpg", "a-c/d.jpg", "a/x/e.jpg", "a.jpg", "b/f.jpg", "a/x-y.jpg"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	walked := make([]string, 0)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		walked = append(walked, path)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sorted := append([]string{}, walked...)
+	sort.Slice(sorted, func(a, b int) bool { return comparePath(sorted[a], sorted[b]) < 0 })
+	if strings.Join(sorted, "\n") != strings.Join(walked, "\n") {
+		t.Errorf("comparePath order\n%s\ndiffers from walk order\n%s", strings.Join(sorted, "\n"),
+			strings.Join(walked, "\n"))
+	}
+}
+
+func TestJournalDonePosition(t *testing.T) {
+	dir := t.TempDir()
+	j, err := OpenJournal(filepath.Join(dir, "load.journal"), "/pictures", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	for _, path := range []string{"/pictures/1", "/pictures/2", "/pictures/3"} {
+		j.Dispatch(path)
+	}
+	steps := []struct {
+		path     string
+		err      error
+		position string
+	}{
+		{"/pictures/2", nil, ""},
+		{"/pictures/old", nil, ""},
+		{"/pictures/1", nil, "/pictures/2"},
+		{"/pictures/3", errors.New("corrupt"), "/pictures/3"},
+	}
+	for _, step := range steps {
+		j.Done(step.path, step.err)
+		if position := j.Position(); position != step.position {
+			t.Errorf("after Done(%s) position %q, want %q", step.path, position, step.position)
+		}
+	}
+	if failed := j.FailedPaths(); len(failed) != 1 || failed[0] != "/pictures/3" {
+		t.Errorf("failed paths %v, want /pictures/3", failed)
+	}
+}
+
+func TestJournalResume(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "load.journal")
+	j, err := OpenJournal(fileName, "/pictures", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/pictures/a/1", "/pictures/a/2", "/pictures/b/1", "/pictures/b/2", "/pictures/c/1"} {
+		j.Dispatch(path)
+	}
+	j.Done("/pictures/a/1", nil)
+	j.Done("/pictures/a/2", errors.New("corrupt"))
+	j.Done("/pictures/b/2", nil)
+	j.Done("/pictures/b/1", errors.New("timeout"))
+	j.Done("/pictures/b/1", nil)
+	j.Done("/pictures/retried", errors.New("again"))
+	if err = j.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// truncated line of an interrupted run
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Done":"/pictures/c`)
+	f.Close()
+
+	if _, err = OpenJournal(fileName, "/other", true); err == nil {
+		t.Error("journal of another directory resumed")
+	}
+	j, err = OpenJournal(fileName, "/pictures", true)
+	if err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if position := j.Position(); position != "/pictures/b/2" {
+		t.Errorf("position %q, want /pictures/b/2", position)
+	}
+	for path, completed := range map[string]bool{"/pictures/a/1": true, "/pictures/b/1": true,
+		"/pictures/retried": true, "/pictures/c/1": false} {
+		if j.Completed(path) != completed {
+			t.Errorf("Completed(%s) = %v, want %v", path, !completed, completed)
+		}
+	}
+	if !j.SkipDir("/pictures/a") || j.SkipDir("/pictures/b") || j.SkipDir("/pictures/c") {
+		t.Errorf("SkipDir a=%v b=%v c=%v, want true false false", j.SkipDir("/pictures/a"),
+			j.SkipDir("/pictures/b"), j.SkipDir("/pictures/c"))
+	}
+	failed := j.FailedPaths()
+	if strings.Join(failed, ",") != "/pictures/a/2,/pictures/retried" {
+		t.Errorf("failed paths %v", failed)
+	}
+	if len(j.done) != 0 {
+		t.Errorf("done paths up to the position not compacted: %v", j.done)
+	}
+	if err = j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the compacted journal contains directory, position and failed paths
+	f, err = os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		lines++
+	}
+	if lines != 4 {
+		t.Errorf("compacted journal has %d lines, want 4", lines)
+	}
+}
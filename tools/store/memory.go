@@ -0,0 +1,635 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryRecord one picture record containing metadata and data fields
+type memoryRecord struct {
+	Metadata  PictureMetadata
+	Media     []byte
+	Thumbnail []byte
+}
+
+// memoryContent persistent content of the memory repository
+type memoryContent struct {
+	LastIsn    uint64
+	Records    map[uint64]*memoryRecord
+	Segments   map[string]map[uint32][]byte
+	Renditions map[string]map[uint32]*Rendition
+}
+
+// MemoryRepository in-memory implementation of the picture repository. If
+// a file name is given the content is loaded at open and written back at
+// close.
+type MemoryRepository struct {
+	lock     sync.Mutex
+	fileName string
+	content  memoryContent
+}
+
+// memoryCursor cursor over a copied result list
+type memoryCursor struct {
+	data []interface{}
+	pos  int
+}
+
+// NewMemoryRepository create empty in-memory picture repository
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{content: memoryContent{Records: make(map[uint64]*memoryRecord),
+		Segments: make(map[string]map[uint32][]byte), Renditions: make(map[string]map[uint32]*Rendition)}}
+}
+
+// OpenMemoryRepository open in-memory picture repository stored in the given file.
+// A not existing file is created at close.
+func OpenMemoryRepository(fileName string) (*MemoryRepository, error) {
+	mr := NewMemoryRepository()
+	mr.fileName = fileName
+	f, err := os.Open(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return mr, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	err = gob.NewDecoder(f).Decode(&mr.content)
+	if err != nil {
+		return nil, fmt.Errorf("error reading memory repository %s: %v", fileName, err)
+	}
+	if mr.content.Records == nil {
+		mr.content.Records = make(map[uint64]*memoryRecord)
+	}
+	if mr.content.Segments == nil {
+		mr.content.Segments = make(map[string]map[uint32][]byte)
+	}
+	if mr.content.Renditions == nil {
+		mr.content.Renditions = make(map[string]map[uint32]*Rendition)
+	}
+	return mr, nil
+}
+
+func (mc *memoryCursor) HasNextRecord() bool {
+	return mc.pos < len(mc.data)
+}
+
+func (mc *memoryCursor) NextData() (interface{}, error) {
+	if mc.pos >= len(mc.data) {
+		return nil, fmt.Errorf("cursor end reached")
+	}
+	d := mc.data[mc.pos]
+	mc.pos++
+	return d, nil
+}
+
+func copyLocations(locations []*PictureLocation) []*PictureLocation {
+	list := make([]*PictureLocation, 0, len(locations))
+	for _, l := range locations {
+		// empty entries are used to shrink the period group
+		if l == nil || *l == (PictureLocation{}) {
+			continue
+		}
+		c := *l
+		list = append(list, &c)
+	}
+	return list
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+func (mr *memoryRecord) metadata() *PictureMetadata {
+	md := mr.Metadata
+	md.PictureLocation = copyLocations(mr.Metadata.PictureLocation)
+	md.NrPictureLocation = len(md.PictureLocation)
+	return &md
+}
+
+func (mr *memoryRecord) data() *PictureData {
+	return &PictureData{Index: mr.Metadata.Index, ChecksumPicture: mr.Metadata.ChecksumPicture,
+		ChecksumSHA256:  mr.Metadata.ChecksumSHA256,
+		MIMEType:        mr.Metadata.MIMEType,
+		PictureLocation: copyLocations(mr.Metadata.PictureLocation),
+		Media:           copyBytes(mr.Media), Thumbnail: copyBytes(mr.Thumbnail),
+		NrSegments: mr.Metadata.NrSegments}
+}
+
+// sortedIsns all ISN in ascending order, must be called with lock held
+func (mr *MemoryRepository) sortedIsns() []uint64 {
+	isns := make([]uint64, 0, len(mr.content.Records))
+	for isn := range mr.content.Records {
+		isns = append(isns, isn)
+	}
+	sort.Slice(isns, func(i, j int) bool { return isns[i] < isns[j] })
+	return isns
+}
+
+func (mr *MemoryRepository) search(match func(r *memoryRecord) bool) []*memoryRecord {
+	list := make([]*memoryRecord, 0)
+	for _, isn := range mr.sortedIsns() {
+		r := mr.content.Records[isn]
+		if match(r) {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+func (mr *MemoryRepository) record(isn uint64) (*memoryRecord, error) {
+	r, ok := mr.content.Records[isn]
+	if !ok {
+		return nil, fmt.Errorf("record ISN=%d %w", isn, ErrNotFound)
+	}
+	return r, nil
+}
+
+func matchHash(key string) func(r *memoryRecord) bool {
+	return func(r *memoryRecord) bool {
+		for _, l := range r.Metadata.PictureLocation {
+			if l.PictureHash == key {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func matchChecksum(checksum string) func(r *memoryRecord) bool {
+	return func(r *memoryRecord) bool {
+		return r.Metadata.ChecksumPicture == checksum
+	}
+}
+
+// PictureFileAvailable check if picture path key (PM) is stored
+func (mr *MemoryRepository) PictureFileAvailable(key string) (bool, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	return len(mr.search(matchHash(key))) > 0, nil
+}
+
+// PictureMediaAvailable check if picture checksum (CP) is stored
+func (mr *MemoryRepository) PictureMediaAvailable(checksum string) (bool, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	return len(mr.search(matchChecksum(checksum))) > 0, nil
+}
+
+// ReadChecksumMetadata read metadata with locations of the checksum (CP)
+func (mr *MemoryRepository) ReadChecksumMetadata(checksum string) ([]*PictureMetadata, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	list := make([]*PictureMetadata, 0)
+	for _, r := range mr.search(matchChecksum(checksum)) {
+		list = append(list, r.metadata())
+	}
+	return list, nil
+}
+
+// ReadFileMetadata read metadata with locations of the picture path key (PM)
+func (mr *MemoryRepository) ReadFileMetadata(key string) ([]*PictureMetadata, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	list := make([]*PictureMetadata, 0)
+	for _, r := range mr.search(matchHash(key)) {
+		list = append(list, r.metadata())
+	}
+	return list, nil
+}
+
+// ReadMedia read picture data with media and thumbnail of the given ISN
+func (mr *MemoryRepository) ReadMedia(isn uint64) (*PictureData, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	r, err := mr.record(isn)
+	if err != nil {
+		return nil, err
+	}
+	return r.data(), nil
+}
+
+// StoreMetadata insert or update all metadata fields
+func (mr *MemoryRepository) StoreMetadata(insert bool, metadata *PictureMetadata) error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	if insert {
+		mr.content.LastIsn++
+		metadata.Index = mr.content.LastIsn
+		mr.content.Records[metadata.Index] = &memoryRecord{}
+	}
+	r, err := mr.record(metadata.Index)
+	if err != nil {
+		return err
+	}
+	r.Metadata = *metadata
+	r.Metadata.PictureLocation = copyLocations(metadata.PictureLocation)
+	r.Metadata.NrPictureLocation = len(r.Metadata.PictureLocation)
+	return nil
+}
+
+// UpdateMediaChunk update the media (DP) of the ISN at the offset, a chunk
+// at offset 0 replaces the media
+func (mr *MemoryRepository) UpdateMediaChunk(isn, offset uint64, chunk []byte) error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	r, err := mr.record(isn)
+	if err != nil {
+		return err
+	}
+	if offset > uint64(len(r.Media)) {
+		return fmt.Errorf("media chunk offset %d behind media end %d", offset, len(r.Media))
+	}
+	r.Media = append(r.Media[:offset], chunk...)
+	return nil
+}
+
+// UpdateThumbnail update checksum and thumbnail (CP,DT) of the picture data index
+func (mr *MemoryRepository) UpdateThumbnail(data *PictureData) error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	r, err := mr.record(data.Index)
+	if err != nil {
+		return err
+	}
+	r.Metadata.ChecksumPicture = data.ChecksumPicture
+	r.Thumbnail = copyBytes(data.Thumbnail)
+	return nil
+}
+
+// UpdateDimensions update fill, original and thumbnail dimensions
+// (FI,WI,HE,TW,TH) of the metadata index
+func (mr *MemoryRepository) UpdateDimensions(metadata *PictureMetadata) error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	r, err := mr.record(metadata.Index)
+	if err != nil {
+		return err
+	}
+	r.Metadata.Fill = metadata.Fill
+	r.Metadata.Width = metadata.Width
+	r.Metadata.Height = metadata.Height
+	r.Metadata.ThumbnailWidth = metadata.ThumbnailWidth
+	r.Metadata.ThumbnailHeight = metadata.ThumbnailHeight
+	return nil
+}
+
+// UpdateSHA256 update SHA-256 checksum (CS) of the picture data index
+func (mr *MemoryRepository) UpdateSHA256(data *PictureData) error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	r, err := mr.record(data.Index)
+	if err != nil {
+		return err
+	}
+	r.Metadata.ChecksumSHA256 = data.ChecksumSHA256
+	return nil
+}
+
+// UpdateMIMEType update MIME type (TY) of the picture data index
+func (mr *MemoryRepository) UpdateMIMEType(data *PictureData) error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	r, err := mr.record(data.Index)
+	if err != nil {
+		return err
+	}
+	r.Metadata.MIMEType = data.MIMEType
+	return nil
+}
+
+// UpdateLocations update picture location list (PL) of the metadata index
+func (mr *MemoryRepository) UpdateLocations(metadata *PictureMetadata) error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	r, err := mr.record(metadata.Index)
+	if err != nil {
+		return err
+	}
+	r.Metadata.PictureLocation = copyLocations(metadata.PictureLocation)
+	r.Metadata.NrPictureLocation = len(r.Metadata.PictureLocation)
+	return nil
+}
+
+// SearchHash search all ISN containing the picture path key (PM)
+func (mr *MemoryRepository) SearchHash(key string) ([]uint64, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	list := make([]uint64, 0)
+	for _, r := range mr.search(matchHash(key)) {
+		list = append(list, r.Metadata.Index)
+	}
+	return list, nil
+}
+
+// SearchName search all ISN containing the picture name (PN)
+func (mr *MemoryRepository) SearchName(name string) ([]uint64, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	list := make([]uint64, 0)
+	for _, r := range mr.search(func(r *memoryRecord) bool {
+		for _, l := range r.Metadata.PictureLocation {
+			if l.PictureName == name {
+				return true
+			}
+		}
+		return false
+	}) {
+		list = append(list, r.Metadata.Index)
+	}
+	return list, nil
+}
+
+// SearchPair search all ISN of the RAW and JPEG pair key (RP)
+func (mr *MemoryRepository) SearchPair(key string) ([]uint64, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	list := make([]uint64, 0)
+	for _, r := range mr.search(func(r *memoryRecord) bool {
+		return r.Metadata.PairKey == key
+	}) {
+		list = append(list, r.Metadata.Index)
+	}
+	return list, nil
+}
+
+// Delete delete record with given ISN
+func (mr *MemoryRepository) Delete(isn uint64) error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	r, err := mr.record(isn)
+	if err != nil {
+		return err
+	}
+	delete(mr.content.Records, isn)
+	if len(mr.search(matchChecksum(r.Metadata.ChecksumPicture))) == 0 {
+		delete(mr.content.Segments, r.Metadata.ChecksumPicture)
+		delete(mr.content.Renditions, r.Metadata.ChecksumPicture)
+	}
+	return nil
+}
+
+// SegmentsAvailable memory repository always supports segments
+func (mr *MemoryRepository) SegmentsAvailable() bool {
+	return true
+}
+
+// StoreSegment store media segment of the given checksum (CP)
+func (mr *MemoryRepository) StoreSegment(checksum string, sequence uint32, data []byte) error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	segments, ok := mr.content.Segments[checksum]
+	if !ok {
+		segments = make(map[uint32][]byte)
+		mr.content.Segments[checksum] = segments
+	}
+	segments[sequence] = copyBytes(data)
+	return nil
+}
+
+// ReadSegment read media segment of the given checksum (CP)
+func (mr *MemoryRepository) ReadSegment(checksum string, sequence uint32) ([]byte, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	segment, ok := mr.content.Segments[checksum][sequence]
+	if !ok {
+		return nil, fmt.Errorf("segment %d of %s %w", sequence, checksum, ErrNotFound)
+	}
+	return copyBytes(segment), nil
+}
+
+// DeleteSegments delete all media segments of the given checksum (CP)
+func (mr *MemoryRepository) DeleteSegments(checksum string) error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	delete(mr.content.Segments, checksum)
+	return nil
+}
+
+// RenditionsAvailable memory repository always supports renditions
+func (mr *MemoryRepository) RenditionsAvailable() bool {
+	return true
+}
+
+// StoreRendition store rendition of the checksum (CP) and size
+func (mr *MemoryRepository) StoreRendition(rendition *Rendition) error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	renditions, ok := mr.content.Renditions[rendition.ChecksumPicture]
+	if !ok {
+		renditions = make(map[uint32]*Rendition)
+		mr.content.Renditions[rendition.ChecksumPicture] = renditions
+	}
+	c := *rendition
+	c.Data = copyBytes(rendition.Data)
+	renditions[rendition.Size] = &c
+	return nil
+}
+
+// ReadRendition read rendition of the given checksum (CP) and size
+func (mr *MemoryRepository) ReadRendition(checksum string, size uint32) (*Rendition, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	rendition, ok := mr.content.Renditions[checksum][size]
+	if !ok {
+		return nil, fmt.Errorf("rendition %d of %s %w", size, checksum, ErrNotFound)
+	}
+	c := *rendition
+	c.Data = copyBytes(rendition.Data)
+	return &c, nil
+}
+
+// ReadRenditionSizes sizes of all renditions stored for the checksum (CP)
+func (mr *MemoryRepository) ReadRenditionSizes(checksum string) ([]uint32, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	sizes := make([]uint32, 0)
+	for size := range mr.content.Renditions[checksum] {
+		sizes = append(sizes, size)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	return sizes, nil
+}
+
+// DeleteRenditions delete all renditions of the given checksum (CP)
+func (mr *MemoryRepository) DeleteRenditions(checksum string) error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	delete(mr.content.Renditions, checksum)
+	return nil
+}
+
+// ReadHost cursor of picture data located at host (PH)
+func (mr *MemoryRepository) ReadHost(host string) (PictureCursor, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	cursor := &memoryCursor{}
+	for _, r := range mr.search(func(r *memoryRecord) bool {
+		for _, l := range r.Metadata.PictureLocation {
+			if l.PictureHost == host {
+				return true
+			}
+		}
+		return false
+	}) {
+		cursor.data = append(cursor.data, r.data())
+	}
+	return cursor, nil
+}
+
+// ReadChecksum cursor of picture data with checksum (CP)
+func (mr *MemoryRepository) ReadChecksum(checksum string) (PictureCursor, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	cursor := &memoryCursor{}
+	for _, r := range mr.search(matchChecksum(checksum)) {
+		cursor.data = append(cursor.data, r.data())
+	}
+	return cursor, nil
+}
+
+// ReadData cursor of all picture data including media and MIME type
+func (mr *MemoryRepository) ReadData(limit uint64) (PictureCursor, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	cursor := &memoryCursor{}
+	for _, isn := range mr.sortedIsns() {
+		if limit != 0 && uint64(len(cursor.data)) >= limit {
+			break
+		}
+		cursor.data = append(cursor.data, mr.content.Records[isn].data())
+	}
+	return cursor, nil
+}
+
+// ReadMetadata cursor of all picture metadata
+func (mr *MemoryRepository) ReadMetadata(limit uint64) (PictureCursor, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	cursor := &memoryCursor{}
+	for _, isn := range mr.sortedIsns() {
+		if limit != 0 && uint64(len(cursor.data)) >= limit {
+			break
+		}
+		cursor.data = append(cursor.data, mr.content.Records[isn].metadata())
+	}
+	return cursor, nil
+}
+
+// ReadOption cursor of picture metadata with the option (OP)
+func (mr *MemoryRepository) ReadOption(option string) (PictureCursor, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	cursor := &memoryCursor{}
+	for _, r := range mr.search(func(r *memoryRecord) bool {
+		return r.Metadata.Option == option
+	}) {
+		cursor.data = append(cursor.data, r.metadata())
+	}
+	return cursor, nil
+}
+
+// ReadGeoCell cursor of picture metadata in geo cells (GC) starting with the
+// prefix
+func (mr *MemoryRepository) ReadGeoCell(prefix string) (PictureCursor, error) {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	cursor := &memoryCursor{}
+	for _, r := range mr.search(func(r *memoryRecord) bool {
+		return r.Metadata.GeoCell != "" && strings.HasPrefix(r.Metadata.GeoCell, prefix)
+	}) {
+		cursor.data = append(cursor.data, r.metadata())
+	}
+	return cursor, nil
+}
+
+// HistogramChecksum call function for each checksum (CP)
+func (mr *MemoryRepository) HistogramChecksum(limit uint64, fn ChecksumQuantity) error {
+	mr.lock.Lock()
+	histogram := make(map[string]uint64)
+	for _, r := range mr.content.Records {
+		histogram[r.Metadata.ChecksumPicture]++
+	}
+	mr.lock.Unlock()
+	checksums := make([]string, 0, len(histogram))
+	for c := range histogram {
+		checksums = append(checksums, c)
+	}
+	sort.Strings(checksums)
+	for i, c := range checksums {
+		if limit != 0 && uint64(i) >= limit {
+			break
+		}
+		err := fn(c, histogram[c])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EndTransaction changes are visible at once, the content is written into
+// the repository file at close
+func (mr *MemoryRepository) EndTransaction() error {
+	return nil
+}
+
+// save write content into repository file if defined
+func (mr *MemoryRepository) save() error {
+	mr.lock.Lock()
+	defer mr.lock.Unlock()
+	if mr.fileName == "" {
+		return nil
+	}
+	tmpName := mr.fileName + ".tmp"
+	f, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(&mr.content)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, mr.fileName)
+}
+
+// Close repository, the content is written if stored in a file
+func (mr *MemoryRepository) Close() {
+	err := mr.save()
+	if err != nil {
+		fmt.Println("Error writing memory repository:", err)
+	}
+}
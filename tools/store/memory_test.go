@@ -0,0 +1,177 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func storeTestRecord(t *testing.T, mr *MemoryRepository, checksum, name string, media []byte) uint64 {
+	t.Helper()
+	metadata := &PictureMetadata{ChecksumPicture: checksum, Option: "original",
+		PictureLocation: []*PictureLocation{{PictureName: name, PictureHash: createMd5([]byte(name)),
+			PictureDirectory: "dir", PictureHost: "host"}}}
+	err := mr.StoreMetadata(true, metadata)
+	if err != nil {
+		t.Fatalf("Error storing metadata: %v", err)
+	}
+	err = mr.UpdateMediaChunk(metadata.Index, 0, media)
+	if err != nil {
+		t.Fatalf("Error updating media: %v", err)
+	}
+	return metadata.Index
+}
+
+func TestMemoryRepositoryStoreRead(t *testing.T) {
+	mr := NewMemoryRepository()
+	isn := storeTestRecord(t, mr, "AA", "a.jpg", []byte("media"))
+	storeTestRecord(t, mr, "BB", "b.jpg", []byte("other"))
+
+	data, err := mr.ReadMedia(isn)
+	if err != nil {
+		t.Fatalf("Error reading media: %v", err)
+	}
+	if !bytes.Equal(data.Media, []byte("media")) {
+		t.Errorf("Media = %q, want %q", data.Media, "media")
+	}
+	if ok, _ := mr.PictureFileAvailable(createMd5([]byte("a.jpg"))); !ok {
+		t.Error("Picture key of a.jpg not available")
+	}
+	if ok, _ := mr.PictureMediaAvailable("CC"); ok {
+		t.Error("Checksum CC available")
+	}
+	isns, err := mr.SearchHash(createMd5([]byte("b.jpg")))
+	if err != nil || len(isns) != 1 || isns[0] == isn {
+		t.Errorf("SearchHash b.jpg = %v, %v", isns, err)
+	}
+	metadata, err := mr.ReadChecksumMetadata("AA")
+	if err != nil || len(metadata) != 1 || metadata[0].Index != isn {
+		t.Errorf("ReadChecksumMetadata AA = %v, %v", metadata, err)
+	}
+	cursor, err := mr.ReadOption("original")
+	if err != nil {
+		t.Fatalf("Error reading option: %v", err)
+	}
+	n := 0
+	for cursor.HasNextRecord() {
+		_, err = cursor.NextData()
+		if err != nil {
+			t.Fatalf("Error reading cursor: %v", err)
+		}
+		n++
+	}
+	if n != 2 {
+		t.Errorf("ReadOption original = %d records, want 2", n)
+	}
+	_, err = mr.ReadMedia(isn + 100)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("ReadMedia unknown ISN error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryRepositoryDelete(t *testing.T) {
+	mr := NewMemoryRepository()
+	first := storeTestRecord(t, mr, "AA", "a.jpg", nil)
+	second := storeTestRecord(t, mr, "AA", "b.jpg", nil)
+	err := mr.StoreSegment("AA", 1, []byte("segment"))
+	if err != nil {
+		t.Fatalf("Error storing segment: %v", err)
+	}
+
+	err = mr.Delete(first)
+	if err != nil {
+		t.Fatalf("Error deleting ISN=%d: %v", first, err)
+	}
+	if _, err = mr.ReadSegment("AA", 1); err != nil {
+		t.Errorf("Segment referenced by ISN=%d deleted: %v", second, err)
+	}
+	err = mr.Delete(second)
+	if err != nil {
+		t.Fatalf("Error deleting ISN=%d: %v", second, err)
+	}
+	if _, err = mr.ReadSegment("AA", 1); err == nil {
+		t.Error("Unreferenced segment not deleted")
+	}
+	if ok, _ := mr.PictureMediaAvailable("AA"); ok {
+		t.Error("Deleted checksum AA still available")
+	}
+	if err = mr.Delete(first); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete of deleted ISN error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryRepositoryPersist(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "memory.db")
+	mr, err := OpenMemoryRepository(fileName)
+	if err != nil {
+		t.Fatalf("Error opening memory repository: %v", err)
+	}
+	isn := storeTestRecord(t, mr, "AA", "a.jpg", []byte("media"))
+	err = mr.EndTransaction()
+	if err != nil {
+		t.Fatalf("Error ending transaction: %v", err)
+	}
+	if _, err = os.Stat(fileName); !os.IsNotExist(err) {
+		t.Errorf("Repository file written before close: %v", err)
+	}
+	mr.Close()
+
+	mr, err = OpenMemoryRepository(fileName)
+	if err != nil {
+		t.Fatalf("Error reopening memory repository: %v", err)
+	}
+	data, err := mr.ReadMedia(isn)
+	if err != nil || !bytes.Equal(data.Media, []byte("media")) {
+		t.Errorf("Reopened ISN=%d media = %v, %v", isn, data, err)
+	}
+}
+
+// TestMemoryRepositoryShared connections sharing the repository do not
+// close it, the file is written once by the owner
+func TestMemoryRepositoryShared(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "pictures.gob")
+	mr, err := OpenMemoryRepository(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		ps := InitStorePictureRepository(false, mr)
+		ps.MaxBlobSize = 50000000
+		if err = ps.LoadPicture(true, testPicture); err != nil {
+			t.Fatalf("Error loading %s: %v", testPicture, err)
+		}
+		ps.Close()
+	}
+	if _, err = os.Stat(fileName); !os.IsNotExist(err) {
+		t.Fatalf("Repository file written by closing a connection: %v", err)
+	}
+	mr.Close()
+	reopened, err := OpenMemoryRepository(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.content.Records) != 1 {
+		t.Errorf("%d records written by the owner, want 1", len(reopened.content.Records))
+	}
+}
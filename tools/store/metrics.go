@@ -0,0 +1,217 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets upper bounds in seconds of the latency histograms
+var LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+const metricsPrefix = "picture_"
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Histogram latency histogram, safe for concurrent use
+type Histogram struct {
+	buckets []float64
+	// counts per bucket, the last one counts durations above all buckets
+	counts []uint64
+	sum    uint64
+}
+
+// NewHistogram new histogram with the given bucket upper bounds in seconds
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+}
+
+// Observe count the duration
+func (h *Histogram) Observe(d time.Duration) {
+	if h == nil {
+		return
+	}
+	i := sort.SearchFloat64s(h.buckets, d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+}
+
+// write histogram in the Prometheus text format, labels are added to each
+// sample
+func (h *Histogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	cumulative := uint64(0)
+	for i, b := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep,
+			strconv.FormatFloat(b, 'g', -1, 64), cumulative)
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.buckets)])
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, cumulative)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, float64(atomic.LoadUint64(&h.sum))/float64(time.Second))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, cumulative)
+}
+
+type metricsCounter struct {
+	name  string
+	help  string
+	value func() uint64
+}
+
+// MetricsExporter exports the statistic of a run and the busy state of the
+// workers in the Prometheus text format
+type MetricsExporter struct {
+	statistic *PictureStatistic
+	lock      sync.Mutex
+	workers   []*PictureConnection
+	counters  []*metricsCounter
+}
+
+// NewMetricsExporter new metrics exporter of the statistic
+func NewMetricsExporter(stat *PictureStatistic) *MetricsExporter {
+	return &MetricsExporter{statistic: stat}
+}
+
+// AddWorker export the busy state of the picture connection
+func (me *MetricsExporter) AddWorker(ps *PictureConnection) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.workers = append(me.workers, ps)
+}
+
+// AddCounter export an additional counter of the tool, the value function
+// is called concurrently to the run
+func (me *MetricsExporter) AddCounter(name, help string, value func() uint64) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.counters = append(me.counters, &metricsCounter{name: name, help: help, value: value})
+}
+
+// WriteMetrics write all metrics in the Prometheus text format
+func (me *MetricsExporter) WriteMetrics(w io.Writer) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	snapshot := me.statistic.Snapshot()
+	for c := Counter(0); c < nrCounters; c++ {
+		writeCounter(w, c.String(), counterMetrics[c].help, snapshot.Counter(c))
+	}
+	for _, mc := range me.counters {
+		writeCounter(w, mc.name, mc.help, mc.value())
+	}
+
+	name := metricsPrefix + "errors_by_class_total"
+	fmt.Fprintf(w, "# HELP %s Errors by error class\n# TYPE %s counter\n", name, name)
+	for _, class := range snapshot.ErrorClasses() {
+		fmt.Fprintf(w, "%s{class=\"%s\"} %d\n", name, labelEscaper.Replace(class), snapshot.Errors[class])
+	}
+
+	name = metricsPrefix + "other_hosts"
+	fmt.Fprintf(w, "# HELP %s Other hosts found during verify\n# TYPE %s gauge\n", name, name)
+	fmt.Fprintf(w, "%s %d\n", name, len(snapshot.HostsFound))
+
+	name = metricsPrefix + "worker_busy"
+	fmt.Fprintf(w, "# HELP %s Worker currently processing a file\n# TYPE %s gauge\n", name, name)
+	for i, ps := range me.workers {
+		busy := 0
+		if ps.Processing() != "" {
+			busy = 1
+		}
+		fmt.Fprintf(w, "%s{worker=\"%d\"} %d\n", name, i, busy)
+	}
+
+	name = metricsPrefix + "thumbnail_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Duration of the thumbnail creation\n# TYPE %s histogram\n", name, name)
+	me.statistic.thumbnail.write(w, name, "")
+
+	name = metricsPrefix + "repository_call_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Duration of the repository operations\n# TYPE %s histogram\n", name, name)
+	me.statistic.lock.RLock()
+	calls := make(map[string]*Histogram, len(me.statistic.calls))
+	ops := make([]string, 0, len(me.statistic.calls))
+	for op, h := range me.statistic.calls {
+		calls[op] = h
+		ops = append(ops, op)
+	}
+	me.statistic.lock.RUnlock()
+	sort.Strings(ops)
+	for _, op := range ops {
+		calls[op].write(w, name, "op=\""+labelEscaper.Replace(op)+"\"")
+	}
+}
+
+func writeCounter(w io.Writer, name, help string, value uint64) {
+	name = metricsPrefix + name + "_total"
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+}
+
+// WriteWorkers write the file each worker currently processes, one line
+// per worker. The file names are not exported as metric labels to keep the
+// number of time series bounded.
+func (me *MetricsExporter) WriteWorkers(w io.Writer) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	for i, ps := range me.workers {
+		fmt.Fprintf(w, "%d %s\n", i, ps.Processing())
+	}
+}
+
+// ServeHTTP serve the metrics
+func (me *MetricsExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	me.WriteMetrics(w)
+}
+
+// ListenAndServe serve the metrics on /metrics and the files processed by
+// the workers on /debug/workers of the address in the background. An error
+// is returned if the address cannot be used.
+func (me *MetricsExporter) ListenAndServe(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", me)
+	mux.HandleFunc("/debug/workers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		me.WriteWorkers(w)
+	})
+	go func() {
+		err := http.Serve(listener, mux)
+		if err != nil {
+			fmt.Println("Metrics server error:", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,93 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bytes"
+	"flag"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// updateGolden write the golden files instead of comparing with them
+var updateGolden = flag.Bool("update", false, "update the golden files of the tests")
+
+const metricsGolden = "testdata/metrics.golden"
+
+func TestWriteMetrics(t *testing.T) {
+	stat := NewPictureStatistic()
+	stat.Add(StatChecked, 3)
+	stat.Inc(StatLoaded)
+	stat.Add(StatBytesLoaded, 1024)
+	stat.AddError(ErrNotFound)
+	stat.AddError(&fs.PathError{Op: "open \"a\"\n\\", Path: "a", Err: fs.ErrNotExist})
+	stat.AddOtherHost("other")
+	// a duration on the bucket bound is counted in the bucket
+	for _, d := range []time.Duration{3 * time.Millisecond, 7 * time.Millisecond, 10 * time.Millisecond,
+		20 * time.Second} {
+		stat.ObserveThumbnail(d)
+	}
+	stat.ObserveCall("store", 40*time.Millisecond)
+	stat.ObserveCall("read \"media\"", 2*time.Second)
+
+	exporter := NewMetricsExporter(stat)
+	exporter.AddCounter("quarantined", "Corrupt media files in quarantine", func() uint64 { return 2 })
+	idle := InitStorePictureRepository(false, NewMemoryRepository())
+	busy := InitStorePictureRepository(false, NewMemoryRepository())
+	busy.processing.Store("/pictures/a.jpg")
+	exporter.AddWorker(idle)
+	exporter.AddWorker(busy)
+
+	var buffer bytes.Buffer
+	exporter.WriteMetrics(&buffer)
+	if *updateGolden {
+		if err := os.WriteFile(metricsGolden, buffer.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := os.ReadFile(metricsGolden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffer.Bytes(), expected) {
+		t.Errorf("Metrics differ from %s, run with -update after checking the difference:\n%s",
+			metricsGolden, buffer.String())
+	}
+
+	for _, line := range strings.Split(buffer.String(), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") && strings.HasSuffix(line, " counter") &&
+			!strings.HasSuffix(strings.Fields(line)[2], "_total") {
+			t.Errorf("Counter without _total suffix: %s", line)
+		}
+	}
+
+	// the file names are listed on the workers page only
+	if strings.Contains(buffer.String(), "a.jpg") {
+		t.Error("File name exported as metric")
+	}
+	buffer.Reset()
+	exporter.WriteWorkers(&buffer)
+	if buffer.String() != "0 \n1 /pictures/a.jpg\n" {
+		t.Errorf("Workers %q", buffer.String())
+	}
+}
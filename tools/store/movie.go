@@ -0,0 +1,468 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tknie/adabas-go-api/adatypes"
+)
+
+// maxMovieBoxSize maximum size of the movie box read into memory
+const maxMovieBoxSize = 64 * 1024 * 1024
+
+// movieEpoch start of the ISOBMFF/QuickTime time stamps
+var movieEpoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// iso6709 location in ISO 6709 notation like +52.5200+013.4050+034.000/
+var iso6709 = regexp.MustCompile(`^([+-][0-9]+(?:\.[0-9]+)?)([+-][0-9]+(?:\.[0-9]+)?)([+-][0-9]+(?:\.[0-9]+)?)?`)
+
+// movieInfo metadata of the ISOBMFF/QuickTime movie box
+type movieInfo struct {
+	created   time.Time
+	duration  time.Duration
+	width     uint32
+	height    uint32
+	rotation  int
+	make      string
+	model     string
+	location  string
+	createTag string
+	cover     []byte
+}
+
+// VideoFrameExtractor external command extracting a key frame of videos
+// without embedded cover image. Empty disables extraction.
+var VideoFrameExtractor = "ffmpeg"
+
+// readMovieBox search the top level boxes for the movie box. The media
+// data box is skipped, so the movie box can be at the end of big files.
+func readMovieBox(r io.ReaderAt) ([]byte, error) {
+	header := make([]byte, 16)
+	offset := int64(0)
+	for {
+		n, err := r.ReadAt(header, offset)
+		if n < 8 {
+			if err == io.EOF || err == nil {
+				return nil, fmt.Errorf("no movie box found")
+			}
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(header[0:4]))
+		boxType := string(header[4:8])
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			if boxType != "moov" {
+				return nil, fmt.Errorf("no movie box found")
+			}
+			size = maxMovieBoxSize
+		case 1:
+			if n < 16 {
+				return nil, fmt.Errorf("box %s large size truncated", boxType)
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		if size < headerSize {
+			return nil, fmt.Errorf("box %s size %d invalid", boxType, size)
+		}
+		if boxType == "moov" {
+			if size-headerSize > maxMovieBoxSize {
+				return nil, fmt.Errorf("movie box size %d too big", size)
+			}
+			data := make([]byte, size-headerSize)
+			n, err = r.ReadAt(data, offset+headerSize)
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			return data[:n], nil
+		}
+		offset += size
+	}
+}
+
+// parseMovie parse movie header, track header, user data and meta
+// information of the movie box
+func parseMovie(data []byte) (*movieInfo, error) {
+	boxes, err := readBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+	mi := &movieInfo{}
+	for _, b := range boxes {
+		switch b.boxType {
+		case "mvhd":
+			mi.parseMovieHeader(&boxReader{data: b.data})
+		case "trak":
+			mi.parseTrack(b.data)
+		case "udta":
+			mi.parseUserData(b.data)
+		case "meta":
+			mi.parseMeta(b.data)
+		}
+	}
+	return mi, nil
+}
+
+func (mi *movieInfo) parseMovieHeader(br *boxReader) {
+	version, _ := br.fullBox()
+	var created, duration uint64
+	var timescale uint32
+	if version == 1 {
+		created = br.uint(8)
+		br.uint(8)
+		timescale = br.u32()
+		duration = br.uint(8)
+	} else {
+		created = br.uint(4)
+		br.uint(4)
+		timescale = br.u32()
+		duration = br.uint(4)
+	}
+	if br.err != nil {
+		return
+	}
+	if created != 0 {
+		mi.created = movieEpoch.Add(time.Duration(created) * time.Second)
+	}
+	if timescale != 0 {
+		mi.duration = time.Duration(duration) * time.Second / time.Duration(timescale)
+	}
+}
+
+func (mi *movieInfo) parseTrack(data []byte) {
+	boxes, err := readBoxes(data)
+	if err != nil {
+		return
+	}
+	for _, b := range boxes {
+		if b.boxType == "tkhd" {
+			mi.parseTrackHeader(&boxReader{data: b.data})
+		}
+	}
+}
+
+// parseTrackHeader take dimensions and rotation of the first video track.
+// Audio tracks have no dimensions.
+func (mi *movieInfo) parseTrackHeader(br *boxReader) {
+	version, _ := br.fullBox()
+	if version == 1 {
+		br.uint(8 + 8 + 4 + 4 + 8)
+	} else {
+		br.uint(4 + 4 + 4 + 4 + 4)
+	}
+	br.uint(8 + 2 + 2 + 2 + 2)
+	var matrix [9]int32
+	for i := range matrix {
+		matrix[i] = int32(br.u32())
+	}
+	width := br.u32() >> 16
+	height := br.u32() >> 16
+	if br.err != nil || width == 0 || height == 0 || mi.width != 0 {
+		return
+	}
+	mi.width = width
+	mi.height = height
+	a, b := matrix[0], matrix[1]
+	switch {
+	case a == 0 && b > 0:
+		mi.rotation = 90
+	case a < 0 && b == 0:
+		mi.rotation = 180
+	case a == 0 && b < 0:
+		mi.rotation = 270
+	}
+}
+
+// parseUserData QuickTime user data with international text entries
+func (mi *movieInfo) parseUserData(data []byte) {
+	boxes, err := readBoxes(data)
+	if err != nil {
+		return
+	}
+	for _, b := range boxes {
+		switch b.boxType {
+		case "\xa9xyz":
+			mi.location = userDataText(b.data)
+		case "\xa9day":
+			mi.createTag = userDataText(b.data)
+		case "\xa9mak":
+			mi.make = userDataText(b.data)
+		case "\xa9mod":
+			mi.model = userDataText(b.data)
+		case "meta":
+			mi.parseMeta(b.data)
+		}
+	}
+}
+
+// userDataText text of QuickTime international text or an iTunes data box
+func userDataText(data []byte) string {
+	if len(data) >= 16 && string(data[4:8]) == "data" {
+		return strings.TrimRight(string(data[16:]), "\x00")
+	}
+	if len(data) < 4 {
+		return ""
+	}
+	size := int(binary.BigEndian.Uint16(data[0:2]))
+	if size > len(data)-4 {
+		size = len(data) - 4
+	}
+	return strings.TrimRight(string(data[4:4+size]), "\x00")
+}
+
+// parseMeta meta box with key and item list boxes. The QuickTime meta box
+// is no full box, the ISOBMFF meta box starts with version and flags.
+func (mi *movieInfo) parseMeta(data []byte) {
+	if len(data) >= 4 && binary.BigEndian.Uint32(data[0:4]) == 0 {
+		data = data[4:]
+	}
+	boxes, err := readBoxes(data)
+	if err != nil {
+		return
+	}
+	keys := make([]string, 0)
+	for _, b := range boxes {
+		switch b.boxType {
+		case "keys":
+			br := &boxReader{data: b.data}
+			br.fullBox()
+			count := br.u32()
+			for i := uint32(0); i < count && br.err == nil; i++ {
+				size := int(br.u32())
+				br.fourCC()
+				if size < 8 || br.pos+size-8 > len(br.data) {
+					break
+				}
+				keys = append(keys, string(br.data[br.pos:br.pos+size-8]))
+				br.pos += size - 8
+			}
+		case "ilst":
+			items, err := readBoxes(b.data)
+			if err != nil {
+				return
+			}
+			for _, item := range items {
+				key := item.boxType
+				index := int(binary.BigEndian.Uint32([]byte(key)))
+				if index > 0 && index <= len(keys) {
+					key = keys[index-1]
+				}
+				if key == "covr" || key == "com.apple.quicktime.artwork" {
+					if len(item.data) > 16 && string(item.data[4:8]) == "data" {
+						mi.cover = item.data[16:]
+					}
+					continue
+				}
+				mi.metaValue(key, userDataText(item.data))
+			}
+		}
+	}
+}
+
+func (mi *movieInfo) metaValue(key, value string) {
+	if value == "" {
+		return
+	}
+	switch key {
+	case "com.apple.quicktime.creationdate", "\xa9day":
+		mi.createTag = value
+	case "com.apple.quicktime.location.ISO6709", "\xa9xyz":
+		mi.location = value
+	case "com.apple.quicktime.make", "\xa9mak":
+		mi.make = value
+	case "com.apple.quicktime.model", "\xa9mod":
+		mi.model = value
+	}
+}
+
+// creationTime creation time of the meta data tag, the movie header time
+// is used if no tag is available
+func (mi *movieInfo) creationTime() (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05-0700", "2006-01-02T15:04:05Z0700", "2006-01-02"} {
+		t, err := time.Parse(layout, mi.createTag)
+		if err == nil {
+			return t, true
+		}
+	}
+	return mi.created, !mi.created.IsZero()
+}
+
+// coordinates latitude, longitude and altitude of the ISO 6709 location
+func (mi *movieInfo) coordinates() (lat, long, alt float64, ok bool) {
+	m := iso6709.FindStringSubmatch(mi.location)
+	if m == nil {
+		return 0, 0, 0, false
+	}
+	lat, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	long, err = strconv.ParseFloat(m[2], 64)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	if m[3] != "" {
+		alt, _ = strconv.ParseFloat(m[3], 64)
+	}
+	return lat, long, alt, true
+}
+
+// rotationOrientation EXIF orientation equivalent of the track rotation
+func rotationOrientation(rotation int) byte {
+	switch rotation {
+	case 90:
+		return 6
+	case 180:
+		return 3
+	case 270:
+		return 8
+	}
+	return 1
+}
+
+// extractMovieMetadata extract creation time, duration, dimensions,
+// rotation and location out of the movie box of MP4/QuickTime files
+func extractMovieMetadata(pic *PictureBinary) error {
+	media, err := pic.mediaSource()
+	if err != nil {
+		return err
+	}
+	defer media.Close()
+	r, ok := media.(io.ReaderAt)
+	if !ok {
+		return fmt.Errorf("media source without random access")
+	}
+	return applyMovieMetadata(r, pic.MetaData)
+}
+
+// ReadMovieMetadata set movie metadata out of the MP4/QuickTime file
+func ReadMovieMetadata(fileName string, metadata *PictureMetadata) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return applyMovieMetadata(f, metadata)
+}
+
+func applyMovieMetadata(r io.ReaderAt, metadata *PictureMetadata) error {
+	data, err := readMovieBox(r)
+	if err != nil {
+		adatypes.Central.Log.Debugf("Movie box error %v", err)
+		return err
+	}
+	mi, err := parseMovie(data)
+	if err != nil {
+		return err
+	}
+	if t, ok := mi.creationTime(); ok {
+		metadata.ExifTaken = t.String()
+	}
+	metadata.Duration = uint64(mi.duration / time.Millisecond)
+	metadata.ExifXdimension = mi.width
+	metadata.ExifYdimension = mi.height
+	metadata.ExifOrientation = rotationOrientation(mi.rotation)
+	metadata.ExifMake = mi.make
+	metadata.ExifModel = mi.model
+	if lat, long, alt, ok := mi.coordinates(); ok {
+		metadata.SetLocation(lat, long, alt)
+	}
+	return nil
+}
+
+// moviePoster poster frame of the video, the embedded cover image is used
+// if available. Otherwise a key frame is extracted by the external
+// VideoFrameExtractor.
+func moviePoster(fileName string) (image.Image, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := readMovieBox(f)
+	if err == nil {
+		mi, perr := parseMovie(data)
+		if perr == nil && len(mi.cover) > 0 {
+			img, _, derr := image.Decode(bytes.NewReader(mi.cover))
+			if derr == nil {
+				return img, nil
+			}
+			adatypes.Central.Log.Debugf("Movie cover decode error %v", derr)
+		}
+	}
+	return extractVideoFrame(fileName)
+}
+
+func extractVideoFrame(fileName string) (image.Image, error) {
+	if VideoFrameExtractor == "" {
+		return nil, fmt.Errorf("no video frame extractor configured")
+	}
+	path, err := exec.LookPath(VideoFrameExtractor)
+	if err != nil {
+		return nil, fmt.Errorf("video frame extractor not available: %v", err)
+	}
+	dir, err := os.MkdirTemp("", "poster")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	output := dir + string(os.PathSeparator) + "poster.jpg"
+	out, err := exec.Command(path, "-v", "error", "-i", fileName, "-vf", "thumbnail",
+		"-frames:v", "1", "-y", output).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("video frame extractor error %v: %s", err, out)
+	}
+	f, err := os.Open(output)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return jpeg.Decode(f)
+}
+
+// CreatePosterThumbnail thumbnail of the poster frame of the video file,
+// returns the JPEG thumbnail and its width and height
+func CreatePosterThumbnail(fileName string) ([]byte, uint32, uint32, error) {
+	format, _, err := DetectFormat(fileName)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if format == nil || format.Poster == nil {
+		return nil, 0, 0, fmt.Errorf("no video format")
+	}
+	img, err := format.Poster(fileName)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return resizePicture(img, ThumbnailSize)
+}
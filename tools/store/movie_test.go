@@ -0,0 +1,181 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// testBox ISOBMFF box with the given type and content
+func testBox(boxType string, content ...[]byte) []byte {
+	data := bytes.Join(content, nil)
+	box := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(box[0:4], uint32(8+len(data)))
+	copy(box[4:8], boxType)
+	return append(box, data...)
+}
+
+func testUint(size int, v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b[8-size:]
+}
+
+// testMovieHeader movie header box, version 1 uses 64-bit times
+func testMovieHeader(version int, created uint64, timescale uint32, duration uint64) []byte {
+	size := 4
+	if version == 1 {
+		size = 8
+	}
+	return testBox("mvhd", testUint(4, uint64(version)<<24), testUint(size, created),
+		testUint(size, 0), testUint(4, uint64(timescale)), testUint(size, duration),
+		make([]byte, 80))
+}
+
+// testTrackHeader version 0 track header box with the rotation matrix
+// values a and b and the dimensions
+func testTrackHeader(a, b int32, width, height uint32) []byte {
+	matrix := []int32{a, b, 0, -b, a, 0, 0, 0, 0x40000000}
+	content := [][]byte{testUint(4, 0), make([]byte, 20), make([]byte, 16)}
+	for _, m := range matrix {
+		content = append(content, testUint(4, uint64(uint32(m))))
+	}
+	content = append(content, testUint(4, uint64(width)<<16), testUint(4, uint64(height)<<16))
+	return testBox("tkhd", content...)
+}
+
+// testUserDataText QuickTime international text entry
+func testUserDataText(boxType, text string) []byte {
+	return testBox(boxType, testUint(2, uint64(len(text))), testUint(2, 0), []byte(text))
+}
+
+// testMetaData QuickTime meta box with keys and item list
+func testMetaData(values map[string]string) []byte {
+	keys := [][]byte{testUint(4, 0), testUint(4, uint64(len(values)))}
+	items := make([][]byte, 0)
+	index := uint64(0)
+	for _, key := range []string{"com.apple.quicktime.creationdate",
+		"com.apple.quicktime.location.ISO6709", "com.apple.quicktime.make",
+		"com.apple.quicktime.model"} {
+		value, ok := values[key]
+		if !ok {
+			continue
+		}
+		index++
+		keys = append(keys, testBox("mdta", []byte(key)))
+		items = append(items, testBox(string(testUint(4, index)),
+			testBox("data", testUint(4, 1), testUint(4, 0), []byte(value))))
+	}
+	return testBox("meta", testBox("keys", keys...), testBox("ilst", items...))
+}
+
+func TestParseMovie(t *testing.T) {
+	audio := testBox("trak", testTrackHeader(0x10000, 0, 0, 0))
+	tests := []struct {
+		name      string
+		movie     []byte
+		created   time.Time
+		duration  time.Duration
+		width     uint32
+		height    uint32
+		rotation  int
+		make      string
+		model     string
+		latitude  float64
+		longitude float64
+		altitude  float64
+	}{
+		{"quicktime user data", bytes.Join([][]byte{
+			testMovieHeader(0, 3600, 600, 6000),
+			audio,
+			testBox("trak", testTrackHeader(0, 0x10000, 1920, 1080)),
+			testBox("udta", testUserDataText("\xa9xyz", "+52.5200+013.4050+034.000/"),
+				testUserDataText("\xa9mak", "Apple"), testUserDataText("\xa9mod", "iPhone 12"))}, nil),
+			movieEpoch.Add(time.Hour), 10 * time.Second, 1920, 1080, 90,
+			"Apple", "iPhone 12", 52.52, 13.405, 34},
+		{"mp4 meta keys", bytes.Join([][]byte{
+			testMovieHeader(1, 7200, 1000, 2500),
+			testBox("trak", testTrackHeader(0, -0x10000, 3840, 2160)),
+			testMetaData(map[string]string{
+				"com.apple.quicktime.creationdate":     "2021-06-05T14:30:00+0200",
+				"com.apple.quicktime.location.ISO6709": "-33.8568+151.2153/",
+				"com.apple.quicktime.model":            "Pixel 6"})}, nil),
+			time.Date(2021, 6, 5, 14, 30, 0, 0, time.FixedZone("", 2*3600)), 2500 * time.Millisecond,
+			3840, 2160, 270, "", "Pixel 6", -33.8568, 151.2153, 0},
+		{"upside down without location", bytes.Join([][]byte{
+			testMovieHeader(0, 0, 0, 0),
+			testBox("trak", testTrackHeader(-0x10000, 0, 640, 480))}, nil),
+			time.Time{}, 0, 640, 480, 180, "", "", 0, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mi, err := parseMovie(test.movie)
+			if err != nil {
+				t.Fatalf("parse movie: %v", err)
+			}
+			created, _ := mi.creationTime()
+			if !created.Equal(test.created) {
+				t.Errorf("created %v, want %v", created, test.created)
+			}
+			if mi.duration != test.duration {
+				t.Errorf("duration %v, want %v", mi.duration, test.duration)
+			}
+			if mi.width != test.width || mi.height != test.height || mi.rotation != test.rotation {
+				t.Errorf("dimension %dx%d rotation %d, want %dx%d rotation %d", mi.width, mi.height,
+					mi.rotation, test.width, test.height, test.rotation)
+			}
+			if mi.make != test.make || mi.model != test.model {
+				t.Errorf("make %q model %q, want %q %q", mi.make, mi.model, test.make, test.model)
+			}
+			lat, long, alt, ok := mi.coordinates()
+			if ok != (test.latitude != 0) || lat != test.latitude || long != test.longitude ||
+				alt != test.altitude {
+				t.Errorf("location %v %v %v (%v), want %v %v %v", lat, long, alt, ok,
+					test.latitude, test.longitude, test.altitude)
+			}
+		})
+	}
+}
+
+func TestParseMovieTruncated(t *testing.T) {
+	movie := testMovieHeader(0, 0, 600, 600)
+	if _, err := parseMovie(movie[:len(movie)-10]); err == nil {
+		t.Error("truncated movie box parsed without error")
+	}
+}
+
+func TestReadMovieBox(t *testing.T) {
+	moov := testBox("moov", testMovieHeader(0, 0, 600, 600))
+	file := bytes.Join([][]byte{testBox("ftyp", []byte("isom"), testUint(4, 0)),
+		testBox("mdat", make([]byte, 1000)), moov}, nil)
+	data, err := readMovieBox(bytes.NewReader(file))
+	if err != nil {
+		t.Fatalf("read movie box: %v", err)
+	}
+	if !bytes.Equal(data, moov[8:]) {
+		t.Errorf("movie box content differs")
+	}
+	if _, err = readMovieBox(bytes.NewReader(file[:len(file)-len(moov)])); err == nil {
+		t.Error("file without movie box read without error")
+	}
+}
@@ -0,0 +1,115 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"image"
+	"image/draw"
+	"io"
+)
+
+// orientImage transform the image into the displayed orientation of the
+// EXIF orientation tag. Orientations 5 to 8 swap width and height.
+func orientImage(src image.Image, orientation byte) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	b := src.Bounds()
+	rgba, ok := src.(*image.RGBA)
+	if !ok || b.Min.X != 0 || b.Min.Y != 0 {
+		rgba = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	}
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			si := rgba.PixOffset(x, y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], rgba.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// orient apply the EXIF orientation if the decoder of the format does not
+func (format *MediaFormat) orient(src image.Image, orientation byte) image.Image {
+	if format.Oriented {
+		return src
+	}
+	if p, ok := src.(*profiledImage); ok {
+		return withProfile(orientImage(p.Image, orientation), p.transform)
+	}
+	return orientImage(src, orientation)
+}
+
+// FillType fill of the web application, "1" for portrait and "2" for
+// landscape pictures
+func FillType(width, height uint32) string {
+	if height > width {
+		return "1"
+	}
+	return "2"
+}
+
+// CreateOrientedThumbnail decode the media, apply the EXIF orientation of
+// the metadata and return the JPEG thumbnail. Original and thumbnail
+// dimensions and the fill of the metadata are set.
+func CreateOrientedThumbnail(format *MediaFormat, media io.Reader, metadata *PictureMetadata) ([]byte, error) {
+	srcImage, err := format.Decode(media)
+	if err != nil {
+		return nil, err
+	}
+	width, height := displayedSize(format, srcImage, metadata.ExifOrientation)
+	reduced := reduceImage(srcImage, ThumbnailSize)
+	return orientedThumbnail(format, format.orient(reduced, metadata.ExifOrientation), width, height, metadata)
+}
+
+// orientedThumbnail thumbnail of the image already in displayed orientation,
+// width and height are the displayed dimensions of the original
+func orientedThumbnail(format *MediaFormat, oriented image.Image, width, height uint32, metadata *PictureMetadata) ([]byte, error) {
+	thumbnail, w, h, err := resizePicture(oriented, ThumbnailSize)
+	if err != nil {
+		return nil, err
+	}
+	metadata.SetDimensions(format, width, height, w, h)
+	return thumbnail, nil
+}
@@ -0,0 +1,68 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math/bits"
+	"strconv"
+
+	"github.com/nfnt/resize"
+)
+
+// PerceptualHash difference hash (dHash) of the image as 16 hex digits. The
+// image is scaled down to 9x8 gray pixels and each bit is set if a pixel is
+// brighter than its right neighbour. Re-saved, resized or re-compressed copies
+// of the same picture get the same or a near hash.
+func PerceptualHash(img image.Image) string {
+	var transform *iccTransform
+	if p, ok := img.(*profiledImage); ok {
+		img, transform = p.Image, p.transform
+	}
+	var small image.Image = resize.Resize(9, 8, img, resize.Bilinear)
+	if transform != nil {
+		small = transform.apply(small)
+	}
+	b := small.Bounds()
+	hash := uint64(0)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := color.GrayModel.Convert(small.At(b.Min.X+x, b.Min.Y+y)).(color.Gray)
+			right := color.GrayModel.Convert(small.At(b.Min.X+x+1, b.Min.Y+y)).(color.Gray)
+			hash <<= 1
+			if left.Y > right.Y {
+				hash |= 1
+			}
+		}
+	}
+	return fmt.Sprintf("%016X", hash)
+}
+
+// ParsePerceptualHash parse perceptual hash stored in the descriptor
+func ParsePerceptualHash(hash string) (uint64, error) {
+	return strconv.ParseUint(hash, 16, 64)
+}
+
+// HammingDistance number of different bits of two perceptual hashes
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
@@ -22,12 +22,14 @@ package store
 import (
 	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
 	"image"
 	"image/jpeg"
+	"io"
 	"os"
 	"regexp"
-	"strings"
+	"time"
 
 	"github.com/rwcarlsen/goexif/exif"
 
@@ -38,11 +40,16 @@ import (
 
 // PictureBinary definition
 type PictureBinary struct {
-	Index       uint64 `adabas:"#isn" json:"-"`
-	FileName    string `xml:"-" json:"-"`
-	MetaData    *PictureMetadata
-	MaxBlobSize int64 // 50000000
-	Data        *PictureData
+	Index          uint64 `adabas:"#isn" json:"-"`
+	FileName       string `xml:"-" json:"-"`
+	MetaData       *PictureMetadata
+	MaxBlobSize    int64 // 50000000
+	Data           *PictureData
+	Segmented      bool
+	format         *MediaFormat
+	renditionSizes []uint32
+	renditions     []*Rendition
+	exifThumbnail  []byte
 }
 
 // PictureMetadata definition
@@ -52,9 +59,12 @@ type PictureMetadata struct {
 	Fill              string             `adabas:"::FI"`
 	MIMEType          string             `adabas:"::TY"`
 	Option            string             `adabas:"::OP"`
-	Width             uint32             `adabas:"::HE"`
-	Height            uint32             `adabas:"::WI"`
+	Width             uint32             `adabas:"::WI"`
+	Height            uint32             `adabas:"::HE"`
+	ThumbnailWidth    uint32             `adabas:"::TW"`
+	ThumbnailHeight   uint32             `adabas:"::TH"`
 	ChecksumPicture   string             `adabas:":key:CP"`
+	ChecksumSHA256    string             `adabas:"::CS"`
 	NrPictureLocation int                `adabas:"::#PL"`
 	PictureLocation   []*PictureLocation `adabas:"::PL"`
 	ExifModel         string             `adabas:"::MO"`
@@ -64,6 +74,15 @@ type PictureMetadata struct {
 	ExifOrientation   byte               `adabas:"::OR"`
 	ExifXdimension    uint32             `adabas:"::XD"`
 	ExifYdimension    uint32             `adabas:"::YD"`
+	ExifLatitude      float64            `adabas:"::LA"`
+	ExifLongitude     float64            `adabas:"::LO"`
+	ExifAltitude      float64            `adabas:"::AL"`
+	GeoCell           string             `adabas:"::GC"`
+	Duration          uint64             `adabas:"::DU"`
+	PerceptualHash    string             `adabas:"::DH"`
+	PairKey           string             `adabas:"::RP"`
+	MediaSize         uint64             `adabas:"::MS"`
+	NrSegments        uint32             `adabas:"::SG"`
 }
 
 type PictureLocation struct {
@@ -77,15 +96,23 @@ type PictureLocation struct {
 type PictureData struct {
 	Index           uint64             `adabas:":isn" json:"-"`
 	ChecksumPicture string             `adabas:":key:CP"`
+	ChecksumSHA256  string             `adabas:"::CS"`
+	MIMEType        string             `adabas:"::TY"`
 	PictureLocation []*PictureLocation `adabas:"::PL"`
 	Media           []byte             `adabas:"::DP" xml:"-" json:"-"`
 	Thumbnail       []byte             `adabas:"::DT" xml:"-" json:"-"`
+	NrSegments      uint32             `adabas:"::SG"`
 	//	ChecksumThumbnail string `adabas:":key:CT"`
 }
 
 var re = regexp.MustCompile(`(?m).*/([^/]*)`)
 
-// LoadFile load file
+// readChunkSize size of the chunks read and checksummed during ingest
+const readChunkSize = 1024 * 1024
+
+// LoadFile calculate the MD5 and SHA-256 checksums of the file reading it in
+// chunks. The media is not kept in memory, it is streamed from the file at
+// store time. Only the chunk in work is acquired from the global MediaBudget.
 func (pic *PictureBinary) LoadFile() error {
 	f, err := os.Open(pic.FileName)
 	if err != nil {
@@ -98,35 +125,49 @@ func (pic *PictureBinary) LoadFile() error {
 		return err
 	}
 	pic.Data = &PictureData{}
-	if fi.Size() > pic.MaxBlobSize {
-		return fmt.Errorf("file tooo big %d>%d", fi.Size(), pic.MaxBlobSize)
+	size := fi.Size()
+	if pic.MaxBlobSize > 0 && size > pic.MaxBlobSize {
+		if !pic.Segmented {
+			return fmt.Errorf("%w %d>%d", ErrTooBig, size, pic.MaxBlobSize)
+		}
+		pic.Data.NrSegments = uint32((size + pic.MaxBlobSize - 1) / pic.MaxBlobSize)
+	}
+	MediaBudget.Acquire(readChunkSize)
+	defer MediaBudget.Release(readChunkSize)
+	h := md5.New()
+	hs := sha256.New()
+	n, err := io.CopyBuffer(io.MultiWriter(h, hs), io.LimitReader(f, size), make([]byte, readChunkSize))
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
 	}
-	pic.Data.Media = make([]byte, fi.Size())
-	var n int
-	n, err = f.Read(pic.Data.Media)
-	adatypes.Central.Log.Debugf("Number of bytes read: %d/%d -> %v\n", n, len(pic.Data.Media), err)
 	if err != nil {
+		adatypes.Central.Log.Debugf("Error reading chunk at %d/%d -> %v\n", n, size, err)
 		return err
 	}
-	pic.Data.ChecksumPicture = createMd5(pic.Data.Media)
+	pic.Data.ChecksumPicture = fmt.Sprintf("%X", h.Sum(nil))
 	pic.MetaData.ChecksumPicture = pic.Data.ChecksumPicture
-	adatypes.Central.Log.Debugf("PictureBinary checksum %s size=%d len=%d", pic.Data.ChecksumPicture, fi.Size(), len(pic.Data.Media))
+	pic.Data.ChecksumSHA256 = fmt.Sprintf("%X", hs.Sum(nil))
+	pic.MetaData.ChecksumSHA256 = pic.Data.ChecksumSHA256
+	pic.MetaData.MediaSize = uint64(size)
+	pic.MetaData.NrSegments = pic.Data.NrSegments
+	adatypes.Central.Log.Debugf("PictureBinary checksum %s size=%d", pic.Data.ChecksumPicture, size)
 
 	return nil
 }
 
+// Release release the media data held for the store
+func (pic *PictureBinary) Release() {
+	if pic.Data != nil {
+		pic.Data.Media = nil
+	}
+	pic.exifThumbnail = nil
+}
+
 func createMd5(input []byte) string {
 	return fmt.Sprintf("%X", md5.Sum(input))
 }
 
-func resizePicture(media []byte, max int) ([]byte, uint32, uint32, error) {
-	var buffer bytes.Buffer
-	buffer.Write(media)
-	srcImage, _, err := image.Decode(&buffer)
-	if err != nil {
-		adatypes.Central.Log.Debugf("Decode image for thumbnail error %v", err)
-		return nil, 0, 0, err
-	}
+func resizePicture(srcImage image.Image, max int) ([]byte, uint32, uint32, error) {
 	maxX := uint(0)
 	maxY := uint(0)
 	b := srcImage.Bounds()
@@ -139,13 +180,21 @@ func resizePicture(media []byte, max int) ([]byte, uint32, uint32, error) {
 	}
 	//fmt.Println("Original size: ", height, width, "to", max, "window", maxX, maxY)
 	//dstImageFill := imaging.Fill(srcImage, 100, 100, imaging.Center, imaging.Lanczos)
-	newImage := resize.Resize(maxX, maxY, srcImage, resize.Lanczos3)
+	var transform *iccTransform
+	if p, ok := srcImage.(*profiledImage); ok {
+		srcImage, transform = p.Image, p.transform
+	}
+	var newImage image.Image = resize.Resize(maxX, maxY, srcImage, resize.Lanczos3)
+	if transform != nil {
+		// convert the scaled image into sRGB
+		newImage = transform.apply(newImage)
+	}
 	b = newImage.Bounds()
 	width = uint32(b.Max.X)
 	height = uint32(b.Max.Y)
 	//fmt.Println("New size: ", height, width)
 	buf := new(bytes.Buffer)
-	err = jpeg.Encode(buf, newImage, nil)
+	err := jpeg.Encode(buf, newImage, &jpeg.Options{Quality: ThumbnailQuality})
 	if err != nil {
 		// fmt.Println("Error generating thumbnail", err)
 		adatypes.Central.Log.Debugf("Encode image for thumbnail error %v", err)
@@ -156,12 +205,22 @@ func resizePicture(media []byte, max int) ([]byte, uint32, uint32, error) {
 
 // ExtractExif extract EXIF data
 func (pic *PictureBinary) ExtractExif() error {
-	buffer := bytes.NewBuffer(pic.Data.Media)
-	x, err := exif.Decode(buffer)
+	media, err := pic.mediaSource()
+	if err != nil {
+		return err
+	}
+	defer media.Close()
+	x, err := exif.Decode(media)
 	if err != nil {
 		// fmt.Println("Exif error: ", buffer.Len(), err)
 		return err
 	}
+	pic.applyExif(x)
+	return nil
+}
+
+// applyExif set metadata out of the decoded EXIF data
+func (pic *PictureBinary) applyExif(x *exif.Exif) {
 	// fmt.Println(x)
 	// var p Printer
 	// x.Walk(p)
@@ -190,6 +249,13 @@ func (pic *PictureBinary) ExtractExif() error {
 		pic.MetaData.ExifOrigTime = tmo.String()
 	}
 
+	if ThumbnailMode == ThumbnailExif {
+		thumbnail, terr := x.JpegThumbnail()
+		if terr == nil {
+			pic.exifThumbnail = thumbnail
+		}
+	}
+
 	o, oerr := x.Get(exif.Orientation)
 	if oerr == nil {
 		v, _ := o.Int(0)
@@ -206,20 +272,61 @@ func (pic *PictureBinary) ExtractExif() error {
 		v, _ := yd.Int(0)
 		pic.MetaData.ExifYdimension = uint32(v)
 	}
-	return nil
+
+	lat, long, lerr := x.LatLong()
+	if lerr == nil {
+		alt := float64(0)
+		a, aerr := x.Get(exif.GPSAltitude)
+		if aerr == nil {
+			r, rerr := a.Rat(0)
+			if rerr == nil {
+				alt, _ = r.Float64()
+			}
+			ar, arerr := x.Get(exif.GPSAltitudeRef)
+			if arerr == nil {
+				if v, _ := ar.Int(0); v == 1 {
+					alt = -alt
+				}
+			}
+		}
+		pic.MetaData.SetLocation(lat, long, alt)
+	}
 }
 
 // CreateThumbnail create thumbnail
 func (pic *PictureBinary) CreateThumbnail() error {
-	if strings.HasPrefix(pic.MetaData.MIMEType, "image") {
-		thmb, w, h, err := resizePicture(pic.Data.Media, 200)
+	if pic.format != nil && pic.format.Image() {
+		if len(pic.renditionSizes) == 0 && pic.embeddedThumbnail() {
+			adatypes.Central.Log.Debugf("Use EXIF thumbnail")
+			return nil
+		}
+		media, err := pic.mediaSource()
+		if err != nil {
+			return err
+		}
+		defer media.Close()
+		srcImage, err := pic.format.Decode(media)
+		if err != nil {
+			adatypes.Central.Log.Debugf("Error generating thumbnail: %v", err)
+			return err
+		}
+		orientation := pic.MetaData.ExifOrientation
+		width, height := displayedSize(pic.format, srcImage, orientation)
+		if len(pic.renditionSizes) > 0 {
+			pic.renditions, err = createRenditions(pic.MetaData.ChecksumPicture,
+				pic.format.orient(srcImage, orientation), pic.renditionSizes)
+			if err != nil {
+				adatypes.Central.Log.Debugf("Error generating renditions: %v", err)
+			}
+		}
+		reduced := reduceImage(srcImage, ThumbnailSize)
+		pic.MetaData.PerceptualHash = PerceptualHash(reduced)
+		thmb, err := orientedThumbnail(pic.format, pic.format.orient(reduced, orientation), width, height, pic.MetaData)
 		if err != nil {
 			adatypes.Central.Log.Debugf("Error generating thumbnail: %v", err)
 			return err
 		}
 		pic.Data.Thumbnail = thmb
-		pic.MetaData.Width = w
-		pic.MetaData.Height = h
 		// pic.Data.ChecksumThumbnail = createMd5(pic.Data.Thumbnail)
 		// adatypes.Central.Log.Debugf("Thumbnail checksum", pic.Data.ChecksumThumbnail)
 	} else {
@@ -229,6 +336,21 @@ func (pic *PictureBinary) CreateThumbnail() error {
 
 }
 
+// CreatePoster create thumbnail out of the poster frame of videos
+func (pic *PictureBinary) CreatePoster() error {
+	srcImage, err := pic.format.Poster(pic.FileName)
+	if err != nil {
+		return err
+	}
+	thmb, w, h, err := resizePicture(srcImage, ThumbnailSize)
+	if err != nil {
+		return err
+	}
+	pic.Data.Thumbnail = thmb
+	pic.MetaData.SetDimensions(pic.format, 0, 0, w, h)
+	return nil
+}
+
 // ReadDatabase read picture binary from database
 func (pic *PictureBinary) ReadDatabase(connection *adabas.Connection, hash, repository string) (err error) {
 	request, rerr := connection.CreateMapReadRequest(PictureBinary{})
@@ -248,7 +370,7 @@ func (pic *PictureBinary) ReadDatabase(connection *adabas.Connection, hash, repo
 		return
 	}
 	if len(result.Data) == 0 {
-		return fmt.Errorf("no data found")
+		return fmt.Errorf("data of %s %w", hash, ErrNotFound)
 	}
 	resultPic := result.Data[0].(*PictureBinary)
 	*pic = *resultPic
@@ -269,94 +391,132 @@ func loadMovie(fileName string, ada *adabas.Adabas) error {
 }
 
 func (pic *PictureBinary) storeRecord(insert bool, ps *PictureConnection) (err error) {
-	fileName := pic.FileName
-	suffix := fileName[strings.LastIndex(fileName, ".")+1:]
-	suffix = strings.ToLower(suffix)
-	switch suffix {
-	case "jpg", "jpeg", "gif":
-		pic.MetaData.MIMEType = "image/" + suffix
-		pic.ExtractExif()
+	if pic.format == nil {
+		pic.format = FormatBySuffix(pic.FileName)
+		if pic.format == nil {
+			return fmt.Errorf("unknown media format of %s", pic.FileName)
+		}
+	}
+	pic.MetaData.MIMEType = pic.format.MIMEType
+	if pic.format.Metadata != nil {
+		merr := pic.format.Metadata(pic)
+		if merr != nil {
+			adatypes.Central.Log.Debugf("Metadata error %v", merr)
+		}
+	}
+	if pic.format.Image() {
+		if ps.repository.RenditionsAvailable() {
+			pic.renditionSizes = RenditionSizes
+		}
+		start := time.Now()
 		terr := pic.CreateThumbnail()
+		ps.statistics.ObserveThumbnail(time.Since(start))
 		if terr != nil {
-			adatypes.Central.Log.Debugf("Create thumbnail error %v", terr)
-			return terr
+			// store the picture without thumbnail, the EXIF dimensions are used
+			fmt.Printf("Decode error %s, stored without thumbnail: %v\n", pic.FileName, terr)
+			ps.statistics.Inc(StatDecodeFailed)
+			pic.MetaData.SetDimensions(pic.format, 0, 0, 0, 0)
 		}
-		if pic.MetaData.Height > pic.MetaData.Width {
-			pic.MetaData.Fill = "1"
-		} else {
-			pic.MetaData.Fill = "2"
+	} else {
+		pic.MetaData.SetDimensions(pic.format, 0, 0, 0, 0)
+		if pic.format.Poster != nil {
+			start := time.Now()
+			perr := pic.CreatePoster()
+			ps.statistics.ObserveThumbnail(time.Since(start))
+			if perr != nil {
+				adatypes.Central.Log.Debugf("Create poster thumbnail error %v", perr)
+			}
 		}
-	case "m4v", "mov":
-		pic.MetaData.MIMEType = "video/mp4"
-		pic.MetaData.Fill = "0"
-	default:
-		panic("Unknown suffix " + suffix)
 	}
 	adatypes.Central.Log.Debugf("Done set value to Picture, searching ...")
 
 	if pic.MetaData.ChecksumPicture == "" {
-		panic(fmt.Sprintf("Checksum picture empty: %v", pic.MetaData.PictureLocation))
+		return fmt.Errorf("checksum picture empty: %v", pic.MetaData.PictureLocation)
 	}
 	fmt.Printf("Store data %s %v\n", pic.MetaData.ChecksumPicture, pic.MetaData.PictureLocation)
-	if insert {
-		//fmt.Println("Store record metadata ....", p.MetaData.Md5)
-		err = ps.store.StoreData(pic.MetaData)
-	} else {
-		// fmt.Println("Update record ....", p.MetaData.Md5, "with ISN", p.MetaData.Index)
-		err = ps.store.UpdateData(pic.MetaData)
-	}
+	err = ps.repository.StoreMetadata(insert, pic.MetaData)
 	if err != nil {
 		fmt.Printf("Error storing record metadata: %v (%s)", err, pic.MetaData.ChecksumPicture)
-		return err
+		return backendError("store metadata", err)
 	}
 	fmt.Printf("Stored metadata %s into ISN=%d\n", pic.MetaData.ChecksumPicture, pic.MetaData.Index)
+	defer func() {
+		if err != nil {
+			pic.removeIncomplete(ps)
+		}
+	}()
 	pic.Data.ChecksumPicture = pic.MetaData.ChecksumPicture
 	pic.Data.Index = pic.MetaData.Index
 	if !ps.ChecksumRun {
 		// ok, err = ps.checkPicture(pictureKey)
 		// if err == nil && !ok {
 		// fmt.Println("Store data storage")
-		// fmt.Println("Update record data ....", p.Data.Md5, " of size ", len(p.Data.Media))
-		err = ps.storeData.UpdateData(pic.Data, true)
+		err = pic.storeMedia(ps)
 		if err != nil {
 			fmt.Println("Error updating record data:", err)
 			return err
 		}
-		err = ps.connection.EndTransaction()
-		if err != nil {
-			panic("Data write: end of transaction error: " + err.Error())
+		if pic.Data.NrSegments > 1 {
+			ps.statistics.Inc(StatSegmented)
 		}
 	}
 	//}
 	// fmt.Println("Update record thumbnail ....", p.Data.Md5)
-	err = ps.storeThumb.UpdateData(pic.Data)
+	err = ps.repository.UpdateThumbnail(pic.Data)
 	if err != nil {
 		fmt.Printf("Updating thumbnail request error %d: %v\n", pic.Data.Index, err)
-		return err
+		return backendError("update thumbnail", err)
 	}
+	for _, rendition := range pic.renditions {
+		err = ps.repository.StoreRendition(rendition)
+		if err != nil {
+			fmt.Printf("Storing rendition %d error %d: %v\n", rendition.Size, pic.Data.Index, err)
+			return backendError("store rendition", err)
+		}
+	}
+	pic.renditions = nil
 	adatypes.Central.Log.Debugf("Updated record into ISN=%d ChecksumPicture=%s", pic.MetaData.Index, pic.Data.ChecksumPicture)
-	err = ps.store.EndTransaction()
+	err = ps.repository.EndTransaction()
 	if err != nil {
-		panic("End of transaction error: " + err.Error())
+		return backendError("end transaction", err)
 	}
-	Statistics.Loaded++
+	ps.statistics.Inc(StatLoaded)
+	ps.statistics.Add(StatBytesLoaded, pic.MetaData.MediaSize)
 	return nil
 }
 
+// removeIncomplete delete the record and the segments of a failed store.
+// Otherwise the incomplete record is found by its checksum and never
+// repaired by a later run.
+func (pic *PictureBinary) removeIncomplete(ps *PictureConnection) {
+	fmt.Printf("Remove incomplete record ISN=%d of %s\n", pic.MetaData.Index, pic.FileName)
+	err := ps.repository.Delete(pic.MetaData.Index)
+	if err == nil && pic.Data.NrSegments > 1 {
+		err = ps.repository.DeleteSegments(pic.Data.ChecksumPicture)
+	}
+	if err == nil {
+		err = ps.repository.EndTransaction()
+	}
+	if err != nil {
+		fmt.Printf("Error removing incomplete record ISN=%d: %v\n", pic.MetaData.Index, err)
+	}
+}
+
 func (pic *PictureBinary) checkAndAddFile(ps *PictureConnection, fileName, directoryName string) (err error) {
-	result, err := ps.readAddAndCheck.ReadLogicalWith("CP=" + pic.Data.ChecksumPicture)
+	result, err := ps.repository.ReadChecksumMetadata(pic.Data.ChecksumPicture)
 	if err != nil {
 		fmt.Printf("Error checking PictureHash=%s: %v\n", pic.Data.ChecksumPicture, err)
-		panic("Read error " + err.Error())
+		return backendError("read checksum", err)
 	}
-	if result.NrRecords() != 1 {
-		panic("Error receiving nr records for checking")
+	pm := matchSHA256(result, pic.Data.ChecksumSHA256)
+	if pm == nil {
+		return fmt.Errorf("metadata of %s %w", pic.Data.ChecksumPicture, ErrNotFound)
 	}
-	pm := result.Data[0].(*PictureMetadata)
+	pic.MetaData.Index = pm.Index
 	ph := make(map[string]*PictureLocation)
 	for _, p := range pm.PictureLocation {
 		if p.PictureDirectory == directoryName && p.PictureHost == Hostname {
-			Statistics.Found++
+			ps.statistics.Inc(StatFound)
 			return nil
 		}
 
@@ -381,22 +541,85 @@ func (pic *PictureBinary) checkAndAddFile(ps *PictureConnection, fileName, direc
 			newPLList = append(newPLList, &PictureLocation{})
 		}
 		pm.PictureLocation = newPLList
-		Statistics.Duplicated++
+		ps.statistics.Inc(StatDuplicated)
 	}
 
-	err = ps.storeEntries.UpdateData(pm)
+	err = ps.repository.UpdateLocations(pm)
 	if err != nil {
-		return err
+		return backendError("update locations", err)
 	}
-	err = ps.storeEntries.EndTransaction()
+	err = ps.repository.EndTransaction()
 	if err != nil {
-		panic("End of transaction error: " + err.Error())
+		return backendError("end transaction", err)
 	}
-	Statistics.Added++
+	ps.statistics.Inc(StatAdded)
 
 	return nil
 }
 
+// detachFile remove the location of a changed file from the record it was
+// stored in. If reuse is set and no other location is left, the ISN of the
+// record is returned to update it in place with the new content, otherwise
+// a record without locations is deleted. Files recorded without checksum
+// keep their old location.
+func (ps *PictureConnection) detachFile(state *FileState, pictureKey string, reuse bool) (uint64, error) {
+	if state == nil || state.Checksum == "" {
+		return 0, nil
+	}
+	result, err := ps.repository.ReadChecksumMetadata(state.Checksum)
+	if err != nil {
+		return 0, backendError("read checksum", err)
+	}
+	for _, pm := range result {
+		if pm.Index != state.Isn {
+			continue
+		}
+		locations := make([]*PictureLocation, 0, len(pm.PictureLocation))
+		for _, p := range pm.PictureLocation {
+			if p.PictureHash != pictureKey || p.PictureHost != Hostname {
+				locations = append(locations, p)
+			}
+		}
+		switch {
+		case len(locations) > 0:
+			// clear the entries of the removed locations
+			for len(locations) < len(pm.PictureLocation) {
+				locations = append(locations, &PictureLocation{})
+			}
+			pm.PictureLocation = locations
+			err = ps.repository.UpdateLocations(pm)
+			if err != nil {
+				return 0, backendError("update locations", err)
+			}
+		case reuse:
+			if len(result) == 1 {
+				// the old content is replaced, segments and renditions are
+				// stored by checksum
+				if ps.repository.SegmentsAvailable() {
+					err = ps.repository.DeleteSegments(state.Checksum)
+					if err != nil {
+						return 0, backendError("delete segments", err)
+					}
+				}
+				if ps.repository.RenditionsAvailable() {
+					err = ps.repository.DeleteRenditions(state.Checksum)
+					if err != nil {
+						return 0, backendError("delete renditions", err)
+					}
+				}
+			}
+			return pm.Index, nil
+		default:
+			err = ps.repository.Delete(pm.Index)
+			if err != nil {
+				return 0, backendError("delete", err)
+			}
+		}
+		return 0, backendError("end transaction", ps.repository.EndTransaction())
+	}
+	return 0, nil
+}
+
 func createPictureLocation(pictureName, directoryName string) *PictureLocation {
 	picShortName := re.FindStringSubmatch(pictureName)[1]
 	// var re = regexp.MustCompile(`(?m).*/([^/]*)/.*`)
@@ -0,0 +1,74 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// QuarantineEntry corrupt media file found at ingest
+type QuarantineEntry struct {
+	FileName string
+	MIMEType string
+	Reason   string
+	Stored   bool
+	Time     time.Time
+}
+
+// QuarantineList corrupt media files found at ingest
+type QuarantineList struct {
+	lock    sync.Mutex
+	Entries []*QuarantineEntry
+}
+
+// Quarantine corrupt media files of this run
+var Quarantine = &QuarantineList{}
+
+// Add add corrupt media file to the quarantine list
+func (ql *QuarantineList) Add(fileName string, format *MediaFormat, reason error, stored bool) {
+	ql.lock.Lock()
+	defer ql.lock.Unlock()
+	entry := &QuarantineEntry{FileName: fileName, Reason: reason.Error(), Stored: stored, Time: time.Now()}
+	if format != nil {
+		entry.MIMEType = format.MIMEType
+	}
+	ql.Entries = append(ql.Entries, entry)
+}
+
+// Len number of corrupt media files
+func (ql *QuarantineList) Len() int {
+	ql.lock.Lock()
+	defer ql.lock.Unlock()
+	return len(ql.Entries)
+}
+
+// WriteReport write the quarantine list as JSON report
+func (ql *QuarantineList) WriteReport(fileName string) error {
+	ql.lock.Lock()
+	defer ql.lock.Unlock()
+	data, err := json.MarshalIndent(ql, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, data, 0644)
+}
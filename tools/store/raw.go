@@ -0,0 +1,240 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// TIFF tags needed to find the embedded JPEG previews of RAW files
+const (
+	tiffTagNewSubfileType  = 0x00fe
+	tiffTagCompression     = 0x0103
+	tiffTagStripOffsets    = 0x0111
+	tiffTagStripByteCounts = 0x0117
+	tiffTagSubIFDs         = 0x014a
+	tiffTagJPEGOffset      = 0x0201
+	tiffTagJPEGLength      = 0x0202
+	tiffTagExifIFD         = 0x8769
+)
+
+// maxRawIFDs limit of IFDs parsed to protect against loops
+const maxRawIFDs = 32
+
+func cr2Magic(header []byte) bool {
+	return len(header) >= 10 && bytes.HasPrefix(header, []byte("II*\x00")) &&
+		string(header[8:10]) == "CR"
+}
+
+// rawPreview JPEG preview candidate in the RAW file
+type rawPreview struct {
+	offset int64
+	length int64
+}
+
+// tiffIFDEntry entry of a TIFF image file directory
+type tiffIFDEntry struct {
+	tag      uint16
+	dataType uint16
+	count    uint32
+	value    []byte
+}
+
+// rawParser parse the TIFF structure of RAW files
+type rawParser struct {
+	r        io.ReaderAt
+	order    binary.ByteOrder
+	visited  map[int64]bool
+	previews []rawPreview
+}
+
+func (rp *rawParser) readIFD(offset int64) ([]*tiffIFDEntry, int64, error) {
+	countBuffer := make([]byte, 2)
+	_, err := rp.r.ReadAt(countBuffer, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	count := int64(rp.order.Uint16(countBuffer))
+	buffer := make([]byte, count*12+4)
+	_, err = rp.r.ReadAt(buffer, offset+2)
+	if err != nil {
+		return nil, 0, err
+	}
+	entries := make([]*tiffIFDEntry, 0, count)
+	for i := int64(0); i < count; i++ {
+		e := buffer[i*12 : i*12+12]
+		entries = append(entries, &tiffIFDEntry{tag: rp.order.Uint16(e[0:2]),
+			dataType: rp.order.Uint16(e[2:4]), count: rp.order.Uint32(e[4:8]), value: e[8:12]})
+	}
+	next := int64(rp.order.Uint32(buffer[count*12:]))
+	return entries, next, nil
+}
+
+// values integer values of SHORT or LONG entries
+func (rp *rawParser) values(e *tiffIFDEntry) []int64 {
+	size := int64(4)
+	if e.dataType == 3 {
+		size = 2
+	} else if e.dataType != 4 && e.dataType != 13 {
+		return nil
+	}
+	data := e.value
+	if int64(e.count)*size > 4 {
+		if e.count > 1024 {
+			return nil
+		}
+		data = make([]byte, int64(e.count)*size)
+		_, err := rp.r.ReadAt(data, int64(rp.order.Uint32(e.value)))
+		if err != nil {
+			return nil
+		}
+	}
+	list := make([]int64, 0, e.count)
+	for i := int64(0); i < int64(e.count); i++ {
+		if size == 2 {
+			list = append(list, int64(rp.order.Uint16(data[i*2:])))
+		} else {
+			list = append(list, int64(rp.order.Uint32(data[i*4:])))
+		}
+	}
+	return list
+}
+
+func (rp *rawParser) first(e *tiffIFDEntry) int64 {
+	v := rp.values(e)
+	if len(v) == 0 {
+		return 0
+	}
+	return v[0]
+}
+
+// parseIFD collect JPEG previews of the IFD and all sub IFDs
+func (rp *rawParser) parseIFD(offset int64) {
+	for offset != 0 && !rp.visited[offset] && len(rp.visited) < maxRawIFDs {
+		rp.visited[offset] = true
+		entries, next, err := rp.readIFD(offset)
+		if err != nil {
+			return
+		}
+		var jpegOffset, jpegLength, compression int64
+		var strips, stripCounts []int64
+		for _, e := range entries {
+			switch e.tag {
+			case tiffTagJPEGOffset:
+				jpegOffset = rp.first(e)
+			case tiffTagJPEGLength:
+				jpegLength = rp.first(e)
+			case tiffTagCompression:
+				compression = rp.first(e)
+			case tiffTagStripOffsets:
+				strips = rp.values(e)
+			case tiffTagStripByteCounts:
+				stripCounts = rp.values(e)
+			case tiffTagSubIFDs, tiffTagExifIFD:
+				for _, sub := range rp.values(e) {
+					rp.parseIFD(sub)
+				}
+			}
+		}
+		if jpegOffset > 0 && jpegLength > 0 {
+			rp.previews = append(rp.previews, rawPreview{offset: jpegOffset, length: jpegLength})
+		}
+		// old style JPEG (6) or JPEG (7) compressed single strip
+		if (compression == 6 || compression == 7) && len(strips) == 1 && len(stripCounts) == 1 {
+			rp.previews = append(rp.previews, rawPreview{offset: strips[0], length: stripCounts[0]})
+		}
+		offset = next
+	}
+}
+
+// rawPreviews all JPEG preview candidates, biggest first
+func rawPreviews(r io.ReaderAt) ([]rawPreview, error) {
+	header := make([]byte, 8)
+	_, err := r.ReadAt(header, 0)
+	if err != nil {
+		return nil, err
+	}
+	rp := &rawParser{r: r, visited: make(map[int64]bool)}
+	switch string(header[0:4]) {
+	case "II*\x00":
+		rp.order = binary.LittleEndian
+	case "MM\x00*":
+		rp.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("no TIFF based RAW file")
+	}
+	rp.parseIFD(int64(rp.order.Uint32(header[4:8])))
+	sort.Slice(rp.previews, func(i, j int) bool {
+		return rp.previews[i].length > rp.previews[j].length
+	})
+	return rp.previews, nil
+}
+
+// decodeRawPreview decode the biggest embedded JPEG preview of the RAW file.
+// Lossless JPEG coded sensor data is skipped because it cannot be decoded.
+func decodeRawPreview(r io.Reader) (image.Image, error) {
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		ra = bytes.NewReader(data)
+	}
+	previews, err := rawPreviews(ra)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range previews {
+		img, err := decodeJPEG(io.NewSectionReader(ra, p.offset, p.length))
+		if err == nil {
+			return img, nil
+		}
+	}
+	return nil, fmt.Errorf("no JPEG preview found in RAW file")
+}
+
+// pairFile search file of the pair format with the same base name in the
+// same directory. RAW files are paired with JPEG files and vice versa.
+func pairFile(fileName string, format *MediaFormat) string {
+	base := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	for _, f := range formats {
+		if f == format || f.Raw == format.Raw || (!f.Raw && f.Name != "jpeg") ||
+			(!format.Raw && format.Name != "jpeg") {
+			continue
+		}
+		for _, s := range f.Suffixes {
+			for _, name := range []string{base + "." + s, base + "." + strings.ToUpper(s)} {
+				if st, err := os.Stat(name); err == nil && !st.IsDir() {
+					return name
+				}
+			}
+		}
+	}
+	return ""
+}
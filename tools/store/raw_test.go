@@ -0,0 +1,293 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testIFDEntry TIFF IFD entry with SHORT (3) or LONG (4) values
+type testIFDEntry struct {
+	tag      uint16
+	dataType uint16
+	values   []uint32
+}
+
+// testTIFFWriter TIFF file built bottom up. Data and sub IFDs are written
+// before the IFDs referencing them.
+type testTIFFWriter struct {
+	order binary.ByteOrder
+	data  []byte
+}
+
+func newTestTIFFWriter(order binary.ByteOrder) *testTIFFWriter {
+	header := []byte("II*\x00\x00\x00\x00\x00")
+	if order == binary.BigEndian {
+		header = []byte("MM\x00*\x00\x00\x00\x00")
+	}
+	return &testTIFFWriter{order: order, data: header}
+}
+
+// add append the data and return its offset
+func (tw *testTIFFWriter) add(data []byte) uint32 {
+	offset := uint32(len(tw.data))
+	tw.data = append(tw.data, data...)
+	return offset
+}
+
+// ifd append the IFD with the entries and the offset of the next IFD and
+// return its offset. Values not fitting into the entry are written before.
+func (tw *testTIFFWriter) ifd(next uint32, entries ...testIFDEntry) uint32 {
+	buffer := make([]byte, 2+len(entries)*12+4)
+	tw.order.PutUint16(buffer, uint16(len(entries)))
+	for i, e := range entries {
+		size := 4
+		if e.dataType == 3 {
+			size = 2
+		}
+		values := make([]byte, len(e.values)*size)
+		for j, v := range e.values {
+			if size == 2 {
+				tw.order.PutUint16(values[j*2:], uint16(v))
+			} else {
+				tw.order.PutUint32(values[j*4:], v)
+			}
+		}
+		entry := buffer[2+i*12:]
+		tw.order.PutUint16(entry[0:], e.tag)
+		tw.order.PutUint16(entry[2:], e.dataType)
+		tw.order.PutUint32(entry[4:], uint32(len(e.values)))
+		if len(values) > 4 {
+			tw.order.PutUint32(entry[8:], tw.add(values))
+		} else {
+			copy(entry[8:12], values)
+		}
+	}
+	tw.order.PutUint32(buffer[len(buffer)-4:], next)
+	return tw.add(buffer)
+}
+
+// setNext change the offset of the next IFD of the IFD
+func (tw *testTIFFWriter) setNext(offset, next uint32) {
+	count := uint32(tw.order.Uint16(tw.data[offset:]))
+	tw.order.PutUint32(tw.data[offset+2+count*12:], next)
+}
+
+// bytes complete TIFF file with the first IFD
+func (tw *testTIFFWriter) bytes(first uint32) []byte {
+	tw.order.PutUint32(tw.data[4:8], first)
+	return tw.data
+}
+
+// testJPEG JPEG coded gray picture of the given size
+func testJPEG(t *testing.T, width, height int) []byte {
+	var buffer bytes.Buffer
+	err := jpeg.Encode(&buffer, image.NewGray(image.Rect(0, 0, width, height)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// jpegEntries JPEG interchange format entries of the preview
+func jpegEntries(offset uint32, length int) []testIFDEntry {
+	return []testIFDEntry{{tiffTagJPEGOffset, 4, []uint32{offset}},
+		{tiffTagJPEGLength, 4, []uint32{uint32(length)}}}
+}
+
+// stripEntries single or multiple strip entries with the compression
+func stripEntries(compression uint32, offsets []uint32, counts []uint32) []testIFDEntry {
+	return []testIFDEntry{{tiffTagNewSubfileType, 4, []uint32{0}},
+		{tiffTagCompression, 3, []uint32{compression}},
+		{tiffTagStripOffsets, 4, offsets}, {tiffTagStripByteCounts, 4, counts}}
+}
+
+func TestRawPreviews(t *testing.T) {
+	tests := []struct {
+		name     string
+		build    func(tw *testTIFFWriter) uint32
+		expected []rawPreview
+	}{
+		{"JPEG interchange format", func(tw *testTIFFWriter) uint32 {
+			return tw.ifd(0, jpegEntries(100, 50)...)
+		}, []rawPreview{{100, 50}}},
+		{"IFD chain biggest first", func(tw *testTIFFWriter) uint32 {
+			ifd1 := tw.ifd(0, jpegEntries(300, 90)...)
+			return tw.ifd(ifd1, jpegEntries(100, 20)...)
+		}, []rawPreview{{300, 90}, {100, 20}}},
+		{"sub IFDs and EXIF IFD", func(tw *testTIFFWriter) uint32 {
+			sub1 := tw.ifd(0, jpegEntries(1000, 500)...)
+			sub2 := tw.ifd(0, stripEntries(6, []uint32{2000}, []uint32{800})...)
+			nested := tw.ifd(0, jpegEntries(3000, 70)...)
+			exifIFD := tw.ifd(0, testIFDEntry{tiffTagSubIFDs, 4, []uint32{nested}})
+			return tw.ifd(0, append(jpegEntries(100, 30),
+				testIFDEntry{tiffTagSubIFDs, 4, []uint32{sub1, sub2}},
+				testIFDEntry{tiffTagExifIFD, 4, []uint32{exifIFD}})...)
+		}, []rawPreview{{2000, 800}, {1000, 500}, {3000, 70}, {100, 30}}},
+		{"strip selection", func(tw *testTIFFWriter) uint32 {
+			uncompressed := tw.ifd(0, stripEntries(1, []uint32{1000}, []uint32{900})...)
+			multiple := tw.ifd(0, stripEntries(6, []uint32{2000, 3000}, []uint32{100, 100})...)
+			lossless := tw.ifd(0, stripEntries(7, []uint32{4000}, []uint32{700})...)
+			oldStyle := tw.ifd(0, stripEntries(6, []uint32{5000}, []uint32{600})...)
+			return tw.ifd(0, testIFDEntry{tiffTagSubIFDs, 4,
+				[]uint32{uncompressed, multiple, lossless, oldStyle}})
+		}, []rawPreview{{4000, 700}, {5000, 600}}},
+		{"loops visited once", func(tw *testTIFFWriter) uint32 {
+			// sub IFD referencing itself
+			self := uint32(len(tw.data))
+			tw.ifd(0, append(jpegEntries(500, 60), testIFDEntry{tiffTagSubIFDs, 4, []uint32{self}})...)
+			ifd1 := tw.ifd(0, append(jpegEntries(300, 40), testIFDEntry{tiffTagSubIFDs, 4, []uint32{self}})...)
+			ifd0 := tw.ifd(ifd1, append(jpegEntries(100, 20), testIFDEntry{tiffTagExifIFD, 4, []uint32{ifd1}})...)
+			// next IFD of the last IFD references the first one
+			tw.setNext(ifd1, ifd0)
+			return ifd0
+		}, []rawPreview{{500, 60}, {300, 40}, {100, 20}}},
+		{"IFD outside of the file", func(tw *testTIFFWriter) uint32 {
+			return tw.ifd(0, append(jpegEntries(100, 20),
+				testIFDEntry{tiffTagSubIFDs, 4, []uint32{1 << 20}})...)
+		}, []rawPreview{{100, 20}}},
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for _, test := range tests {
+			tw := newTestTIFFWriter(order)
+			previews, err := rawPreviews(bytes.NewReader(tw.bytes(test.build(tw))))
+			if err != nil {
+				t.Errorf("%s %v: unexpected error %v", test.name, order, err)
+				continue
+			}
+			if !reflect.DeepEqual(previews, test.expected) {
+				t.Errorf("%s %v: previews %v, expected %v", test.name, order, previews, test.expected)
+			}
+		}
+	}
+}
+
+func TestRawPreviewsLimit(t *testing.T) {
+	tw := newTestTIFFWriter(binary.LittleEndian)
+	next := uint32(0)
+	for i := 0; i < 2*maxRawIFDs; i++ {
+		next = tw.ifd(next, jpegEntries(uint32(100+i), 10+i)...)
+	}
+	previews, err := rawPreviews(bytes.NewReader(tw.bytes(next)))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(previews) != maxRawIFDs {
+		t.Errorf("%d previews of a chain of %d IFDs, expected %d", len(previews), 2*maxRawIFDs, maxRawIFDs)
+	}
+}
+
+func TestRawPreviewsInvalid(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("II*"), []byte("GIF89a\x00\x00")} {
+		if _, err := rawPreviews(bytes.NewReader(data)); err == nil {
+			t.Errorf("No error for %q", data)
+		}
+	}
+}
+
+func TestDecodeRawPreview(t *testing.T) {
+	small := testJPEG(t, 16, 12)
+	big := testJPEG(t, 64, 48)
+	tw := newTestTIFFWriter(binary.LittleEndian)
+	smallOffset := tw.add(small)
+	bigOffset := tw.add(big)
+	// lossless JPEG coded sensor data can not be decoded and is skipped
+	sensor := bytes.Repeat([]byte{0xff, 0xd8, 0xff, 0xc3}, 1000)
+	sensorOffset := tw.add(sensor)
+	raw := tw.ifd(0, stripEntries(7, []uint32{sensorOffset}, []uint32{uint32(len(sensor))})...)
+	preview := tw.ifd(0, stripEntries(6, []uint32{bigOffset}, []uint32{uint32(len(big))})...)
+	data := tw.bytes(tw.ifd(0, append(jpegEntries(smallOffset, len(small)),
+		testIFDEntry{tiffTagSubIFDs, 4, []uint32{raw, preview}})...))
+
+	// reader with and without random access
+	for _, r := range []io.Reader{bytes.NewReader(data), io.MultiReader(bytes.NewReader(data))} {
+		img, err := decodeRawPreview(r)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if b := img.Bounds(); b.Dx() != 64 || b.Dy() != 48 {
+			t.Errorf("Preview of %dx%d decoded, expected the biggest 64x48", b.Dx(), b.Dy())
+		}
+	}
+
+	tw = newTestTIFFWriter(binary.LittleEndian)
+	sensorOffset = tw.add(sensor)
+	data = tw.bytes(tw.ifd(0, stripEntries(7, []uint32{sensorOffset}, []uint32{uint32(len(sensor))})...))
+	if _, err := decodeRawPreview(bytes.NewReader(data)); err == nil {
+		t.Error("Error expected without decodable preview")
+	}
+}
+
+func TestPairFile(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.cr2", "a.jpg", "b.CR2", "b.JPG", "c.dng", "c.jpeg",
+		"d.nef", "e.jpg", "e.png", "f.ARW", "f.jpg", "h.png", "h.dng"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "g.jpg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "g.cr2"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		fileName string
+		pair     string
+	}{
+		{"a.cr2", "a.jpg"},
+		{"a.jpg", "a.cr2"},
+		{"b.CR2", "b.JPG"},
+		{"b.JPG", "b.CR2"},
+		{"c.dng", "c.jpeg"},
+		{"c.jpeg", "c.dng"},
+		{"d.nef", ""},
+		{"e.jpg", ""},
+		{"e.png", ""},
+		{"f.jpg", "f.ARW"},
+		{"f.ARW", "f.jpg"},
+		{"g.cr2", ""},
+		{"h.png", ""},
+		{"h.dng", ""},
+	}
+	for _, test := range tests {
+		fileName := filepath.Join(dir, test.fileName)
+		format := FormatBySuffix(fileName)
+		if format == nil {
+			t.Fatalf("No format of %s", test.fileName)
+		}
+		expected := ""
+		if test.pair != "" {
+			expected = filepath.Join(dir, test.pair)
+		}
+		if pair := pairFile(fileName, format); pair != expected {
+			t.Errorf("Pair of %s is %q, expected %q", test.fileName, pair, expected)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RenditionSizes long edge sizes of the renditions generated in addition
+// to the thumbnail. Pictures smaller than a size get no rendition of it.
+var RenditionSizes = []uint32{1024, 2048}
+
+// Rendition scaled JPEG copy of the picture stored in the rendition file
+// keyed by checksum (CP) and size
+type Rendition struct {
+	ChecksumPicture string
+	Size            uint32
+	Width           uint32
+	Height          uint32
+	Data            []byte
+}
+
+// ParseRenditionSizes parse comma-separated list of rendition sizes
+func ParseRenditionSizes(list string) ([]uint32, error) {
+	sizes := make([]uint32, 0)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(s, 10, 32)
+		if err != nil || v == 0 {
+			return nil, fmt.Errorf("invalid rendition size %s", s)
+		}
+		sizes = append(sizes, uint32(v))
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	return sizes, nil
+}
+
+func renditionKey(checksum string, size uint32) string {
+	return fmt.Sprintf("%s-%05d", checksum, size)
+}
+
+// renditionKeySize size part of the rendition key
+func renditionKeySize(key string) (uint32, error) {
+	key = strings.TrimSpace(key)
+	i := strings.LastIndex(key, "-")
+	if i < 0 {
+		return 0, fmt.Errorf("invalid rendition key %s", key)
+	}
+	v, err := strconv.ParseUint(key[i+1:], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rendition key %s", key)
+	}
+	return uint32(v), nil
+}
+
+// newRendition rendition with dimensions taken out of the JPEG data
+func newRendition(checksum string, size uint32, data []byte) (*Rendition, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return &Rendition{ChecksumPicture: checksum, Size: size, Width: uint32(config.Width),
+		Height: uint32(config.Height), Data: data}, nil
+}
+
+// createRenditions scale the oriented image to all sizes smaller than its
+// long edge
+func createRenditions(checksum string, oriented image.Image, sizes []uint32) ([]*Rendition, error) {
+	b := oriented.Bounds()
+	longEdge := uint32(b.Dx())
+	if uint32(b.Dy()) > longEdge {
+		longEdge = uint32(b.Dy())
+	}
+	renditions := make([]*Rendition, 0, len(sizes))
+	for _, size := range sizes {
+		if size >= longEdge {
+			continue
+		}
+		data, w, h, err := resizePicture(reduceImage(oriented, int(size)), int(size))
+		if err != nil {
+			return nil, err
+		}
+		renditions = append(renditions, &Rendition{ChecksumPicture: checksum, Size: size,
+			Width: w, Height: h, Data: data})
+	}
+	return renditions, nil
+}
+
+// CreateRenditions decode the media, apply the EXIF orientation of the
+// metadata and scale it to all given sizes smaller than the picture
+func CreateRenditions(format *MediaFormat, media io.Reader, metadata *PictureMetadata, sizes []uint32) ([]*Rendition, error) {
+	srcImage, err := format.Decode(media)
+	if err != nil {
+		return nil, err
+	}
+	return createRenditions(metadata.ChecksumPicture,
+		format.orient(srcImage, metadata.ExifOrientation), sizes)
+}
+
+// MissingRenditionSizes sizes of the list not stored for the picture yet.
+// Sizes not smaller than the original dimensions are skipped.
+func MissingRenditionSizes(repository PictureRepository, metadata *PictureMetadata, sizes []uint32) ([]uint32, error) {
+	stored, err := repository.ReadRenditionSizes(metadata.ChecksumPicture)
+	if err != nil {
+		return nil, err
+	}
+	longEdge := metadata.Width
+	if metadata.Height > longEdge {
+		longEdge = metadata.Height
+	}
+	missing := make([]uint32, 0, len(sizes))
+	for _, size := range sizes {
+		if longEdge > 0 && size >= longEdge {
+			continue
+		}
+		found := false
+		for _, s := range stored {
+			if s == size {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, size)
+		}
+	}
+	return missing, nil
+}
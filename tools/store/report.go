@@ -0,0 +1,201 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Exit codes of the tools
+const (
+	// ExitClean all work done without errors
+	ExitClean = 0
+	// ExitPartial the run completed, but some files or records failed
+	ExitPartial = 1
+	// ExitFatal the run was aborted
+	ExitFatal = 2
+)
+
+// MaxReportFailures maximum failures listed in the run report, all
+// failures are counted in FailedTotal
+var MaxReportFailures = 10000
+
+// ReportFailure file or record failed during the run
+type ReportFailure struct {
+	Path  string `json:",omitempty"`
+	Isn   uint64 `json:",omitempty"`
+	Class string
+	Error string
+}
+
+type reportCounter struct {
+	name  string
+	value func() uint64
+}
+
+// RunReport machine-readable summary of a tool run
+type RunReport struct {
+	Tool        string
+	Host        string
+	Parameters  map[string]string
+	Start       time.Time
+	End         time.Time
+	Duration    float64
+	Status      string
+	ExitCode    int
+	Fatal       string `json:",omitempty"`
+	Interrupted string `json:",omitempty"`
+	Counters    map[string]uint64
+	Errors      map[string]uint64
+	Failed      []*ReportFailure
+	FailedTotal uint64
+	lock        sync.Mutex
+	statistic   *PictureStatistic
+	counters    []*reportCounter
+}
+
+// NewRunReport new run report of the tool, the parameters are taken from
+// the parsed flags
+func NewRunReport(tool string, flags *flag.FlagSet) *RunReport {
+	report := &RunReport{Tool: tool, Host: Hostname, Start: time.Now(),
+		Parameters: make(map[string]string), Counters: make(map[string]uint64),
+		Errors: make(map[string]uint64), Failed: make([]*ReportFailure, 0)}
+	flags.VisitAll(func(f *flag.Flag) {
+		report.Parameters[f.Name] = f.Value.String()
+	})
+	return report
+}
+
+// SetStatistics report the counters of the statistic
+func (report *RunReport) SetStatistics(stat *PictureStatistic) {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	report.statistic = stat
+}
+
+// AddCounter report a counter of the tool, the value is taken at the end
+// of the run
+func (report *RunReport) AddCounter(name string, value func() uint64) {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	report.counters = append(report.counters, &reportCounter{name: name, value: value})
+}
+
+// FailedPath report the file failed with the error
+func (report *RunReport) FailedPath(path string, err error) {
+	report.failed(&ReportFailure{Path: path, Class: ErrorClass(err), Error: err.Error()})
+}
+
+// FailedIsn report the record failed with the error
+func (report *RunReport) FailedIsn(isn uint64, err error) {
+	report.failed(&ReportFailure{Isn: isn, Class: ErrorClass(err), Error: err.Error()})
+}
+
+func (report *RunReport) failed(failure *ReportFailure) {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	report.FailedTotal++
+	report.Errors[failure.Class]++
+	if len(report.Failed) < MaxReportFailures {
+		report.Failed = append(report.Failed, failure)
+	}
+}
+
+// Abort report the fatal error aborting the run
+func (report *RunReport) Abort(err error) {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	report.Fatal = err.Error()
+}
+
+// Interrupt report the graceful stop of the run, the work done is complete
+// but not all work is done. The run is partial unless it is aborted.
+func (report *RunReport) Interrupt(reason string) {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	report.Interrupted = reason
+}
+
+// finish end the run and evaluate the exit code
+func (report *RunReport) finish() {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	report.End = time.Now()
+	report.Duration = report.End.Sub(report.Start).Seconds()
+	errors := report.FailedTotal
+	if report.statistic != nil {
+		snapshot := report.statistic.Snapshot()
+		for c := Counter(0); c < nrCounters; c++ {
+			report.Counters[c.String()] = snapshot.Counter(c)
+		}
+		errors += snapshot.NrErrors
+	}
+	for _, rc := range report.counters {
+		report.Counters[rc.name] = rc.value()
+	}
+	switch {
+	case report.Fatal != "":
+		report.Status = "fatal"
+		report.ExitCode = ExitFatal
+	case errors > 0 || report.Interrupted != "":
+		report.Status = "partial"
+		report.ExitCode = ExitPartial
+	default:
+		report.Status = "clean"
+		report.ExitCode = ExitClean
+	}
+}
+
+// WriteReport write the run report as JSON
+func (report *RunReport) WriteReport(fileName string) error {
+	report.lock.Lock()
+	defer report.lock.Unlock()
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, data, 0644)
+}
+
+// Exit end the run, write the report if a file name is given and exit with
+// the exit code of the run. Deferred first in main it runs after all other
+// deferred functions. A panic of main aborts the run.
+func (report *RunReport) Exit(fileName string) {
+	if r := recover(); r != nil {
+		fmt.Fprintf(os.Stderr, "panic: %v\n%s", r, debug.Stack())
+		report.Abort(fmt.Errorf("panic: %v", r))
+	}
+	report.finish()
+	if fileName != "" {
+		err := report.WriteReport(fileName)
+		if err != nil {
+			fmt.Println("Error writing run report:", err)
+		}
+	}
+	if report.ExitCode != ExitClean {
+		os.Exit(report.ExitCode)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+// PictureCursor cursor over picture records. The data returned by
+// NextData is either *PictureData or *PictureMetadata depending on
+// the repository call creating the cursor.
+type PictureCursor interface {
+	HasNextRecord() bool
+	NextData() (interface{}, error)
+}
+
+// ChecksumQuantity called for each ChecksumPicture descriptor value with
+// the number of records containing the value
+type ChecksumQuantity func(checksum string, quantity uint64) error
+
+// PictureRepository storage backend of the picture tools
+type PictureRepository interface {
+	// PictureFileAvailable check if picture path key (PM) is stored
+	PictureFileAvailable(key string) (bool, error)
+	// PictureMediaAvailable check if picture checksum (CP) is stored
+	PictureMediaAvailable(checksum string) (bool, error)
+	// ReadChecksumMetadata read metadata with locations of the checksum (CP)
+	ReadChecksumMetadata(checksum string) ([]*PictureMetadata, error)
+	// ReadFileMetadata read metadata with locations of the picture path
+	// key (PM)
+	ReadFileMetadata(key string) ([]*PictureMetadata, error)
+	// ReadMedia read picture data with media and thumbnail of the given ISN
+	ReadMedia(isn uint64) (*PictureData, error)
+	// StoreMetadata insert or update all metadata fields, the ISN is set
+	// into the metadata index
+	StoreMetadata(insert bool, metadata *PictureMetadata) error
+	// UpdateMediaChunk update the media (DP) of the ISN at the offset, a
+	// chunk at offset 0 replaces the media
+	UpdateMediaChunk(isn, offset uint64, chunk []byte) error
+	// UpdateThumbnail update checksum and thumbnail (CP,DT) of the picture data index
+	UpdateThumbnail(data *PictureData) error
+	// UpdateDimensions update fill, original and thumbnail dimensions (FI,WI,HE,TW,TH)
+	// of the metadata index
+	UpdateDimensions(metadata *PictureMetadata) error
+	// UpdateSHA256 update SHA-256 checksum (CS) of the picture data index
+	UpdateSHA256(data *PictureData) error
+	// UpdateMIMEType update MIME type (TY) of the picture data index
+	UpdateMIMEType(data *PictureData) error
+	// UpdateLocations update picture location list (PL) of the metadata index
+	UpdateLocations(metadata *PictureMetadata) error
+	// SearchHash search all ISN containing the picture path key (PM)
+	SearchHash(key string) ([]uint64, error)
+	// SearchName search all ISN containing the picture name (PN)
+	SearchName(name string) ([]uint64, error)
+	// SearchPair search all ISN of the RAW and JPEG pair key (RP)
+	SearchPair(key string) ([]uint64, error)
+	// Delete delete record with given ISN, media segments are deleted
+	// if no other record references them
+	Delete(isn uint64) error
+	// SegmentsAvailable true if media bigger than the maximum blob size
+	// can be stored in segments
+	SegmentsAvailable() bool
+	// StoreSegment store media segment of the given checksum (CP)
+	StoreSegment(checksum string, sequence uint32, data []byte) error
+	// ReadSegment read media segment of the given checksum (CP)
+	ReadSegment(checksum string, sequence uint32) ([]byte, error)
+	// DeleteSegments delete all media segments of the given checksum (CP)
+	DeleteSegments(checksum string) error
+	// RenditionsAvailable true if renditions can be stored
+	RenditionsAvailable() bool
+	// StoreRendition store rendition of the checksum (CP) and size
+	StoreRendition(rendition *Rendition) error
+	// ReadRendition read rendition of the given checksum (CP) and size
+	ReadRendition(checksum string, size uint32) (*Rendition, error)
+	// ReadRenditionSizes sizes of all renditions stored for the checksum (CP)
+	ReadRenditionSizes(checksum string) ([]uint32, error)
+	// DeleteRenditions delete all renditions of the given checksum (CP)
+	DeleteRenditions(checksum string) error
+	// ReadHost cursor of picture data located at host (PH)
+	ReadHost(host string) (PictureCursor, error)
+	// ReadChecksum cursor of picture data with checksum (CP)
+	ReadChecksum(checksum string) (PictureCursor, error)
+	// ReadData cursor of all picture data including media and MIME type,
+	// limit 0 is all
+	ReadData(limit uint64) (PictureCursor, error)
+	// ReadMetadata cursor of all picture metadata, limit 0 is all
+	ReadMetadata(limit uint64) (PictureCursor, error)
+	// ReadOption cursor of picture metadata with the option (OP)
+	ReadOption(option string) (PictureCursor, error)
+	// ReadGeoCell cursor of picture metadata in geo cells (GC) starting
+	// with the prefix
+	ReadGeoCell(prefix string) (PictureCursor, error)
+	// HistogramChecksum call function for each checksum (CP), limit 0 is all
+	HistogramChecksum(limit uint64, fn ChecksumQuantity) error
+	// EndTransaction commit pending changes
+	EndTransaction() error
+	// Close repository
+	Close()
+}
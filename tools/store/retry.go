@@ -0,0 +1,460 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy retry of repository operations failing with a temporary
+// Adabas response code. The connection is reconnected before the retry if
+// the response code signals a lost session. A lost session or backout with
+// uncommitted changes is not retried per operation, the unit of work is
+// repeated from the start instead.
+type RetryPolicy struct {
+	// Attempts maximum number of attempts including the first one
+	Attempts int
+	// Backoff wait time before the first retry, doubled for each retry
+	Backoff time.Duration
+	// MaxBackoff maximum wait time between two attempts
+	MaxBackoff time.Duration
+	// Responses retriable Adabas response codes
+	Responses map[int]bool
+	// Reconnect response codes needing a new connection before the retry
+	Reconnect map[int]bool
+}
+
+// DefaultRetryResponses temporary Adabas response codes: 9 transaction
+// backed out, 48 file locked by utility, 145 record in hold, 148 database
+// not active, 149 communication error, 255 buffers exhausted
+const DefaultRetryResponses = "9,48,145,148,149,255"
+
+// defaultReconnectResponses response codes of a lost session
+const defaultReconnectResponses = "9,148,149"
+
+// DefaultRetryPolicy retry policy of new Adabas repositories, one attempt
+// disables the retry
+var DefaultRetryPolicy = &RetryPolicy{Attempts: 1, Backoff: 2 * time.Second, MaxBackoff: time.Minute,
+	Responses: mustParseResponseCodes(DefaultRetryResponses), Reconnect: mustParseResponseCodes(defaultReconnectResponses)}
+
+// ParseResponseCodes parse comma-separated list of Adabas response codes
+func ParseResponseCodes(list string) (map[int]bool, error) {
+	codes := make(map[int]bool)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		code, err := strconv.Atoi(s)
+		if err != nil || code <= 0 {
+			return nil, fmt.Errorf("invalid response code %s", s)
+		}
+		codes[code] = true
+	}
+	return codes, nil
+}
+
+func mustParseResponseCodes(list string) map[int]bool {
+	codes, err := ParseResponseCodes(list)
+	if err != nil {
+		panic(err)
+	}
+	return codes
+}
+
+func (policy *RetryPolicy) String() string {
+	codes := make([]string, 0, len(policy.Responses))
+	for code := range policy.Responses {
+		codes = append(codes, strconv.Itoa(code))
+	}
+	sort.Strings(codes)
+	return fmt.Sprintf("attempts=%d backoff=%v max backoff=%v responses=%s", policy.Attempts,
+		policy.Backoff, policy.MaxBackoff, strings.Join(codes, ","))
+}
+
+// retriable check if the error is temporary, the second return value is
+// true if the connection need to be reconnected. Network errors are
+// handled as lost session.
+func (policy *RetryPolicy) retriable(err error) (bool, bool) {
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return true, true
+	}
+	var be *BackendError
+	if !errors.As(err, &be) {
+		be, _ = backendError("", err).(*BackendError)
+	}
+	if be == nil || !policy.Responses[be.Response] {
+		return false, false
+	}
+	return true, policy.Reconnect[be.Response]
+}
+
+// backoff wait time before the given retry
+func (policy *RetryPolicy) backoff(retry int) time.Duration {
+	wait := policy.Backoff
+	for i := 1; i < retry && wait < policy.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if policy.MaxBackoff > 0 && wait > policy.MaxBackoff {
+		wait = policy.MaxBackoff
+	}
+	return wait
+}
+
+// reconnector repository able to open a new connection
+type reconnector interface {
+	Reconnect() error
+}
+
+// retryRepository repository retrying the operations of the wrapped
+// repository according to the retry policy. The duration of each attempt is
+// counted in the statistics. Operations are only retried after a reconnect
+// as long as no changes are pending, otherwise the error wraps
+// ErrTransactionLost.
+type retryRepository struct {
+	PictureRepository
+	policy     *RetryPolicy
+	statistics *PictureStatistic
+	// pending changes not committed by EndTransaction yet
+	pending bool
+}
+
+// transactionLostError backend error which backed out the uncommitted
+// changes
+type transactionLostError struct {
+	err error
+}
+
+func (e *transactionLostError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrTransactionLost, e.err)
+}
+
+// Unwrap the backend error
+func (e *transactionLostError) Unwrap() error {
+	return e.err
+}
+
+// Is lost transactions match ErrTransactionLost
+func (e *transactionLostError) Is(target error) bool {
+	return target == ErrTransactionLost
+}
+
+// WithRetry wrap the repository retrying failed operations. The repository
+// is returned unchanged if there is no policy.
+func WithRetry(repository PictureRepository, policy *RetryPolicy) PictureRepository {
+	if policy == nil {
+		return repository
+	}
+	return &retryRepository{PictureRepository: repository, policy: policy}
+}
+
+// SetRepositoryStatistics count retries, reconnects and the duration of the
+// operations of a repository created with WithRetry in the statistic
+func SetRepositoryStatistics(repository PictureRepository, stat *PictureStatistic) {
+	if rr, ok := repository.(*retryRepository); ok {
+		rr.statistics = stat
+	}
+}
+
+// do call the operation until it succeeds, the error is not temporary or
+// all attempts are used. A lost session with pending changes is not
+// retried, the connection is reconnected and the transaction is lost.
+func (rr *retryRepository) do(op string, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		err = fn()
+		rr.statistics.ObserveCall(op, time.Since(start))
+		if err == nil || attempt >= rr.policy.Attempts {
+			break
+		}
+		retry, reconnect := rr.policy.retriable(err)
+		if !retry {
+			break
+		}
+		if reconnect && rr.pending {
+			return rr.lost(op, err)
+		}
+		wait := rr.policy.backoff(attempt)
+		fmt.Printf("%s %s failed, retry %d in %v: %v\n", time.Now().Format(timeFormat), op, attempt, wait, err)
+		rr.statistics.Inc(StatRetries)
+		time.Sleep(wait)
+		if reconnect {
+			rr.reconnect()
+		}
+	}
+	return err
+}
+
+// change call the changing operation like do, the change is pending until
+// the next EndTransaction
+func (rr *retryRepository) change(op string, fn func() error) error {
+	err := rr.do(op, fn)
+	if err == nil {
+		rr.pending = true
+	}
+	return err
+}
+
+// lost reconnect for the next unit of work and return the error of the
+// lost transaction
+func (rr *retryRepository) lost(op string, err error) error {
+	fmt.Printf("%s %s failed, transaction lost: %v\n", time.Now().Format(timeFormat), op, err)
+	rr.pending = false
+	rr.reconnect()
+	return &transactionLostError{err: backendError(op, err)}
+}
+
+func (rr *retryRepository) reconnect() {
+	if rc, ok := rr.PictureRepository.(reconnector); ok {
+		if rerr := rc.Reconnect(); rerr != nil {
+			fmt.Printf("%s Reconnect failed: %v\n", time.Now().Format(timeFormat), rerr)
+			return
+		}
+		rr.statistics.Inc(StatReconnects)
+	}
+}
+
+// retryUnit call the unit of work again from the start as long as it fails
+// with ErrTransactionLost and the attempts of the retry policy of the
+// repository are not used up
+func retryUnit(repository PictureRepository, op string, unit func() error) error {
+	rr, ok := repository.(*retryRepository)
+	if !ok {
+		return unit()
+	}
+	for attempt := 1; ; attempt++ {
+		err := unit()
+		if err == nil || attempt >= rr.policy.Attempts || !errors.Is(err, ErrTransactionLost) {
+			return err
+		}
+		wait := rr.policy.backoff(attempt)
+		fmt.Printf("%s %s failed, repeat %d in %v: %v\n", time.Now().Format(timeFormat), op, attempt, wait, err)
+		rr.statistics.Inc(StatRetries)
+		time.Sleep(wait)
+	}
+}
+
+func (rr *retryRepository) PictureFileAvailable(key string) (ok bool, err error) {
+	err = rr.do("check picture file", func() (e error) {
+		ok, e = rr.PictureRepository.PictureFileAvailable(key)
+		return
+	})
+	return
+}
+
+func (rr *retryRepository) PictureMediaAvailable(checksum string) (ok bool, err error) {
+	err = rr.do("check picture media", func() (e error) {
+		ok, e = rr.PictureRepository.PictureMediaAvailable(checksum)
+		return
+	})
+	return
+}
+
+func (rr *retryRepository) ReadChecksumMetadata(checksum string) (list []*PictureMetadata, err error) {
+	err = rr.do("read checksum", func() (e error) {
+		list, e = rr.PictureRepository.ReadChecksumMetadata(checksum)
+		return
+	})
+	return
+}
+
+func (rr *retryRepository) ReadFileMetadata(key string) (list []*PictureMetadata, err error) {
+	err = rr.do("read file", func() (e error) {
+		list, e = rr.PictureRepository.ReadFileMetadata(key)
+		return
+	})
+	return
+}
+
+func (rr *retryRepository) ReadMedia(isn uint64) (data *PictureData, err error) {
+	err = rr.do("read media", func() (e error) {
+		data, e = rr.PictureRepository.ReadMedia(isn)
+		return
+	})
+	return
+}
+
+func (rr *retryRepository) StoreMetadata(insert bool, metadata *PictureMetadata) error {
+	return rr.change("store metadata", func() error { return rr.PictureRepository.StoreMetadata(insert, metadata) })
+}
+
+func (rr *retryRepository) UpdateMediaChunk(isn, offset uint64, chunk []byte) error {
+	return rr.change("update media", func() error { return rr.PictureRepository.UpdateMediaChunk(isn, offset, chunk) })
+}
+
+func (rr *retryRepository) UpdateThumbnail(data *PictureData) error {
+	return rr.change("update thumbnail", func() error { return rr.PictureRepository.UpdateThumbnail(data) })
+}
+
+func (rr *retryRepository) UpdateDimensions(metadata *PictureMetadata) error {
+	return rr.change("update dimensions", func() error { return rr.PictureRepository.UpdateDimensions(metadata) })
+}
+
+func (rr *retryRepository) UpdateSHA256(data *PictureData) error {
+	return rr.change("update SHA-256", func() error { return rr.PictureRepository.UpdateSHA256(data) })
+}
+
+func (rr *retryRepository) UpdateMIMEType(data *PictureData) error {
+	return rr.change("update MIME type", func() error { return rr.PictureRepository.UpdateMIMEType(data) })
+}
+
+func (rr *retryRepository) UpdateLocations(metadata *PictureMetadata) error {
+	return rr.change("update locations", func() error { return rr.PictureRepository.UpdateLocations(metadata) })
+}
+
+func (rr *retryRepository) SearchHash(key string) (isns []uint64, err error) {
+	err = rr.do("search hash", func() (e error) {
+		isns, e = rr.PictureRepository.SearchHash(key)
+		return
+	})
+	return
+}
+
+func (rr *retryRepository) SearchName(name string) (isns []uint64, err error) {
+	err = rr.do("search name", func() (e error) {
+		isns, e = rr.PictureRepository.SearchName(name)
+		return
+	})
+	return
+}
+
+func (rr *retryRepository) SearchPair(key string) (isns []uint64, err error) {
+	err = rr.do("search pair", func() (e error) {
+		isns, e = rr.PictureRepository.SearchPair(key)
+		return
+	})
+	return
+}
+
+func (rr *retryRepository) Delete(isn uint64) error {
+	return rr.change("delete", func() error { return rr.PictureRepository.Delete(isn) })
+}
+
+func (rr *retryRepository) StoreSegment(checksum string, sequence uint32, data []byte) error {
+	return rr.change("store segment", func() error { return rr.PictureRepository.StoreSegment(checksum, sequence, data) })
+}
+
+func (rr *retryRepository) ReadSegment(checksum string, sequence uint32) (data []byte, err error) {
+	err = rr.do("read segment", func() (e error) {
+		data, e = rr.PictureRepository.ReadSegment(checksum, sequence)
+		return
+	})
+	return
+}
+
+func (rr *retryRepository) DeleteSegments(checksum string) error {
+	return rr.change("delete segments", func() error { return rr.PictureRepository.DeleteSegments(checksum) })
+}
+
+func (rr *retryRepository) StoreRendition(rendition *Rendition) error {
+	return rr.change("store rendition", func() error { return rr.PictureRepository.StoreRendition(rendition) })
+}
+
+func (rr *retryRepository) ReadRendition(checksum string, size uint32) (rendition *Rendition, err error) {
+	err = rr.do("read rendition", func() (e error) {
+		rendition, e = rr.PictureRepository.ReadRendition(checksum, size)
+		return
+	})
+	return
+}
+
+func (rr *retryRepository) ReadRenditionSizes(checksum string) (sizes []uint32, err error) {
+	err = rr.do("read rendition sizes", func() (e error) {
+		sizes, e = rr.PictureRepository.ReadRenditionSizes(checksum)
+		return
+	})
+	return
+}
+
+func (rr *retryRepository) DeleteRenditions(checksum string) error {
+	return rr.change("delete renditions", func() error { return rr.PictureRepository.DeleteRenditions(checksum) })
+}
+
+func (rr *retryRepository) ReadHost(host string) (cursor PictureCursor, err error) {
+	err = rr.do("read host", func() (e error) {
+		cursor, e = rr.PictureRepository.ReadHost(host)
+		return
+	})
+	return
+}
+
+func (rr *retryRepository) ReadChecksum(checksum string) (cursor PictureCursor, err error) {
+	err = rr.do("read checksum", func() (e error) {
+		cursor, e = rr.PictureRepository.ReadChecksum(checksum)
+		return
+	})
+	return
+}
+
+func (rr *retryRepository) ReadData(limit uint64) (cursor PictureCursor, err error) {
+	err = rr.do("read data", func() (e error) {
+		cursor, e = rr.PictureRepository.ReadData(limit)
+		return
+	})
+	return
+}
+
+func (rr *retryRepository) ReadOption(option string) (cursor PictureCursor, err error) {
+	err = rr.do("read option", func() (e error) {
+		cursor, e = rr.PictureRepository.ReadOption(option)
+		return
+	})
+	return
+}
+
+func (rr *retryRepository) ReadGeoCell(prefix string) (cursor PictureCursor, err error) {
+	err = rr.do("read geo cell", func() (e error) {
+		cursor, e = rr.PictureRepository.ReadGeoCell(prefix)
+		return
+	})
+	return
+}
+
+func (rr *retryRepository) ReadMetadata(limit uint64) (cursor PictureCursor, err error) {
+	err = rr.do("read metadata", func() (e error) {
+		cursor, e = rr.PictureRepository.ReadMetadata(limit)
+		return
+	})
+	return
+}
+
+// EndTransaction commit the pending changes. The commit is never retried on
+// its own, a lost session loses the transaction.
+func (rr *retryRepository) EndTransaction() error {
+	start := time.Now()
+	err := rr.PictureRepository.EndTransaction()
+	rr.statistics.ObserveCall("end transaction", time.Since(start))
+	if err == nil {
+		rr.pending = false
+		return nil
+	}
+	if retry, reconnect := rr.policy.retriable(err); retry && reconnect && rr.policy.Attempts > 1 {
+		return rr.lost("end transaction", err)
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// flakyRepository memory repository failing with Adabas response codes
+type flakyRepository struct {
+	*MemoryRepository
+	mediaFailures  int
+	commitFailures int
+	readFailures   int
+	commits        int
+	reconnects     int
+}
+
+func (fr *flakyRepository) UpdateMediaChunk(isn, offset uint64, chunk []byte) error {
+	if fr.mediaFailures > 0 {
+		fr.mediaFailures--
+		return errors.New("ADAGE09000: transaction backed out")
+	}
+	return fr.MemoryRepository.UpdateMediaChunk(isn, offset, chunk)
+}
+
+func (fr *flakyRepository) EndTransaction() error {
+	fr.commits++
+	if fr.commitFailures > 0 {
+		fr.commitFailures--
+		return errors.New("communication error, response code 149")
+	}
+	return fr.MemoryRepository.EndTransaction()
+}
+
+func (fr *flakyRepository) PictureFileAvailable(key string) (bool, error) {
+	if fr.readFailures > 0 {
+		fr.readFailures--
+		return false, errors.New("ADAGE94000: database not active")
+	}
+	return fr.MemoryRepository.PictureFileAvailable(key)
+}
+
+func (fr *flakyRepository) Reconnect() error {
+	fr.reconnects++
+	return nil
+}
+
+func testRetryPolicy() *RetryPolicy {
+	policy := *DefaultRetryPolicy
+	policy.Attempts = 3
+	policy.Backoff = time.Millisecond
+	return &policy
+}
+
+func TestRetryReadWithoutPendingChanges(t *testing.T) {
+	fr := &flakyRepository{MemoryRepository: NewMemoryRepository(), readFailures: 1}
+	repository := WithRetry(fr, testRetryPolicy())
+	if _, err := repository.PictureFileAvailable("AA"); err != nil {
+		t.Fatalf("read not retried: %v", err)
+	}
+	if fr.reconnects != 1 {
+		t.Errorf("reconnects=%d, want 1", fr.reconnects)
+	}
+}
+
+func TestRetryEndTransactionNotRepeated(t *testing.T) {
+	fr := &flakyRepository{MemoryRepository: NewMemoryRepository(), commitFailures: 1}
+	repository := WithRetry(fr, testRetryPolicy())
+	storeTestRecord(t, fr.MemoryRepository, "AA", "a.jpg", nil)
+	if err := repository.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	err := repository.EndTransaction()
+	if !errors.Is(err, ErrTransactionLost) || !errors.Is(err, ErrBackend) {
+		t.Errorf("EndTransaction error = %v, want lost transaction", err)
+	}
+	if fr.commits != 1 || fr.reconnects != 1 {
+		t.Errorf("commits=%d reconnects=%d, want 1 and 1", fr.commits, fr.reconnects)
+	}
+}
+
+func TestLoadPictureTransactionLost(t *testing.T) {
+	fr := &flakyRepository{MemoryRepository: NewMemoryRepository(), mediaFailures: 1}
+	ps := InitStorePictureRepository(false, WithRetry(fr, testRetryPolicy()))
+	ps.MaxBlobSize = 50000000
+
+	err := ps.LoadPicture(true, testPicture)
+	if err != nil {
+		t.Fatalf("Error loading %s: %v", testPicture, err)
+	}
+	if fr.reconnects != 1 {
+		t.Errorf("reconnects=%d, want 1", fr.reconnects)
+	}
+	if len(fr.content.Records) != 1 {
+		t.Errorf("%d records stored, want 1", len(fr.content.Records))
+	}
+	for _, r := range fr.content.Records {
+		if len(r.Media) == 0 || len(r.Thumbnail) == 0 {
+			t.Errorf("record incomplete: media %d bytes, thumbnail %d bytes", len(r.Media), len(r.Thumbnail))
+		}
+	}
+	snapshot := ps.Statistics().Snapshot()
+	if snapshot.Loaded != 1 || snapshot.Retries != 1 {
+		t.Errorf("Loaded=%d Retries=%d, want 1 and 1", snapshot.Loaded, snapshot.Retries)
+	}
+}
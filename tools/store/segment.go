@@ -0,0 +1,212 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/tknie/adabas-go-api/adabas"
+	"github.com/tknie/adabas-go-api/adatypes"
+)
+
+// Media bigger than the maximum blob size is stored in segments. The first
+// segment is the media (DP) of the picture record, segment 1 up to
+// NrSegments-1 are stored in the segment file referenced by the checksum.
+
+// storeMedia stream the media from the file into the record, only one
+// chunk or segment is held in memory. The first MaxBlobSize bytes are the
+// media (DP) of the record, the rest is stored in segments.
+func (pic *PictureBinary) storeMedia(ps *PictureConnection) error {
+	f, err := os.Open(pic.FileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := md5.New()
+	size := int64(pic.MetaData.MediaSize)
+	first := size
+	if pic.Data.NrSegments > 1 {
+		first = pic.MaxBlobSize
+	}
+	MediaBudget.Acquire(readChunkSize)
+	chunk := make([]byte, readChunkSize)
+	for offset := int64(0); offset < first; {
+		n := first - offset
+		if n > readChunkSize {
+			n = readChunkSize
+		}
+		_, err = io.ReadFull(f, chunk[:n])
+		if err == nil {
+			h.Write(chunk[:n])
+			err = backendError("update media", ps.repository.UpdateMediaChunk(pic.Data.Index, uint64(offset), chunk[:n]))
+		}
+		if err != nil {
+			MediaBudget.Release(readChunkSize)
+			return err
+		}
+		offset += n
+	}
+	MediaBudget.Release(readChunkSize)
+	err = ps.repository.EndTransaction()
+	if err != nil {
+		return backendError("end transaction", err)
+	}
+	if pic.Data.NrSegments > 1 {
+		err = pic.storeSegments(ps, f, h)
+		if err != nil {
+			fmt.Println("Error storing media segments:", err)
+			return err
+		}
+	}
+	if fmt.Sprintf("%X", h.Sum(nil)) != pic.Data.ChecksumPicture {
+		return fmt.Errorf("file %s changed during load", pic.FileName)
+	}
+	return nil
+}
+
+// storeSegments read all segments after the first one from the file and
+// store them one by one. Only one segment is held in memory.
+func (pic *PictureBinary) storeSegments(ps *PictureConnection, f io.Reader, h hash.Hash) error {
+	checksum := pic.Data.ChecksumPicture
+	err := ps.repository.DeleteSegments(checksum)
+	if err != nil {
+		return backendError("store segments", err)
+	}
+	remaining := int64(pic.MetaData.MediaSize) - pic.MaxBlobSize
+	for sequence := uint32(1); sequence < pic.Data.NrSegments; sequence++ {
+		size := pic.MaxBlobSize
+		if size > remaining {
+			size = remaining
+		}
+		MediaBudget.Acquire(size)
+		segment := make([]byte, size)
+		_, err = io.ReadFull(f, segment)
+		if err == nil {
+			h.Write(segment)
+			err = backendError("store segments", ps.repository.StoreSegment(checksum, sequence, segment))
+		}
+		MediaBudget.Release(size)
+		if err != nil {
+			return err
+		}
+		err = ps.repository.EndTransaction()
+		if err != nil {
+			return backendError("end transaction", err)
+		}
+		adatypes.Central.Log.Debugf("Stored segment %d/%d of %s", sequence, pic.Data.NrSegments, checksum)
+		remaining -= size
+	}
+	return nil
+}
+
+// segmentReader read media segments on demand
+type segmentReader struct {
+	repository PictureRepository
+	checksum   string
+	next       uint32
+	nrSegments uint32
+	current    *bytes.Reader
+}
+
+func (sr *segmentReader) Read(p []byte) (int, error) {
+	for sr.current == nil || sr.current.Len() == 0 {
+		if sr.next >= sr.nrSegments {
+			return 0, io.EOF
+		}
+		segment, err := sr.repository.ReadSegment(sr.checksum, sr.next)
+		if err != nil {
+			return 0, err
+		}
+		sr.current = bytes.NewReader(segment)
+		sr.next++
+	}
+	return sr.current.Read(p)
+}
+
+// MediaReader reader providing the complete media of the picture data,
+// additional segments are read from the repository on demand. The
+// checksum read out of the database is blank padded.
+func MediaReader(repository PictureRepository, data *PictureData) io.Reader {
+	if data.NrSegments < 2 {
+		return bytes.NewReader(data.Media)
+	}
+	return io.MultiReader(bytes.NewReader(data.Media),
+		&segmentReader{repository: repository, checksum: strings.Trim(data.ChecksumPicture, " "),
+			next: 1, nrSegments: data.NrSegments})
+}
+
+// DatabaseMediaReader reader providing the complete media of the picture
+// data read with the connection, additional segments are read from the
+// segment file on demand
+func DatabaseMediaReader(connection *adabas.Connection, segmentFile adabas.Fnr, data *PictureData) io.Reader {
+	repository := &adabasRepository{connection: connection,
+		dbReference: &DatabaseReference{SegmentFile: segmentFile}}
+	return MediaReader(repository, data)
+}
+
+// LoadSegments append all additional segments to the media of the picture data
+func LoadSegments(repository PictureRepository, data *PictureData) error {
+	if data.NrSegments < 2 {
+		return nil
+	}
+	var buffer bytes.Buffer
+	_, err := io.Copy(&buffer, MediaReader(repository, data))
+	if err != nil {
+		return err
+	}
+	data.Media = buffer.Bytes()
+	data.NrSegments = 1
+	return nil
+}
+
+// ReadDatabaseSegments append all additional segments stored in the segment file
+// to the media read with ReadDatabase
+func (pic *PictureBinary) ReadDatabaseSegments(connection *adabas.Connection, segmentFile adabas.Fnr) error {
+	repository := &adabasRepository{connection: connection,
+		dbReference: &DatabaseReference{SegmentFile: segmentFile}}
+	var buffer bytes.Buffer
+	buffer.Write(pic.Data.Media)
+	for sequence := uint32(1); pic.Data.NrSegments == 0 || sequence < pic.Data.NrSegments; sequence++ {
+		segment, err := repository.ReadSegment(strings.Trim(pic.Data.ChecksumPicture, " "), sequence)
+		if err != nil {
+			// number of segments unknown, stop at first missing segment
+			if pic.Data.NrSegments == 0 {
+				break
+			}
+			return err
+		}
+		buffer.Write(segment)
+	}
+	pic.Data.Media = buffer.Bytes()
+	return nil
+}
+
+// mediaSource reader of the complete media during load. The media is not
+// held in memory, so the file is read again. The returned reader
+// implements io.ReaderAt for random access.
+func (pic *PictureBinary) mediaSource() (io.ReadCloser, error) {
+	return os.Open(pic.FileName)
+}
@@ -0,0 +1,290 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter statistic counter of a picture run
+type Counter int
+
+// Counters of the picture statistic
+const (
+	StatChecked Counter = iota
+	StatLoaded
+	StatFound
+	StatToBig
+	StatNrErrors
+	StatNrDeleted
+	StatAdded
+	StatEmpty
+	StatIgnored
+	StatDuplicated
+	StatSegmented
+	StatCollisions
+	StatUnknown
+	StatPaired
+	StatMimeMismatch
+	StatDecodeFailed
+	StatCorrupt
+	StatRetries
+	StatReconnects
+	StatVerified
+	StatSizeDiffFound
+	StatDiffFound
+	StatNotFound
+	StatOtherHost
+	StatBytesLoaded
+	StatResumed
+	StatUnchanged
+	StatChanged
+	nrCounters
+)
+
+// counterMetrics metric name and help of the counters
+var counterMetrics = [nrCounters]struct{ name, help string }{
+	StatChecked:       {"checked", "Media files checked"},
+	StatLoaded:        {"loaded", "Media files loaded"},
+	StatFound:         {"found", "Media files already loaded"},
+	StatToBig:         {"too_big", "Media files bigger than the maximum blob size"},
+	StatNrErrors:      {"errors", "Media files failed with error"},
+	StatNrDeleted:     {"deleted", "Media files deleted by filter"},
+	StatAdded:         {"added", "Locations added to already loaded media"},
+	StatEmpty:         {"empty", "Empty media files"},
+	StatIgnored:       {"ignored", "Media files ignored by query"},
+	StatDuplicated:    {"duplicated", "Duplicated media files"},
+	StatSegmented:     {"segmented", "Media files stored in segments"},
+	StatCollisions:    {"collisions", "Checksum collisions"},
+	StatUnknown:       {"unknown", "Files of unknown media format"},
+	StatPaired:        {"paired", "RAW and JPEG pairs"},
+	StatMimeMismatch:  {"mime_mismatch", "Suffixes not matching the content"},
+	StatDecodeFailed:  {"decode_failed", "Pictures stored without thumbnail"},
+	StatCorrupt:       {"corrupt", "Media files failed the integrity validation"},
+	StatRetries:       {"retries", "Retried repository operations"},
+	StatReconnects:    {"reconnects", "Repository reconnects"},
+	StatVerified:      {"verified", "Media files verified"},
+	StatSizeDiffFound: {"size_diff_found", "Verified media files differing in size"},
+	StatDiffFound:     {"diff_found", "Verified media files differing in content"},
+	StatNotFound:      {"not_found", "Verified media files not found"},
+	StatOtherHost:     {"other_host", "Verified locations of other hosts"},
+	StatBytesLoaded:   {"loaded_bytes", "Media bytes loaded"},
+	StatResumed:       {"resumed", "Media files skipped, completed by a previous run"},
+	StatUnchanged:     {"unchanged", "Media files skipped, unchanged in the file state"},
+	StatChanged:       {"changed", "Media files changed since the last load"},
+}
+
+func (counter Counter) String() string {
+	return counterMetrics[counter].name
+}
+
+// PictureStatistic statistic of a picture load or verify run, safe for
+// concurrent use. Counters are updated atomically, the error histogram and
+// the hosts under the lock. Snapshot locks exclusively to get a consistent
+// copy of all values.
+type PictureStatistic struct {
+	counters  [nrCounters]uint64
+	lock      sync.RWMutex
+	errors    map[string]uint64
+	hosts     map[string]bool
+	thumbnail *Histogram
+	calls     map[string]*Histogram
+}
+
+// StatisticSnapshot consistent copy of the picture statistic
+type StatisticSnapshot struct {
+	Time          time.Time
+	Checked       uint64
+	Loaded        uint64
+	Found         uint64
+	ToBig         uint64
+	NrErrors      uint64
+	NrDeleted     uint64
+	Added         uint64
+	Empty         uint64
+	Ignored       uint64
+	Duplicated    uint64
+	Segmented     uint64
+	Collisions    uint64
+	Unknown       uint64
+	Paired        uint64
+	MimeMismatch  uint64
+	DecodeFailed  uint64
+	Corrupt       uint64
+	Retries       uint64
+	Reconnects    uint64
+	Verified      uint64
+	SizeDiffFound uint64
+	DiffFound     uint64
+	NotFound      uint64
+	OtherHost     uint64
+	BytesLoaded   uint64
+	Resumed       uint64
+	Unchanged     uint64
+	Changed       uint64
+	// Errors histogram of the error classes
+	Errors map[string]uint64
+	// HostsFound other hosts of verified picture locations
+	HostsFound []string
+	counters   [nrCounters]uint64
+}
+
+// NewPictureStatistic new statistic of a picture run
+func NewPictureStatistic() *PictureStatistic {
+	return &PictureStatistic{errors: make(map[string]uint64), hosts: make(map[string]bool),
+		thumbnail: NewHistogram(LatencyBuckets), calls: make(map[string]*Histogram)}
+}
+
+// Inc increment the counter, nil statistics are ignored
+func (stat *PictureStatistic) Inc(counter Counter) {
+	stat.Add(counter, 1)
+}
+
+// Add add to the counter, nil statistics are ignored
+func (stat *PictureStatistic) Add(counter Counter, n uint64) {
+	if stat == nil {
+		return
+	}
+	stat.lock.RLock()
+	atomic.AddUint64(&stat.counters[counter], n)
+	stat.lock.RUnlock()
+}
+
+// Get current value of the counter
+func (stat *PictureStatistic) Get(counter Counter) uint64 {
+	if stat == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&stat.counters[counter])
+}
+
+// AddError count the error in the histogram of the error class and in the
+// number of errors
+func (stat *PictureStatistic) AddError(err error) {
+	if stat == nil || err == nil {
+		return
+	}
+	stat.lock.Lock()
+	defer stat.lock.Unlock()
+	stat.errors[ErrorClass(err)]++
+	stat.counters[StatNrErrors]++
+}
+
+// AddOtherHost count picture location of another host
+func (stat *PictureStatistic) AddOtherHost(host string) {
+	if stat == nil {
+		return
+	}
+	stat.lock.Lock()
+	defer stat.lock.Unlock()
+	stat.hosts[host] = true
+	stat.counters[StatOtherHost]++
+}
+
+// ObserveThumbnail count the duration of a thumbnail creation
+func (stat *PictureStatistic) ObserveThumbnail(d time.Duration) {
+	if stat == nil {
+		return
+	}
+	stat.thumbnail.Observe(d)
+}
+
+// ObserveCall count the duration of a repository operation
+func (stat *PictureStatistic) ObserveCall(op string, d time.Duration) {
+	if stat == nil {
+		return
+	}
+	stat.lock.RLock()
+	h, ok := stat.calls[op]
+	stat.lock.RUnlock()
+	if !ok {
+		stat.lock.Lock()
+		if h, ok = stat.calls[op]; !ok {
+			h = NewHistogram(LatencyBuckets)
+			stat.calls[op] = h
+		}
+		stat.lock.Unlock()
+	}
+	h.Observe(d)
+}
+
+// Snapshot consistent copy of all statistic values
+func (stat *PictureStatistic) Snapshot() *StatisticSnapshot {
+	stat.lock.Lock()
+	defer stat.lock.Unlock()
+	c := &stat.counters
+	snapshot := &StatisticSnapshot{Time: time.Now(),
+		Checked: c[StatChecked], Loaded: c[StatLoaded], Found: c[StatFound], ToBig: c[StatToBig],
+		NrErrors: c[StatNrErrors], NrDeleted: c[StatNrDeleted], Added: c[StatAdded], Empty: c[StatEmpty],
+		Ignored: c[StatIgnored], Duplicated: c[StatDuplicated], Segmented: c[StatSegmented],
+		Collisions: c[StatCollisions], Unknown: c[StatUnknown], Paired: c[StatPaired],
+		MimeMismatch: c[StatMimeMismatch], DecodeFailed: c[StatDecodeFailed], Corrupt: c[StatCorrupt],
+		Retries: c[StatRetries], Reconnects: c[StatReconnects], Verified: c[StatVerified],
+		SizeDiffFound: c[StatSizeDiffFound], DiffFound: c[StatDiffFound], NotFound: c[StatNotFound],
+		OtherHost: c[StatOtherHost], BytesLoaded: c[StatBytesLoaded], Resumed: c[StatResumed],
+		Unchanged: c[StatUnchanged], Changed: c[StatChanged],
+		Errors: make(map[string]uint64, len(stat.errors)), HostsFound: make([]string, 0, len(stat.hosts)),
+		counters: *c}
+	for class, n := range stat.errors {
+		snapshot.Errors[class] = n
+	}
+	for host := range stat.hosts {
+		snapshot.HostsFound = append(snapshot.HostsFound, host)
+	}
+	sort.Strings(snapshot.HostsFound)
+	return snapshot
+}
+
+func (stat *PictureStatistic) String() string {
+	return stat.Snapshot().String()
+}
+
+func (snapshot *StatisticSnapshot) String() string {
+	var buffer bytes.Buffer
+	t := snapshot.Time.Format(timeFormat)
+	buffer.WriteString(fmt.Sprintf("%s Picture directory checked=%d loaded=%d found=%d too big=%d errors=%d deleted=%d\n",
+		t, snapshot.Checked, snapshot.Loaded, snapshot.Found, snapshot.ToBig, snapshot.NrErrors, snapshot.NrDeleted))
+	buffer.WriteString(fmt.Sprintf("%s Picture directory added=%d empty=%d ignored=%d duplicated=%d segmented=%d collisions=%d unknown=%d paired=%d mime mismatch=%d decode failed=%d corrupt=%d retries=%d reconnects=%d resumed=%d unchanged=%d changed=%d\n",
+		t, snapshot.Added, snapshot.Empty, snapshot.Ignored, snapshot.Duplicated, snapshot.Segmented,
+		snapshot.Collisions, snapshot.Unknown, snapshot.Paired, snapshot.MimeMismatch, snapshot.DecodeFailed,
+		snapshot.Corrupt, snapshot.Retries, snapshot.Reconnects, snapshot.Resumed,
+		snapshot.Unchanged, snapshot.Changed))
+	return buffer.String()
+}
+
+// Counter value of the counter at the snapshot time
+func (snapshot *StatisticSnapshot) Counter(counter Counter) uint64 {
+	return snapshot.counters[counter]
+}
+
+// ErrorClasses error classes of the histogram sorted by name
+func (snapshot *StatisticSnapshot) ErrorClasses() []string {
+	classes := make([]string, 0, len(snapshot.Errors))
+	for class := range snapshot.Errors {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return classes
+}
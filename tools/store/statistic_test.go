@@ -0,0 +1,104 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestStatisticConcurrent update the statistic of several workers while
+// snapshots are taken, run with -race
+func TestStatisticConcurrent(t *testing.T) {
+	const workers = 8
+	const updates = 1000
+	stat := NewPictureStatistic()
+	var wg sync.WaitGroup
+	done := make(chan bool)
+	snapshots := make(chan error, 1)
+	go func() {
+		for {
+			snapshot := stat.Snapshot()
+			errors := uint64(0)
+			for _, n := range snapshot.Errors {
+				errors += n
+			}
+			if errors != snapshot.NrErrors {
+				snapshots <- fmt.Errorf("snapshot with %d classified errors and NrErrors=%d", errors, snapshot.NrErrors)
+				return
+			}
+			select {
+			case <-done:
+				snapshots <- nil
+				return
+			default:
+			}
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				stat.Inc(StatChecked)
+				stat.Add(StatBytesLoaded, 10)
+				stat.AddError(ErrNotFound)
+				stat.AddOtherHost(fmt.Sprintf("host%d", w))
+				stat.ObserveCall(fmt.Sprintf("op%d", i%3), time.Millisecond)
+				stat.ObserveThumbnail(time.Millisecond)
+				_ = stat.Get(StatChecked)
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+	if err := <-snapshots; err != nil {
+		t.Fatal(err)
+	}
+	snapshot := stat.Snapshot()
+	if snapshot.Checked != workers*updates || snapshot.BytesLoaded != workers*updates*10 {
+		t.Errorf("Checked=%d BytesLoaded=%d, want %d and %d", snapshot.Checked, snapshot.BytesLoaded,
+			workers*updates, workers*updates*10)
+	}
+	if snapshot.NrErrors != workers*updates || snapshot.Errors[ErrNotFound.Error()] != workers*updates {
+		t.Errorf("NrErrors=%d Errors=%v, want %d", snapshot.NrErrors, snapshot.Errors, workers*updates)
+	}
+	if snapshot.OtherHost != workers*updates || len(snapshot.HostsFound) != workers {
+		t.Errorf("OtherHost=%d HostsFound=%v", snapshot.OtherHost, snapshot.HostsFound)
+	}
+	if len(stat.calls) != 3 {
+		t.Errorf("%d call histograms, want 3", len(stat.calls))
+	}
+}
+
+// TestStatisticNil a nil statistic ignores all updates
+func TestStatisticNil(t *testing.T) {
+	var stat *PictureStatistic
+	stat.Inc(StatChecked)
+	stat.AddError(ErrNotFound)
+	stat.AddOtherHost("host")
+	stat.ObserveCall("op", time.Second)
+	stat.ObserveThumbnail(time.Second)
+	if stat.Get(StatChecked) != 0 {
+		t.Error("nil statistic counted")
+	}
+}
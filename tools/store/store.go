@@ -3,6 +3,7 @@ package store
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 
@@ -13,95 +14,81 @@ import (
 const PictureNameSN = "PN"
 
 type DatabaseReference struct {
-	Dbid        string
-	PictureFile adabas.Fnr
-	AlbumFile   adabas.Fnr
+	Dbid          string
+	PictureFile   adabas.Fnr
+	AlbumFile     adabas.Fnr
+	SegmentFile   adabas.Fnr
+	RenditionFile adabas.Fnr
 }
 
 var mapCurrentPictureChecksum = &sync.Map{}
 
-// InitStorePictureBinary init store picture connection
+// InitStorePictureBinary init store picture connection. Failed operations
+// are retried using the DefaultRetryPolicy, lost connections and all their
+// requests are created again.
 func InitStorePictureBinary(shortenName bool, dbReference *DatabaseReference, connection *adabas.Connection) (ps *PictureConnection, err error) {
-	ps = &PictureConnection{ShortenName: shortenName, ChecksumRun: false, Verbose: false}
-	ps.dbReference = dbReference
-	ps.connection = connection
-	ps.store, err = connection.CreateMapStoreRequest((*PictureMetadata)(nil))
+	repository, err := NewAdabasRepository(dbReference, connection)
 	if err != nil {
-		connection.Close()
 		return nil, err
 	}
-	err = ps.store.StoreFields("*")
-	if err != nil {
-		return nil, err
-	}
-	ps.storeData, err = ps.connection.CreateMapStoreRequest((*PictureData)(nil))
-	if err != nil {
-		ps.connection.Close()
-		return nil, err
-	}
-	err = ps.storeData.StoreFields("DP")
-	if err != nil {
-		return nil, err
-	}
-	ps.storeThumb, err = ps.connection.CreateMapStoreRequest((*PictureData)(nil))
-	if err != nil {
-		ps.connection.Close()
-		return nil, err
-	}
-	err = ps.storeThumb.StoreFields("CP,DT")
-	// "Md5,ChecksumPicture,ChecksumThumbnail,Thumbnail")
-	if err != nil {
-		return nil, err
-	}
-	ps.storeEntries, err = ps.connection.CreateMapStoreRequest((*PictureMetadata)(nil))
-	if err != nil {
-		ps.connection.Close()
-		return nil, err
-	}
-	err = ps.storeEntries.StoreFields("PL")
-	if err != nil {
-		return nil, err
-	}
-	ps.readFileNameCheck, err = ps.connection.CreateMapReadRequest((*PictureMetadata)(nil))
-	if err != nil {
-		ps.connection.Close()
-		return nil, err
-	}
-	err = ps.readFileNameCheck.QueryFields("PM")
-	if err != nil {
-		ps.connection.Close()
-		return nil, err
-	}
-	ps.readAddAndCheck, err = ps.connection.CreateMapReadRequest((*PictureMetadata)(nil))
-	if err != nil {
-		ps.connection.Close()
-		return nil, err
-	}
-	err = ps.readAddAndCheck.QueryFields("CP,PL")
-	if err != nil {
-		ps.connection.Close()
-		return nil, err
-	}
-	ps.readMediaCheck, err = ps.connection.CreateMapReadRequest((*PictureData)(nil))
-	if err != nil {
-		ps.connection.Close()
-		return nil, err
-	}
-	err = ps.readMediaCheck.QueryFields("CP")
-	if err != nil {
-		ps.connection.Close()
-		return nil, err
-	}
-	ps.histCheck, err = ps.connection.CreateMapReadRequest((*PictureMetadata)(nil))
+	ps = InitStorePictureRepository(shortenName, WithRetry(repository, DefaultRetryPolicy))
+	ps.ownRepository = true
+	return ps, nil
+}
+
+// OpenStorePictureBinary open the Adabas repository referenced by the
+// database reference and init the store picture connection owning it.
+// Connection errors are returned as backend errors.
+func OpenStorePictureBinary(shortenName bool, dbReference *DatabaseReference) (*PictureConnection, error) {
+	repository, err := OpenAdabasRepository(dbReference)
 	if err != nil {
-		ps.connection.Close()
 		return nil, err
 	}
-	return
+	ps := InitStorePictureRepository(shortenName, repository)
+	ps.ownRepository = true
+	return ps, nil
+}
+
+// InitStorePictureRepository init store picture connection using the given
+// repository. The repository may be shared by several connections, it is
+// not closed with the connection but by its owner.
+func InitStorePictureRepository(shortenName bool, repository PictureRepository) *PictureConnection {
+	ps := &PictureConnection{ShortenName: shortenName, ChecksumRun: false,
+		Verbose: false, repository: repository}
+	ps.SetStatistics(NewPictureStatistic())
+	return ps
+}
+
+// Statistics statistic of the picture connection
+func (ps *PictureConnection) Statistics() *PictureStatistic {
+	return ps.statistics
+}
+
+// SetStatistics set the statistic of the picture connection, connections
+// of the same run share one statistic. Retries of the repository are
+// counted in it too.
+func (ps *PictureConnection) SetStatistics(stat *PictureStatistic) {
+	ps.statistics = stat
+	SetRepositoryStatistics(ps.repository, stat)
+}
+
+// Processing file the picture connection currently loads, empty if idle
+func (ps *PictureConnection) Processing() string {
+	file, _ := ps.processing.Load().(string)
+	return file
 }
 
-// LoadPicture load picture data into database
+// LoadPicture load picture data into database. A lost transaction loads the
+// picture again from the start according to the retry policy.
 func (ps *PictureConnection) LoadPicture(insert bool, fileName string) error {
+	ps.processing.Store(fileName)
+	defer ps.processing.Store("")
+	return retryUnit(ps.repository, "load "+fileName, func() error {
+		return ps.loadPicture(insert, fileName)
+	})
+}
+
+func (ps *PictureConnection) loadPicture(insert bool, fileName string) error {
 	fs := strings.Split(fileName, string(os.PathSeparator))
 	pictureName := fileName
 	directoryName := fileName
@@ -116,6 +103,18 @@ func (ps *PictureConnection) LoadPicture(insert bool, fileName string) error {
 		}
 	}
 	pictureKey := createMd5([]byte(pictureName))
+	var info os.FileInfo
+	var state *FileState
+	if insert && ps.FileState != nil {
+		var unchanged bool
+		info, _ = os.Stat(fileName)
+		state, unchanged = ps.FileState.Lookup(fileName, info)
+		if unchanged {
+			adatypes.Central.Log.Debugf("%s -> picture file unchanged", pictureName)
+			ps.statistics.Inc(StatUnchanged)
+			return nil
+		}
+	}
 	var err error
 	var ok bool
 	ok, err = ps.pictureFileAvailable(pictureKey)
@@ -126,31 +125,72 @@ func (ps *PictureConnection) LoadPicture(insert bool, fileName string) error {
 	empty := checkEmpty(fileName)
 	if empty {
 		adatypes.Central.Log.Debugf(pictureName, "-> picture file empty")
-		Statistics.Empty++
+		ps.statistics.Inc(StatEmpty)
+		ps.FileState.Remove(fileName)
 		if ok {
 			fmt.Printf("Remove empty file from database: %s(%s)\n", fileName, pictureKey)
 			ps.DeleteMd5(pictureKey)
 		}
 		return nil
 	}
-	Statistics.Checked++
-	if ok && insert {
+	ps.statistics.Inc(StatChecked)
+	if ok && insert && state == nil {
 		adatypes.Central.Log.Debugf("%s -> picture name already loaded", pictureName)
-		Statistics.Found++
+		ps.statistics.Inc(StatFound)
+		return ps.recordFound(fileName, info, pictureKey)
+	}
+	format, mismatch, err := DetectFormat(fileName)
+	if err != nil {
+		adatypes.Central.Log.Debugf("Detect format error %v", err)
+		return err
+	}
+	if format == nil {
+		fmt.Printf("Skip unknown media format: %s\n", fileName)
+		ps.statistics.Inc(StatUnknown)
 		return nil
 	}
+	if mismatch {
+		fmt.Printf("Suffix does not match content %s: %s\n", format.MIMEType, fileName)
+		ps.statistics.Inc(StatMimeMismatch)
+	}
+	if verr := ValidateMedia(format, fileName); verr != nil {
+		fmt.Printf("Validation failed %s: %v\n", fileName, verr)
+		ps.statistics.Inc(StatCorrupt)
+		Quarantine.Add(fileName, format, verr, ps.StoreCorrupt)
+		if !ps.StoreCorrupt {
+			return verr
+		}
+	}
 	pictureLocation := createPictureLocation(pictureName, directoryName)
 	p := PictureBinary{FileName: fileName,
-		MetaData: &PictureMetadata{}, MaxBlobSize: ps.MaxBlobSize}
+		MetaData: &PictureMetadata{}, MaxBlobSize: ps.MaxBlobSize,
+		Segmented: ps.repository.SegmentsAvailable(), format: format}
 	p.MetaData.PictureLocation = append(p.MetaData.PictureLocation, pictureLocation)
+	if pair := pairFile(fileName, format); pair != "" {
+		// RAW and JPEG of the same base name share the pair key
+		adatypes.Central.Log.Debugf("%s paired with %s", fileName, pair)
+		p.MetaData.PairKey = createMd5([]byte(strings.TrimSuffix(pictureName, filepath.Ext(pictureName))))
+		ps.statistics.Inc(StatPaired)
+	}
 	err = p.LoadFile()
 	if err != nil {
 		adatypes.Central.Log.Debugf("Load file error %v", err)
 		return err
 	}
+	defer p.Release()
+	if state != nil {
+		if state.Checksum == p.Data.ChecksumPicture {
+			// only touched, the content is stored already
+			ps.statistics.Inc(StatFound)
+			ps.FileState.Record(fileName, info, state.Checksum, state.Isn)
+			return nil
+		}
+		fmt.Printf("Picture file changed: %s\n", fileName)
+		ps.statistics.Inc(StatChanged)
+	}
 
 	for {
-		mediaAvailable, merr := ps.pictureMediaAvailable(p.Data.ChecksumPicture)
+		mediaAvailable, merr := ps.pictureMediaAvailable(p.Data.ChecksumPicture, p.Data.ChecksumSHA256)
 		if merr != nil {
 			adatypes.Central.Log.Debugf("Availability data check error %v", merr)
 			return merr
@@ -174,54 +214,80 @@ func (ps *PictureConnection) LoadPicture(insert bool, fileName string) error {
 				fmt.Printf("%s picture ... %s\r", info, fileName)
 
 			}
-			p.storeRecord(insert, ps)
+			isn, serr := ps.detachFile(state, pictureKey, true)
+			if serr == nil {
+				if isn != 0 {
+					// the record of the changed file is updated in place
+					p.MetaData.Index = isn
+				}
+				serr = p.storeRecord(insert && isn == 0, ps)
+			}
 			picCheckLock, _ = mapCurrentPictureChecksum.LoadAndDelete(p.MetaData.ChecksumPicture)
 			picCheckLock.(*sync.Mutex).Unlock()
-
-		} else {
-			if ps.Verbose {
-				fmt.Printf("Skipping picture ... %s [%s]\r", fileName, p.Data.ChecksumPicture)
+			if serr == nil {
+				ps.FileState.Record(fileName, info, p.Data.ChecksumPicture, p.MetaData.Index)
 			}
-			p.checkAndAddFile(ps, fileName, directoryName)
+			return serr
+		}
+		if ps.Verbose {
+			fmt.Printf("Skipping picture ... %s [%s]\r", fileName, p.Data.ChecksumPicture)
+		}
+		_, err = ps.detachFile(state, pictureKey, false)
+		if err == nil {
+			err = p.checkAndAddFile(ps, fileName, directoryName)
+		}
+		if err == nil {
+			ps.FileState.Record(fileName, info, p.Data.ChecksumPicture, p.MetaData.Index)
 		}
+		return err
+	}
+}
+
+// recordFound record the state of a file loaded before the file state was
+// kept. The checksum and ISN of the stored record are needed to update the
+// record if the file changes later, they are left empty if the path is
+// stored more than once.
+func (ps *PictureConnection) recordFound(fileName string, info os.FileInfo, pictureKey string) error {
+	if ps.FileState == nil {
 		return nil
 	}
+	list, err := ps.repository.ReadFileMetadata(pictureKey)
+	if err != nil {
+		return backendError("read file", err)
+	}
+	checksum, isn := "", uint64(0)
+	if len(list) == 1 {
+		checksum, isn = strings.Trim(list[0].ChecksumPicture, " "), list[0].Index
+	}
+	ps.FileState.Record(fileName, info, checksum, isn)
+	return nil
 }
 
 // DeleteMd5 delete picture key
 func (psx *PictureConnection) DeleteMd5(key string) error {
-	result, err := psx.readFileNameCheck.ReadLogicalWith("Md5=" + key)
+	isns, err := psx.repository.SearchHash(key)
 	if err != nil {
 		fmt.Printf("Error checking Md5=%s: %v\n", key, err)
-		panic("Read error " + err.Error())
-		//		return false, err
+		return backendError("search hash", err)
 	}
 
-	deleteRequest, err := psx.connection.CreateDeleteRequest(psx.dbReference.PictureFile)
-	defer deleteRequest.BackoutTransaction()
-	if err != nil {
-		return err
-	}
-	for _, r := range result.Values {
-		deleteRequest.Delete(r.Isn)
+	for _, isn := range isns {
+		err = psx.repository.Delete(isn)
+		if err != nil {
+			return backendError("delete", err)
+		}
 	}
-	return nil
+	return backendError("end transaction", psx.repository.EndTransaction())
 }
 
 // DeleteIsn delete image Isn
 func (psx *PictureConnection) DeleteIsn(isn adatypes.Isn) error {
 	fmt.Printf("Delete image with ISN=%d\n", isn)
-	deleteRequest, err := psx.connection.CreateDeleteRequest(psx.dbReference.PictureFile)
-	defer deleteRequest.BackoutTransaction()
+	err := psx.repository.Delete(uint64(isn))
 	if err != nil {
-		return err
+		return backendError("delete", err)
 	}
-	err = deleteRequest.Delete(isn)
-	if err != nil {
-		return err
-	}
-	err = deleteRequest.EndTransaction()
-	return err
+	return backendError("end transaction", psx.repository.EndTransaction())
 }
 
 // DeletePath delete image given with path
@@ -230,21 +296,20 @@ func (psx *PictureConnection) DeletePath(path string) error {
 		return nil
 	}
 	fmt.Printf("Delete image with path=%s\n", path)
-	readRequest, err := psx.connection.CreateFileReadRequest(psx.dbReference.PictureFile)
-	if err != nil {
-		return err
-	}
-	readRequest.QueryFields("")
-	result, resErr := readRequest.ReadLogicalWith(PictureNameSN + "=" + path)
+	isns, resErr := psx.repository.SearchName(path)
 	if resErr != nil {
-		return resErr
+		return backendError("search name", resErr)
 	}
-	if result.NrRecords() != 1 {
-		fmt.Printf("Found more then one or no record: %d\n", result.NrRecords())
-		return fmt.Errorf("found more then one record")
+	switch len(isns) {
+	case 0:
+		return fmt.Errorf("path %s %w", path, ErrNotFound)
+	case 1:
+	default:
+		fmt.Printf("Found more then one record: %d\n", len(isns))
+		return fmt.Errorf("path %s found %d times: %w", path, len(isns), ErrDuplicate)
 	}
-	for _, record := range result.Values {
-		psx.DeleteIsn(record.Isn)
+	for _, isn := range isns {
+		psx.DeleteIsn(adatypes.Isn(isn))
 	}
 	return nil
 }
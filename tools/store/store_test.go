@@ -0,0 +1,225 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tknie/adabas-go-api/adatypes"
+	"go.uber.org/zap"
+)
+
+// testPicture picture loaded by the repository tests
+const testPicture = "../testimg/IMG_1098.jpg"
+
+func TestMain(m *testing.M) {
+	adatypes.Central.Log = zap.NewNop().Sugar()
+	os.Exit(m.Run())
+}
+
+func TestLoadPictureMemory(t *testing.T) {
+	mr := NewMemoryRepository()
+	ps := InitStorePictureRepository(false, mr)
+	ps.MaxBlobSize = 50000000
+
+	err := ps.LoadPicture(true, testPicture)
+	if err != nil {
+		t.Fatalf("Error loading %s: %v", testPicture, err)
+	}
+	err = ps.LoadPicture(true, testPicture)
+	if err != nil {
+		t.Fatalf("Error reloading %s: %v", testPicture, err)
+	}
+	snapshot := ps.Statistics().Snapshot()
+	if snapshot.Loaded != 1 || snapshot.Found != 1 {
+		t.Errorf("Loaded=%d Found=%d, want 1 and 1", snapshot.Loaded, snapshot.Found)
+	}
+
+	key := createMd5([]byte("testimg/IMG_1098.jpg"))
+	isns, err := mr.SearchHash(key)
+	if err != nil || len(isns) != 1 {
+		t.Fatalf("SearchHash = %v, %v", isns, err)
+	}
+	data, err := mr.ReadMedia(isns[0])
+	if err != nil {
+		t.Fatalf("Error reading media: %v", err)
+	}
+	original, err := os.ReadFile(testPicture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data.Media, original) {
+		t.Errorf("Media of %d bytes differs from the %d bytes of the file", len(data.Media), len(original))
+	}
+	if len(data.Thumbnail) == 0 {
+		t.Error("No thumbnail stored")
+	}
+
+	err = ps.DeleteMd5(key)
+	if err != nil {
+		t.Fatalf("Error deleting %s: %v", key, err)
+	}
+	if ok, _ := mr.PictureFileAvailable(key); ok {
+		t.Error("Deleted picture still available")
+	}
+}
+
+// failingSegments memory repository failing to store the media segments
+type failingSegments struct {
+	*MemoryRepository
+}
+
+func (fs failingSegments) StoreSegment(checksum string, sequence uint32, data []byte) error {
+	return errors.New("segment file full")
+}
+
+func TestLoadPictureIncompleteRemoved(t *testing.T) {
+	mr := NewMemoryRepository()
+	ps := InitStorePictureRepository(false, failingSegments{mr})
+	ps.MaxBlobSize = 10000
+
+	err := ps.LoadPicture(true, testPicture)
+	if err == nil {
+		t.Fatal("Load with failing segment store succeeded")
+	}
+	if ok, _ := mr.PictureFileAvailable(createMd5([]byte("testimg/IMG_1098.jpg"))); ok {
+		t.Error("Incomplete record not removed")
+	}
+	if len(mr.content.Records) != 0 || len(mr.content.Segments) != 0 {
+		t.Errorf("%d records and %d segment lists left", len(mr.content.Records), len(mr.content.Segments))
+	}
+}
+
+func copyTestPicture(t *testing.T, source, target string) {
+	t.Helper()
+	data, err := os.ReadFile(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(target, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadPictureFoundWithoutState(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "pictures")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(dir, "a.jpg")
+	copyTestPicture(t, testPicture, fileName)
+	mr := NewMemoryRepository()
+	ps := InitStorePictureRepository(false, mr)
+	ps.MaxBlobSize = 50000000
+	if err := ps.LoadPicture(true, fileName); err != nil {
+		t.Fatalf("Error loading %s: %v", fileName, err)
+	}
+	isns, err := mr.SearchHash(createMd5([]byte("pictures/a.jpg")))
+	if err != nil || len(isns) != 1 {
+		t.Fatalf("SearchHash = %v, %v", isns, err)
+	}
+
+	// the file state is started after the first load
+	ps.FileState, err = OpenFileState(filepath.Join(t.TempDir(), "state"), "memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.FileState.Close()
+	if err = ps.LoadPicture(true, fileName); err != nil {
+		t.Fatalf("Error loading %s with state: %v", fileName, err)
+	}
+	info, _ := os.Stat(fileName)
+	state, unchanged := ps.FileState.Lookup(fileName, info)
+	if !unchanged || state.Isn != isns[0] || state.Checksum != mr.content.Records[isns[0]].Metadata.ChecksumPicture {
+		t.Fatalf("state of found file %#v unchanged=%v, want ISN=%d", state, unchanged, isns[0])
+	}
+
+	// a changed file updates the record in place
+	copyTestPicture(t, "../testimg/IMG_1111.jpg", fileName)
+	if err = ps.LoadPicture(true, fileName); err != nil {
+		t.Fatalf("Error loading changed %s: %v", fileName, err)
+	}
+	if len(mr.content.Records) != 1 {
+		t.Errorf("%d records after the change, want 1", len(mr.content.Records))
+	}
+	if r, ok := mr.content.Records[isns[0]]; !ok || r.Metadata.ChecksumPicture == state.Checksum {
+		t.Errorf("record ISN=%d not updated in place", isns[0])
+	}
+}
+
+func TestVerifyPictureRepository(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "pictures")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	single := filepath.Join(dir, "single.jpg")
+	segmented := filepath.Join(dir, "segmented.jpg")
+	copyTestPicture(t, testPicture, single)
+	copyTestPicture(t, "../testimg/IMG_1111.jpg", segmented)
+	mr := NewMemoryRepository()
+	ps := InitStorePictureRepository(false, mr)
+	ps.MaxBlobSize = 50000000
+	if err := ps.LoadPicture(true, single); err != nil {
+		t.Fatalf("Error loading %s: %v", single, err)
+	}
+	ps.MaxBlobSize = 10000
+	if err := ps.LoadPicture(true, segmented); err != nil {
+		t.Fatalf("Error loading %s: %v", segmented, err)
+	}
+	if len(mr.content.Segments) != 1 {
+		t.Fatalf("%d segment lists stored, want 1", len(mr.content.Segments))
+	}
+
+	stat := NewPictureStatistic()
+	if err := VerifyPictureRepository(mr, 2, stat); err != nil {
+		t.Fatalf("Error verifying: %v", err)
+	}
+	if snapshot := stat.Snapshot(); snapshot.Verified != 2 || snapshot.DiffFound != 0 {
+		t.Errorf("Verified=%d DiffFound=%d, want 2 and 0", snapshot.Verified, snapshot.DiffFound)
+	}
+
+	// changed segment is found comparing segment by segment
+	var segments map[uint32][]byte
+	for _, s := range mr.content.Segments {
+		segments = s
+	}
+	segments[2][10]++
+	stat = NewPictureStatistic()
+	if err := VerifyPictureRepository(mr, 2, stat); err != nil {
+		t.Fatalf("Error verifying: %v", err)
+	}
+	if snapshot := stat.Snapshot(); snapshot.Verified != 1 || snapshot.DiffFound != 1 {
+		t.Errorf("Verified=%d DiffFound=%d, want 1 and 1", snapshot.Verified, snapshot.DiffFound)
+	}
+
+	// missing segment stops the verify after all threads are finished
+	delete(segments, 2)
+	err := VerifyPictureRepository(mr, 2, NewPictureStatistic())
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Verify with missing segment returned %v, want %v", err, ErrNotFound)
+	}
+	if inUse := MediaBudget.InUse(); inUse != 0 {
+		t.Errorf("%d bytes of the media budget still in use", inUse)
+	}
+}
@@ -0,0 +1,249 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+	"strings"
+
+	"github.com/tknie/adabas-go-api/adatypes"
+)
+
+// ThumbnailMethod method used to generate thumbnails and renditions
+type ThumbnailMethod byte
+
+const (
+	// ThumbnailExact decode the complete picture and resample it with Lanczos3
+	ThumbnailExact ThumbnailMethod = iota
+	// ThumbnailReduced decode the complete picture, reduce it by 1/2, 1/4
+	// or 1/8 by averaging pixel blocks and resample the reduced picture
+	// with Lanczos3
+	ThumbnailReduced
+	// ThumbnailExif use the embedded EXIF thumbnail if it is large enough,
+	// otherwise the same as ThumbnailReduced
+	ThumbnailExif
+)
+
+var thumbnailMethodNames = []string{"exact", "reduced", "exif"}
+
+// ThumbnailMode method used to generate thumbnails and renditions
+var ThumbnailMode = ThumbnailExact
+
+// ThumbnailSize long edge of the generated thumbnails
+var ThumbnailSize = 200
+
+// ThumbnailQuality JPEG quality of the generated thumbnails and renditions
+var ThumbnailQuality = jpeg.DefaultQuality
+
+// exifThumbnailTolerance maximum relative difference of the aspect ratio of
+// the EXIF thumbnail to the original picture. Cameras put black bars into
+// thumbnails of other aspect ratios.
+const exifThumbnailTolerance = 0.02
+
+func (method ThumbnailMethod) String() string {
+	if int(method) < len(thumbnailMethodNames) {
+		return thumbnailMethodNames[method]
+	}
+	return fmt.Sprintf("unknown(%d)", method)
+}
+
+// ParseThumbnailMethod parse thumbnail method name (exact, reduced or exif)
+func ParseThumbnailMethod(name string) (ThumbnailMethod, error) {
+	for i, n := range thumbnailMethodNames {
+		if strings.EqualFold(strings.TrimSpace(name), n) {
+			return ThumbnailMethod(i), nil
+		}
+	}
+	return ThumbnailExact, fmt.Errorf("unknown thumbnail method %s", name)
+}
+
+// reduceFactor biggest factor of 1/2, 1/4 or 1/8 keeping the long edge at
+// least the given size
+func reduceFactor(width, height, size int) int {
+	longEdge := width
+	if height > longEdge {
+		longEdge = height
+	}
+	for f := 8; f > 1; f /= 2 {
+		if longEdge/f >= size {
+			return f
+		}
+	}
+	return 1
+}
+
+// reduceImage reduce the decoded image by 1/2, 1/4 or 1/8 as long as the
+// long edge is not smaller than the given size. The planes are reduced by
+// averaging the pixel blocks, which is cheaper than resampling the complete
+// image with Lanczos3. The complete image is still decoded before. The
+// image is returned unchanged using ThumbnailExact or if the image type is
+// not supported.
+func reduceImage(src image.Image, size int) image.Image {
+	if p, ok := src.(*profiledImage); ok {
+		return withProfile(reduceImage(p.Image, size), p.transform)
+	}
+	if ThumbnailMode == ThumbnailExact {
+		return src
+	}
+	b := src.Bounds()
+	if b.Min.X != 0 || b.Min.Y != 0 {
+		return src
+	}
+	w, h := b.Dx(), b.Dy()
+	f := reduceFactor(w, h, size)
+	if f == 1 {
+		return src
+	}
+	r := image.Rect(0, 0, w/f, h/f)
+	switch s := src.(type) {
+	case *image.YCbCr:
+		dst := image.NewYCbCr(r, s.SubsampleRatio)
+		reducePlane(dst.Y, dst.YStride, r.Dx(), r.Dy(), s.Y, s.YStride, w, h, f, 1)
+		cw, ch := chromaSize(r.Dx(), r.Dy(), s.SubsampleRatio)
+		scw, sch := chromaSize(w, h, s.SubsampleRatio)
+		reducePlane(dst.Cb, dst.CStride, cw, ch, s.Cb, s.CStride, scw, sch, f, 1)
+		reducePlane(dst.Cr, dst.CStride, cw, ch, s.Cr, s.CStride, scw, sch, f, 1)
+		return dst
+	case *image.Gray:
+		dst := image.NewGray(r)
+		reducePlane(dst.Pix, dst.Stride, r.Dx(), r.Dy(), s.Pix, s.Stride, w, h, f, 1)
+		return dst
+	case *image.RGBA:
+		dst := image.NewRGBA(r)
+		reducePlane(dst.Pix, dst.Stride, r.Dx(), r.Dy(), s.Pix, s.Stride, w, h, f, 4)
+		return dst
+	}
+	return src
+}
+
+// chromaSize width and height of the chroma planes
+func chromaSize(width, height int, ratio image.YCbCrSubsampleRatio) (int, int) {
+	switch ratio {
+	case image.YCbCrSubsampleRatio422:
+		return (width + 1) / 2, height
+	case image.YCbCrSubsampleRatio420:
+		return (width + 1) / 2, (height + 1) / 2
+	case image.YCbCrSubsampleRatio440:
+		return width, (height + 1) / 2
+	case image.YCbCrSubsampleRatio411:
+		return (width + 3) / 4, height
+	case image.YCbCrSubsampleRatio410:
+		return (width + 3) / 4, (height + 1) / 2
+	}
+	return width, height
+}
+
+// reducePlane average the f*f blocks of the source plane into the
+// destination plane. Blocks at the right and bottom border may be smaller.
+func reducePlane(dst []uint8, dstStride, dw, dh int, src []uint8, srcStride, sw, sh, f, channels int) {
+	for y := 0; y < dh; y++ {
+		sy0 := y * f
+		if sy0 >= sh {
+			sy0 = sh - 1
+		}
+		sy1 := sy0 + f
+		if sy1 > sh {
+			sy1 = sh
+		}
+		for x := 0; x < dw; x++ {
+			sx0 := x * f
+			if sx0 >= sw {
+				sx0 = sw - 1
+			}
+			sx1 := sx0 + f
+			if sx1 > sw {
+				sx1 = sw
+			}
+			n := (sy1 - sy0) * (sx1 - sx0)
+			for c := 0; c < channels; c++ {
+				sum := 0
+				for sy := sy0; sy < sy1; sy++ {
+					row := src[sy*srcStride:]
+					for sx := sx0; sx < sx1; sx++ {
+						sum += int(row[sx*channels+c])
+					}
+				}
+				dst[y*dstStride+x*channels+c] = uint8((sum + n/2) / n)
+			}
+		}
+	}
+}
+
+// displayedSize width and height of the decoded image in displayed
+// orientation
+func displayedSize(format *MediaFormat, srcImage image.Image, orientation byte) (uint32, uint32) {
+	b := srcImage.Bounds()
+	if !format.Oriented && orientation >= 5 && orientation <= 8 {
+		return uint32(b.Dy()), uint32(b.Dx())
+	}
+	return uint32(b.Dx()), uint32(b.Dy())
+}
+
+// embeddedThumbnail create the thumbnail out of the EXIF thumbnail, if the
+// thumbnail method allows it and the EXIF thumbnail is large enough and has
+// the aspect ratio of the picture. The perceptual hash is calculated out of
+// the EXIF thumbnail, too.
+func (pic *PictureBinary) embeddedThumbnail() bool {
+	if ThumbnailMode != ThumbnailExif || len(pic.exifThumbnail) == 0 || pic.format.Oriented {
+		return false
+	}
+	width, height := int(pic.MetaData.ExifXdimension), int(pic.MetaData.ExifYdimension)
+	if width == 0 || height == 0 {
+		media, err := pic.mediaSource()
+		if err != nil {
+			return false
+		}
+		config, _, err := image.DecodeConfig(media)
+		media.Close()
+		if err != nil {
+			return false
+		}
+		width, height = config.Width, config.Height
+	}
+	thumbnail, err := jpeg.Decode(bytes.NewReader(pic.exifThumbnail))
+	if err != nil {
+		adatypes.Central.Log.Debugf("Error decoding EXIF thumbnail: %v", err)
+		return false
+	}
+	b := thumbnail.Bounds()
+	if b.Dx() < ThumbnailSize && b.Dy() < ThumbnailSize {
+		return false
+	}
+	ratio := float64(width) / float64(height)
+	if math.Abs(float64(b.Dx())/float64(b.Dy())-ratio)/ratio > exifThumbnailTolerance {
+		return false
+	}
+	orientation := pic.MetaData.ExifOrientation
+	w, h := uint32(width), uint32(height)
+	if orientation >= 5 && orientation <= 8 {
+		w, h = h, w
+	}
+	thmb, err := orientedThumbnail(pic.format, pic.format.orient(thumbnail, orientation), w, h, pic.MetaData)
+	if err != nil {
+		return false
+	}
+	pic.MetaData.PerceptualHash = PerceptualHash(thumbnail)
+	pic.Data.Thumbnail = thmb
+	return true
+}
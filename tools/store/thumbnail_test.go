@@ -0,0 +1,91 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bytes"
+	"image/jpeg"
+	"os"
+	"testing"
+)
+
+// benchmarkPicture picture used by the thumbnail benchmarks
+const benchmarkPicture = "../testimg/IMG_1098.jpg"
+
+func readBenchmarkPicture(b *testing.B) []byte {
+	data, err := os.ReadFile(benchmarkPicture)
+	if err != nil {
+		b.Fatalf("Error reading %s: %v", benchmarkPicture, err)
+	}
+	return data
+}
+
+func benchmarkThumbnail(b *testing.B, method ThumbnailMethod) {
+	data := readBenchmarkPicture(b)
+	format := FormatByMIMEType("image/jpeg")
+	defer func(mode ThumbnailMethod) { ThumbnailMode = mode }(ThumbnailMode)
+	ThumbnailMode = method
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := CreateOrientedThumbnail(format, bytes.NewReader(data), &PictureMetadata{})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkThumbnailExact current path: complete decode and Lanczos3
+func BenchmarkThumbnailExact(b *testing.B) {
+	benchmarkThumbnail(b, ThumbnailExact)
+}
+
+// BenchmarkThumbnailReduced complete decode, reduce by 1/2, 1/4 or 1/8 and
+// Lanczos3
+func BenchmarkThumbnailReduced(b *testing.B) {
+	benchmarkThumbnail(b, ThumbnailReduced)
+}
+
+// BenchmarkThumbnailExif use an embedded EXIF thumbnail. The test picture
+// has no EXIF thumbnail, so a 320 pixel copy is used like a camera would
+// embed it. The picture dimension is read out of the file like during load.
+func BenchmarkThumbnailExif(b *testing.B) {
+	data := readBenchmarkPicture(b)
+	format := FormatByMIMEType("image/jpeg")
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		b.Fatal(err)
+	}
+	exifThumbnail, _, _, err := resizePicture(img, 320)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func(mode ThumbnailMethod) { ThumbnailMode = mode }(ThumbnailMode)
+	ThumbnailMode = ThumbnailExif
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pic := &PictureBinary{FileName: benchmarkPicture, MetaData: &PictureMetadata{},
+			Data: &PictureData{}, format: format, exifThumbnail: exifThumbnail}
+		if !pic.embeddedThumbnail() {
+			b.Fatal("EXIF thumbnail not used")
+		}
+	}
+}
@@ -0,0 +1,242 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// zeroTailSize bytes at the end of the file checked for zero filled tails
+// left by interrupted copies. Only formats ending with a trailer are
+// checked, other formats may be padded with zeros.
+const zeroTailSize = 4096
+
+// jpegTrailerSize bytes at the end of JPEG files searched for the end of
+// image marker, some cameras append trailers after it
+const jpegTrailerSize = 64 * 1024
+
+// ValidateMedia check the structural integrity of the media file if the
+// format provides a validator. Integrity failures wrap ErrCorrupt.
+func ValidateMedia(format *MediaFormat, fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := st.Size()
+	if format == nil || format.Validate == nil {
+		return nil
+	}
+	if err = format.Validate(f, size); err != nil {
+		return fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return nil
+}
+
+// readTail read the last bytes of the file
+func readTail(r io.ReaderAt, size, length int64) ([]byte, error) {
+	if length > size {
+		length = size
+	}
+	tail := make([]byte, length)
+	_, err := r.ReadAt(tail, size-length)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return tail, nil
+}
+
+func checkZeroTail(r io.ReaderAt, size int64) error {
+	tail, err := readTail(r, size, zeroTailSize)
+	if err != nil {
+		return err
+	}
+	for _, b := range tail {
+		if b != 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("zero filled tail of %d bytes", len(tail))
+}
+
+// validateJPEG check the end of image marker. The marker of the embedded
+// thumbnail may be found in front of a zero filled tail, so the tail is
+// checked first.
+func validateJPEG(r io.ReaderAt, size int64) error {
+	if err := checkZeroTail(r, size); err != nil {
+		return err
+	}
+	tail, err := readTail(r, size, jpegTrailerSize)
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(tail, []byte{0xff, 0xd9}) {
+		return fmt.Errorf("JPEG end of image marker missing")
+	}
+	return nil
+}
+
+// validatePNG check the IEND chunk at the end
+func validatePNG(r io.ReaderAt, size int64) error {
+	tail, err := readTail(r, size, 12)
+	if err != nil {
+		return err
+	}
+	if len(tail) < 12 || string(tail[4:8]) != "IEND" {
+		if zerr := checkZeroTail(r, size); zerr != nil {
+			return zerr
+		}
+		return fmt.Errorf("PNG end chunk missing")
+	}
+	return nil
+}
+
+// validateGIF check the GIF trailer
+func validateGIF(r io.ReaderAt, size int64) error {
+	tail, err := readTail(r, size, 1)
+	if err != nil {
+		return err
+	}
+	if len(tail) < 1 || tail[0] != 0x3b {
+		if zerr := checkZeroTail(r, size); zerr != nil {
+			return zerr
+		}
+		return fmt.Errorf("GIF trailer missing")
+	}
+	return nil
+}
+
+// validateWebp check the RIFF size against the file size
+func validateWebp(r io.ReaderAt, size int64) error {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return err
+	}
+	if int64(binary.LittleEndian.Uint32(header[4:]))+8 > size {
+		return fmt.Errorf("RIFF size %d exceeds file size %d", binary.LittleEndian.Uint32(header[4:]), size)
+	}
+	return nil
+}
+
+// validateBMP check the BMP file size field
+func validateBMP(r io.ReaderAt, size int64) error {
+	header := make([]byte, 6)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return err
+	}
+	if int64(binary.LittleEndian.Uint32(header[2:])) > size {
+		return fmt.Errorf("BMP size %d exceeds file size %d", binary.LittleEndian.Uint32(header[2:]), size)
+	}
+	return nil
+}
+
+// validateTIFF check the first image file directory is inside the file,
+// used for TIFF and the TIFF based RAW formats
+func validateTIFF(r io.ReaderAt, size int64) error {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return err
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if header[0] == 'M' {
+		order = binary.BigEndian
+	}
+	offset := int64(order.Uint32(header[4:]))
+	if offset < 8 || offset+2 > size {
+		return fmt.Errorf("TIFF directory offset %d outside of file size %d", offset, size)
+	}
+	count := make([]byte, 2)
+	if _, err := r.ReadAt(count, offset); err != nil {
+		return err
+	}
+	if offset+2+int64(order.Uint16(count))*12 > size {
+		return fmt.Errorf("TIFF directory at %d truncated", offset)
+	}
+	return nil
+}
+
+// boxValidator check the top level boxes of ISO base media files (MP4,
+// QuickTime, HEIF) chain up to the file size and the required boxes exist
+func boxValidator(required ...string) func(r io.ReaderAt, size int64) error {
+	return func(r io.ReaderAt, size int64) error {
+		found := make(map[string]bool)
+		header := make([]byte, 16)
+		offset := int64(0)
+		for offset < size {
+			if size-offset < 8 {
+				return fmt.Errorf("%d trailing bytes after last box", size-offset)
+			}
+			n, err := r.ReadAt(header, offset)
+			if n < 8 {
+				return fmt.Errorf("box header at %d truncated: %v", offset, err)
+			}
+			boxSize := int64(binary.BigEndian.Uint32(header[0:4]))
+			boxType := header[4:8]
+			if !validFourCC(boxType) {
+				return fmt.Errorf("invalid box type %q at %d", boxType, offset)
+			}
+			headerSize := int64(8)
+			switch boxSize {
+			case 0:
+				// box extends to the end of file
+				boxSize = size - offset
+			case 1:
+				if n < 16 {
+					return fmt.Errorf("box %s large size truncated", boxType)
+				}
+				boxSize = int64(binary.BigEndian.Uint64(header[8:16]))
+				headerSize = 16
+			}
+			if boxSize < headerSize {
+				return fmt.Errorf("box %s size %d invalid", boxType, boxSize)
+			}
+			if offset+boxSize > size {
+				return fmt.Errorf("box %s truncated, %d of %d bytes", boxType, size-offset, boxSize)
+			}
+			found[string(boxType)] = true
+			offset += boxSize
+		}
+		for _, r := range required {
+			if !found[r] {
+				return fmt.Errorf("box %s missing", r)
+			}
+		}
+		return nil
+	}
+}
+
+// validFourCC box types are printable ASCII, QuickTime uses the copyright
+// sign as first character
+func validFourCC(fourCC []byte) bool {
+	for i, c := range fourCC {
+		if (c < 0x20 || c > 0x7e) && !(i == 0 && c == 0xa9) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,63 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateMediaZeroTail(t *testing.T) {
+	zeros := make([]byte, zeroTailSize)
+	jpegData := []byte{0xff, 0xd8, 0xff, 0xe0, 0, 4, 0, 0, 0xff, 0xd9}
+	bmpData := append([]byte("BM\x00\x00\x00\x00"), zeros...)
+	binary.LittleEndian.PutUint32(bmpData[2:], uint32(len(bmpData)))
+	tests := []struct {
+		name    string
+		format  string
+		data    []byte
+		corrupt bool
+	}{
+		{"jpeg", "image/jpeg", jpegData, false},
+		{"jpeg zero tail", "image/jpeg", append(append([]byte{}, jpegData...), zeros...), true},
+		{"gif zero tail", "image/gif", append([]byte("GIF89a"), zeros...), true},
+		{"bmp zero padded", "image/bmp", bmpData, false},
+		{"unknown format", "", zeros, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "media")
+			if err := os.WriteFile(fileName, test.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := ValidateMedia(FormatByMIMEType(test.format), fileName)
+			if errors.Is(err, ErrCorrupt) != test.corrupt {
+				t.Errorf("ValidateMedia = %v, corrupt %v", err, test.corrupt)
+			}
+			if test.corrupt && !strings.Contains(err.Error(), "zero filled tail") {
+				t.Errorf("ValidateMedia = %v, want zero filled tail", err)
+			}
+		})
+	}
+}
@@ -96,11 +96,67 @@ func main() {
 	var dbidParameter string
 	var mapFnrParameter int
 	var verify bool
+	var poster bool
+	var repair bool
+	var pictureFnrParameter int
+	var segmentFnrParameter int
+	var limit int
+	var test bool
+	var memoryFile string
+	var reportFile string
 	flag.StringVar(&fileName, "p", "", "File name of picture to be imported")
 	flag.StringVar(&dbidParameter, "d", "23", "Map repository Database id")
 	flag.IntVar(&mapFnrParameter, "f", 4, "Map repository file number")
 	flag.BoolVar(&verify, "v", false, "Verify data")
+	flag.BoolVar(&poster, "V", false, "Backfill poster thumbnails of video records without thumbnail")
+	flag.BoolVar(&repair, "R", false, "Repair thumbnail and fill of pictures with EXIF orientation other than 1")
+	flag.IntVar(&pictureFnrParameter, "P", 100, "Picture file number used by poster backfill and orientation repair")
+	flag.IntVar(&segmentFnrParameter, "S", 0, "Segment file number for media bigger than the maximum binary blob size (0 is disabled)")
+	flag.IntVar(&limit, "l", 10, "Maximum records to read (0 is all)")
+	flag.BoolVar(&test, "t", false, "Dry run, don't change")
+	flag.StringVar(&memoryFile, "M", "", "Use local memory repository stored in this file instead of Adabas")
+	flag.StringVar(&reportFile, "report", "", "Write JSON run report to `file`")
 	flag.Parse()
+	report := store.NewRunReport("thumbnail", flag.CommandLine)
+	defer report.Exit(reportFile)
+
+	if poster || repair {
+		repository, err := openRepository(dbidParameter, pictureFnrParameter, segmentFnrParameter, memoryFile)
+		if err != nil {
+			fmt.Println("Error getting connection", err)
+			report.Abort(err)
+			return
+		}
+		defer repository.Close()
+		if test {
+			fmt.Println("Test mode ENABLED")
+		}
+		if poster {
+			pb := &posterBackfill{repository: repository, limit: uint64(limit), test: test, report: report}
+			report.AddCounter("poster_counter", func() uint64 { return pb.counter })
+			report.AddCounter("poster_updated", func() uint64 { return pb.updated })
+			report.AddCounter("poster_skipped", func() uint64 { return pb.skipped })
+			report.AddCounter("poster_failures", func() uint64 { return pb.failures })
+			err = pb.fill()
+			if err != nil {
+				fmt.Println("Error backfill poster thumbnails", err)
+				report.Abort(err)
+			}
+		}
+		if repair {
+			rp := &orientationRepair{repository: repository, limit: uint64(limit), test: test, report: report}
+			report.AddCounter("repair_counter", func() uint64 { return rp.counter })
+			report.AddCounter("repair_updated", func() uint64 { return rp.updated })
+			report.AddCounter("repair_skipped", func() uint64 { return rp.skipped })
+			report.AddCounter("repair_failures", func() uint64 { return rp.failures })
+			err = rp.repair()
+			if err != nil {
+				fmt.Println("Error repair orientation", err)
+				report.Abort(err)
+			}
+		}
+		return
+	}
 
 	//	adabas.AddGlobalMapRepository(dbidParameter, adabas.Fnr(mapFnrParameter))
 	adabas.AddGlobalMapRepositoryReference(fmt.Sprintf("%s,%d", dbidParameter, mapFnrParameter))
@@ -108,23 +164,27 @@ func main() {
 	con, err := adabas.NewConnection("acj;map")
 	if err != nil {
 		fmt.Println("Error connection", err)
+		report.Abort(err)
 		return
 	}
 	defer con.Close()
 	readRequest, rerr := con.CreateMapReadRequest((*store.Album)(nil))
 	if rerr != nil {
 		fmt.Println("Read request", rerr)
+		report.Abort(rerr)
 		return
 	}
 	readRequest.Limit = 0
 	err = readRequest.QueryFields("Title,Thumbnail,Pictures,Date")
 	if err != nil {
 		fmt.Println("Read fields error", err)
+		report.Abort(err)
 		return
 	}
 	result, readErr := readRequest.ReadLogicalBy("Date")
 	if readErr != nil {
 		fmt.Println("Read error", readErr)
+		report.Abort(readErr)
 		return
 	}
 	for _, d := range result.Data {
@@ -133,3 +193,13 @@ func main() {
 
 	}
 }
+
+func openRepository(dbidParameter string, pictureFnr, segmentFnr int, memoryFile string) (store.PictureRepository, error) {
+	if memoryFile != "" {
+		fmt.Printf("Use memory repository %s\n", memoryFile)
+		return store.OpenMemoryRepository(memoryFile)
+	}
+	fmt.Printf("Connect to %s/%d\n", dbidParameter, pictureFnr)
+	return store.OpenAdabasRepository(&store.DatabaseReference{Dbid: dbidParameter,
+		PictureFile: adabas.Fnr(pictureFnr), SegmentFile: adabas.Fnr(segmentFnr)})
+}
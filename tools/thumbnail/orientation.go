@@ -0,0 +1,109 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+	"tux-lobload/store"
+)
+
+type orientationRepair struct {
+	repository store.PictureRepository
+	limit      uint64
+	test       bool
+	counter    uint64
+	updated    uint64
+	skipped    uint64
+	failures   uint64
+	report     *store.RunReport
+}
+
+func (rp *orientationRepair) String() string {
+	return fmt.Sprintf("%s Picture counter=%d updated=%d skipped=%d failures=%d",
+		time.Now().Format(timeFormat), rp.counter, rp.updated, rp.skipped, rp.failures)
+}
+
+// repair regenerate thumbnail (DT) and fill of all pictures with an EXIF
+// orientation other than 1
+func (rp *orientationRepair) repair() error {
+	stop := schedule(func() { fmt.Println(rp) }, 15*time.Second)
+	defer func() { stop <- true }()
+	cursor, err := rp.repository.ReadMetadata(rp.limit)
+	if err != nil {
+		return err
+	}
+	for cursor.HasNextRecord() {
+		d, err := cursor.NextData()
+		if err != nil {
+			return err
+		}
+		rp.counter++
+		md := d.(*store.PictureMetadata)
+		format := store.FormatByMIMEType(md.MIMEType)
+		if md.ExifOrientation < 2 || format == nil || !format.Image() {
+			rp.skipped++
+			continue
+		}
+		err = rp.repairRecord(md, format)
+		if err != nil {
+			fmt.Printf("Error repair ISN=%d: %v\n", md.Index, err)
+			rp.report.FailedIsn(md.Index, err)
+			rp.failures++
+		}
+	}
+	fmt.Println(rp)
+	if rp.test {
+		return nil
+	}
+	return rp.repository.EndTransaction()
+}
+
+func (rp *orientationRepair) repairRecord(md *store.PictureMetadata, format *store.MediaFormat) error {
+	data, err := rp.repository.ReadMedia(md.Index)
+	if err != nil {
+		return err
+	}
+	fill := md.Fill
+	thumbnail, err := store.CreateOrientedThumbnail(format,
+		store.MediaReader(rp.repository, data), md)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Repair ISN=%d orientation=%d %dx%d fill %s -> %s\n", md.Index,
+		md.ExifOrientation, md.Width, md.Height, fill, md.Fill)
+	rp.updated++
+	if rp.test {
+		return nil
+	}
+	data.Thumbnail = thumbnail
+	err = rp.repository.UpdateThumbnail(data)
+	if err != nil {
+		return err
+	}
+	err = rp.repository.UpdateDimensions(md)
+	if err != nil {
+		return err
+	}
+	if rp.updated%100 == 0 {
+		return rp.repository.EndTransaction()
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"tux-lobload/store"
+)
+
+var timeFormat = "2006-01-02 15:04:05"
+
+type posterBackfill struct {
+	repository store.PictureRepository
+	limit      uint64
+	test       bool
+	counter    uint64
+	updated    uint64
+	skipped    uint64
+	failures   uint64
+	report     *store.RunReport
+}
+
+func (pb *posterBackfill) String() string {
+	return fmt.Sprintf("%s Picture counter=%d updated=%d skipped=%d failures=%d",
+		time.Now().Format(timeFormat), pb.counter, pb.updated, pb.skipped, pb.failures)
+}
+
+// fill walk all picture data and generate the poster thumbnail of video
+// records with empty thumbnail (DT)
+func (pb *posterBackfill) fill() error {
+	stop := schedule(func() { fmt.Println(pb) }, 15*time.Second)
+	defer func() { stop <- true }()
+	cursor, err := pb.repository.ReadData(pb.limit)
+	if err != nil {
+		return err
+	}
+	for cursor.HasNextRecord() {
+		d, err := cursor.NextData()
+		if err != nil {
+			return err
+		}
+		pb.counter++
+		data := d.(*store.PictureData)
+		if !strings.HasPrefix(data.MIMEType, "video/") || len(data.Thumbnail) > 0 {
+			pb.skipped++
+			continue
+		}
+		err = pb.fillRecord(data)
+		if err != nil {
+			fmt.Printf("Error poster ISN=%d: %v\n", data.Index, err)
+			pb.report.FailedIsn(data.Index, err)
+			pb.failures++
+		}
+	}
+	fmt.Println(pb)
+	if pb.test {
+		return nil
+	}
+	return pb.repository.EndTransaction()
+}
+
+// fillRecord write the complete media including all segments into a
+// temporary file and extract the poster frame out of it
+func (pb *posterBackfill) fillRecord(data *store.PictureData) error {
+	if len(data.Media) == 0 {
+		return fmt.Errorf("media empty")
+	}
+	suffix := ""
+	if len(data.PictureLocation) > 0 {
+		suffix = filepath.Ext(data.PictureLocation[0].PictureName)
+	}
+	f, err := os.CreateTemp("", "poster*"+suffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, store.MediaReader(pb.repository, data))
+	f.Close()
+	if err != nil {
+		return err
+	}
+	thumbnail, width, height, err := store.CreatePosterThumbnail(f.Name())
+	if err != nil {
+		return err
+	}
+	md := &store.PictureMetadata{Index: data.Index}
+	err = store.ReadMovieMetadata(f.Name(), md)
+	if err != nil {
+		return err
+	}
+	md.SetDimensions(store.FormatByMIMEType(data.MIMEType), 0, 0, width, height)
+	fmt.Printf("Poster thumbnail ISN=%d %dx%d\n", data.Index, width, height)
+	pb.updated++
+	if pb.test {
+		return nil
+	}
+	data.Thumbnail = thumbnail
+	err = pb.repository.UpdateThumbnail(data)
+	if err != nil {
+		return err
+	}
+	err = pb.repository.UpdateDimensions(md)
+	if err != nil {
+		return err
+	}
+	if pb.updated%100 == 0 {
+		return pb.repository.EndTransaction()
+	}
+	return nil
+}
+
+func schedule(what func(), delay time.Duration) chan bool {
+	stop := make(chan bool)
+
+	go func() {
+		for {
+			what()
+			select {
+			case <-time.After(delay):
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
@@ -24,7 +24,6 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"os/exec"
 	"runtime"
 	"runtime/pprof"
 	"strings"
@@ -148,14 +147,25 @@ func main() {
 	var mapFnrParameter int
 	var limit int
 	var delete bool
+	var mimeType bool
+	var pictureFnrParameter int
+	var test bool
+	var memoryFile string
 	var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to `file`")
 	var memprofile = flag.String("memprofile", "", "write memory profile to `file`")
+	var reportFile = flag.String("report", "", "write JSON run report to `file`")
 
 	flag.StringVar(&dbidParameter, "d", "23", "Map repository Database id")
 	flag.IntVar(&mapFnrParameter, "f", 4, "Map repository file number")
 	flag.IntVar(&limit, "l", 10, "Maximum records to read (0 is all)")
 	flag.BoolVar(&delete, "D", false, "Delete duplicate entries")
+	flag.BoolVar(&mimeType, "m", false, "Backfill MIMEType detected out of media content")
+	flag.IntVar(&pictureFnrParameter, "p", 100, "Picture file number used by MIMEType backfill")
+	flag.BoolVar(&test, "t", false, "Dry run, don't change")
+	flag.StringVar(&memoryFile, "M", "", "Use local memory repository stored in this file instead of Adabas")
 	flag.Parse()
+	report := store.NewRunReport("updoption", flag.CommandLine)
+	defer report.Exit(*reportFile)
 
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
@@ -169,6 +179,11 @@ func main() {
 	}
 	defer writeMemProfile(*memprofile)
 
+	if mimeType {
+		backfillMIMEType(dbidParameter, pictureFnrParameter, memoryFile, uint64(limit), test, report)
+		return
+	}
+
 	// if  {
 	// 	fmt.Println("File name option is required")
 	// 	flag.Usage()
@@ -180,6 +195,7 @@ func main() {
 	a, err := adabas.NewAdabas(dbidParameter, id)
 	if err != nil {
 		fmt.Println("Adabas target generation error", err)
+		report.Abort(err)
 		return
 	}
 	adabas.AddGlobalMapRepository(a.URL, adabas.Fnr(mapFnrParameter))
@@ -188,6 +204,41 @@ func main() {
 	err = c.analyzeDoublikats()
 	if err != nil {
 		fmt.Println("Error anaylzing douplikats", err)
+		report.Abort(err)
+	}
+}
+
+func backfillMIMEType(dbidParameter string, pictureFnr int, memoryFile string, limit uint64, test bool, report *store.RunReport) {
+	if test {
+		fmt.Println("Test mode ENABLED")
+	}
+	var repository store.PictureRepository
+	var err error
+	if memoryFile != "" {
+		fmt.Printf("Use memory repository %s\n", memoryFile)
+		repository, err = store.OpenMemoryRepository(memoryFile)
+	} else {
+		fmt.Printf("Connect to %s/%d\n", dbidParameter, pictureFnr)
+		repository, err = store.OpenAdabasRepository(&store.DatabaseReference{Dbid: dbidParameter,
+			PictureFile: adabas.Fnr(pictureFnr)})
+	}
+	if err != nil {
+		fmt.Println("Error getting connection", err)
+		report.Abort(err)
+		return
+	}
+	defer repository.Close()
+
+	mb := &mimeBackfill{repository: repository, limit: limit, test: test, report: report}
+	report.AddCounter("counter", func() uint64 { return mb.counter })
+	report.AddCounter("updated", func() uint64 { return mb.updated })
+	report.AddCounter("unchanged", func() uint64 { return mb.unchanged })
+	report.AddCounter("unknown", func() uint64 { return mb.unknown })
+	report.AddCounter("failures", func() uint64 { return mb.failures })
+	err = mb.fill()
+	if err != nil {
+		fmt.Println("Error backfill MIMEType", err)
+		report.Abort(err)
 	}
 }
 
@@ -354,37 +405,14 @@ func (checker *checker) listDuplikats(checksum string) (err error) {
 
 func (checker *checker) tagInfoVideo(isn adatypes.Isn, filename string) error {
 	fmt.Println("Check picture", isn, "at", filename)
-	cmd := exec.Command("ffprobe", "-v", "quiet", "-print_format", "json", "-show_streams", "-show_format", filename)
-	x, err := cmd.Output()
-	if err != nil {
-		return err
-	}
-	var v interface{}
-	err = json.Unmarshal(x, &v)
+	up := &store.PictureMetadata{Index: uint64(isn)}
+	err := store.ReadMovieMetadata(filename, up)
 	if err != nil {
 		return err
 	}
-	data := v.(map[string]interface{})
-	t, ok := data["format"]
-	if !ok {
+	if up.ExifTaken == "" {
 		return nil
 	}
-	tags := t.(map[string]interface{})
-	ctag, ok := tags["tags"]
-	if !ok {
-		return nil
-	}
-	ct := ctag.(map[string]interface{})
-	cts, ok := ct["creation_time"]
-	if !ok {
-		return nil
-	}
-	ctime := cts.(string)
-	createTime, tErr := time.Parse(time.RFC3339, ctime)
-	if tErr != nil {
-		return tErr
-	}
-	up := &store.PictureMetadata{Index: uint64(isn), ExifTaken: createTime.String()}
 	err = checker.updateMovieTime(up)
 	if err != nil {
 		fmt.Println("Update movie error", err)
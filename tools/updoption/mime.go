@@ -0,0 +1,111 @@
+/*
+* Copyright © 2018-2019 private, Darmstadt, Germany and/or its licensors
+*
+* SPDX-License-Identifier: Apache-2.0
+*
+*   Licensed under the Apache License, Version 2.0 (the "License");
+*   you may not use this file except in compliance with the License.
+*   You may obtain a copy of the License at
+*
+*       http://www.apache.org/licenses/LICENSE-2.0
+*
+*   Unless required by applicable law or agreed to in writing, software
+*   distributed under the License is distributed on an "AS IS" BASIS,
+*   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*   See the License for the specific language governing permissions and
+*   limitations under the License.
+*
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+	"tux-lobload/store"
+)
+
+type mimeBackfill struct {
+	repository store.PictureRepository
+	limit      uint64
+	test       bool
+	counter    uint64
+	updated    uint64
+	unchanged  uint64
+	unknown    uint64
+	failures   uint64
+	report     *store.RunReport
+}
+
+func (mb *mimeBackfill) String() string {
+	return fmt.Sprintf("%s Picture counter=%d updated=%d unchanged=%d unknown=%d failures=%d",
+		time.Now().Format(timeFormat), mb.counter, mb.updated, mb.unchanged, mb.unknown, mb.failures)
+}
+
+// fill walk all picture data and correct the MIME type (TY) using the
+// media content signature instead of the file suffix
+func (mb *mimeBackfill) fill() error {
+	stop := schedule(func() { fmt.Println(mb) }, 15*time.Second)
+	defer func() { stop <- true }()
+	cursor, err := mb.repository.ReadData(mb.limit)
+	if err != nil {
+		return err
+	}
+	for cursor.HasNextRecord() {
+		d, err := cursor.NextData()
+		if err != nil {
+			return err
+		}
+		mb.counter++
+		err = mb.fillRecord(d.(*store.PictureData))
+		if err != nil {
+			fmt.Printf("Error MIME type ISN=%d: %v\n", d.(*store.PictureData).Index, err)
+			mb.report.FailedIsn(d.(*store.PictureData).Index, err)
+			mb.failures++
+		}
+	}
+	fmt.Println(mb)
+	if mb.test {
+		return nil
+	}
+	return mb.repository.EndTransaction()
+}
+
+// fillRecord detect MIME type of the first media bytes, the file name of
+// the first location is only used if the content is ambiguous
+func (mb *mimeBackfill) fillRecord(data *store.PictureData) error {
+	if len(data.Media) == 0 {
+		return fmt.Errorf("media empty")
+	}
+	fileName := ""
+	if len(data.PictureLocation) > 0 {
+		fileName = data.PictureLocation[0].PictureName
+	}
+	header := data.Media
+	if len(header) > 32 {
+		header = header[:32]
+	}
+	format, _ := store.DetectContentFormat(header, fileName)
+	if format == nil {
+		mb.unknown++
+		return nil
+	}
+	if format.MIMEType == data.MIMEType {
+		mb.unchanged++
+		return nil
+	}
+	fmt.Printf("Correct MIME type ISN=%d %s -> %s\n", data.Index, data.MIMEType, format.MIMEType)
+	data.MIMEType = format.MIMEType
+	mb.updated++
+	if mb.test {
+		return nil
+	}
+	err := mb.repository.UpdateMIMEType(data)
+	if err != nil {
+		return err
+	}
+	if mb.updated%100 == 0 {
+		return mb.repository.EndTransaction()
+	}
+	return nil
+}